@@ -14,8 +14,17 @@ func newAggregateCmd() *cobra.Command {
 	aggregateCmd := &cobra.Command{
 		Use:   "aggregate <dnsmag-file1> [dnsmag-file2...]",
 		Short: "Aggregate multiple DNSMAG files into combined statistics",
-		Long:  `Aggregate domain statistics from multiple DNSMAG files into a single combined dataset.`,
-		Args:  cobra.MinimumNArgs(1),
+		Long: `Aggregate domain statistics from multiple DNSMAG files into a single combined dataset.
+
+Datasets given more than once, e.g. the same file twice or the same dataset in two sequences, are
+skipped with a warning, as aggregating them again would count their queries twice. Datasets that
+overlap partially, e.g. an aggregate and one of the datasets aggregated into it, are errors. The
+identifiers of the datasets aggregated are listed in the metadata of the aggregated dataset.
+
+All datasets must have the same date, unless --period is used to roll up datasets from several days,
+e.g. a week or a month, into one dataset. The clients of all days in the period are counted together,
+and the period and any days in it without data are recorded in the metadata of the rollup.`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			stdout := cmd.OutOrStdout()
 			stderr := cmd.ErrOrStderr()
@@ -28,14 +37,18 @@ func newAggregateCmd() *cobra.Command {
 				quiet     bool
 				output    string
 				forceDate string
+				periodStr string
+				rejectDup bool
 			)
 
 			parseFlags(cmd, map[string]any{
-				"top":        &top,
-				"verbose":    &verbose,
-				"quiet":      &quiet,
-				"output":     &output,
-				"force-date": &forceDate,
+				"top":               &top,
+				"verbose":           &verbose,
+				"quiet":             &quiet,
+				"output":            &output,
+				"force-date":        &forceDate,
+				"period":            &periodStr,
+				"reject-duplicates": &rejectDup,
 			})
 
 			// Quiet and verbose flags are mutually exclusive
@@ -44,6 +57,20 @@ func newAggregateCmd() *cobra.Command {
 				return fmt.Errorf("conflicting flags: cannot use both --quiet and --verbose")
 			}
 
+			if forceDate != "" && periodStr != "" {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("conflicting flags: cannot use both --force-date and --period")
+			}
+
+			var period *internal.DatasetPeriod
+			if periodStr != "" {
+				var err error
+				if period, err = internal.ParsePeriod(periodStr); err != nil {
+					cmd.SilenceUsage = true
+					return err
+				}
+			}
+
 			var forcedDate *time.Time
 			if forceDate != "" {
 				parsedDate, err := time.Parse("2006-01-02", forceDate)
@@ -54,10 +81,26 @@ func newAggregateCmd() *cobra.Command {
 				forcedDate = &parsedDate
 			}
 
+			writeOpts, err := writeOptions(cmd)
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+
 			seq := internal.NewDatasetSequence(top, forcedDate, forcedDate != nil, stderr)
+			if period != nil {
+				seq.SetPeriod(period)
+			}
+			if rejectDup {
+				seq.RejectDuplicates()
+			}
+			if err := configureSequence(cmd, seq); err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
 
 			// Load all provided DNSMAG files
-			err := loadDatasets(cmd, seq, args, verbose)
+			err = loadDatasets(cmd, seq, args, verbose)
 			if err != nil {
 				cmd.SilenceUsage = true
 				return err
@@ -69,7 +112,7 @@ func newAggregateCmd() *cobra.Command {
 
 			// Save the aggregated dataset to output file if specified
 			if output != "" {
-				outFilename, err := internal.WriteDNSMagFile(seq.Result, output, stdout)
+				outFilename, err := internal.WriteDNSMagFileWithOptions(seq.Result, output, stdout, writeOpts)
 				if err != nil {
 					cmd.SilenceUsage = true
 					return fmt.Errorf("failed to write aggregated dataset to %s: %w", output, err)
@@ -84,7 +127,11 @@ func newAggregateCmd() *cobra.Command {
 				if seq.Count == 0 {
 					fmt.Fprintf(stderr, "Statistics for %s:\n", args[0])
 				} else {
-					fmt.Fprintf(stderr, "Aggregated statistics for %d datasets:\n", seq.Count)
+					fmt.Fprintf(stderr, "Aggregated statistics for %d datasets", seq.Count)
+					if seq.Duplicates > 0 {
+						fmt.Fprintf(stderr, " (%d duplicates skipped)", seq.Duplicates)
+					}
+					fmt.Fprintln(stderr, ":")
 				}
 				fmt.Fprintln(stderr)
 			}
@@ -116,6 +163,13 @@ func newAggregateCmd() *cobra.Command {
 	aggregateCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
 	aggregateCmd.Flags().BoolP("quiet", "q", false, "Quiet mode")
 	aggregateCmd.Flags().String("force-date", "", "Force a specific date for the aggregated dataset (YYYY-MM-DD format)")
+	aggregateCmd.Flags().Bool("reject-duplicates", false, "Fail if a dataset is given more than once, instead of skipping it with a warning")
+	aggregateCmd.Flags().String("period", "", "Roll up datasets from the days in a period: YYYY-MM-DD/YYYY-MM-DD (inclusive) or a month, YYYY-MM")
+	aggregateCmd.Flags().String("encrypt-to", "", "File with a PEM encoded X25519 public key to encrypt the aggregated dataset to (optional)")
+	aggregateCmd.Flags().String("compress", "", "Compress the output file: 'none', 'gzip' or 'zstd' (optional, with --append defaults to the compression of the existing file)")
+	aggregateCmd.Flags().Bool("append", false, "Add the aggregated dataset to the datasets in an existing output file, instead of replacing it")
+	aggregateCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	aggregateCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
 
 	return aggregateCmd
 }
@@ -2,10 +2,17 @@ package cmd
 
 import (
 	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
 	"dnsmag/internal"
+	"encoding/json"
+	"encoding/pem"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -295,3 +302,245 @@ func createDNSMagFilesWithDifferentDates(t *testing.T, date1, date2 string) (str
 
 	return file1, file2, cleanup
 }
+
+func TestAggregateCmd_Provenance(t *testing.T) {
+	dir := t.TempDir()
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--source", "Operator A",
+		"--site", "ams1",
+		"--output", dir + "/a.cbor",
+	}, 200, "TSV source A")
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test3.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--source", "Operator B",
+		"--site", "fra1,ams1",
+		"--output", dir + "/b.cbor",
+	}, 16, "TSV source B")
+
+	aggregateCmd := newAggregateCmd()
+	aggregateCmd.SetArgs([]string{"--output", dir + "/aggregate.cbor", dir + "/a.cbor", dir + "/b.cbor"})
+	var buf bytes.Buffer
+	aggregateCmd.SetOut(&buf)
+	aggregateCmd.SetErr(&buf)
+	if err := aggregateCmd.Execute(); err != nil {
+		t.Fatalf("Aggregate command failed: %v\nOutput: %s", err, buf.String())
+	}
+
+	viewCmd := newViewCmd()
+	viewCmd.SetArgs([]string{dir + "/aggregate.cbor"})
+	buf.Reset()
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, buf.String())
+	}
+
+	output := buf.String()
+	for _, expected := range []string{
+		`Sources\s+: Operator A, Operator B`,
+		`Sites\s+: ams1, fra1`,
+		`Input files\s+: 2`,
+		`Client prefix lengths\s+: IPv4 /24, IPv6 /48`,
+		`Parent datasets\s+: 2`,
+	} {
+		if !regexp.MustCompile(expected).MatchString(output) {
+			t.Errorf("Expected view output to match %q:\n%s", expected, output)
+		}
+	}
+}
+
+// writeTestIdentity generates an X25519 key pair and writes it to PEM files in dir
+func writeTestIdentity(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(priv.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	privFile := filepath.Join(dir, name+".pem")
+	pubFile := filepath.Join(dir, name+".pub.pem")
+	if err := os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return privFile, pubFile
+}
+
+func TestAggregateCmd_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	identity, recipient := writeTestIdentity(t, dir, "collector")
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--encrypt-to", recipient,
+		"--output", dir + "/a.cbor",
+	}, 200, "TSV encrypted")
+
+	// Encrypted datasets can only be loaded with the identity
+	var buf bytes.Buffer
+	aggregateCmd := newAggregateCmd()
+	aggregateCmd.SetArgs([]string{"--output", dir + "/aggregate.cbor", dir + "/a.cbor"})
+	aggregateCmd.SetOut(&buf)
+	aggregateCmd.SetErr(&buf)
+	if err := aggregateCmd.Execute(); err == nil || !strings.Contains(err.Error(), "an identity is required") {
+		t.Errorf("Expected missing identity error, got: %v", err)
+	}
+
+	aggregateCmd = newAggregateCmd()
+	aggregateCmd.SetArgs([]string{"--identity", identity, "--encrypt-to", recipient, "--output", dir + "/aggregate.cbor", dir + "/a.cbor"})
+	buf.Reset()
+	aggregateCmd.SetOut(&buf)
+	aggregateCmd.SetErr(&buf)
+	if err := aggregateCmd.Execute(); err != nil {
+		t.Fatalf("Aggregate command failed: %v\nOutput: %s", err, buf.String())
+	}
+
+	// The aggregated dataset is encrypted as well
+	viewCmd := newViewCmd()
+	viewCmd.SetArgs([]string{dir + "/aggregate.cbor"})
+	buf.Reset()
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	if err := viewCmd.Execute(); err == nil || !strings.Contains(err.Error(), "an identity is required") {
+		t.Errorf("Expected missing identity error, got: %v", err)
+	}
+
+	viewCmd = newViewCmd()
+	viewCmd.SetArgs([]string{"--identity", identity, dir + "/aggregate.cbor"})
+	buf.Reset()
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !regexp.MustCompile(`Total queries\s+:\s+200`).MatchString(buf.String()) {
+		t.Errorf("Expected 200 queries in view output:\n%s", buf.String())
+	}
+}
+
+func TestAggregateCmd_Period(t *testing.T) {
+	file1, file2, cleanup := createDNSMagFilesWithDifferentDates(t, "2026-09-01", "2026-09-03")
+	defer cleanup()
+	output := filepath.Join(t.TempDir(), "week.cbor")
+
+	aggregateCmd := newAggregateCmd()
+	aggregateCmd.SetArgs([]string{
+		"--period", "2026-09-01/2026-09-07",
+		"--output", output,
+		file1,
+		file2,
+	})
+
+	var aggregateBuf bytes.Buffer
+	aggregateCmd.SetOut(&aggregateBuf)
+	aggregateCmd.SetErr(&aggregateBuf)
+
+	if err := aggregateCmd.Execute(); err != nil {
+		t.Fatalf("Aggregate command with --period failed: %v\nOutput: %s", err, aggregateBuf.String())
+	}
+	for _, pattern := range []*regexp.Regexp{
+		regexp.MustCompile(`Aggregated statistics for 2 datasets:`),
+		regexp.MustCompile(`Period\s+:\s+2026-09-01 - 2026-09-07 \(7 days, 5 without data\)`),
+		regexp.MustCompile(`Total queries\s+:\s+40`),
+	} {
+		if !pattern.MatchString(aggregateBuf.String()) {
+			t.Errorf("Expected pattern %q not found in output:\n%s", pattern.String(), aggregateBuf.String())
+		}
+	}
+
+	// The report of a rollup has a period instead of a date
+	var reportBuf bytes.Buffer
+	reportCmd := newReportCmd()
+	reportCmd.SetOut(&reportBuf)
+	reportCmd.SetErr(&reportBuf)
+	reportCmd.SetArgs([]string{"--source", "test", output})
+	if err := reportCmd.Execute(); err != nil {
+		t.Fatalf("Report command failed: %v\nOutput: %s", err, reportBuf.String())
+	}
+	var report internal.Report
+	if err := json.Unmarshal(reportBuf.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+	if report.Date != "" || report.Period == nil || report.Period.Start != "2026-09-01" || report.Period.End != "2026-09-07" ||
+		report.Period.Days != 7 || len(report.Period.MissingDates) != 5 {
+		t.Errorf("Unexpected report period:\n%s", reportBuf.String())
+	}
+
+	for name, args := range map[string][]string{
+		"outside period":  {"--period", "2026-09-02/2026-09-07", file1, file2},
+		"with force date": {"--period", "2026-09", "--force-date", "2026-09-01", file1, file2},
+		"invalid period":  {"--period", "2026-09-07/2026-09-01", file1, file2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			aggregateCmd := newAggregateCmd()
+			aggregateCmd.SetArgs(args)
+			aggregateCmd.SetOut(io.Discard)
+			aggregateCmd.SetErr(io.Discard)
+			if err := aggregateCmd.Execute(); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
+
+func TestAggregateCmd_Duplicates(t *testing.T) {
+	file1, file2, cleanup := createDNSMagFilesWithDifferentDates(t, "2026-09-01", "2026-09-01")
+	defer cleanup()
+	output := filepath.Join(t.TempDir(), "aggregate.cbor")
+
+	// The same file given twice is only counted once
+	aggregateCmd := newAggregateCmd()
+	aggregateCmd.SetArgs([]string{"--output", output, file1, file2, file1})
+	var aggregateBuf bytes.Buffer
+	aggregateCmd.SetOut(&aggregateBuf)
+	aggregateCmd.SetErr(&aggregateBuf)
+	if err := aggregateCmd.Execute(); err != nil {
+		t.Fatalf("Aggregate command failed: %v\nOutput: %s", err, aggregateBuf.String())
+	}
+	for _, pattern := range []*regexp.Regexp{
+		regexp.MustCompile(`Warning: Skipping dataset .*#1, a duplicate of dataset .*#1`),
+		regexp.MustCompile(`Aggregated statistics for 2 datasets \(1 duplicates skipped\):`),
+		regexp.MustCompile(`Total queries\s+:\s+40`),
+		regexp.MustCompile(`Parent datasets\s+:\s+2`),
+	} {
+		if !pattern.MatchString(aggregateBuf.String()) {
+			t.Errorf("Expected pattern %q not found in output:\n%s", pattern.String(), aggregateBuf.String())
+		}
+	}
+
+	// An aggregate can not be aggregated with one of its parents
+	for name, args := range map[string][]string{
+		"reject duplicates": {"--reject-duplicates", file1, file2, file1},
+		"overlap":           {output, file2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			aggregateCmd := newAggregateCmd()
+			aggregateCmd.SetArgs(args)
+			aggregateCmd.SetOut(io.Discard)
+			aggregateCmd.SetErr(io.Discard)
+			if err := aggregateCmd.Execute(); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
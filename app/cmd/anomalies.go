@@ -0,0 +1,143 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newAnomaliesCmd() *cobra.Command {
+	anomaliesCmd := &cobra.Command{
+		Use:   "anomalies <dnsmag-file1> [dnsmag-file2...]",
+		Short: "Detect domains rising in magnitude in daily DNSMAG files",
+		Long: `Detect domains rising significantly in daily DNSMAG files, e.g. a previously quiet undelegated TLD.
+
+Every domain has a rolling baseline of the preceding calendar days (--window), with the median and
+median absolute deviation (MAD) of its magnitude and clients. Days without a file are left out of the
+baseline, and days a domain was not seen count as zero. A domain is flagged as a jump on a day if the
+robust z-score, 0.6745 * (value - median) / MAD, of its magnitude or clients is at least --threshold,
+and as new if it was not seen on any day of the baseline. Domains with fewer than --min-clients
+clients on the day are not flagged.
+
+By default only the last day is evaluated, use --days to evaluate more days. Each file must hold the
+datasets of a single day, like for the timeseries command. The anomalies are written as JSON.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stderr := cmd.ErrOrStderr()
+			stdout := cmd.OutOrStdout()
+
+			var (
+				verbose    bool
+				window     int
+				minHistory int
+				threshold  float64
+				minClients int
+				days       int
+				output     string
+			)
+
+			parseFlags(cmd, map[string]any{
+				"verbose":     &verbose,
+				"window":      &window,
+				"min-history": &minHistory,
+				"threshold":   &threshold,
+				"min-clients": &minClients,
+				"days":        &days,
+				"output":      &output,
+			})
+
+			if minClients < 0 {
+				return fmt.Errorf("invalid minimum clients %d, must be 0 or more", minClients)
+			}
+			if days < 0 {
+				return fmt.Errorf("invalid days %d, must be 0 or more", days)
+			}
+			opts := internal.AnomalyOptions{
+				Window:     window,
+				MinHistory: minHistory,
+				Threshold:  threshold,
+				MinClients: uint64(minClients),
+				Days:       days,
+			}
+
+			cmd.SilenceUsage = true
+
+			var datasets []internal.MagnitudeDataset
+			for _, filename := range args {
+				seq := internal.NewDatasetSequence(0, nil, false, stderr)
+				if err := configureSequence(cmd, seq); err != nil {
+					return err
+				}
+				if err := loadDatasets(cmd, seq, []string{filename}, verbose); err != nil {
+					return err
+				}
+				if seq.Count == 0 {
+					return fmt.Errorf("no datasets found in %s", filename)
+				}
+				datasets = append(datasets, seq.Result)
+			}
+
+			ts, err := internal.NewTimeSeries(datasets, 0)
+			if err != nil {
+				return err
+			}
+			if len(ts.Dates) <= minHistory {
+				fmt.Fprintf(stderr, "Warning: %d days are not enough for a baseline of at least %d days\n", len(ts.Dates), minHistory)
+			}
+
+			anomalies, err := internal.DetectAnomalies(ts, opts)
+			if err != nil {
+				return err
+			}
+			if verbose {
+				for _, anomaly := range anomalies {
+					fmt.Fprintln(stderr, anomaly)
+				}
+				fmt.Fprintf(stderr, "Found %d anomalies\n", len(anomalies))
+			}
+
+			var buf bytes.Buffer
+			if err := internal.OutputAnomaliesJSON(&buf, anomalies, opts); err != nil {
+				return fmt.Errorf("failed to output anomalies: %w", err)
+			}
+
+			// Write the anomalies to the specified output file or stdout
+			if output != "" && output != "-" {
+				// #nosec G306
+				if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+					return fmt.Errorf("failed to write to %s: %w", output, err)
+				}
+				if verbose {
+					fmt.Fprintf(stderr, "Anomalies written to %s\n", output)
+				}
+			} else if _, err := stdout.Write(buf.Bytes()); err != nil {
+				return fmt.Errorf("failed to write to stdout: %w", err)
+			}
+
+			return nil
+		},
+	}
+
+	anomaliesCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	anomaliesCmd.Flags().Int("window", internal.DefaultAnomalyWindow, "Number of preceding calendar days in the rolling baseline")
+	anomaliesCmd.Flags().Int("min-history", internal.DefaultAnomalyMinHistory, "Minimum number of days with data in the baseline needed to evaluate a day")
+	anomaliesCmd.Flags().Float64("threshold", internal.DefaultAnomalyThreshold, "Robust z-score above which a rise is significant")
+	anomaliesCmd.Flags().Int("min-clients", internal.DefaultAnomalyMinClients, "Minimum number of clients of a domain on a day to be flagged")
+	anomaliesCmd.Flags().Int("days", 1, "Number of most recent days to evaluate (0 for all days with enough history)")
+	anomaliesCmd.Flags().StringP("output", "o", "", "Output file (optional, defaults to stdout)")
+	anomaliesCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	anomaliesCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+
+	return anomaliesCmd
+}
+
+var anomaliesCmd = newAnomaliesCmd()
+
+func init() {
+	rootCmd.AddCommand(anomaliesCmd)
+}
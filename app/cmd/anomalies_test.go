@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAnomaliesCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	// Four days of 20 clients querying com and one querying zz, then a day with 30 clients querying zz
+	var files []string
+	for day := 1; day <= 5; day++ {
+		var tsv strings.Builder
+		for c := 1; c <= 20; c++ {
+			fmt.Fprintf(&tsv, "10.1.%d.1\tcom\t1\n", c)
+		}
+		zzClients := 1
+		if day == 5 {
+			zzClients = 30
+		}
+		for c := 1; c <= zzClients; c++ {
+			fmt.Fprintf(&tsv, "10.2.%d.1\tzz\t1\n", c)
+		}
+		input := fmt.Sprintf("%s/day%d.tsv", dir, day)
+		if err := os.WriteFile(input, []byte(tsv.String()), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", input, err)
+		}
+		output := fmt.Sprintf("%s/day%d.cbor", dir, day)
+		executeCollectAndVerify(t, []string{
+			input,
+			"--filetype", "tsv",
+			"--date", fmt.Sprintf("2026-09-%02d", day),
+			"--output", output,
+		}, 20+zzClients, "TSV")
+		files = append(files, output)
+	}
+
+	var buf bytes.Buffer
+	anomaliesCmd := newAnomaliesCmd()
+	anomaliesCmd.SetOut(&buf)
+	anomaliesCmd.SetErr(&buf)
+	anomaliesCmd.SetArgs(append([]string{"--window", "4"}, files...))
+	if err := anomaliesCmd.Execute(); err != nil {
+		t.Fatalf("Anomalies command failed: %v\nOutput: %s", err, buf.String())
+	}
+	var result struct {
+		Window    int
+		Anomalies []struct {
+			Date   string
+			Domain string
+			Kind   string
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to parse JSON anomalies: %v\nOutput: %s", err, buf.String())
+	}
+	if result.Window != 4 || len(result.Anomalies) != 1 {
+		t.Fatalf("Expected 1 anomaly, got %s", buf.String())
+	}
+	if a := result.Anomalies[0]; a.Date != "2026-09-05" || a.Domain != "zz" || a.Kind != "jump" {
+		t.Errorf("Expected a jump of zz on 2026-09-05, got %+v", a)
+	}
+
+	// Too few days for the minimum history
+	buf.Reset()
+	anomaliesCmd = newAnomaliesCmd()
+	anomaliesCmd.SetOut(&buf)
+	anomaliesCmd.SetErr(&buf)
+	anomaliesCmd.SetArgs(files[:2])
+	if err := anomaliesCmd.Execute(); err != nil {
+		t.Fatalf("Anomalies command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "not enough for a baseline") || !strings.Contains(buf.String(), `"anomalies": []`) {
+		t.Errorf("Expected a warning and no anomalies, got %s", buf.String())
+	}
+
+	anomaliesCmd = newAnomaliesCmd()
+	anomaliesCmd.SetOut(&buf)
+	anomaliesCmd.SetErr(&buf)
+	anomaliesCmd.SetArgs(append([]string{"--min-history", "8"}, files...))
+	if err := anomaliesCmd.Execute(); err == nil {
+		t.Errorf("Expected an error for a minimum history longer than the window")
+	}
+}
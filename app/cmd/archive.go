@@ -0,0 +1,213 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"dnsmag/internal"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+func newArchiveCmd() *cobra.Command {
+	archiveCmd := &cobra.Command{
+		Use:   "archive",
+		Short: "Manage a local archive of datasets",
+		Long: `Manage a content-addressed local archive of datasets, laid out by date like
+
+  year=2026/month=09/day=01/id=<sha256>.cbor
+
+with an index of the date, source, generator and domains of every dataset in an embedded
+database (index.db in the archive directory). Datasets are stored one per file, exactly as
+imported, including signatures and encryption. The hash is the SHA-256 of the stored dataset,
+so importing the same dataset twice stores it once.`,
+	}
+
+	archiveCmd.PersistentFlags().StringP("archive", "a", "", "Archive directory (required)")
+	if err := archiveCmd.MarkPersistentFlagRequired("archive"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mark 'archive' flag as required: %v\n", err)
+		os.Exit(1)
+	}
+
+	archiveCmd.AddCommand(newArchiveImportCmd(), newArchiveListCmd())
+	return archiveCmd
+}
+
+func newArchiveImportCmd() *cobra.Command {
+	importCmd := &cobra.Command{
+		Use:   "import <dnsmag-file1> [dnsmag-file2...]",
+		Short: "Import the datasets in DNSMAG files into an archive",
+		Long: `Import every dataset in the DNSMAG files into the archive, skipping datasets already in it.
+Encrypted datasets are stored encrypted, but need --identity to be decrypted for the index.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdin := cmd.InOrStdin()
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				root    string
+				verbose bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"archive": &root,
+				"verbose": &verbose,
+			})
+
+			cmd.SilenceUsage = true
+
+			archive, err := internal.OpenArchive(root, false)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = archive.Close() }()
+			if err := configureSequence(cmd, archive); err != nil {
+				return err
+			}
+
+			imported, existing := 0, 0
+			for _, filename := range args {
+				var added []internal.ArchiveEntry
+				var found int
+				if filename == "-" {
+					added, found, err = archive.ImportFromReader(stdin, "<stdin#%d>")
+				} else {
+					added, found, err = archive.ImportFile(filename)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to import %s: %w", filename, err)
+				}
+				if verbose {
+					for _, entry := range added {
+						fmt.Fprintf(stderr, "Imported dataset %s (%s) from %s to %s\n", entry.Identifier, entry.Date, filename, entry.Path)
+					}
+				}
+				imported += len(added)
+				existing += found
+			}
+
+			fmt.Fprintf(stderr, "Imported %d datasets (%d already in the archive)\n", imported, existing)
+			return nil
+		},
+	}
+
+	importCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	importCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	importCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+
+	return importCmd
+}
+
+func newArchiveListCmd() *cobra.Command {
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the datasets in an archive",
+		Long: `List the datasets in an archive matching a query of date, source, generator and domain, e.g.
+all datasets for 2026-09 from a source:
+
+  dnsmag archive list --archive /data/dnsmag --date 2026-09 --source example
+
+Use --paths to list only the paths of the stored datasets, e.g. to aggregate them:
+
+  dnsmag aggregate --output 2026-09.cbor $(dnsmag archive list -a /data/dnsmag --date 2026-09 --paths)`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdout := cmd.OutOrStdout()
+
+			var (
+				root       string
+				query      internal.ArchiveQuery
+				jsonOutput bool
+				paths      bool
+				output     string
+			)
+
+			parseFlags(cmd, map[string]any{
+				"archive":   &root,
+				"date":      &query.Date,
+				"source":    &query.Source,
+				"generator": &query.Generator,
+				"domain":    &query.Domain,
+				"json":      &jsonOutput,
+				"paths":     &paths,
+				"output":    &output,
+			})
+
+			if jsonOutput && paths {
+				return fmt.Errorf("--json and --paths can not be combined")
+			}
+
+			cmd.SilenceUsage = true
+
+			archive, err := internal.OpenArchive(root, true)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = archive.Close() }()
+
+			entries, err := archive.Query(query)
+			if err != nil {
+				return err
+			}
+
+			writer := stdout
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return fmt.Errorf("failed to create %s: %w", output, err)
+				}
+				defer f.Close()
+				writer = f
+			}
+
+			switch {
+			case jsonOutput:
+				return outputArchiveEntriesJSON(writer, entries)
+			case paths:
+				for _, entry := range entries {
+					fmt.Fprintln(writer, archive.Path(entry))
+				}
+			default:
+				for _, entry := range entries {
+					source := strings.Join(entry.Sources, ",")
+					if source == "" {
+						source = "-"
+					}
+					fmt.Fprintf(writer, "%s %-20s %s %6d domains %10d queries  %s\n",
+						entry.Date, source, entry.Identifier, entry.Domains, entry.Queries, entry.Path)
+				}
+			}
+			return nil
+		},
+	}
+
+	listCmd.Flags().String("date", "", "Year, month or day of the datasets: YYYY, YYYY-MM or YYYY-MM-DD (optional)")
+	listCmd.Flags().String("source", "", "Source the datasets must include (optional)")
+	listCmd.Flags().String("generator", "", "Generator of the datasets, e.g. \"dnsmag v1.2.0\" (optional)")
+	listCmd.Flags().String("domain", "", "Domain the datasets must contain (optional)")
+	listCmd.Flags().BoolP("json", "j", false, "JSON output")
+	listCmd.Flags().Bool("paths", false, "Only list the paths of the stored datasets")
+	listCmd.Flags().StringP("output", "o", "", "Output file (optional, defaults to stdout)")
+
+	return listCmd
+}
+
+// outputArchiveEntriesJSON writes archive entries as a JSON list
+func outputArchiveEntriesJSON(writer io.Writer, entries []internal.ArchiveEntry) error {
+	jsonData, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to generate JSON: %w", err)
+	}
+	_, err = fmt.Fprintln(writer, string(jsonData))
+	return err
+}
+
+var archiveCmd = newArchiveCmd()
+
+func init() {
+	rootCmd.AddCommand(archiveCmd)
+}
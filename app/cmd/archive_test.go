@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestArchiveCmd(t *testing.T) {
+	dir := t.TempDir()
+	root := dir + "/archive"
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-01",
+		"--source", "example",
+		"--output", dir + "/day1.cbor",
+	}, 200, "TSV")
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.csv.gz",
+		"--filetype", "csv",
+		"--date", "2026-09-02",
+		"--output", dir + "/day2.cbor",
+	}, 200, "CSV")
+
+	runArchive := func(args ...string) (string, error) {
+		var buf bytes.Buffer
+		archiveCmd := newArchiveCmd()
+		archiveCmd.SetOut(&buf)
+		archiveCmd.SetErr(&buf)
+		archiveCmd.SetArgs(args)
+		err := archiveCmd.Execute()
+		return buf.String(), err
+	}
+
+	output, err := runArchive("import", "--archive", root, dir+"/day1.cbor", dir+"/day2.cbor")
+	if err != nil {
+		t.Fatalf("Archive import failed: %v\nOutput: %s", err, output)
+	}
+	if !strings.Contains(output, "Imported 2 datasets (0 already in the archive)") {
+		t.Errorf("Unexpected import output: %s", output)
+	}
+	output, err = runArchive("import", "-a", root, dir+"/day1.cbor")
+	if err != nil || !strings.Contains(output, "Imported 0 datasets (1 already in the archive)") {
+		t.Errorf("Expected the dataset to be in the archive already, got %v\nOutput: %s", err, output)
+	}
+
+	output, err = runArchive("list", "--archive", root, "--date", "2026-09", "--source", "example", "--json")
+	if err != nil {
+		t.Fatalf("Archive list failed: %v\nOutput: %s", err, output)
+	}
+	var entries []internal.ArchiveEntry
+	if err := json.Unmarshal([]byte(output), &entries); err != nil {
+		t.Fatalf("Failed to parse JSON list: %v\nOutput: %s", err, output)
+	}
+	if len(entries) != 1 || entries[0].Date != "2026-09-01" || !slices.Equal(entries[0].Sources, []string{"example"}) {
+		t.Errorf("Expected the dataset of 2026-09-01 from example, got %+v", entries)
+	}
+
+	output, err = runArchive("list", "--archive", root, "--generator", "dnsmag "+internal.Version, "--json")
+	if err != nil {
+		t.Fatalf("Archive list failed: %v\nOutput: %s", err, output)
+	}
+	if err := json.Unmarshal([]byte(output), &entries); err != nil || len(entries) != 2 {
+		t.Errorf("Expected both datasets by generator, got %v\nOutput: %s", err, output)
+	}
+	output, err = runArchive("list", "--archive", root, "--generator", "other-tool", "--json")
+	if err != nil || strings.TrimSpace(output) != "[]" {
+		t.Errorf("Expected no datasets of another generator, got %v\nOutput: %s", err, output)
+	}
+
+	output, err = runArchive("list", "--archive", root, "--paths", "--domain", "com")
+	if err != nil {
+		t.Fatalf("Archive list failed: %v\nOutput: %s", err, output)
+	}
+	paths := strings.Fields(output)
+	if len(paths) != 2 {
+		t.Fatalf("Expected 2 paths, got %q", output)
+	}
+	for _, path := range paths {
+		if !strings.HasPrefix(path, root+"/year=2026/month=09/day=0") {
+			t.Errorf("Unexpected path %s", path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Stored dataset missing: %v", err)
+		}
+	}
+
+	output, err = runArchive("list", "--archive", root)
+	if err != nil || len(strings.Split(strings.TrimSpace(output), "\n")) != 2 || !strings.Contains(output, "example") {
+		t.Errorf("Expected 2 datasets listed, got %v\nOutput: %s", err, output)
+	}
+
+	if _, err := runArchive("list", "--archive", dir+"/missing"); err == nil {
+		t.Errorf("Expected an error listing a missing archive")
+	}
+	if _, err := runArchive("list", "--archive", root, "--date", "September"); err == nil {
+		t.Errorf("Expected an error for an invalid date")
+	}
+}
@@ -0,0 +1,124 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"crypto/ecdh"
+	"dnsmag/internal"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newCheckCmd() *cobra.Command {
+	checkCmd := &cobra.Command{
+		Use:   "check <dnsmag-file> [dnsmag-file2...]",
+		Short: "Check the consistency of datasets in DNSMAG files",
+		Long: `Check the semantic consistency of every dataset in one or more DNSMAG files:
+
+  - stored client counts must match the cardinality of the HLLs
+  - every domain HLL must be a subset of the global HLL (adding it does not change the cardinality)
+  - the sum of the domain query counts must not exceed the total query count
+
+Suspicious values, such as domains with more clients than queries or than in total, and partial
+datasets are reported as warnings. Findings are printed as text, or with --json as a
+machine-readable list. Fails if there are errors, or with --strict any findings at all.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdout := cmd.OutOrStdout()
+
+			var (
+				identityFile string
+				jsonOutput   bool
+				output       string
+				strict       bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"identity": &identityFile,
+				"json":     &jsonOutput,
+				"output":   &output,
+				"strict":   &strict,
+			})
+
+			cmd.SilenceUsage = true
+
+			var identity *ecdh.PrivateKey
+			if identityFile != "" {
+				var err error
+				if identity, err = internal.LoadIdentity(identityFile); err != nil {
+					return fmt.Errorf("failed to load identity: %w", err)
+				}
+			}
+
+			findings := []internal.Finding{}
+			for _, filename := range args {
+				err := readInput(cmd, filename, func(reader io.Reader) error {
+					fileFindings, err := internal.CheckDatasets(reader, fmt.Sprintf("%s#%%d", filename), identity)
+					findings = append(findings, fileFindings...)
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("failed to check %s: %w", filename, err)
+				}
+			}
+
+			writer := stdout
+			if output != "" && output != "-" {
+				f, err := os.Create(output)
+				if err != nil {
+					return fmt.Errorf("failed to create %s: %w", output, err)
+				}
+				defer f.Close()
+				writer = f
+			}
+
+			if jsonOutput {
+				if err := outputFindingsJSON(writer, findings); err != nil {
+					return err
+				}
+			} else {
+				for _, finding := range findings {
+					fmt.Fprintln(writer, finding)
+				}
+			}
+
+			errors := 0
+			for _, finding := range findings {
+				if finding.Severity == internal.SeverityError {
+					errors++
+				}
+			}
+			if errors > 0 || (strict && len(findings) > 0) {
+				return fmt.Errorf("found %d errors and %d warnings", errors, len(findings)-errors)
+			}
+			return nil
+		},
+	}
+
+	checkCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+	checkCmd.Flags().BoolP("json", "j", false, "JSON output")
+	checkCmd.Flags().StringP("output", "o", "", "Output file for the findings (optional, defaults to stdout)")
+	checkCmd.Flags().Bool("strict", false, "Fail on warnings as well as errors")
+
+	return checkCmd
+}
+
+// outputFindingsJSON writes check findings as a JSON object with a list of findings
+func outputFindingsJSON(writer io.Writer, findings []internal.Finding) error {
+	jsonData, err := json.MarshalIndent(map[string]any{"findings": findings}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to generate JSON findings: %w", err)
+	}
+	_, err = fmt.Fprintln(writer, string(jsonData))
+	return err
+}
+
+var checkCmd = newCheckCmd()
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--output", dir + "/data.cbor",
+	}, 200, "TSV")
+
+	var buf bytes.Buffer
+	checkCmd := newCheckCmd()
+	checkCmd.SetOut(&buf)
+	checkCmd.SetErr(&buf)
+	checkCmd.SetArgs([]string{"--json", "--strict", dir + "/data.cbor"})
+	if err := checkCmd.Execute(); err != nil {
+		t.Fatalf("Check command failed: %v\nOutput: %s", err, buf.String())
+	}
+
+	var result struct {
+		Findings []internal.Finding `json:"findings"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to parse JSON findings: %v\nOutput: %s", err, buf.String())
+	}
+	if result.Findings == nil || len(result.Findings) != 0 {
+		t.Errorf("Expected empty findings list, got: %s", buf.String())
+	}
+
+	// Change the stored all_clients_count of the dataset
+	data, err := os.ReadFile(dir + "/data.cbor")
+	if err != nil {
+		t.Fatalf("Failed to read dataset: %v", err)
+	}
+	key := []byte("all_clients_count")
+	idx := bytes.Index(data, key)
+	if idx < 0 {
+		t.Fatalf("all_clients_count not found in dataset")
+	}
+	// 0x18 is a one byte unsigned integer, test2.tsv has fewer than 256 clients
+	if data[idx+len(key)] != 0x18 {
+		t.Fatalf("Unexpected encoding of all_clients_count: %#x", data[idx+len(key)])
+	}
+	data[idx+len(key)+1]++
+	if err := os.WriteFile(dir+"/inconsistent.cbor", data, 0o600); err != nil {
+		t.Fatalf("Failed to write inconsistent dataset: %v", err)
+	}
+
+	buf.Reset()
+	checkCmd = newCheckCmd()
+	checkCmd.SetOut(&buf)
+	checkCmd.SetErr(&buf)
+	checkCmd.SetArgs([]string{dir + "/data.cbor", dir + "/inconsistent.cbor"})
+	err = checkCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "found 1 errors") {
+		t.Errorf("Expected check to fail, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), "inconsistent.cbor#1: error: clients_count_mismatch: all_clients_count") {
+		t.Errorf("Expected clients count mismatch in output:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "data.cbor#1") {
+		t.Errorf("Expected no findings for consistent dataset:\n%s", buf.String())
+	}
+}
@@ -3,8 +3,11 @@
 package cmd
 
 import (
+	"context"
 	"dnsmag/internal"
 	"fmt"
+	"io"
+	"slices"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -15,8 +18,20 @@ func newCollectCmd() *cobra.Command {
 		Use:   "collect <input-file> [input-file2] [input-file3...]",
 		Short: "Parse PCAP or CSV files and generate domain statistics",
 		Long: `Parse one or more PCAP files containing DNS traffic and generate domain statistics.
-Save them to a DNSMAG file (CBOR format).`,
-		Args: cobra.MinimumNArgs(1),
+Save them to a DNSMAG file (CBOR format).
+
+With --checkpoint, the collection state is saved between input files, and an interrupted run can be
+continued with --resume. Resuming is per input file: files that were completely processed are skipped,
+and the file that was being processed is read again from its start.
+
+With --watch, run continuously and collect files appearing in a spool directory into one
+dataset per UTC day, written to --output-dir when the day has closed.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if watch, _ := cmd.Flags().GetString("watch"); watch != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			stdin := cmd.InOrStdin()
 			stdout := cmd.OutOrStdout()
@@ -32,6 +47,23 @@ Save them to a DNSMAG file (CBOR format).`,
 				verbose  bool
 				quiet    bool
 				chunk    int
+				source   string
+				sites    []string
+
+				checkpoint         string
+				checkpointInterval time.Duration
+				resume             string
+
+				watch        string
+				outputDir    string
+				pattern      string
+				pollInterval time.Duration
+				settle       time.Duration
+				dayGrace     time.Duration
+				processed    string
+				moveTo       string
+
+				metricsListen string
 			)
 
 			parseFlags(cmd, map[string]any{
@@ -42,6 +74,23 @@ Save them to a DNSMAG file (CBOR format).`,
 				"verbose":  &verbose,
 				"quiet":    &quiet,
 				"chunk":    &chunk,
+				"source":   &source,
+				"site":     &sites,
+
+				"checkpoint":          &checkpoint,
+				"checkpoint-interval": &checkpointInterval,
+				"resume":              &resume,
+
+				"watch":         &watch,
+				"output-dir":    &outputDir,
+				"pattern":       &pattern,
+				"poll-interval": &pollInterval,
+				"settle":        &settle,
+				"day-grace":     &dayGrace,
+				"processed":     &processed,
+				"move-to":       &moveTo,
+
+				"metrics-listen": &metricsListen,
 			})
 
 			// Validate filetype
@@ -67,6 +116,17 @@ Save them to a DNSMAG file (CBOR format).`,
 				return fmt.Errorf("conflicting flags: cannot use both --quiet and --verbose")
 			}
 
+			// Unless specified, continue saving checkpoints to the file we resume from
+			if resume != "" && checkpoint == "" {
+				checkpoint = resume
+			}
+
+			// Input from STDIN can't be skipped when resuming
+			if checkpoint != "" && slices.Contains(args, "-") {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("checkpoints can not be used when reading from STDIN")
+			}
+
 			// Collect all datasets from input files
 			var chunkSize uint
 			if chunk < 0 {
@@ -74,11 +134,92 @@ Save them to a DNSMAG file (CBOR format).`,
 			} else {
 				chunkSize = uint(chunk) * 1000 * 1000
 			}
-			collector := internal.NewCollector(topCount, chunkSize, verbose, date, timing)
-			err := collector.ProcessFiles(args, filetype, stdin, stderr)
+
+			// Serve metrics while collecting, if requested
+			ctx, cancel := context.WithCancel(cmd.Context())
+			defer cancel()
+			var metrics *internal.Metrics
+			if metricsListen != "" {
+				metrics = internal.NewMetrics()
+				addr, err := internal.ServeMetrics(ctx, metricsListen, metrics, stderr)
+				if err != nil {
+					cmd.SilenceUsage = true
+					return err
+				}
+				if verbose {
+					fmt.Fprintf(stderr, "Serving metrics on http://%s/metrics\n", addr)
+				}
+			}
+
+			writeOpts, err := writeOptions(cmd)
 			if err != nil {
 				cmd.SilenceUsage = true
-				return fmt.Errorf("failed to process files: %w", err)
+				return err
+			}
+
+			if watch != "" {
+				if output != "" || checkpoint != "" || dateStr != "" || writeOpts != (internal.WriteOptions{}) {
+					cmd.SilenceUsage = true
+					return fmt.Errorf("--output, --checkpoint, --resume, --date, --encrypt-to, --compress and --append can not be used with --watch")
+				}
+				if outputDir == "" {
+					cmd.SilenceUsage = true
+					return fmt.Errorf("--output-dir is required with --watch")
+				}
+
+				logger := stderr
+				if quiet {
+					logger = io.Discard
+				}
+				watcher, err := internal.NewWatcher(internal.WatchOptions{
+					Dir:          watch,
+					Pattern:      pattern,
+					Filetype:     filetype,
+					TopCount:     topCount,
+					ChunkSize:    chunkSize,
+					OutputDir:    outputDir,
+					PollInterval: pollInterval,
+					Settle:       settle,
+					DayGrace:     dayGrace,
+					Processed:    processed,
+					MoveTo:       moveTo,
+					Metrics:      metrics,
+					Source:       source,
+					Sites:        sites,
+				}, verbose, logger)
+				if err != nil {
+					cmd.SilenceUsage = true
+					return err
+				}
+
+				cmd.SilenceUsage = true
+				return watcher.Run(ctx)
+			}
+
+			collector := internal.NewCollector(topCount, chunkSize, verbose, date, timing)
+			collector.SetMetrics(metrics)
+			if checkpoint != "" {
+				collector.EnableCheckpoints(checkpoint, checkpointInterval)
+			}
+			if resume != "" {
+				if err := collector.Resume(resume); err != nil {
+					cmd.SilenceUsage = true
+					return fmt.Errorf("failed to resume from checkpoint %s: %w", resume, err)
+				}
+				if verbose {
+					fmt.Fprintf(stderr, "Resuming collection from checkpoint %s\n", resume)
+				}
+			}
+			// Provenance from the command line takes precedence over the one in a checkpoint
+			if source != "" || len(sites) > 0 {
+				collector.SetProvenance(source, sites)
+			}
+			// When interrupted, the collector finalises what it has and marks the result as partial.
+			// The partial result is saved below, before returning the error.
+			processErr := collector.ProcessFiles(ctx, args, filetype, stdin, stderr)
+			if processErr != nil && !collector.Result.Partial {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("failed to process files: %w", processErr)
 			}
 
 			if verbose {
@@ -88,12 +229,14 @@ Save them to a DNSMAG file (CBOR format).`,
 			// Write stats to DNSMAG file only if output is specified
 			// When no output file is specified, only show stats on stderr
 			if output != "" {
-				filename, err := internal.WriteDNSMagFile(collector.Result, output, stdout)
+				filename, err := internal.WriteDNSMagFileWithOptions(collector.Result, output, stdout, writeOpts)
 				if err != nil {
 					cmd.SilenceUsage = true
 					return fmt.Errorf("failed to write DNSMAG to %s: %w", filename, err)
 				}
-				if !quiet {
+				if collector.Result.Partial {
+					fmt.Fprintf(stderr, "Saved partial statistics to %s\n\n", filename)
+				} else if !quiet {
 					fmt.Fprintf(stderr, "Saved aggregated statistics to %s\n\n", filename)
 				}
 			}
@@ -108,6 +251,11 @@ Save them to a DNSMAG file (CBOR format).`,
 				}
 			}
 
+			if processErr != nil {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("failed to process files: %w", processErr)
+			}
+
 			return nil
 		},
 	}
@@ -118,6 +266,23 @@ Save them to a DNSMAG file (CBOR format).`,
 	collectCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
 	collectCmd.Flags().BoolP("quiet", "q", false, "Quiet mode")
 	collectCmd.Flags().IntP("chunk", "c", internal.DefaultCollectDomainsChunk, "Number of queries to process in one go (in millions, 0 = unlimited)")
+	collectCmd.Flags().String("source", "", "Organisation or operator collecting the data, recorded in the dataset metadata (optional)")
+	collectCmd.Flags().StringSlice("site", nil, "Site the data was collected at, recorded in the dataset metadata (optional, repeatable)")
+	collectCmd.Flags().String("encrypt-to", "", "File with a PEM encoded X25519 public key to encrypt the output dataset to (optional)")
+	collectCmd.Flags().String("compress", "", "Compress the output file: 'none', 'gzip' or 'zstd' (optional, with --append defaults to the compression of the existing file)")
+	collectCmd.Flags().Bool("append", false, "Add the dataset to the datasets in an existing output file, instead of replacing it")
+	collectCmd.Flags().String("checkpoint", "", "File to periodically save collection state to, for use with --resume (optional)")
+	collectCmd.Flags().Duration("checkpoint-interval", internal.DefaultCheckpointInterval, "Minimum time between checkpoints (0 = after every input file)")
+	collectCmd.Flags().String("resume", "", "Resume an interrupted collection from a checkpoint file, skipping input files that were completely processed")
+	collectCmd.Flags().String("watch", "", "Spool directory to continuously collect input files from (daemon mode)")
+	collectCmd.Flags().String("output-dir", "", "Directory to save the per-day datasets to in watch mode")
+	collectCmd.Flags().String("pattern", "*", "Glob pattern of input files to pick up in watch mode")
+	collectCmd.Flags().Duration("poll-interval", internal.DefaultWatchPollInterval, "Time between scans of the spool directory in watch mode")
+	collectCmd.Flags().Duration("settle", internal.DefaultWatchSettle, "Time an input file must be unchanged before it is considered complete in watch mode")
+	collectCmd.Flags().Duration("day-grace", internal.DefaultWatchDayGrace, "Time to wait for late input files after the end of a UTC day before saving its dataset")
+	collectCmd.Flags().String("processed", internal.ProcessedKeep, "What to do with processed input files in watch mode, once the dataset of their day has been written: 'keep', 'delete' or 'move'")
+	collectCmd.Flags().String("move-to", "", "Directory to move processed input files to, with --processed move")
+	collectCmd.Flags().String("metrics-listen", "", "Address to serve OpenMetrics /metrics on while collecting, e.g. 127.0.0.1:9100 (optional)")
 
 	return collectCmd
 }
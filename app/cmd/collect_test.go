@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"dnsmag/internal"
 	"os"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -236,3 +239,222 @@ func TestCollect_NoDomainsCSV_Verbose(t *testing.T) {
 		})
 	}
 }
+
+func TestCollect_CheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	checkpoint := dir + "/collect.checkpoint"
+
+	// First run saves a checkpoint after the only input file
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--checkpoint", checkpoint,
+		"--checkpoint-interval", "0s",
+	}, 200, "TSV")
+
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatalf("Expected checkpoint file to be written: %v", err)
+	}
+
+	// Resumed run skips the already processed file, but still includes its records
+	output := executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"../../testdata/test3.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--resume", checkpoint,
+		"--verbose",
+	}, 216, "TSV resumed")
+
+	if !regexp.MustCompile(`Skipping tsv file already processed according to checkpoint: .*test2.tsv`).MatchString(output) {
+		t.Errorf("Expected test2.tsv to be skipped, output:\n%s", output)
+	}
+}
+
+func TestCollect_CheckpointStdin(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := newCollectCmd()
+	cmd.SetArgs([]string{"-", "--checkpoint", t.TempDir() + "/collect.checkpoint"})
+	cmd.SetIn(&bytes.Buffer{})
+	cmd.SetOut(stdout)
+	cmd.SetErr(stderr)
+
+	err := cmd.Execute()
+	if err == nil || !regexp.MustCompile(`checkpoints can not be used when reading from STDIN`).MatchString(err.Error()) {
+		t.Errorf("Expected error about checkpoints and STDIN, got: %v", err)
+	}
+}
+
+func TestCollect_InterruptedWritesPartial(t *testing.T) {
+	output := t.TempDir() + "/partial.dnsmag"
+
+	// A cancelled context simulates receiving SIGINT/SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := newCollectCmd()
+	cmd.SetArgs([]string{"../../testdata/test1.pcap.gz", "--output", output})
+	cmd.SetOut(stdout)
+	cmd.SetErr(stderr)
+
+	err := cmd.ExecuteContext(ctx)
+	if err == nil || !regexp.MustCompile(`collection interrupted`).MatchString(err.Error()) {
+		t.Fatalf("Expected collection interrupted error, got: %v", err)
+	}
+	if !regexp.MustCompile(`Saved partial statistics to .*partial.dnsmag`).MatchString(stderr.String()) {
+		t.Errorf("Expected message about saved partial statistics, output:\n%s", stderr.String())
+	}
+
+	// The partial dataset is marked as such when viewed
+	viewCmd := newViewCmd()
+	viewCmd.SetArgs([]string{output})
+	var viewBuf bytes.Buffer
+	viewCmd.SetOut(&viewBuf)
+	viewCmd.SetErr(&viewBuf)
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, viewBuf.String())
+	}
+	if !regexp.MustCompile(`Partial dataset\s+:\s+yes`).MatchString(viewBuf.String()) {
+		t.Errorf("Expected partial dataset in view output:\n%s", viewBuf.String())
+	}
+}
+
+func TestCollect_Watch(t *testing.T) {
+	spool := t.TempDir()
+	outputDir := t.TempDir()
+
+	data, err := os.ReadFile("../../testdata/test2.tsv")
+	if err != nil {
+		t.Fatalf("Failed to read test TSV file: %v", err)
+	}
+	if err := os.WriteFile(spool+"/test2.tsv", data, 0o600); err != nil {
+		t.Fatalf("Failed to write spool file: %v", err)
+	}
+
+	// Stop the watcher shortly after the first scan of the spool directory
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := newCollectCmd()
+	cmd.SetArgs([]string{
+		"--watch", spool,
+		"--output-dir", outputDir,
+		"--filetype", "tsv",
+		"--settle", "0s",
+		"--poll-interval", "50ms",
+		"--processed", "delete",
+	})
+	cmd.SetOut(stdout)
+	cmd.SetErr(stderr)
+
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		t.Fatalf("collect --watch failed: %v\nstderr: %s", err, stderr.String())
+	}
+
+	// The day is still open, so its dataset is saved as partial on shutdown
+	if !regexp.MustCompile(`Saved partial dataset for \d{4}-\d{2}-\d{2} to `).MatchString(stderr.String()) {
+		t.Errorf("Expected partial dataset to be saved on shutdown, output:\n%s", stderr.String())
+	}
+	if _, err := os.Stat(spool + "/test2.tsv"); !os.IsNotExist(err) {
+		t.Error("Expected processed file to be deleted")
+	}
+
+	date := time.Now().UTC().Format(time.DateOnly)
+	viewCmd := newViewCmd()
+	viewCmd.SetArgs([]string{outputDir + "/dnsmag-" + date + ".cbor"})
+	var viewBuf bytes.Buffer
+	viewCmd.SetOut(&viewBuf)
+	viewCmd.SetErr(&viewBuf)
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, viewBuf.String())
+	}
+	if !regexp.MustCompile(`Total queries\s+:\s+200`).MatchString(viewBuf.String()) {
+		t.Errorf("Expected 200 queries in watch output dataset:\n%s", viewBuf.String())
+	}
+}
+
+func TestCollect_WatchInvalidFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+	}{
+		{"input files", []string{"--watch", t.TempDir(), "--output-dir", t.TempDir(), "file.pcap"}, `unknown command "file.pcap"`},
+		{"no output dir", []string{"--watch", t.TempDir()}, `--output-dir is required`},
+		{"with output", []string{"--watch", t.TempDir(), "--output-dir", t.TempDir(), "--output", "x"}, `can not be used with --watch`},
+		{"with compress", []string{"--watch", t.TempDir(), "--output-dir", t.TempDir(), "--compress", "gzip"}, `can not be used with --watch`},
+		{"move without dir", []string{"--watch", t.TempDir(), "--output-dir", t.TempDir(), "--processed", "move"}, `directory to move processed files to`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := newCollectCmd()
+			cmd.SetArgs(tt.args)
+			var buf bytes.Buffer
+			cmd.SetOut(&buf)
+			cmd.SetErr(&buf)
+
+			err := cmd.Execute()
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestCollect_CompressedAppend(t *testing.T) {
+	dir := t.TempDir()
+	output := dir + "/data.cbor.zst"
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--compress", "zstd",
+		"--output", output,
+	}, 200, "TSV compressed")
+
+	// Appending keeps the compression of the existing file
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test3.tsv",
+		"--filetype", "tsv",
+		"--date", "2000-01-01",
+		"--append",
+		"--output", output,
+	}, 16, "TSV appended")
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Errorf("Expected zstd compressed output, got % x", data[:4])
+	}
+
+	viewCmd := newViewCmd()
+	viewCmd.SetArgs([]string{output})
+	var buf bytes.Buffer
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !regexp.MustCompile(`Total queries\s+:\s+216`).MatchString(buf.String()) {
+		t.Errorf("Expected 216 queries from both datasets in view output:\n%s", buf.String())
+	}
+
+	// Compression can not change when appending
+	collectCmd := newCollectCmd()
+	collectCmd.SetArgs([]string{"../../testdata/test3.tsv", "--filetype", "tsv", "--append", "--compress", "gzip", "--output", output})
+	collectCmd.SetOut(&buf)
+	collectCmd.SetErr(&buf)
+	if err := collectCmd.Execute(); err == nil || !strings.Contains(err.Error(), "can not append gzip compressed dataset") {
+		t.Errorf("Expected compression mismatch error, got: %v", err)
+	}
+}
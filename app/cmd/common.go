@@ -3,9 +3,13 @@
 package cmd
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"dnsmag/internal"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -19,10 +23,16 @@ func parseFlags(cmd *cobra.Command, flags map[string]any) {
 		switch v := dest.(type) {
 		case *int:
 			*v, err = cmd.Flags().GetInt(name)
+		case *float64:
+			*v, err = cmd.Flags().GetFloat64(name)
 		case *bool:
 			*v, err = cmd.Flags().GetBool(name)
 		case *string:
 			*v, err = cmd.Flags().GetString(name)
+		case *time.Duration:
+			*v, err = cmd.Flags().GetDuration(name)
+		case *[]string:
+			*v, err = cmd.Flags().GetStringSlice(name)
 		default:
 			fmt.Fprintf(stderr, "Unsupported flag type for %s\n", name)
 			os.Exit(1)
@@ -63,3 +73,71 @@ func loadDatasets(cmd *cobra.Command, seq *internal.DatasetSequence, args []stri
 	}
 	return nil
 }
+
+// readInput calls read with a file, or STDIN if the filename is "-". The file is closed before readInput
+// returns, so that reading many files does not keep them all open.
+func readInput(cmd *cobra.Command, filename string, read func(reader io.Reader) error) error {
+	if filename == "-" {
+		return read(cmd.InOrStdin())
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return read(f)
+}
+
+// datasetReader reads datasets that may be signed and/or encrypted, like a DatasetSequence or an Archive
+type datasetReader interface {
+	RequireSignatures(trusted []ed25519.PublicKey)
+	SetIdentity(identity *ecdh.PrivateKey)
+}
+
+// configureSequence makes seq only accept datasets signed by a key in the --trusted-keys file, and
+// decrypt encrypted datasets with the key in the --identity file, if given
+func configureSequence(cmd *cobra.Command, seq datasetReader) error {
+	var trustedKeys, identity string
+	parseFlags(cmd, map[string]any{
+		"trusted-keys": &trustedKeys,
+		"identity":     &identity,
+	})
+
+	if trustedKeys != "" {
+		keys, err := internal.LoadTrustedKeys(trustedKeys)
+		if err != nil {
+			return fmt.Errorf("failed to load trusted keys: %w", err)
+		}
+		seq.RequireSignatures(keys)
+	}
+	if identity != "" {
+		key, err := internal.LoadIdentity(identity)
+		if err != nil {
+			return fmt.Errorf("failed to load identity: %w", err)
+		}
+		seq.SetIdentity(key)
+	}
+	return nil
+}
+
+// writeOptions returns how to write output datasets, from the --encrypt-to, --compress and --append flags
+func writeOptions(cmd *cobra.Command) (internal.WriteOptions, error) {
+	var (
+		encryptTo string
+		opts      internal.WriteOptions
+	)
+	parseFlags(cmd, map[string]any{
+		"encrypt-to": &encryptTo,
+		"compress":   &opts.Compression,
+		"append":     &opts.Append,
+	})
+
+	if encryptTo != "" {
+		recipient, err := internal.LoadRecipientKey(encryptTo)
+		if err != nil {
+			return opts, fmt.Errorf("failed to load recipient key: %w", err)
+		}
+		opts.Recipient = recipient
+	}
+	return opts, nil
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"dnsmag/internal"
 	"fmt"
 	"os"
@@ -59,7 +60,7 @@ func loadDatasetFromCSV(csvData string, dateStr string, verbose bool) (*internal
 
 	timing.StartParsing()
 
-	err := internal.LoadCSVFromReader(reader, collector, "csv")
+	err := internal.LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,103 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newDiffCmd() *cobra.Command {
+	diffCmd := &cobra.Command{
+		Use:   "diff <old-dnsmag-file> <new-dnsmag-file>",
+		Short: "Show the differences between two DNSMAG files",
+		Long: `Compare the datasets in two DNSMAG files, of any dates, and show the per-domain changes in clients,
+queries and magnitude, the domains entering or leaving the top domains by magnitude, and the estimated
+overlap of the client populations. Files with several datasets of the same date are aggregated first.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stderr := cmd.ErrOrStderr()
+			stdout := cmd.OutOrStdout()
+
+			var (
+				verbose bool
+				json    bool
+				top     int
+				output  string
+			)
+
+			parseFlags(cmd, map[string]any{
+				"verbose": &verbose,
+				"json":    &json,
+				"top":     &top,
+				"output":  &output,
+			})
+
+			cmd.SilenceUsage = true
+
+			var datasets []internal.MagnitudeDataset
+			for _, filename := range args {
+				seq := internal.NewDatasetSequence(0, nil, false, stderr)
+				if err := configureSequence(cmd, seq); err != nil {
+					return err
+				}
+				if err := loadDatasets(cmd, seq, []string{filename}, verbose); err != nil {
+					return err
+				}
+				if seq.Count == 0 {
+					return fmt.Errorf("no datasets found in %s", filename)
+				}
+				datasets = append(datasets, seq.Result)
+			}
+
+			diff, err := internal.DiffDatasets(datasets[0], datasets[1], top)
+			if err != nil {
+				return err
+			}
+
+			var buf bytes.Buffer
+			if json {
+				err = internal.OutputDatasetDiffJSON(&buf, diff)
+			} else {
+				err = internal.OutputDatasetDiff(&buf, diff)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to output diff: %w", err)
+			}
+
+			// Write the diff to the specified output file or stdout
+			if output != "" && output != "-" {
+				// #nosec G306
+				if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+					return fmt.Errorf("failed to write to %s: %w", output, err)
+				}
+				if verbose {
+					fmt.Fprintf(stderr, "Diff written to %s\n", output)
+				}
+			} else if _, err := stdout.Write(buf.Bytes()); err != nil {
+				return fmt.Errorf("failed to write to stdout: %w", err)
+			}
+
+			return nil
+		},
+	}
+
+	diffCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	diffCmd.Flags().BoolP("json", "j", false, "JSON output")
+	diffCmd.Flags().IntP("top", "n", internal.DefaultDomainCount, "Number of top domains to report entering or leaving (0 to disable)")
+	diffCmd.Flags().StringP("output", "o", "", "Output file (optional, defaults to stdout)")
+	diffCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	diffCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+
+	return diffCmd
+}
+
+var diffCmd = newDiffCmd()
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiffCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-01",
+		"--output", dir + "/old.cbor",
+	}, 200, "TSV")
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.csv.gz",
+		"--filetype", "csv",
+		"--date", "2026-09-02",
+		"--output", dir + "/new.cbor",
+	}, 200, "CSV")
+
+	var buf bytes.Buffer
+	diffCmd := newDiffCmd()
+	diffCmd.SetOut(&buf)
+	diffCmd.SetErr(&buf)
+	diffCmd.SetArgs([]string{dir + "/old.cbor", dir + "/new.cbor"})
+	if err := diffCmd.Execute(); err != nil {
+		t.Fatalf("Diff command failed: %v\nOutput: %s", err, buf.String())
+	}
+	for _, expected := range []string{
+		"Date                            : 2026-09-01 -> 2026-09-02",
+		"Domain changes:",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in output:\n%s", expected, buf.String())
+		}
+	}
+
+	buf.Reset()
+	diffCmd = newDiffCmd()
+	diffCmd.SetOut(&buf)
+	diffCmd.SetErr(&buf)
+	diffCmd.SetArgs([]string{"--json", "--top", "3", dir + "/new.cbor", dir + "/new.cbor"})
+	if err := diffCmd.Execute(); err != nil {
+		t.Fatalf("Diff command failed: %v\nOutput: %s", err, buf.String())
+	}
+	var diff internal.DatasetDiff
+	if err := json.Unmarshal(buf.Bytes(), &diff); err != nil {
+		t.Fatalf("Failed to parse JSON diff: %v\nOutput: %s", err, buf.String())
+	}
+	if diff.Top != 3 || len(diff.Entered) != 0 || len(diff.Left) != 0 || diff.ClientOverlap.Jaccard != 1 {
+		t.Errorf("Expected identical datasets, got %+v", diff)
+	}
+	for _, d := range diff.Domains {
+		if d.MagnitudeChange != 0 || d.ClientsChange != 0 || d.QueriesChange != 0 {
+			t.Errorf("Expected no change for %s, got %+v", d.Domain, d)
+		}
+	}
+
+	diffCmd = newDiffCmd()
+	diffCmd.SetOut(&buf)
+	diffCmd.SetErr(&buf)
+	diffCmd.SetArgs([]string{dir + "/old.cbor"})
+	if err := diffCmd.Execute(); err == nil {
+		t.Error("Expected error with one file")
+	}
+}
@@ -0,0 +1,129 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"dnsmag/internal"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newFilterCmd() *cobra.Command {
+	filterCmd := &cobra.Command{
+		Use:   "filter <dnsmag-file1> [dnsmag-file2...]",
+		Short: "Write a dataset with a subset of the domains in DNSMAG files",
+		Long: `Write a new dataset with only the domains matching an include and/or exclude list, e.g. to share
+only the collision-relevant part of a dataset or to strip out known-noisy names.
+
+Domain lists are files with one domain name per line. Patterns are regular expressions (RE2 syntax)
+matching anywhere in the domain name unless anchored, e.g. '^(local|home|corp)$'. A domain is kept if
+it is in the include list or matches the include pattern (or neither is given), and it is neither in
+the exclude list nor matches the exclude pattern.
+
+The datasets in the input files are aggregated first, like the aggregate command does. The client
+HLL and counts of the whole dataset are kept intact, so the magnitudes of the remaining domains are
+unchanged. The applied filter is recorded in the metadata of the new dataset.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdout := cmd.OutOrStdout()
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				includeFile    string
+				includePattern string
+				excludeFile    string
+				excludePattern string
+				output         string
+				verbose        bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"include":         &includeFile,
+				"include-pattern": &includePattern,
+				"exclude":         &excludeFile,
+				"exclude-pattern": &excludePattern,
+				"output":          &output,
+				"verbose":         &verbose,
+			})
+
+			cmd.SilenceUsage = true
+
+			var include, exclude []string
+			var err error
+			if includeFile != "" {
+				if include, err = internal.LoadDomainList(includeFile); err != nil {
+					return fmt.Errorf("failed to load include list: %w", err)
+				}
+			}
+			if excludeFile != "" {
+				if exclude, err = internal.LoadDomainList(excludeFile); err != nil {
+					return fmt.Errorf("failed to load exclude list: %w", err)
+				}
+			}
+			filter, err := internal.NewDomainFilter(include, includePattern, exclude, excludePattern)
+			if err != nil {
+				return err
+			}
+
+			writeOpts, err := writeOptions(cmd)
+			if err != nil {
+				return err
+			}
+
+			seq := internal.NewDatasetSequence(0, nil, false, stderr)
+			if err := configureSequence(cmd, seq); err != nil {
+				return err
+			}
+			if err := loadDatasets(cmd, seq, args, verbose); err != nil {
+				return err
+			}
+			if seq.Count == 0 {
+				return fmt.Errorf("no datasets found")
+			}
+
+			filtered, err := internal.FilterDataset(seq.Result, filter)
+			if err != nil {
+				return fmt.Errorf("failed to filter dataset: %w", err)
+			}
+			if verbose {
+				fmt.Fprintf(stderr, "Kept %d of %d domains\n", len(filtered.Domains), len(seq.Result.Domains))
+			}
+
+			outFilename, err := internal.WriteDNSMagFileWithOptions(filtered, output, stdout, writeOpts)
+			if err != nil {
+				return fmt.Errorf("failed to write filtered dataset to %s: %w", output, err)
+			}
+			if verbose {
+				fmt.Fprintf(stderr, "Filtered dataset saved to %s\n", outFilename)
+			}
+
+			return nil
+		},
+	}
+
+	filterCmd.Flags().String("include", "", "File with domains to keep, one per line (optional)")
+	filterCmd.Flags().String("include-pattern", "", "Regular expression matching domains to keep (optional)")
+	filterCmd.Flags().String("exclude", "", "File with domains to remove, one per line (optional)")
+	filterCmd.Flags().String("exclude-pattern", "", "Regular expression matching domains to remove (optional)")
+	filterCmd.Flags().StringP("output", "o", "", "Output file for the filtered dataset ('-' for stdout, required)")
+	filterCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	filterCmd.Flags().String("encrypt-to", "", "File with a PEM encoded X25519 public key to encrypt the filtered dataset to (optional)")
+	filterCmd.Flags().String("compress", "", "Compress the output file: 'none', 'gzip' or 'zstd' (optional, with --append defaults to the compression of the existing file)")
+	filterCmd.Flags().Bool("append", false, "Add the filtered dataset to the datasets in an existing output file, instead of replacing it")
+	filterCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	filterCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+	if err := filterCmd.MarkFlagRequired("output"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mark 'output' flag as required: %v\n", err)
+		os.Exit(1)
+	}
+
+	return filterCmd
+}
+
+var filterCmd = newFilterCmd()
+
+func init() {
+	rootCmd.AddCommand(filterCmd)
+}
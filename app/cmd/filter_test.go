@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFilterCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--output", dir + "/data.cbor",
+	}, 200, "TSV")
+
+	if err := os.WriteFile(dir+"/noisy.txt", []byte("# noisy names\nlocal\narpa.\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write exclude list: %v", err)
+	}
+
+	var buf bytes.Buffer
+	filterCmd := newFilterCmd()
+	filterCmd.SetOut(&buf)
+	filterCmd.SetErr(&buf)
+	filterCmd.SetArgs([]string{
+		"--exclude", dir + "/noisy.txt",
+		"--exclude-pattern", "^u",
+		"--compress", "zstd",
+		"--output", dir + "/filtered.cbor",
+		"--verbose",
+		dir + "/data.cbor",
+	})
+	if err := filterCmd.Execute(); err != nil {
+		t.Fatalf("Filter command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "Kept 4 of 7 domains") {
+		t.Errorf("Expected 4 of 7 domains to be kept:\n%s", buf.String())
+	}
+
+	seq := internal.NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagFile(dir + "/filtered.cbor"); err != nil {
+		t.Fatalf("Failed to load filtered dataset: %v", err)
+	}
+	for _, domain := range []internal.DomainName{"local", "arpa", "uk"} {
+		if _, found := seq.Result.Domains[domain]; found {
+			t.Errorf("Expected %s to be removed", domain)
+		}
+	}
+	if md := seq.Result.Metadata; md == nil || len(md.Filters) != 1 || md.Filters[0].ExcludePattern != "^u" {
+		t.Errorf("Expected the filter to be recorded in the metadata, got %+v", md)
+	}
+
+	buf.Reset()
+	viewCmd := newViewCmd()
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	viewCmd.SetArgs([]string{dir + "/filtered.cbor"})
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "exclude 2 domains, exclude /^u/") {
+		t.Errorf("Expected the filter in the view output:\n%s", buf.String())
+	}
+
+	filterCmd = newFilterCmd()
+	filterCmd.SetOut(&buf)
+	filterCmd.SetErr(&buf)
+	filterCmd.SetArgs([]string{"--output", dir + "/empty.cbor", dir + "/data.cbor"})
+	if err := filterCmd.Execute(); err == nil || !strings.Contains(err.Error(), "empty filter") {
+		t.Errorf("Expected empty filter error, got: %v", err)
+	}
+}
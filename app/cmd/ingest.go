@@ -0,0 +1,138 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"dnsmag/internal"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newIngestCmd() *cobra.Command {
+	ingestCmd := &cobra.Command{
+		Use:   "ingest",
+		Short: "Aggregate CSV/TSV records received over a socket into daily datasets",
+		Long: `Listen on a TCP or Unix socket for newline-delimited CSV/TSV records (client IP address, domain
+and optional query counter) and aggregate them into one dataset per UTC day.
+
+The current day's dataset is periodically saved to --output-dir as a partial dataset, and saved
+as final once the day has ended. On SIGINT/SIGTERM, connections are closed and all datasets saved.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				listen        string
+				filetype      string
+				outputDir     string
+				flushInterval time.Duration
+				topCount      int
+				chunk         int
+				verbose       bool
+				quiet         bool
+				metricsListen string
+				source        string
+				sites         []string
+			)
+
+			parseFlags(cmd, map[string]any{
+				"listen":         &listen,
+				"filetype":       &filetype,
+				"output-dir":     &outputDir,
+				"flush-interval": &flushInterval,
+				"top":            &topCount,
+				"chunk":          &chunk,
+				"verbose":        &verbose,
+				"quiet":          &quiet,
+				"metrics-listen": &metricsListen,
+				"source":         &source,
+				"site":           &sites,
+			})
+
+			// Quiet and verbose flags are mutually exclusive
+			if quiet && verbose {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("conflicting flags: cannot use both --quiet and --verbose")
+			}
+
+			var chunkSize uint
+			if chunk > 0 {
+				chunkSize = uint(chunk) * 1000 * 1000
+			}
+
+			logger := stderr
+			if quiet {
+				logger = io.Discard
+			}
+
+			cmd.SilenceUsage = true
+
+			// Serve metrics while ingesting, if requested
+			var metrics *internal.Metrics
+			if metricsListen != "" {
+				metrics = internal.NewMetrics()
+				addr, err := internal.ServeMetrics(cmd.Context(), metricsListen, metrics, stderr)
+				if err != nil {
+					return err
+				}
+				if !quiet {
+					fmt.Fprintf(stderr, "Serving metrics on http://%s/metrics\n", addr)
+				}
+			}
+
+			ingester, err := internal.NewIngester(internal.IngestOptions{
+				Filetype:      filetype,
+				TopCount:      topCount,
+				ChunkSize:     chunkSize,
+				OutputDir:     outputDir,
+				FlushInterval: flushInterval,
+				Metrics:       metrics,
+				Source:        source,
+				Sites:         sites,
+			}, verbose, logger)
+			if err != nil {
+				return err
+			}
+
+			listener, err := internal.Listen(listen)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", listen, err)
+			}
+			if !quiet {
+				fmt.Fprintf(stderr, "Listening for %s records on %s\n", filetype, listener.Addr())
+			}
+
+			return ingester.Serve(cmd.Context(), listener)
+		},
+	}
+
+	ingestCmd.Flags().StringP("listen", "l", "", "Address to listen on, e.g. tcp://127.0.0.1:5300 or unix:///run/dnsmag.sock (required)")
+	ingestCmd.Flags().String("filetype", "csv", "Record format: 'csv' or 'tsv'")
+	ingestCmd.Flags().String("output-dir", "", "Directory to save the per-day datasets to (required)")
+	ingestCmd.Flags().Duration("flush-interval", internal.DefaultIngestFlushInterval, "Time between saves of the current day's dataset")
+	ingestCmd.Flags().IntP("top", "n", internal.DefaultDomainCount, "Number of domains to collect")
+	ingestCmd.Flags().IntP("chunk", "c", internal.DefaultCollectDomainsChunk, "Number of queries to process in one go (in millions, 0 = unlimited)")
+	ingestCmd.Flags().String("source", "", "Organisation or operator collecting the data, recorded in the dataset metadata (optional)")
+	ingestCmd.Flags().StringSlice("site", nil, "Site the data was collected at, recorded in the dataset metadata (optional, repeatable)")
+	ingestCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	ingestCmd.Flags().BoolP("quiet", "q", false, "Quiet mode")
+	ingestCmd.Flags().String("metrics-listen", "", "Address to serve OpenMetrics /metrics on, e.g. 127.0.0.1:9100 (optional)")
+	for _, name := range []string{"listen", "output-dir"} {
+		if err := ingestCmd.MarkFlagRequired(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mark '%s' flag as required: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	return ingestCmd
+}
+
+var ingestCmd = newIngestCmd()
+
+func init() {
+	rootCmd.AddCommand(ingestCmd)
+}
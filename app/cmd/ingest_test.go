@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for use as command output from multiple goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestIngestCmd_Integration(t *testing.T) {
+	socket := t.TempDir() + "/ingest.sock"
+	outputDir := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stderr := &syncBuffer{}
+	cmd := newIngestCmd()
+	cmd.SetArgs([]string{"--listen", "unix://" + socket, "--output-dir", outputDir, "--filetype", "tsv"})
+	cmd.SetOut(stderr)
+	cmd.SetErr(stderr)
+
+	done := make(chan error)
+	go func() { done <- cmd.ExecuteContext(ctx) }()
+
+	// Wait for the socket to appear
+	var conn net.Conn
+	var err error
+	for range 100 {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect to ingest socket: %v\nOutput: %s", err, stderr.String())
+	}
+
+	data, err := os.ReadFile("../../testdata/test2.tsv")
+	if err != nil {
+		t.Fatalf("Failed to read test TSV file: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Failed to write records: %v", err)
+	}
+
+	// Half-close, and wait for the ingester to close the connection after reading all records
+	if err := conn.(*net.UnixConn).CloseWrite(); err != nil {
+		t.Fatalf("Failed to close connection for writing: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, conn)
+	conn.Close()
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Ingest command failed: %v\nOutput: %s", err, stderr.String())
+	}
+
+	output := stderr.String()
+	if !regexp.MustCompile(`Saved partial dataset for \d{4}-\d{2}-\d{2} to .* \(26 records, 0 invalid\)`).MatchString(output) {
+		t.Errorf("Expected partial dataset to be saved on shutdown, output:\n%s", output)
+	}
+
+	date := time.Now().UTC().Format(time.DateOnly)
+	viewCmd := newViewCmd()
+	viewCmd.SetArgs([]string{outputDir + "/dnsmag-" + date + ".cbor"})
+	var viewBuf bytes.Buffer
+	viewCmd.SetOut(&viewBuf)
+	viewCmd.SetErr(&viewBuf)
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, viewBuf.String())
+	}
+	if !regexp.MustCompile(`Total queries\s+:\s+200`).MatchString(viewBuf.String()) {
+		t.Errorf("Expected 200 queries in ingested dataset:\n%s", viewBuf.String())
+	}
+}
+
+func TestIngestCmd_InvalidListen(t *testing.T) {
+	cmd := newIngestCmd()
+	cmd.SetArgs([]string{"--listen", "udp://127.0.0.1:0", "--output-dir", t.TempDir()})
+	var buf bytes.Buffer
+	cmd.SetOut(&buf)
+	cmd.SetErr(&buf)
+
+	err := cmd.Execute()
+	if err == nil || !regexp.MustCompile(`must start with tcp:// or unix://`).MatchString(err.Error()) {
+		t.Errorf("Expected invalid listen address error, got: %v", err)
+	}
+}
+
+func TestIngestCmd_Metrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stderr := &syncBuffer{}
+	cmd := newIngestCmd()
+	cmd.SetArgs([]string{"--listen", "tcp://127.0.0.1:0", "--output-dir", t.TempDir(), "--metrics-listen", "127.0.0.1:0"})
+	cmd.SetOut(stderr)
+	cmd.SetErr(stderr)
+
+	done := make(chan error)
+	go func() { done <- cmd.ExecuteContext(ctx) }()
+
+	// Wait for the metrics address to be printed
+	re := regexp.MustCompile(`Serving metrics on (http://\S+)`)
+	var url string
+	for range 100 {
+		if m := re.FindStringSubmatch(stderr.String()); m != nil {
+			url = m[1]
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if url == "" {
+		t.Fatalf("Metrics address not printed, output: %s", stderr.String())
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !regexp.MustCompile(`(?m)^dnsmag_records_processed_total 0$`).Match(body) {
+		t.Errorf("Expected records processed counter in metrics:\n%s", body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Ingest command failed: %v\nOutput: %s", err, stderr.String())
+	}
+}
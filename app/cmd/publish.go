@@ -0,0 +1,169 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newPublishCmd() *cobra.Command {
+	publishCmd := &cobra.Command{
+		Use:   "publish <dnsmag-file1> [dnsmag-file2...]",
+		Short: "Upload DNSMAG files to an S3 bucket",
+		Long: `Upload DNSMAG files to an S3 or S3-compatible bucket, with keys computed from the files:
+
+  year=YYYY/month=MM/day=DD/id=<sha256 of the file>
+
+where the date is the date of the datasets in the file. Encrypted datasets are decrypted with --identity
+to find their date. Alternatively, --date gives the date of all the files, which are then uploaded
+without being loaded. Files already published are skipped, unless --force is given. Every upload is
+verified against the SHA-256 checksum (or MD5 ETag) of the file.
+
+Credentials are read from the environment, like the AWS CLI does: AWS_ACCESS_KEY_ID,
+AWS_SECRET_ACCESS_KEY and optionally AWS_SESSION_TOKEN. The region and endpoint can also be set with
+AWS_REGION and AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL), e.g. for a local S3-compatible service.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdout := cmd.OutOrStdout()
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				bucket    string
+				endpoint  string
+				region    string
+				prefix    string
+				dateStr   string
+				pathStyle bool
+				force     bool
+				dryRun    bool
+				verbose   bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"bucket":     &bucket,
+				"endpoint":   &endpoint,
+				"region":     &region,
+				"prefix":     &prefix,
+				"date":       &dateStr,
+				"path-style": &pathStyle,
+				"force":      &force,
+				"dry-run":    &dryRun,
+				"verbose":    &verbose,
+			})
+
+			cmd.SilenceUsage = true
+
+			var date *time.Time
+			if dateStr != "" {
+				parsedDate, err := time.Parse(time.DateOnly, dateStr)
+				if err != nil {
+					return fmt.Errorf("invalid date format '%s', expected YYYY-MM-DD: %w", dateStr, err)
+				}
+				if cmd.Flags().Changed("trusted-keys") {
+					return fmt.Errorf("--date and --trusted-keys can not be combined, signatures are only verified when loading the datasets")
+				}
+				date = &parsedDate
+			}
+
+			config, err := internal.S3ConfigFromEnv(bucket)
+			if err != nil && !dryRun {
+				return err
+			}
+			if endpoint != "" {
+				config.Endpoint = endpoint
+			}
+			if region != "" {
+				config.Region = region
+			}
+			config.PathStyle = pathStyle
+			client, err := internal.NewS3Client(config)
+			if err != nil {
+				return err
+			}
+
+			published, existing := 0, 0
+			for _, filename := range args {
+				data, err := os.ReadFile(filename) // #nosec G304
+				if err != nil {
+					return err
+				}
+
+				day := date
+				if day == nil {
+					// The date of the file is that of its datasets, aggregated like the report command does
+					seq := internal.NewDatasetSequence(0, nil, false, stderr)
+					if err := configureSequence(cmd, seq); err != nil {
+						return err
+					}
+					err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(data), fmt.Sprintf("%s#%%d", filename))
+					if errors.Is(err, internal.ErrNoIdentity) {
+						return fmt.Errorf("%s holds encrypted datasets, use --identity to decrypt them or --date to give their date", filename)
+					}
+					if err != nil {
+						return fmt.Errorf("failed to load DNSMAG file %s: %w", filename, err)
+					}
+					if seq.Count == 0 {
+						return fmt.Errorf("no datasets found in %s", filename)
+					}
+					day = &seq.Result.Date.Time
+				}
+
+				key := internal.PublishKey(prefix, *day, data)
+				if dryRun {
+					fmt.Fprintf(stdout, "Would publish %s to %s\n", filename, client.URL(key))
+					continue
+				}
+
+				res, err := internal.PublishFile(cmd.Context(), client, key, data, force)
+				if err != nil {
+					return fmt.Errorf("failed to publish %s: %w", filename, err)
+				}
+				if res.Existing {
+					existing++
+					if verbose {
+						fmt.Fprintf(stdout, "%s is already published as %s\n", filename, client.URL(key))
+					}
+				} else {
+					published++
+					fmt.Fprintf(stdout, "Published %s to %s (%d bytes, verified)\n", filename, client.URL(key), res.Size)
+				}
+			}
+
+			if verbose && !dryRun {
+				fmt.Fprintf(stderr, "Published %d files (%d already published)\n", published, existing)
+			}
+			return nil
+		},
+	}
+
+	publishCmd.Flags().String("bucket", "", "S3 bucket to publish to (required)")
+	publishCmd.Flags().String("endpoint", "", "URL of an S3-compatible service (optional, defaults to AWS_ENDPOINT_URL_S3, AWS_ENDPOINT_URL or AWS S3)")
+	publishCmd.Flags().String("region", "", "Region of the bucket (optional, defaults to AWS_REGION, AWS_DEFAULT_REGION or "+internal.DefaultS3Region+")")
+	publishCmd.Flags().String("prefix", "", "Prefix of the keys in the bucket (optional)")
+	publishCmd.Flags().String("date", "", "Date of the files in YYYY-MM-DD format, instead of the date of their datasets (optional)")
+	publishCmd.Flags().Bool("path-style", false, "Address the bucket in the URL path instead of the host name, as most S3-compatible services need")
+	publishCmd.Flags().Bool("force", false, "Upload files even if they are already published")
+	publishCmd.Flags().Bool("dry-run", false, "Only show where the files would be published")
+	publishCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	publishCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	publishCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+	if err := publishCmd.MarkFlagRequired("bucket"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mark 'bucket' flag as required: %v\n", err)
+		os.Exit(1)
+	}
+
+	return publishCmd
+}
+
+var publishCmd = newPublishCmd()
+
+func init() {
+	rootCmd.AddCommand(publishCmd)
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublishCmd(t *testing.T) {
+	dir := t.TempDir()
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-01",
+		"--output", dir + "/day1.cbor",
+	}, 200, "TSV")
+	data, err := os.ReadFile(dir + "/day1.cbor")
+	if err != nil {
+		t.Fatalf("Failed to read dataset: %v", err)
+	}
+
+	// A minimal S3 stand-in, storing objects in memory
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+		case http.MethodHead:
+			body, found := objects[r.URL.Path]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(body)))
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+
+	runPublish := func(args ...string) (string, error) {
+		var buf bytes.Buffer
+		publishCmd := newPublishCmd()
+		publishCmd.SetOut(&buf)
+		publishCmd.SetErr(&buf)
+		publishCmd.SetArgs(append([]string{"--bucket", "dnsmag", "--endpoint", server.URL, "--path-style"}, args...))
+		err := publishCmd.Execute()
+		return buf.String(), err
+	}
+
+	output, err := runPublish("--prefix", "datasets", dir+"/day1.cbor")
+	if err != nil {
+		t.Fatalf("Publish command failed: %v\nOutput: %s", err, output)
+	}
+	if !strings.Contains(output, "s3://dnsmag/datasets/year=2026/month=09/day=01/id=") {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	if len(objects) != 1 {
+		t.Fatalf("Expected 1 object, got %d", len(objects))
+	}
+	for path, body := range objects {
+		if !strings.HasPrefix(path, "/dnsmag/datasets/year=2026/month=09/day=01/id=") || !bytes.Equal(body, data) {
+			t.Errorf("Unexpected object %s of %d bytes", path, len(body))
+		}
+	}
+
+	output, err = runPublish("--prefix", "datasets", "--verbose", dir+"/day1.cbor")
+	if err != nil || !strings.Contains(output, "is already published") {
+		t.Errorf("Expected the file to be published already, got %v\nOutput: %s", err, output)
+	}
+
+	// The date of encrypted datasets is only known with the identity, or given with --date
+	identity, recipient := writeTestIdentity(t, dir, "collector")
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-02",
+		"--encrypt-to", recipient,
+		"--output", dir + "/day2.cbor",
+	}, 200, "TSV encrypted")
+	output, err = runPublish(dir + "/day2.cbor")
+	if err == nil || !strings.Contains(err.Error(), "use --identity to decrypt them or --date to give their date") {
+		t.Errorf("Expected an error for encrypted datasets, got %v\nOutput: %s", err, output)
+	}
+	output, err = runPublish("--dry-run", "--identity", identity, dir+"/day2.cbor")
+	if err != nil || !strings.Contains(output, "/year=2026/month=09/day=02/id=") {
+		t.Errorf("Expected the date of the decrypted datasets, got %v\nOutput: %s", err, output)
+	}
+	output, err = runPublish("--date", "2026-09-03", dir+"/day2.cbor")
+	if err != nil || !strings.Contains(output, "/year=2026/month=09/day=03/id=") {
+		t.Errorf("Expected the date given with --date, got %v\nOutput: %s", err, output)
+	}
+	for _, args := range [][]string{{"--date", "2026-09"}, {"--date", "2026-09-03", "--trusted-keys", dir + "/keys.pem"}} {
+		if output, err = runPublish(append(args, dir+"/day2.cbor")...); err == nil {
+			t.Errorf("Expected an error for %v, got %s", args, output)
+		}
+	}
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if output, err = runPublish(dir + "/day1.cbor"); err == nil {
+		t.Errorf("Expected an error without credentials, got %s", output)
+	}
+	output, err = runPublish("--dry-run", dir+"/day1.cbor")
+	if err != nil || !strings.Contains(output, "Would publish") {
+		t.Errorf("Expected a dry run without credentials, got %v\nOutput: %s", err, output)
+	}
+}
@@ -3,10 +3,11 @@
 package cmd
 
 import (
+	"bytes"
 	"dnsmag/internal"
-	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -14,9 +15,17 @@ import (
 func newReportCmd() *cobra.Command {
 	reportCmd := &cobra.Command{
 		Use:   "report <dnsmag-file>",
-		Short: "Generate a JSON report from a DNSMAG file",
-		Long:  `Generate a JSON report from a DNSMAG file according to the report schema.`,
-		Args:  cobra.ExactArgs(1),
+		Short: "Generate a report from a DNSMAG file",
+		Long: `Generate a report from a DNSMAG file according to the report schema.
+
+The report is written as indented JSON by default. With --format it can also be written as CBOR with
+the same content, as a CSV or TSV table of the magnitude data with a header, or as a Markdown or HTML
+document with a summary of the report and a table of the magnitude data.
+
+The unique clients are HyperLogLog estimates, with a standard error of about 0.81%. With --confidence,
+the report includes the lower and upper bounds of the unique clients of each domain and in total at
+that confidence level, and the resulting bounds of the magnitudes.`,
+		Args: cobra.ExactArgs(1),
 		PreRunE: func(cmd *cobra.Command, _ []string) error {
 			sourceType, err := cmd.Flags().GetString("source-type")
 			if err != nil {
@@ -25,7 +34,18 @@ func newReportCmd() *cobra.Command {
 			if sourceType != "authoritative" && sourceType != "recursive" {
 				return fmt.Errorf("invalid source-type '%s'. Must be 'authoritative' or 'recursive'", sourceType)
 			}
-			return nil
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				return fmt.Errorf("failed to get format flag: %v", err)
+			}
+			if err := internal.CheckReportFormat(format); err != nil {
+				return err
+			}
+			confidence, err := cmd.Flags().GetFloat64("confidence")
+			if err != nil {
+				return fmt.Errorf("failed to get confidence flag: %v", err)
+			}
+			return internal.CheckConfidenceLevel(confidence)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
 			stdout := cmd.OutOrStdout()
@@ -37,6 +57,8 @@ func newReportCmd() *cobra.Command {
 				source     string
 				sourceType string
 				output     string
+				format     string
+				confidence float64
 				verbose    bool
 			)
 
@@ -44,10 +66,16 @@ func newReportCmd() *cobra.Command {
 				"source":      &source,
 				"source-type": &sourceType,
 				"output":      &output,
+				"format":      &format,
+				"confidence":  &confidence,
 				"verbose":     &verbose,
 			})
 
 			seq := internal.NewDatasetSequence(0, nil, false, stderr)
+			if err := configureSequence(cmd, seq); err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
 
 			if err := loadDatasets(cmd, seq, []string{filename}, verbose); err != nil {
 				cmd.SilenceUsage = true
@@ -55,17 +83,19 @@ func newReportCmd() *cobra.Command {
 			}
 
 			// Generate the report in a data structure conforming to the schema (report-schema.yaml)
-			report := internal.GenerateReport(seq.Result, source, sourceType)
+			report := internal.GenerateReportWithOptions(seq.Result, source, sourceType, internal.ReportOptions{
+				ConfidenceLevel: confidence,
+			})
 
-			jsonData, err := json.MarshalIndent(report, "", "  ")
-			if err != nil {
+			var buf bytes.Buffer
+			if err := internal.WriteReport(&buf, report, format); err != nil {
 				cmd.SilenceUsage = true
-				return fmt.Errorf("failed to generate JSON report: %w", err)
+				return fmt.Errorf("failed to generate %s report: %w", format, err)
 			}
 
 			// Write the report to the specified output file or stdout
 			if output != "" && output != "-" {
-				err = os.WriteFile(output, jsonData, 0o644) // #nosec G306
+				err := os.WriteFile(output, buf.Bytes(), 0o644) // #nosec G306
 				if err != nil {
 					cmd.SilenceUsage = true
 					return fmt.Errorf("failed to write report to %s: %w", output, err)
@@ -74,7 +104,10 @@ func newReportCmd() *cobra.Command {
 					fmt.Fprintf(stderr, "Report written to %s\n", output)
 				}
 			} else {
-				fmt.Fprintln(stdout, string(jsonData))
+				if _, err := stdout.Write(buf.Bytes()); err != nil {
+					cmd.SilenceUsage = true
+					return fmt.Errorf("failed to write report: %w", err)
+				}
 				if verbose {
 					fmt.Fprintf(stderr, "Report written to STDOUT\n")
 				}
@@ -87,7 +120,11 @@ func newReportCmd() *cobra.Command {
 	reportCmd.Flags().StringP("source", "s", "", "The name of the provider of the magnitude score (required)")
 	reportCmd.Flags().String("source-type", "authoritative", "Source type of the magnitude score (authoritative or recursive)")
 	reportCmd.Flags().StringP("output", "o", "", "Output file (optional, defaults to stdout)")
+	reportCmd.Flags().String("format", "json", "Output format: "+strings.Join(internal.ReportFormats, ", "))
+	reportCmd.Flags().Float64("confidence", 0, "Include intervals of the unique clients and magnitudes at this confidence level, e.g. 0.95 (optional)")
 	reportCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	reportCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	reportCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
 	if err := reportCmd.MarkFlagRequired("source"); err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to mark 'source' flag as required: %v\n", err)
 		os.Exit(1)
@@ -3,10 +3,14 @@ package cmd
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"os"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/fxamacker/cbor/v2"
 )
 
 // validateReportJSON is a helper function to validate the expected JSON structure
@@ -305,3 +309,123 @@ func TestReportCmd_NonExistentFile(t *testing.T) {
 		t.Errorf("Expected error about loading DNSMAG file, got: %v", err)
 	}
 }
+
+func TestReportCmd_Formats(t *testing.T) {
+	dir := t.TempDir()
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test1.pcap.gz",
+		"--output", dir + "/data.cbor",
+	}, 100, "PCAP")
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"csv", "domain,magnitude,uniqueClients,queryVolume\narpa,6.03731253380026,13,16\n"},
+		{"tsv", "net\t6.374139658435677\t15\t20\norg\t7.380246504446294\t23\t24\n"},
+		{"markdown", "| org | 7.380246504446294 | 23 | 24 |\n"},
+		{"html", "<tr><td>org</td><td>7.380246504446294</td><td>23</td><td>24</td></tr>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			reportCmd := newReportCmd()
+			reportCmd.SetArgs([]string{dir + "/data.cbor", "--source", "test-source", "--format", tt.format})
+
+			var reportBuf bytes.Buffer
+			reportCmd.SetOut(&reportBuf)
+			reportCmd.SetErr(&reportBuf)
+			if err := reportCmd.Execute(); err != nil {
+				t.Fatalf("Report command failed: %v\nOutput: %s", err, reportBuf.String())
+			}
+			if !strings.Contains(reportBuf.String(), tt.expected) {
+				t.Errorf("Expected %q in:\n%s", tt.expected, reportBuf.String())
+			}
+		})
+	}
+
+	// CBOR has the same content as JSON
+	reportCmd := newReportCmd()
+	reportCmd.SetArgs([]string{dir + "/data.cbor", "--source", "test-source", "--format", "cbor", "--output", dir + "/report.cbor"})
+	reportCmd.SetOut(io.Discard)
+	if err := reportCmd.Execute(); err != nil {
+		t.Fatalf("Report command failed: %v", err)
+	}
+	data, err := os.ReadFile(dir + "/report.cbor")
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+	var report map[string]any
+	if err := cbor.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Invalid CBOR report: %v", err)
+	}
+	jsonData, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("Failed to convert the report to JSON: %v", err)
+	}
+	validateReportJSON(t, jsonData, "test-source", "authoritative")
+
+	reportCmd = newReportCmd()
+	reportCmd.SetArgs([]string{dir + "/data.cbor", "--source", "test-source", "--format", "xml"})
+	reportCmd.SetOut(io.Discard)
+	reportCmd.SetErr(io.Discard)
+	if err := reportCmd.Execute(); err == nil || !strings.Contains(err.Error(), "invalid format 'xml'") {
+		t.Errorf("Expected an error about the invalid format, got %v", err)
+	}
+}
+
+func TestReportCmd_Confidence(t *testing.T) {
+	dir := t.TempDir()
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test1.pcap.gz",
+		"--output", dir + "/data.cbor",
+	}, 100, "PCAP")
+
+	reportCmd := newReportCmd()
+	reportCmd.SetArgs([]string{dir + "/data.cbor", "--source", "test-source", "--confidence", "0.95"})
+	var reportBuf bytes.Buffer
+	reportCmd.SetOut(&reportBuf)
+	reportCmd.SetErr(&reportBuf)
+	if err := reportCmd.Execute(); err != nil {
+		t.Fatalf("Report command failed: %v\nOutput: %s", err, reportBuf.String())
+	}
+
+	var report struct {
+		ConfidenceLevel         float64 `json:"confidenceLevel"`
+		TotalUniqueClients      uint64  `json:"totalUniqueClients"`
+		TotalUniqueClientsLower *uint64 `json:"totalUniqueClientsLower"`
+		TotalUniqueClientsUpper *uint64 `json:"totalUniqueClientsUpper"`
+		MagnitudeData           []struct {
+			Domain             string   `json:"domain"`
+			Magnitude          float64  `json:"magnitude"`
+			MagnitudeLower     *float64 `json:"magnitudeLower"`
+			MagnitudeUpper     *float64 `json:"magnitudeUpper"`
+			UniqueClients      uint64   `json:"uniqueClients"`
+			UniqueClientsLower *uint64  `json:"uniqueClientsLower"`
+			UniqueClientsUpper *uint64  `json:"uniqueClientsUpper"`
+		} `json:"magnitudeData"`
+	}
+	if err := json.Unmarshal(reportBuf.Bytes(), &report); err != nil {
+		t.Fatalf("Report output is not valid JSON: %v\nOutput: %s", err, reportBuf.String())
+	}
+	if report.ConfidenceLevel != 0.95 || report.TotalUniqueClientsLower == nil || report.TotalUniqueClientsUpper == nil ||
+		*report.TotalUniqueClientsLower > report.TotalUniqueClients || *report.TotalUniqueClientsUpper < report.TotalUniqueClients {
+		t.Errorf("Unexpected total interval in %s", reportBuf.String())
+	}
+	for _, m := range report.MagnitudeData {
+		if m.MagnitudeLower == nil || m.MagnitudeUpper == nil || m.UniqueClientsLower == nil || m.UniqueClientsUpper == nil ||
+			*m.MagnitudeLower > m.Magnitude || *m.MagnitudeUpper < m.Magnitude ||
+			*m.UniqueClientsLower > m.UniqueClients || *m.UniqueClientsUpper < m.UniqueClients {
+			t.Errorf("Unexpected intervals of %s in %s", m.Domain, reportBuf.String())
+		}
+	}
+
+	for _, confidence := range []string{"1", "-0.5"} {
+		reportCmd := newReportCmd()
+		reportCmd.SetArgs([]string{dir + "/data.cbor", "--source", "test-source", "--confidence", confidence})
+		reportCmd.SetOut(io.Discard)
+		reportCmd.SetErr(io.Discard)
+		if err := reportCmd.Execute(); err == nil || !strings.Contains(err.Error(), "invalid confidence level") {
+			t.Errorf("Expected an error for confidence %s, got %v", confidence, err)
+		}
+	}
+}
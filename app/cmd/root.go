@@ -3,7 +3,10 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -16,7 +19,16 @@ It can parse PCAP files, view/save DNSMAG data (CBOR), aggregate multiple datase
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Cancel the command context on SIGINT/SIGTERM, so that long-running commands can shut down gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// Restore default signal handling, so that a second signal terminates immediately
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
 		os.Exit(1)
 	}
 }
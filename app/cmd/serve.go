@@ -0,0 +1,155 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"dnsmag/internal"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+func newServeCmd() *cobra.Command {
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run a collection server accepting dataset uploads",
+		Long: `Run an HTTP server that collects DNSMAG files from sources, e.g. uploaded with 'dnsmag submit',
+and serves the aggregated datasets and JSON reports of each day.
+
+Sources authenticate with bearer tokens listed in the --tokens file, one source and token per line:
+
+    # source token
+    example.net 4f9c2d7e1b8a6035
+
+Uploaded files are validated like the files of the other commands, and every dataset in them must be
+a daily dataset with the source of the token in its metadata (see 'dnsmag collect --source'). The
+datasets are stored in the archive in --archive, which can be used with 'dnsmag archive' while the
+server is not running.
+
+Endpoints:
+
+    POST  /v1/datasets          Upload a file, also resumably in chunks
+    GET   /v1/datasets/<date>   The aggregated dataset of a day
+    GET   /v1/reports/<date>    The JSON report of the aggregated dataset of a day
+
+Both GET endpoints take an optional ?source= parameter to only include the datasets of one source,
+and require a token of any source.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				archiveDir    string
+				tokensFile    string
+				listen        string
+				tlsCert       string
+				tlsKey        string
+				maxUploadSize int
+				reportSource  string
+				sourceType    string
+				quiet         bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"archive":         &archiveDir,
+				"tokens":          &tokensFile,
+				"listen":          &listen,
+				"tls-cert":        &tlsCert,
+				"tls-key":         &tlsKey,
+				"max-upload-size": &maxUploadSize,
+				"report-source":   &reportSource,
+				"source-type":     &sourceType,
+				"quiet":           &quiet,
+			})
+
+			if (tlsCert == "") != (tlsKey == "") {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("--tls-cert and --tls-key must be used together")
+			}
+			if sourceType != "authoritative" && sourceType != "recursive" {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("invalid source-type '%s'. Must be 'authoritative' or 'recursive'", sourceType)
+			}
+			if maxUploadSize <= 0 {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("invalid --max-upload-size %d, must be positive", maxUploadSize)
+			}
+
+			cmd.SilenceUsage = true
+
+			logger := stderr
+			if quiet {
+				logger = io.Discard
+			}
+
+			tokens, err := internal.LoadServerTokens(tokensFile)
+			if err != nil {
+				return fmt.Errorf("failed to load tokens: %w", err)
+			}
+
+			archive, err := internal.OpenArchive(archiveDir, false)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = archive.Close() }()
+
+			server, err := internal.NewServer(archive, filepath.Join(archiveDir, "uploads"), internal.ServerOptions{
+				Tokens:        tokens,
+				MaxUploadSize: int64(maxUploadSize) * 1024 * 1024,
+				ReportSource:  reportSource,
+				SourceType:    sourceType,
+				Logger:        logger,
+			})
+			if err != nil {
+				return err
+			}
+			if err := configureSequence(cmd, server); err != nil {
+				return err
+			}
+
+			listener, err := net.Listen("tcp", listen)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", listen, err)
+			}
+			if !quiet {
+				scheme := "http"
+				if tlsCert != "" {
+					scheme = "https"
+				}
+				fmt.Fprintf(stderr, "Listening on %s://%s\n", scheme, listener.Addr())
+			}
+
+			return server.Serve(cmd.Context(), listener, tlsCert, tlsKey)
+		},
+	}
+
+	serveCmd.Flags().StringP("archive", "a", "", "Archive directory to store the datasets in (required)")
+	serveCmd.Flags().String("tokens", "", "File with the API tokens of the sources (required)")
+	serveCmd.Flags().StringP("listen", "l", internal.DefaultServeListen, "Address to listen on")
+	serveCmd.Flags().String("tls-cert", "", "File with a PEM encoded certificate to serve HTTPS with (optional)")
+	serveCmd.Flags().String("tls-key", "", "File with the PEM encoded private key of the certificate (optional)")
+	serveCmd.Flags().Int("max-upload-size", internal.DefaultServeMaxUploadSize/(1024*1024), "Largest file accepted, in MiB")
+	serveCmd.Flags().String("report-source", "", "Source of the reports (optional, defaults to the sources of the datasets)")
+	serveCmd.Flags().String("source-type", "authoritative", "Source type of the reports (authoritative or recursive)")
+	serveCmd.Flags().BoolP("quiet", "q", false, "Do not log uploads")
+	serveCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	serveCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+	for _, name := range []string{"archive", "tokens"} {
+		if err := serveCmd.MarkFlagRequired(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mark '%s' flag as required: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	return serveCmd
+}
+
+var serveCmd = newServeCmd()
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+}
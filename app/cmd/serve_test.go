@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"dnsmag/internal"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeCmd(t *testing.T) {
+	dir := t.TempDir()
+	tokensFile := dir + "/tokens"
+	if err := os.WriteFile(tokensFile, []byte("example.net example-token-0001\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write tokens: %v", err)
+	}
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-01",
+		"--source", "example.net",
+		"--output", dir + "/day1.cbor",
+	}, 200, "TSV")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stderr := &syncBuffer{}
+	serveCmd := newServeCmd()
+	serveCmd.SetArgs([]string{"--archive", dir + "/archive", "--tokens", tokensFile, "--listen", "127.0.0.1:0", "--source-type", "recursive"})
+	serveCmd.SetOut(stderr)
+	serveCmd.SetErr(stderr)
+
+	done := make(chan error)
+	go func() { done <- serveCmd.ExecuteContext(ctx) }()
+
+	// Wait for the server to listen
+	listening := regexp.MustCompile(`Listening on (http://\S+)`)
+	var url string
+	for range 100 {
+		if matches := listening.FindStringSubmatch(stderr.String()); matches != nil {
+			url = matches[1]
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if url == "" {
+		t.Fatalf("Server did not start\nOutput: %s", stderr.String())
+	}
+
+	var submitBuf bytes.Buffer
+	submitCmd := newSubmitCmd()
+	submitCmd.SetOut(&submitBuf)
+	submitCmd.SetErr(&submitBuf)
+	t.Setenv("DNSMAG_SUBMIT_TOKEN", "example-token-0001")
+	submitCmd.SetArgs([]string{"--url", url + "/v1/datasets", dir + "/day1.cbor"})
+	if err := submitCmd.Execute(); err != nil {
+		t.Fatalf("Submit command failed: %v\nOutput: %s", err, submitBuf.String())
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url+"/v1/reports/2026-09-01", nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer example-token-0001")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get report: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	var report internal.Report
+	if err := json.Unmarshal(body, &report); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("Expected a report, got %d %s (%v)", resp.StatusCode, body, err)
+	}
+	if report.Source != "example.net" || report.SourceType != "recursive" || report.TotalQueryVolume != 200 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve command failed: %v\nOutput: %s", err, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Stored 1 datasets from example.net") {
+		t.Errorf("Expected the upload to be logged, got: %s", stderr.String())
+	}
+
+	// The archive can be used once the server has stopped
+	archive, err := internal.OpenArchive(dir+"/archive", true)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	defer func() { _ = archive.Close() }()
+	if entries, err := archive.Query(internal.ArchiveQuery{Source: "example.net"}); err != nil || len(entries) != 1 {
+		t.Errorf("Expected 1 dataset in the archive, got %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,103 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newSignCmd() *cobra.Command {
+	signCmd := &cobra.Command{
+		Use:   "sign <dnsmag-file>",
+		Short: "Sign the datasets in a DNSMAG file",
+		Long: `Sign every dataset in a DNSMAG file with an Ed25519 key, wrapping each dataset in a COSE_Sign1 structure.
+
+The key is read from a PEM encoded PKCS #8 file, e.g. created with
+
+    openssl genpkey -algorithm ed25519 -out dnsmag-key.pem
+    openssl pkey -in dnsmag-key.pem -pubout -out dnsmag-key.pub.pem
+
+Signed datasets can be loaded by all commands reading DNSMAG files. Use --trusted-keys with those
+commands, or the verify command, to require valid signatures.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdin := cmd.InOrStdin()
+			stdout := cmd.OutOrStdout()
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				keyFile string
+				output  string
+				verbose bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"key":     &keyFile,
+				"output":  &output,
+				"verbose": &verbose,
+			})
+
+			cmd.SilenceUsage = true
+
+			key, err := internal.LoadSigningKey(keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load signing key: %w", err)
+			}
+
+			var reader io.Reader = stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				reader = f
+			}
+
+			// Sign into a buffer, to not leave a partially signed output file behind on errors
+			var buf bytes.Buffer
+			count, err := internal.SignDatasets(reader, &buf, key)
+			if err != nil {
+				return fmt.Errorf("failed to sign %s: %w", args[0], err)
+			}
+
+			if output == "-" {
+				_, err = stdout.Write(buf.Bytes())
+			} else {
+				err = os.WriteFile(output, buf.Bytes(), 0o644) // #nosec G306
+			}
+			if err != nil {
+				return fmt.Errorf("failed to write signed datasets to %s: %w", output, err)
+			}
+
+			if verbose {
+				fmt.Fprintf(stderr, "Signed %d datasets from %s\n", count, args[0])
+			}
+			return nil
+		},
+	}
+
+	signCmd.Flags().StringP("key", "k", "", "File with a PEM encoded Ed25519 private key (required)")
+	signCmd.Flags().StringP("output", "o", "", "Output file for the signed datasets ('-' for stdout, required)")
+	signCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	for _, name := range []string{"key", "output"} {
+		if err := signCmd.MarkFlagRequired(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to mark '%s' flag as required: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	return signCmd
+}
+
+var signCmd = newSignCmd()
+
+func init() {
+	rootCmd.AddCommand(signCmd)
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// writeTestKeys generates an Ed25519 key pair and writes it to PEM files in dir
+func writeTestKeys(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	privFile := filepath.Join(dir, name+".pem")
+	pubFile := filepath.Join(dir, name+".pub.pem")
+	if err := os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return privFile, pubFile
+}
+
+func TestSignCmd_Integration(t *testing.T) {
+	dir := t.TempDir()
+	privFile, pubFile := writeTestKeys(t, dir, "signer")
+	_, otherPubFile := writeTestKeys(t, dir, "other")
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--output", dir + "/data.cbor",
+	}, 200, "TSV")
+
+	var buf bytes.Buffer
+	signCmd := newSignCmd()
+	signCmd.SetOut(&buf)
+	signCmd.SetErr(&buf)
+	signCmd.SetArgs([]string{"--key", privFile, "--output", dir + "/signed.cbor", "--verbose", dir + "/data.cbor"})
+	if err := signCmd.Execute(); err != nil {
+		t.Fatalf("Sign command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "Signed 1 datasets") {
+		t.Errorf("Expected signed count in output:\n%s", buf.String())
+	}
+
+	// Signed datasets verify with the signer's key, but not with another key
+	buf.Reset()
+	verifyCmd := newVerifyCmd()
+	verifyCmd.SetOut(&buf)
+	verifyCmd.SetErr(&buf)
+	verifyCmd.SetArgs([]string{"--trusted-keys", pubFile, dir + "/signed.cbor"})
+	if err := verifyCmd.Execute(); err != nil {
+		t.Fatalf("Verify command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !regexp.MustCompile(`signed.cbor#1: signed by key [0-9a-f]{64} \(verified\)`).MatchString(buf.String()) {
+		t.Errorf("Expected verified signature in output:\n%s", buf.String())
+	}
+
+	for _, tt := range []struct {
+		name    string
+		trusted string
+		file    string
+		errMsg  string
+	}{
+		{"untrusted key", otherPubFile, dir + "/signed.cbor", "signed by untrusted key"},
+		{"unsigned", pubFile, dir + "/data.cbor", "not signed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			verifyCmd := newVerifyCmd()
+			verifyCmd.SetOut(&buf)
+			verifyCmd.SetErr(&buf)
+			verifyCmd.SetArgs([]string{"--trusted-keys", tt.trusted, tt.file})
+			err := verifyCmd.Execute()
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+
+	// View loads signed datasets, and shows the signer
+	buf.Reset()
+	viewCmd := newViewCmd()
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	viewCmd.SetArgs([]string{"--trusted-keys", pubFile, dir + "/signed.cbor"})
+	if err := viewCmd.Execute(); err != nil {
+		t.Fatalf("View command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !regexp.MustCompile(`Signed by\s+: key [0-9a-f]{64} \(verified\)`).MatchString(buf.String()) {
+		t.Errorf("Expected signer in view output:\n%s", buf.String())
+	}
+	if !regexp.MustCompile(`Total queries\s+:\s+200`).MatchString(buf.String()) {
+		t.Errorf("Expected 200 queries in view output:\n%s", buf.String())
+	}
+
+	// Requiring signatures rejects unsigned datasets
+	viewCmd = newViewCmd()
+	viewCmd.SetOut(&buf)
+	viewCmd.SetErr(&buf)
+	viewCmd.SetArgs([]string{"--trusted-keys", pubFile, dir + "/data.cbor"})
+	if err := viewCmd.Execute(); err == nil || !strings.Contains(err.Error(), "is not signed") {
+		t.Errorf("Expected unsigned dataset to be rejected, got: %v", err)
+	}
+}
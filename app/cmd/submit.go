@@ -0,0 +1,175 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"dnsmag/internal"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newSubmitCmd() *cobra.Command {
+	submitCmd := &cobra.Command{
+		Use:   "submit <dnsmag-file1> [dnsmag-file2...]",
+		Short: "Submit DNSMAG files to a collection endpoint",
+		Long: `Submit DNSMAG files to a collection endpoint over HTTP, optionally signing the datasets first,
+and store the receipt returned by the server next to each file (<file>.receipt.json) as proof of
+submission. Files with a receipt for the same contents are not submitted again, unless --force is given.
+
+Authentication is with a bearer token, read from --token-file or the DNSMAG_SUBMIT_TOKEN environment
+variable, and/or a client certificate for mutual TLS (--cert and --key).
+
+Files up to --chunk-size are sent in a single POST request. Larger files are uploaded in chunks, and
+an interrupted upload is resumed where the server left off, also in a later run. Failed requests are
+retried with exponential backoff, honouring Retry-After from the server.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stdout := cmd.OutOrStdout()
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				opts      internal.SubmitOptions
+				tokenFile string
+				certFile  string
+				keyFile   string
+				caFile    string
+				signKey   string
+				chunkSize int
+				force     bool
+				verbose   bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"url":         &opts.URL,
+				"token-file":  &tokenFile,
+				"cert":        &certFile,
+				"key":         &keyFile,
+				"ca":          &caFile,
+				"sign-key":    &signKey,
+				"chunk-size":  &chunkSize,
+				"retries":     &opts.Retries,
+				"backoff":     &opts.Backoff,
+				"max-backoff": &opts.MaxBackoff,
+				"force":       &force,
+				"verbose":     &verbose,
+			})
+
+			if (certFile == "") != (keyFile == "") {
+				return fmt.Errorf("--cert and --key must be given together")
+			}
+			if chunkSize <= 0 {
+				return fmt.Errorf("invalid chunk size %d, must be positive", chunkSize)
+			}
+			opts.ChunkSize = chunkSize * 1024 * 1024
+			if opts.Retries < 0 {
+				return fmt.Errorf("invalid --retries %d, must not be negative", opts.Retries)
+			}
+			if opts.Backoff <= 0 {
+				return fmt.Errorf("invalid --backoff %v, must be positive", opts.Backoff)
+			}
+			if opts.MaxBackoff < opts.Backoff {
+				return fmt.Errorf("invalid --max-backoff %v, must be at least --backoff %v", opts.MaxBackoff, opts.Backoff)
+			}
+
+			cmd.SilenceUsage = true
+
+			opts.Token = os.Getenv("DNSMAG_SUBMIT_TOKEN")
+			if tokenFile != "" {
+				token, err := os.ReadFile(tokenFile) // #nosec G304
+				if err != nil {
+					return fmt.Errorf("failed to read token: %w", err)
+				}
+				opts.Token = strings.TrimSpace(string(token))
+			}
+			if certFile != "" || caFile != "" {
+				tlsConfig, err := internal.LoadClientTLSConfig(certFile, keyFile, caFile)
+				if err != nil {
+					return err
+				}
+				opts.TLSConfig = tlsConfig
+			}
+			if verbose {
+				opts.Logger = stderr
+			}
+
+			submitter, err := internal.NewSubmitter(opts)
+			if err != nil {
+				return err
+			}
+
+			for _, filename := range args {
+				data, err := os.ReadFile(filename) // #nosec G304
+				if err != nil {
+					return err
+				}
+				if signKey != "" {
+					key, err := internal.LoadSigningKey(signKey)
+					if err != nil {
+						return fmt.Errorf("failed to load signing key: %w", err)
+					}
+					var signed bytes.Buffer
+					if _, err := internal.SignDatasets(bytes.NewReader(data), &signed, key); err != nil {
+						return fmt.Errorf("failed to sign %s: %w", filename, err)
+					}
+					data = signed.Bytes()
+				}
+
+				if !force {
+					receipt, err := internal.LoadReceipt(filename)
+					if err != nil {
+						return err
+					}
+					digest := sha256.Sum256(data)
+					if receipt != nil && receipt.SHA256 == hex.EncodeToString(digest[:]) {
+						fmt.Fprintf(stdout, "%s was already submitted on %s\n", filename, receipt.Submitted)
+						continue
+					}
+				}
+
+				start := time.Now()
+				receipt, err := submitter.SubmitFile(cmd.Context(), filename, data)
+				if err != nil {
+					return fmt.Errorf("failed to submit %s: %w", filename, err)
+				}
+				fmt.Fprintf(stdout, "Submitted %s (%d bytes), receipt saved to %s\n", filename, receipt.Size, internal.ReceiptFilename(filename))
+				if verbose {
+					fmt.Fprintf(stderr, "Submission of %s took %v\n", filename, time.Since(start).Round(time.Millisecond))
+				}
+			}
+
+			return nil
+		},
+	}
+
+	submitCmd.Flags().String("url", "", "URL of the collection endpoint (required)")
+	submitCmd.Flags().String("token-file", "", "File with a bearer token to authenticate with (optional, defaults to DNSMAG_SUBMIT_TOKEN)")
+	submitCmd.Flags().String("cert", "", "File with a PEM encoded client certificate for mutual TLS (optional)")
+	submitCmd.Flags().String("key", "", "File with the PEM encoded private key of the client certificate (optional)")
+	submitCmd.Flags().String("ca", "", "File with PEM encoded CA certificates to verify the server with, instead of the system CAs (optional)")
+	submitCmd.Flags().String("sign-key", "", "File with a PEM encoded Ed25519 private key to sign the datasets with before submitting (optional)")
+	submitCmd.Flags().Int("chunk-size", internal.DefaultSubmitChunkSize/(1024*1024), "Size in MiB of the chunks larger files are uploaded in")
+	submitCmd.Flags().Int("retries", internal.DefaultSubmitRetries, "Maximum number of retries of a failed request")
+	submitCmd.Flags().Duration("backoff", internal.DefaultSubmitBackoff, "Delay before the first retry, doubled for every following retry")
+	submitCmd.Flags().Duration("max-backoff", internal.DefaultSubmitMaxBackoff, "Maximum delay between retries")
+	submitCmd.Flags().Bool("force", false, "Submit files even if they have a receipt")
+	submitCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	if err := submitCmd.MarkFlagRequired("url"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mark 'url' flag as required: %v\n", err)
+		os.Exit(1)
+	}
+
+	return submitCmd
+}
+
+var submitCmd = newSubmitCmd()
+
+func init() {
+	rootCmd.AddCommand(submitCmd)
+}
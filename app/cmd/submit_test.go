@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"dnsmag/internal"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubmitCmd(t *testing.T) {
+	dir := t.TempDir()
+	privFile, pubFile := writeTestKeys(t, dir, "signer")
+	trusted, err := internal.LoadTrustedKeys(pubFile)
+	if err != nil {
+		t.Fatalf("Failed to load trusted keys: %v", err)
+	}
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-01",
+		"--output", dir + "/day1.cbor",
+	}, 200, "TSV")
+
+	var mu sync.Mutex
+	submissions := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if _, err := internal.VerifyDatasets(bytes.NewReader(body), trusted); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		submissions++
+		fmt.Fprintf(w, `{"accepted": %d}`, submissions)
+	}))
+	defer server.Close()
+
+	tokenFile := dir + "/token"
+	if err := os.WriteFile(tokenFile, []byte("secret-token\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+
+	runSubmit := func(args ...string) (string, error) {
+		var buf bytes.Buffer
+		submitCmd := newSubmitCmd()
+		submitCmd.SetOut(&buf)
+		submitCmd.SetErr(&buf)
+		submitCmd.SetArgs(append([]string{"--url", server.URL + "/submit", "--backoff", "1ms"}, args...))
+		err := submitCmd.Execute()
+		return buf.String(), err
+	}
+
+	// Unsigned datasets are rejected by the server
+	if output, err := runSubmit("--token-file", tokenFile, dir+"/day1.cbor"); err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("Expected the unsigned dataset to be rejected, got %v\nOutput: %s", err, output)
+	}
+
+	output, err := runSubmit("--token-file", tokenFile, "--sign-key", privFile, dir+"/day1.cbor")
+	if err != nil {
+		t.Fatalf("Submit command failed: %v\nOutput: %s", err, output)
+	}
+	if !strings.Contains(output, "receipt saved to "+dir+"/day1.cbor.receipt.json") {
+		t.Errorf("Unexpected output: %s", output)
+	}
+	receipt, err := internal.LoadReceipt(dir + "/day1.cbor")
+	if err != nil || receipt == nil || receipt.Receipt != `{"accepted": 1}` || receipt.Status != http.StatusOK {
+		t.Errorf("Unexpected receipt %+v (%v)", receipt, err)
+	}
+
+	// Submitted files are skipped, unless forced
+	t.Setenv("DNSMAG_SUBMIT_TOKEN", "secret-token")
+	output, err = runSubmit("--sign-key", privFile, dir+"/day1.cbor")
+	if err != nil || !strings.Contains(output, "was already submitted") || submissions != 1 {
+		t.Errorf("Expected the file to be skipped, got %v\nOutput: %s", err, output)
+	}
+	output, err = runSubmit("--sign-key", privFile, "--force", dir+"/day1.cbor")
+	if err != nil || submissions != 2 {
+		t.Errorf("Expected the file to be submitted again, got %v\nOutput: %s", err, output)
+	}
+
+	if _, err := runSubmit("--cert", dir+"/client.pem", dir+"/day1.cbor"); err == nil {
+		t.Errorf("Expected an error for --cert without --key")
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key to PEM files in dir
+func writeTestCertificate(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile, keyFile := dir+"/"+name+".pem", dir+"/"+name+".key"
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestSubmitCmd_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "client")
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--output", dir + "/data.cbor",
+	}, 200, "TSV")
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"client": %d}`, len(r.TLS.PeerCertificates))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MinVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := dir + "/server-ca.pem"
+	serverCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, serverCert, 0o600); err != nil {
+		t.Fatalf("Failed to write CA: %v", err)
+	}
+
+	runSubmit := func(args ...string) (string, error) {
+		var buf bytes.Buffer
+		submitCmd := newSubmitCmd()
+		submitCmd.SetOut(&buf)
+		submitCmd.SetErr(&buf)
+		submitCmd.SetArgs(append([]string{"--url", server.URL, "--ca", caFile, "--retries", "0"}, args...))
+		err := submitCmd.Execute()
+		return buf.String(), err
+	}
+
+	if output, err := runSubmit(dir + "/data.cbor"); err == nil {
+		t.Errorf("Expected the submission without a client certificate to fail, got %s", output)
+	}
+	output, err := runSubmit("--cert", certFile, "--key", keyFile, dir+"/data.cbor")
+	if err != nil {
+		t.Fatalf("Submit command failed: %v\nOutput: %s", err, output)
+	}
+	receipt, err := internal.LoadReceipt(dir + "/data.cbor")
+	if err != nil || receipt == nil || receipt.Receipt != `{"client": 1}` {
+		t.Errorf("Unexpected receipt %+v (%v)", receipt, err)
+	}
+}
+
+func TestSubmitCmd_InvalidFlags(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--retries", "-1"}, "invalid --retries"},
+		{[]string{"--backoff", "0s"}, "invalid --backoff"},
+		{[]string{"--backoff", "-1s"}, "invalid --backoff"},
+		{[]string{"--backoff", "2s", "--max-backoff", "1s"}, "invalid --max-backoff"},
+	} {
+		submitCmd := newSubmitCmd()
+		submitCmd.SetArgs(append([]string{"--url", "http://localhost/submit", "missing.cbor"}, tt.args...))
+		submitCmd.SetOut(io.Discard)
+		submitCmd.SetErr(io.Discard)
+		if err := submitCmd.Execute(); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%v: expected an error containing %q, got %v", tt.args, tt.expected, err)
+		}
+	}
+}
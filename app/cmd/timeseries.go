@@ -0,0 +1,123 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newTimeseriesCmd() *cobra.Command {
+	timeseriesCmd := &cobra.Command{
+		Use:   "timeseries <dnsmag-file1> [dnsmag-file2...]",
+		Short: "Show the magnitude of domains over time from daily DNSMAG files",
+		Long: `Build a time series from a set of daily DNSMAG files, with the magnitude, unique clients and query
+volume of each domain on each day, as a wide table with a row per domain and columns per day.
+
+Each file must hold the datasets of a single day, which are aggregated first, and each day may only be
+in one file. Domains are included if they are among the top domains by magnitude on at least one day,
+with their values on every day they were seen. Days without a domain have empty cells in CSV output,
+and null values in JSON output.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stderr := cmd.ErrOrStderr()
+			stdout := cmd.OutOrStdout()
+
+			var (
+				verbose bool
+				format  string
+				metrics []string
+				top     int
+				output  string
+			)
+
+			parseFlags(cmd, map[string]any{
+				"verbose": &verbose,
+				"format":  &format,
+				"metrics": &metrics,
+				"top":     &top,
+				"output":  &output,
+			})
+
+			if format != "csv" && format != "json" {
+				return fmt.Errorf("invalid format '%s', must be 'csv' or 'json'", format)
+			}
+			if err := internal.CheckTimeSeriesMetrics(metrics); err != nil {
+				return err
+			}
+			if top < 0 {
+				return fmt.Errorf("invalid top %d, must be 0 or more", top)
+			}
+
+			cmd.SilenceUsage = true
+
+			var datasets []internal.MagnitudeDataset
+			for _, filename := range args {
+				seq := internal.NewDatasetSequence(0, nil, false, stderr)
+				if err := configureSequence(cmd, seq); err != nil {
+					return err
+				}
+				if err := loadDatasets(cmd, seq, []string{filename}, verbose); err != nil {
+					return err
+				}
+				if seq.Count == 0 {
+					return fmt.Errorf("no datasets found in %s", filename)
+				}
+				datasets = append(datasets, seq.Result)
+			}
+
+			ts, err := internal.NewTimeSeries(datasets, top)
+			if err != nil {
+				return err
+			}
+			if verbose {
+				fmt.Fprintf(stderr, "Time series of %d domains over %d days\n", len(ts.Domains), len(ts.Dates))
+			}
+
+			var buf bytes.Buffer
+			if format == "json" {
+				err = internal.OutputTimeSeriesJSON(&buf, ts)
+			} else {
+				err = internal.OutputTimeSeriesCSV(&buf, ts, metrics)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to output time series: %w", err)
+			}
+
+			// Write the time series to the specified output file or stdout
+			if output != "" && output != "-" {
+				// #nosec G306
+				if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+					return fmt.Errorf("failed to write to %s: %w", output, err)
+				}
+				if verbose {
+					fmt.Fprintf(stderr, "Time series written to %s\n", output)
+				}
+			} else if _, err := stdout.Write(buf.Bytes()); err != nil {
+				return fmt.Errorf("failed to write to stdout: %w", err)
+			}
+
+			return nil
+		},
+	}
+
+	timeseriesCmd.Flags().BoolP("verbose", "v", false, "Verbose output")
+	timeseriesCmd.Flags().String("format", "csv", "Output format: 'csv' or 'json'")
+	timeseriesCmd.Flags().StringSlice("metrics", internal.TimeSeriesMetrics, "Metrics in the CSV columns: 'magnitude', 'clients' and/or 'queries'")
+	timeseriesCmd.Flags().IntP("top", "n", 0, "Include the domains among the top N by magnitude on any day (0 for all domains)")
+	timeseriesCmd.Flags().StringP("output", "o", "", "Output file (optional, defaults to stdout)")
+	timeseriesCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	timeseriesCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+
+	return timeseriesCmd
+}
+
+var timeseriesCmd = newTimeseriesCmd()
+
+func init() {
+	rootCmd.AddCommand(timeseriesCmd)
+}
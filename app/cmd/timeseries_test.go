@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"bytes"
+	"dnsmag/internal"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTimeseriesCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-02",
+		"--output", dir + "/day2.cbor",
+	}, 200, "TSV")
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.csv.gz",
+		"--filetype", "csv",
+		"--date", "2026-09-01",
+		"--output", dir + "/day1.cbor",
+	}, 200, "CSV")
+
+	var buf bytes.Buffer
+	timeseriesCmd := newTimeseriesCmd()
+	timeseriesCmd.SetOut(&buf)
+	timeseriesCmd.SetErr(&buf)
+	timeseriesCmd.SetArgs([]string{"--top", "5", "--metrics", "magnitude,clients", dir + "/day2.cbor", dir + "/day1.cbor"})
+	if err := timeseriesCmd.Execute(); err != nil {
+		t.Fatalf("Timeseries command failed: %v\nOutput: %s", err, buf.String())
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v\nOutput: %s", err, buf.String())
+	}
+	header := strings.Join(records[0], ",")
+	if header != "domain,2026-09-01 magnitude,2026-09-01 clients,2026-09-02 magnitude,2026-09-02 clients" {
+		t.Errorf("Unexpected header %s", header)
+	}
+	if len(records) < 6 {
+		t.Errorf("Expected at least 5 domains, got %d rows", len(records)-1)
+	}
+
+	buf.Reset()
+	timeseriesCmd = newTimeseriesCmd()
+	timeseriesCmd.SetOut(&buf)
+	timeseriesCmd.SetErr(&buf)
+	timeseriesCmd.SetArgs([]string{"--format", "json", dir + "/day1.cbor"})
+	if err := timeseriesCmd.Execute(); err != nil {
+		t.Fatalf("Timeseries command failed: %v\nOutput: %s", err, buf.String())
+	}
+	var ts internal.TimeSeries
+	if err := json.Unmarshal(buf.Bytes(), &ts); err != nil {
+		t.Fatalf("Failed to parse JSON time series: %v\nOutput: %s", err, buf.String())
+	}
+	if len(ts.Dates) != 1 || len(ts.Domains) == 0 {
+		t.Errorf("Unexpected time series %+v", ts)
+	}
+
+	// The same day in two files
+	timeseriesCmd = newTimeseriesCmd()
+	timeseriesCmd.SetOut(&buf)
+	timeseriesCmd.SetErr(&buf)
+	timeseriesCmd.SetArgs([]string{dir + "/day1.cbor", dir + "/day1.cbor"})
+	if err := timeseriesCmd.Execute(); err == nil {
+		t.Errorf("Expected an error for two files of the same day")
+	}
+
+	timeseriesCmd = newTimeseriesCmd()
+	timeseriesCmd.SetOut(&buf)
+	timeseriesCmd.SetErr(&buf)
+	timeseriesCmd.SetArgs([]string{"--metrics", "volume", dir + "/day1.cbor"})
+	if err := timeseriesCmd.Execute(); err == nil {
+		t.Errorf("Expected an error for an unknown metric")
+	}
+}
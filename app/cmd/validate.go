@@ -0,0 +1,90 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"crypto/ecdh"
+	"dnsmag/internal"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+)
+
+func newValidateCmd() *cobra.Command {
+	validateCmd := &cobra.Command{
+		Use:   "validate <dnsmag-file> [dnsmag-file2...]",
+		Short: "Validate DNSMAG files against the dataset schema",
+		Long: `Validate that every dataset in one or more DNSMAG files conforms to the dataset schema
+(schema/dataset.cddl): types, required keys, tag 1004 dates and that each HLL decodes with the
+expected parameters. Signed datasets are validated including their payload. Encrypted datasets are
+decrypted and validated if --identity is given, otherwise only their COSE_Encrypt structure is validated.
+
+Every schema violation is printed with its path in the dataset. Fails if any dataset is invalid.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				identityFile string
+				quiet        bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"identity": &identityFile,
+				"quiet":    &quiet,
+			})
+
+			cmd.SilenceUsage = true
+
+			var identity *ecdh.PrivateKey
+			if identityFile != "" {
+				var err error
+				if identity, err = internal.LoadIdentity(identityFile); err != nil {
+					return fmt.Errorf("failed to load identity: %w", err)
+				}
+			}
+
+			invalid := 0
+			for _, filename := range args {
+				var (
+					count      int
+					violations []internal.ValidationError
+				)
+				err := readInput(cmd, filename, func(reader io.Reader) error {
+					var err error
+					count, violations, err = internal.ValidateDatasets(reader, identity)
+					return err
+				})
+				for _, violation := range violations {
+					fmt.Fprintf(stderr, "%s: %s\n", filename, violation)
+				}
+				if err != nil {
+					return fmt.Errorf("validation of %s failed: %w", filename, err)
+				}
+
+				if len(violations) > 0 {
+					invalid++
+				} else if !quiet {
+					fmt.Fprintf(stderr, "%s: %d datasets valid\n", filename, count)
+				}
+			}
+
+			if invalid > 0 {
+				return fmt.Errorf("%d of %d files are not valid", invalid, len(args))
+			}
+			return nil
+		},
+	}
+
+	validateCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+	validateCmd.Flags().BoolP("quiet", "q", false, "Quiet mode, only print schema violations")
+
+	return validateCmd
+}
+
+var validateCmd = newValidateCmd()
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateCmd(t *testing.T) {
+	dir := t.TempDir()
+
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--compress", "gzip",
+		"--output", dir + "/data.cbor",
+	}, 200, "TSV")
+
+	var buf bytes.Buffer
+	validateCmd := newValidateCmd()
+	validateCmd.SetOut(&buf)
+	validateCmd.SetErr(&buf)
+	validateCmd.SetArgs([]string{dir + "/data.cbor"})
+	if err := validateCmd.Execute(); err != nil {
+		t.Fatalf("Validate command failed: %v\nOutput: %s", err, buf.String())
+	}
+	if !strings.Contains(buf.String(), "data.cbor: 1 datasets valid") {
+		t.Errorf("Expected valid dataset in output:\n%s", buf.String())
+	}
+
+	// {"version": 3}
+	if err := os.WriteFile(dir+"/invalid.cbor", []byte{0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x03}, 0o600); err != nil {
+		t.Fatalf("Failed to write invalid dataset: %v", err)
+	}
+
+	buf.Reset()
+	validateCmd = newValidateCmd()
+	validateCmd.SetOut(&buf)
+	validateCmd.SetErr(&buf)
+	validateCmd.SetArgs([]string{dir + "/data.cbor", dir + "/invalid.cbor"})
+	err := validateCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 files are not valid") {
+		t.Errorf("Expected validation to fail, got: %v", err)
+	}
+	for _, expected := range []string{
+		"invalid.cbor: dataset[1].version: unsupported version 3",
+		`invalid.cbor: dataset[1]: missing required key "date"`,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in output:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"dnsmag/internal"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newVerifyCmd() *cobra.Command {
+	verifyCmd := &cobra.Command{
+		Use:   "verify <dnsmag-file> [dnsmag-file2...]",
+		Short: "Verify the signatures of datasets in DNSMAG files",
+		Long: `Verify that every dataset in one or more DNSMAG files is signed by one of the trusted keys.
+Fails if any dataset is unsigned, signed by an unknown key or has an invalid signature.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				trustedKeys string
+				quiet       bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"trusted-keys": &trustedKeys,
+				"quiet":        &quiet,
+			})
+
+			cmd.SilenceUsage = true
+
+			keys, err := internal.LoadTrustedKeys(trustedKeys)
+			if err != nil {
+				return fmt.Errorf("failed to load trusted keys: %w", err)
+			}
+
+			for _, filename := range args {
+				var signatures []internal.DatasetSignature
+				err := readInput(cmd, filename, func(reader io.Reader) error {
+					var err error
+					signatures, err = internal.VerifyDatasets(reader, keys)
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("verification of %s failed: %w", filename, err)
+				}
+
+				if !quiet {
+					for i, sig := range signatures {
+						fmt.Fprintf(stderr, "%s#%d: signed by %s\n", filename, i+1, sig)
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	verifyCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys (required)")
+	verifyCmd.Flags().BoolP("quiet", "q", false, "Quiet mode")
+	if err := verifyCmd.MarkFlagRequired("trusted-keys"); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to mark 'trusted-keys' flag as required: %v\n", err)
+		os.Exit(1)
+	}
+
+	return verifyCmd
+}
+
+var verifyCmd = newVerifyCmd()
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
@@ -44,6 +44,9 @@ func newViewCmd() *cobra.Command {
 			cmd.SilenceUsage = true
 
 			seq := internal.NewDatasetSequence(top, nil, false, stderr)
+			if err := configureSequence(cmd, seq); err != nil {
+				return err
+			}
 
 			if err := loadDatasets(cmd, seq, []string{inputFile}, verbose); err != nil {
 				return err
@@ -89,6 +92,8 @@ func newViewCmd() *cobra.Command {
 	viewCmd.Flags().BoolP("json", "j", false, "JSON output")
 	viewCmd.Flags().IntP("top", "n", internal.DefaultDomainCount, "Number of top domains to display")
 	viewCmd.Flags().StringP("output", "o", "", "Output file (optional, use '-' for stdout, defaults to stderr)")
+	viewCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	viewCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
 
 	return viewCmd
 }
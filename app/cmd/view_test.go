@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -124,7 +125,7 @@ func TestViewCmd_JSON(t *testing.T) {
 		},
 	}
 
-	if stats != expected {
+	if !reflect.DeepEqual(stats, expected) {
 		t.Errorf("JSON output mismatch.\nGot:      %+v\nExpected: %+v", stats, expected)
 	}
 
@@ -0,0 +1,121 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package cmd
+
+import (
+	"dnsmag/internal"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newWebCmd() *cobra.Command {
+	webCmd := &cobra.Command{
+		Use:   "web <directory>",
+		Short: "Serve a read-only web dashboard of the datasets in a directory",
+		Long: `Serve a read-only web dashboard of the DNSMAG files in a directory and its subdirectories.
+
+The dashboard shows the top domains by magnitude of a selected date, the history of a domain over
+all dates, and links to download the JSON report of each date. The datasets of the same date are
+aggregated, and rollups are skipped. All assets are compiled into the binary.
+
+The directory is rescanned in the background every --rescan-interval (0 to never rescan), and new,
+changed and removed files are picked up. The previous datasets are served while they are reloaded.
+
+With --tlds, undelegated TLDs are highlighted. The file lists the delegated TLDs one per line,
+in the format of https://data.iana.org/TLD/tlds-alpha-by-domain.txt.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stderr := cmd.ErrOrStderr()
+
+			var (
+				listen         string
+				tldsFile       string
+				rescanInterval time.Duration
+				reportSource   string
+				sourceType     string
+				quiet          bool
+			)
+
+			parseFlags(cmd, map[string]any{
+				"listen":          &listen,
+				"tlds":            &tldsFile,
+				"rescan-interval": &rescanInterval,
+				"report-source":   &reportSource,
+				"source-type":     &sourceType,
+				"quiet":           &quiet,
+			})
+
+			if sourceType != "authoritative" && sourceType != "recursive" {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("invalid source-type '%s'. Must be 'authoritative' or 'recursive'", sourceType)
+			}
+			if rescanInterval < 0 {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("invalid --rescan-interval %s, must not be negative", rescanInterval)
+			}
+
+			cmd.SilenceUsage = true
+
+			logger := stderr
+			if quiet {
+				logger = io.Discard
+			}
+
+			var tlds map[string]bool
+			if tldsFile != "" {
+				var err error
+				if tlds, err = internal.LoadTLDs(tldsFile); err != nil {
+					return fmt.Errorf("failed to load TLDs: %w", err)
+				}
+			}
+
+			web, err := internal.NewWebServer(args[0], internal.WebOptions{
+				TLDs:           tlds,
+				RescanInterval: rescanInterval,
+				ReportSource:   reportSource,
+				SourceType:     sourceType,
+				Logger:         logger,
+			})
+			if err != nil {
+				return err
+			}
+			if err := configureSequence(cmd, web); err != nil {
+				return err
+			}
+			if err := web.Refresh(); err != nil {
+				return err
+			}
+
+			listener, err := net.Listen("tcp", listen)
+			if err != nil {
+				return fmt.Errorf("failed to listen on %s: %w", listen, err)
+			}
+			if !quiet {
+				fmt.Fprintf(stderr, "Serving the web UI on http://%s\n", listener.Addr())
+			}
+
+			return web.Serve(cmd.Context(), listener)
+		},
+	}
+
+	webCmd.Flags().StringP("listen", "l", internal.DefaultWebListen, "Address to listen on")
+	webCmd.Flags().String("tlds", "", "File with the delegated TLDs, to highlight undelegated ones (optional)")
+	webCmd.Flags().Duration("rescan-interval", internal.DefaultWebRescanInterval, "Time between scans of the directory for changed files (0 to never rescan)")
+	webCmd.Flags().String("report-source", "", "Source of the reports (optional, defaults to the sources of the datasets)")
+	webCmd.Flags().String("source-type", "authoritative", "Source type of the reports (authoritative or recursive)")
+	webCmd.Flags().BoolP("quiet", "q", false, "Do not log skipped files")
+	webCmd.Flags().String("trusted-keys", "", "File with PEM encoded Ed25519 public keys. If set, datasets must be signed by one of them (optional)")
+	webCmd.Flags().String("identity", "", "File with a PEM encoded X25519 private key to decrypt encrypted datasets with (optional)")
+
+	return webCmd
+}
+
+var webCmd = newWebCmd()
+
+func init() {
+	rootCmd.AddCommand(webCmd)
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebCmd(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(dir+"/data", 0o755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	executeCollectAndVerify(t, []string{
+		"../../testdata/test2.tsv",
+		"--filetype", "tsv",
+		"--date", "2026-09-01",
+		"--output", dir + "/data/day1.cbor",
+	}, 200, "TSV")
+	tldsFile := dir + "/tlds.txt"
+	if err := os.WriteFile(tldsFile, []byte("# Version 2026101800\nCOM\nNET\nORG\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write TLDs: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stderr := &syncBuffer{}
+	webCmd := newWebCmd()
+	webCmd.SetArgs([]string{dir + "/data", "--listen", "127.0.0.1:0", "--tlds", tldsFile})
+	webCmd.SetOut(stderr)
+	webCmd.SetErr(stderr)
+
+	done := make(chan error)
+	go func() { done <- webCmd.ExecuteContext(ctx) }()
+
+	// Wait for the server to listen
+	listening := regexp.MustCompile(`Serving the web UI on (http://\S+)`)
+	var url string
+	for range 100 {
+		if matches := listening.FindStringSubmatch(stderr.String()); matches != nil {
+			url = matches[1]
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if url == "" {
+		t.Fatalf("Server did not start\nOutput: %s", stderr.String())
+	}
+
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{"/", "<title>DNS Magnitude</title>"},
+		{"/api/dates", `"2026-09-01"`},
+		{"/api/top/2026-09-01?n=1", `"rank": 1`},
+		{"/reports/2026-09-01", `"totalQueryVolume": 200`},
+	} {
+		resp, err := http.Get(url + tt.path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), tt.expected) {
+			t.Errorf("GET %s: expected %q, got %d %s", tt.path, tt.expected, resp.StatusCode, body)
+		}
+	}
+
+	resp, err := http.Get(url + "/api/dates")
+	if err != nil {
+		t.Fatalf("GET /api/dates failed: %v", err)
+	}
+	var dates struct {
+		Delegation bool `json:"delegation"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dates)
+	_ = resp.Body.Close()
+	if err != nil || !dates.Delegation {
+		t.Errorf("Expected delegation data with --tlds (%v)", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Web command failed: %v\nOutput: %s", err, stderr.String())
+	}
+}
+
+func TestWebCmd_InvalidFlags(t *testing.T) {
+	for _, tt := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{t.TempDir(), "--source-type", "stub"}, "invalid source-type"},
+		{[]string{t.TempDir(), "--rescan-interval", "-1s"}, "invalid --rescan-interval"},
+		{[]string{t.TempDir() + "/missing"}, "missing"},
+	} {
+		webCmd := newWebCmd()
+		webCmd.SetArgs(tt.args)
+		webCmd.SetOut(io.Discard)
+		webCmd.SetErr(io.Discard)
+		if err := webCmd.Execute(); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%v: expected an error containing %q, got %v", tt.args, tt.expected, err)
+		}
+	}
+}
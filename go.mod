@@ -5,18 +5,20 @@ go 1.23
 require (
 	github.com/fxamacker/cbor/v2 v2.8.0
 	github.com/google/gopacket v1.1.19
+	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/segmentio/go-hll v1.0.1
 	github.com/spf13/cobra v1.9.1
 	github.com/zeebo/xxh3 v1.0.2
+	go.etcd.io/bbolt v1.4.3
 )
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
-	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	golang.org/x/sys v0.29.0 // indirect
 )
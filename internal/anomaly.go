@@ -0,0 +1,218 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Kinds of anomalies
+const (
+	AnomalyJump = "jump" // Significant rise above the baseline of a domain
+	AnomalyNew  = "new"  // Domain not seen on any day of the baseline
+)
+
+// Default options for anomaly detection
+const (
+	DefaultAnomalyWindow     = 7
+	DefaultAnomalyMinHistory = 3
+	DefaultAnomalyThreshold  = 3.5
+	DefaultAnomalyMinClients = 10
+)
+
+// Smallest scales of the metrics used for the robust z-score, so that tiny variations of domains with a
+// flat baseline (MAD 0) are not flagged. The clients scale is the larger of minClientsScale and
+// minClientsScaleRatio of the baseline median, to allow for the estimation error of the HLLs.
+const (
+	minMagnitudeScale    = 0.1
+	minClientsScale      = 1
+	minClientsScaleRatio = 0.05
+)
+
+// madScale makes the MAD comparable to the standard deviation of normally distributed values
+const madScale = 0.6745
+
+// AnomalyOptions are the parameters of DetectAnomalies
+type AnomalyOptions struct {
+	Window     int     // Number of preceding calendar days in the rolling baseline
+	MinHistory int     // Minimum number of days with data in the baseline needed to evaluate a day
+	Threshold  float64 // Robust z-score above which a rise is significant
+	MinClients uint64  // Minimum number of clients of a domain on a day to be flagged
+	Days       int     // Number of most recent calendar days to evaluate, 0 for all days with enough history
+}
+
+// AnomalyMetric is the value of a metric of a domain on a day, compared to its baseline
+type AnomalyMetric struct {
+	Value  float64 `json:"value"`
+	Median float64 `json:"median"` // Median over the baseline days
+	MAD    float64 `json:"mad"`    // Median absolute deviation over the baseline days
+	Score  float64 `json:"score"`  // Robust z-score of the value, 0.6745 * (value - median) / MAD
+}
+
+// Anomaly is a domain that rose significantly on a day, or appeared for the first time in the baseline
+type Anomaly struct {
+	Date          string        `json:"date"`
+	Domain        string        `json:"domain"`
+	Kind          string        `json:"kind"`         // jump or new
+	BaselineDays  int           `json:"baselineDays"` // Number of days with data in the baseline
+	BaselineStart string        `json:"baselineStart"`
+	BaselineEnd   string        `json:"baselineEnd"`
+	Magnitude     AnomalyMetric `json:"magnitude"`
+	Clients       AnomalyMetric `json:"clients"`
+	Score         float64       `json:"score"` // Highest score of the metrics
+	Message       string        `json:"message"`
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%s %s: %s", a.Date, a.Domain, a.Message)
+}
+
+// median returns the median of values, sorting them in place
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	slices.Sort(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// compareToBaseline returns a value compared to the median and MAD of the baseline values, with the
+// MAD raised to at least minScale for the score
+func compareToBaseline(value float64, baseline []float64, minScale float64) AnomalyMetric {
+	res := AnomalyMetric{Value: value, Median: median(slices.Clone(baseline))}
+	deviations := make([]float64, len(baseline))
+	for i, v := range baseline {
+		deviations[i] = math.Abs(v - res.Median)
+	}
+	res.MAD = median(deviations)
+	res.Score = madScale * (value - res.Median) / max(res.MAD, minScale)
+	return res
+}
+
+// DetectAnomalies finds domains rising significantly above their rolling baseline in a time series of
+// daily datasets, and domains appearing that were not seen on any day of the baseline. The baseline of a
+// day is the preceding opts.Window calendar days. Days missing from the time series are unknown and left
+// out of the baseline, while days with data where a domain was not seen count as zero clients and
+// magnitude. Only rises are flagged, by the robust z-score of the magnitude or the clients, and only for
+// domains with at least opts.MinClients clients on the day.
+func DetectAnomalies(ts TimeSeries, opts AnomalyOptions) ([]Anomaly, error) {
+	if opts.Window < 1 {
+		return nil, fmt.Errorf("invalid baseline window %d, must be at least 1", opts.Window)
+	}
+	if opts.MinHistory < 1 || opts.MinHistory > opts.Window {
+		return nil, fmt.Errorf("invalid minimum history %d, must be between 1 and the window %d", opts.MinHistory, opts.Window)
+	}
+	if opts.Threshold <= 0 {
+		return nil, fmt.Errorf("invalid threshold %v, must be positive", opts.Threshold)
+	}
+
+	dates := make([]time.Time, len(ts.Dates))
+	for i, date := range ts.Dates {
+		var err error
+		if dates[i], err = time.Parse(time.DateOnly, date); err != nil {
+			return nil, fmt.Errorf("invalid date %q in time series: %w", date, err)
+		}
+		if i > 0 && !dates[i].After(dates[i-1]) {
+			return nil, fmt.Errorf("dates of time series not in ascending order: %s after %s", date, ts.Dates[i-1])
+		}
+	}
+
+	anomalies := []Anomaly{}
+	for day := range ts.Dates {
+		if opts.Days > 0 && !dates[day].After(dates[len(dates)-1].AddDate(0, 0, -opts.Days)) {
+			continue
+		}
+		// The baseline is the days with data in the window before the day
+		start := day
+		for start > 0 && !dates[start-1].Before(dates[day].AddDate(0, 0, -opts.Window)) {
+			start--
+		}
+		if day-start < opts.MinHistory {
+			continue
+		}
+
+		for _, domain := range ts.Domains {
+			if domain.Magnitude[day] == nil || *domain.UniqueClients[day] < opts.MinClients {
+				continue
+			}
+
+			seen := false
+			var magnitudes, clients []float64
+			for i := start; i < day; i++ {
+				var magnitude float64
+				var count uint64
+				if domain.Magnitude[i] != nil {
+					seen = true
+					magnitude, count = *domain.Magnitude[i], *domain.UniqueClients[i]
+				}
+				magnitudes = append(magnitudes, magnitude)
+				clients = append(clients, float64(count))
+			}
+
+			anomaly := Anomaly{
+				Date:          ts.Dates[day],
+				Domain:        domain.Domain,
+				BaselineDays:  day - start,
+				BaselineStart: ts.Dates[start],
+				BaselineEnd:   ts.Dates[day-1],
+			}
+			anomaly.Magnitude = compareToBaseline(*domain.Magnitude[day], magnitudes, minMagnitudeScale)
+			anomaly.Clients = compareToBaseline(float64(*domain.UniqueClients[day]), clients,
+				max(minClientsScale, minClientsScaleRatio*median(slices.Clone(clients))))
+			anomaly.Score = max(anomaly.Magnitude.Score, anomaly.Clients.Score)
+
+			baseline := fmt.Sprintf("the previous %d days", opts.Window)
+			if anomaly.BaselineDays < opts.Window {
+				baseline = fmt.Sprintf("%d of the previous %d days", anomaly.BaselineDays, opts.Window)
+			}
+			switch {
+			case !seen:
+				anomaly.Kind = AnomalyNew
+				anomaly.Message = fmt.Sprintf("new domain with %d clients (magnitude %.2f), not seen in %s",
+					*domain.UniqueClients[day], *domain.Magnitude[day], baseline)
+			case anomaly.Score >= opts.Threshold:
+				anomaly.Kind = AnomalyJump
+				anomaly.Message = fmt.Sprintf("magnitude %.2f (median %.2f) and %d clients (median %.0f) over %s, score %.1f",
+					anomaly.Magnitude.Value, anomaly.Magnitude.Median, *domain.UniqueClients[day], anomaly.Clients.Median,
+					baseline, anomaly.Score)
+			default:
+				continue
+			}
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+
+	slices.SortFunc(anomalies, func(a, b Anomaly) int {
+		if c := strings.Compare(a.Date, b.Date); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	return anomalies, nil
+}
+
+// OutputAnomaliesJSON writes anomalies as JSON, with the options they were detected with
+func OutputAnomaliesJSON(w io.Writer, anomalies []Anomaly, opts AnomalyOptions) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]any{
+		"window":     opts.Window,
+		"threshold":  opts.Threshold,
+		"minClients": opts.MinClients,
+		"anomalies":  anomalies,
+	})
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values   []float64
+		expected float64
+	}{
+		{nil, 0},
+		{[]float64{3}, 3},
+		{[]float64{5, 1, 3}, 3},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	}
+	for _, tt := range tests {
+		if got := median(tt.values); got != tt.expected {
+			t.Errorf("median(%v) = %v, expected %v", tt.values, got, tt.expected)
+		}
+	}
+}
+
+// newAnomalyTimeSeries returns a time series of 8 days, where a quiet domain jumps and a new domain
+// appears on the last day
+func newAnomalyTimeSeries(t *testing.T) TimeSeries {
+	t.Helper()
+	return anomalyTimeSeriesOfDays(t, 1, 2, 3, 4, 5, 6, 7, 8)
+}
+
+// anomalyTimeSeriesOfDays returns a time series of days of September 2026, where a quiet domain jumps
+// and a new domain appears on the last day
+func anomalyTimeSeriesOfDays(t *testing.T, days ...int) TimeSeries {
+	t.Helper()
+
+	var datasets []MagnitudeDataset
+	for _, day := range days {
+		domains := map[string]clientRange{
+			"com":   {0, 999 + day%3},
+			"quiet": {0, 4 + day%2},
+		}
+		if day == days[len(days)-1] {
+			domains["quiet"] = clientRange{0, 199}
+			domains["newtld"] = clientRange{0, 49}
+			domains["small"] = clientRange{0, 2}
+		}
+		datasets = append(datasets, newDiffDataset(t, day, domains))
+	}
+
+	ts, err := NewTimeSeries(datasets, 0)
+	if err != nil {
+		t.Fatalf("NewTimeSeries failed: %v", err)
+	}
+	return ts
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	ts := newAnomalyTimeSeries(t)
+	opts := AnomalyOptions{
+		Window:     DefaultAnomalyWindow,
+		MinHistory: DefaultAnomalyMinHistory,
+		Threshold:  DefaultAnomalyThreshold,
+		MinClients: DefaultAnomalyMinClients,
+		Days:       1,
+	}
+
+	anomalies, err := DetectAnomalies(ts, opts)
+	if err != nil {
+		t.Fatalf("DetectAnomalies failed: %v", err)
+	}
+	if len(anomalies) != 2 {
+		t.Fatalf("Expected 2 anomalies, got %v", anomalies)
+	}
+
+	jump := anomalies[0]
+	if jump.Domain != "quiet" || jump.Kind != AnomalyJump || jump.Date != "2026-09-08" {
+		t.Errorf("Expected a jump of quiet on 2026-09-08, got %+v", jump)
+	}
+	if jump.BaselineDays != 7 || jump.BaselineStart != "2026-09-01" || jump.BaselineEnd != "2026-09-07" {
+		t.Errorf("Expected a baseline of 2026-09-01 - 2026-09-07, got %+v", jump)
+	}
+	if jump.Clients.Median < 5 || jump.Clients.Median > 7 || jump.Score < opts.Threshold {
+		t.Errorf("Unexpected baseline of quiet: %+v", jump)
+	}
+
+	if added := anomalies[1]; added.Domain != "newtld" || added.Kind != AnomalyNew || added.Magnitude.Median != 0 {
+		t.Errorf("Expected newtld to be new, got %+v", added)
+	}
+
+	// Evaluating every day with enough history only finds the anomalies of the last day, not the
+	// small variations before it
+	opts.Days = 0
+	if anomalies, err = DetectAnomalies(ts, opts); err != nil || len(anomalies) != 2 {
+		t.Errorf("Expected 2 anomalies over all days, got %v (%v)", anomalies, err)
+	}
+
+	// Without history before the last day nothing is evaluated
+	opts.Days, opts.MinHistory = 1, 7
+	if anomalies, err = DetectAnomalies(TimeSeries{Dates: ts.Dates[:7], Domains: ts.Domains}, opts); err != nil || len(anomalies) != 0 {
+		t.Errorf("Expected no anomalies without enough history, got %v (%v)", anomalies, err)
+	}
+
+	for _, invalid := range []AnomalyOptions{
+		{Window: 0, MinHistory: 1, Threshold: 3},
+		{Window: 7, MinHistory: 8, Threshold: 3},
+		{Window: 7, MinHistory: 3, Threshold: 0},
+	} {
+		if _, err := DetectAnomalies(ts, invalid); err == nil {
+			t.Errorf("Expected an error for options %+v", invalid)
+		}
+	}
+}
+
+func TestDetectAnomalies_MissingDays(t *testing.T) {
+	opts := AnomalyOptions{Window: 7, MinHistory: 3, Threshold: 3.5, MinClients: 10, Days: 1}
+
+	// The missing days 6 and 7 are left out of the baseline
+	anomalies, err := DetectAnomalies(anomalyTimeSeriesOfDays(t, 1, 2, 3, 4, 5, 8), opts)
+	if err != nil {
+		t.Fatalf("DetectAnomalies failed: %v", err)
+	}
+	if len(anomalies) != 2 {
+		t.Fatalf("Expected 2 anomalies, got %v", anomalies)
+	}
+	if jump := anomalies[0]; jump.BaselineDays != 5 || jump.BaselineStart != "2026-09-01" || jump.BaselineEnd != "2026-09-05" ||
+		!strings.Contains(jump.Message, "over 5 of the previous 7 days") {
+		t.Errorf("Expected a baseline of 5 days, got %+v", jump)
+	}
+
+	// Days before the window are not in the baseline, even if there are no days in between
+	anomalies, err = DetectAnomalies(anomalyTimeSeriesOfDays(t, 1, 2, 3, 4, 5, 6, 7, 20), opts)
+	if err != nil || len(anomalies) != 0 {
+		t.Errorf("Expected no anomalies without history in the window, got %v (%v)", anomalies, err)
+	}
+
+	// Only the days of the window with data count towards the minimum history
+	opts.Days = 0
+	anomalies, err = DetectAnomalies(anomalyTimeSeriesOfDays(t, 1, 2, 9, 10), opts)
+	if err != nil || len(anomalies) != 0 {
+		t.Errorf("Expected no anomalies with 2 days in the window, got %v (%v)", anomalies, err)
+	}
+}
+
+func TestOutputAnomaliesJSON(t *testing.T) {
+	opts := AnomalyOptions{Window: 7, MinHistory: 3, Threshold: 3.5, MinClients: 10, Days: 1}
+	anomalies, err := DetectAnomalies(newAnomalyTimeSeries(t), opts)
+	if err != nil {
+		t.Fatalf("DetectAnomalies failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := OutputAnomaliesJSON(&buf, anomalies, opts); err != nil {
+		t.Fatalf("OutputAnomaliesJSON failed: %v", err)
+	}
+	var decoded struct {
+		Window    int
+		Anomalies []Anomaly
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to parse JSON: %v\n%s", err, buf.String())
+	}
+	if decoded.Window != 7 || len(decoded.Anomalies) != 2 || decoded.Anomalies[1].Kind != AnomalyNew {
+		t.Errorf("Unexpected JSON output:\n%s", buf.String())
+	}
+	if !strings.Contains(decoded.Anomalies[1].Message, "not seen in the previous 7 days") {
+		t.Errorf("Unexpected message %q", decoded.Anomalies[1].Message)
+	}
+}
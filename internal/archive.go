@@ -0,0 +1,344 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ArchiveIndexFilename is the name of the index database in the root directory of an archive
+const ArchiveIndexFilename = "index.db"
+
+// Buckets of the archive index. The keys of the dates, sources, generators and domains buckets end with the
+// hash of a dataset, separated by a NUL byte, so that datasets can be found by a key prefix.
+var (
+	archiveDatasetsBucket   = []byte("datasets")   // hash -> CBOR encoded ArchiveEntry
+	archiveDatesBucket      = []byte("dates")      // date, hash
+	archiveSourcesBucket    = []byte("sources")    // source, date, hash
+	archiveGeneratorsBucket = []byte("generators") // generator, date, hash
+	archiveDomainsBucket    = []byte("domains")    // domain, date, hash
+)
+
+// archiveDateQuery matches the date prefixes of archive queries, a year, month or day
+var archiveDateQuery = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?$`)
+
+// ArchiveEntry describes a dataset in an archive
+type ArchiveEntry struct {
+	Hash       string   `json:"hash"`             // SHA-256 of the stored CBOR item, hex encoded
+	Path       string   `json:"path"`             // Path of the stored CBOR item, relative to the archive root
+	Size       int      `json:"size"`             // Size of the stored CBOR item
+	Date       string   `json:"date"`             // Date of the dataset, the first day of the period for rollups
+	Period     string   `json:"period,omitempty"` // Period of a rollup dataset
+	Identifier string   `json:"id"`
+	Generator  string   `json:"generator"`
+	Sources    []string `json:"sources,omitempty"`
+	Sites      []string `json:"sites,omitempty"`
+	Domains    int      `json:"domains"` // Number of domains in the dataset
+	Clients    uint64   `json:"clients"`
+	Queries    uint64   `json:"queries"`
+	Signed     bool     `json:"signed"`
+	Encrypted  bool     `json:"encrypted"`
+	Imported   string   `json:"imported"` // Time the dataset was imported, in RFC 3339 format
+}
+
+// ArchiveQuery selects datasets in an archive. Empty fields match all datasets.
+type ArchiveQuery struct {
+	Date      string // Year, month or day of the datasets: YYYY, YYYY-MM or YYYY-MM-DD
+	Source    string // One of the sources in the dataset metadata
+	Generator string // Generator of the datasets, e.g. "dnsmag v1.2.0"
+	Domain    string // Domain the datasets must contain
+}
+
+// Archive is a content-addressed local store of datasets, laid out by date like
+// year=YYYY/month=MM/day=DD/id=<hash>.cbor, with an index in an embedded database.
+// Every dataset is stored as a single CBOR item, exactly as it was imported, including any
+// signature and encryption. The hash is the SHA-256 of the stored item.
+type Archive struct {
+	root        string
+	db          *bolt.DB
+	identity    *ecdh.PrivateKey    // Key to decrypt encrypted datasets with, if any
+	trustedKeys []ed25519.PublicKey // Keys datasets must be signed by, if any
+}
+
+// OpenArchive opens the archive in the root directory. Unless readOnly is set, the directory and index
+// are created if necessary. The index can only be opened by one writer at a time.
+func OpenArchive(root string, readOnly bool) (*Archive, error) {
+	index := filepath.Join(root, ArchiveIndexFilename)
+	if readOnly {
+		if _, err := os.Stat(index); err != nil {
+			return nil, fmt.Errorf("no archive in %s: %w", root, err)
+		}
+	} else if err := os.MkdirAll(root, 0o755); err != nil { // #nosec G301
+		return nil, err
+	}
+
+	db, err := bolt.Open(index, 0o644, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive index %s: %w", index, err)
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{archiveDatasetsBucket, archiveDatesBucket, archiveSourcesBucket, archiveGeneratorsBucket, archiveDomainsBucket} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("failed to initialise archive index %s: %w", index, err)
+		}
+	}
+
+	return &Archive{root: root, db: db}, nil
+}
+
+// Close closes the archive index
+func (archive *Archive) Close() error {
+	return archive.db.Close()
+}
+
+// SetIdentity sets the key to decrypt encrypted datasets with when importing them
+func (archive *Archive) SetIdentity(identity *ecdh.PrivateKey) {
+	archive.identity = identity
+}
+
+// RequireSignatures requires imported datasets to be signed by one of the trusted keys
+func (archive *Archive) RequireSignatures(trusted []ed25519.PublicKey) {
+	archive.trustedKeys = trusted
+}
+
+// Path returns the path of the stored dataset of an entry
+func (archive *Archive) Path(entry ArchiveEntry) string {
+	return filepath.Join(archive.root, filepath.FromSlash(entry.Path))
+}
+
+// ImportFile imports the datasets in a DNSMAG file, returning the entries of the datasets added and the
+// number of datasets already in the archive.
+func (archive *Archive) ImportFile(filename string) ([]ArchiveEntry, int, error) {
+	file, err := os.Open(filename) // #nosec G304
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	return archive.ImportFromReader(file, fmt.Sprintf("%s#%%d", filename))
+}
+
+// ImportFromReader imports the datasets in a CBOR sequence, which may be compressed. Encrypted datasets
+// are stored encrypted, but must be decrypted with the identity to be indexed.
+func (archive *Archive) ImportFromReader(reader io.Reader, filenameFmt string) ([]ArchiveEntry, int, error) {
+	var added []ArchiveEntry
+	existing := 0
+	seqNum := 1
+	err := forEachCBORItem(reader, func(item []byte) error {
+		sourceFilename := fmt.Sprintf(filenameFmt, seqNum)
+		seqNum++
+
+		entry, found, err := archive.importItem(item, sourceFilename)
+		if err != nil {
+			return err
+		}
+		if found {
+			existing++
+		} else {
+			added = append(added, entry)
+		}
+		return nil
+	})
+	return added, existing, err
+}
+
+// importItem stores and indexes a dataset, unless it is already in the archive
+func (archive *Archive) importItem(item []byte, sourceFilename string) (ArchiveEntry, bool, error) {
+	digest := sha256.Sum256(item)
+	hash := hex.EncodeToString(digest[:])
+
+	found := false
+	err := archive.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(archiveDatasetsBucket).Get([]byte(hash)) != nil
+		return nil
+	})
+	if err != nil || found {
+		return ArchiveEntry{}, found, err
+	}
+
+	dataset, err := decodeDatasetItem(item, sourceFilename, archive.identity, archive.trustedKeys)
+	if err != nil {
+		return ArchiveEntry{}, false, err
+	}
+	if err := upgradeDataset(&dataset); err != nil {
+		return ArchiveEntry{}, false, fmt.Errorf("failed to import dataset %s: %w", sourceFilename, err)
+	}
+
+	entry := ArchiveEntry{
+		Hash: hash,
+		Path: fmt.Sprintf("year=%04d/month=%02d/day=%02d/id=%s.cbor",
+			dataset.Date.Year(), dataset.Date.Month(), dataset.Date.Day(), hash),
+		Size:       len(item),
+		Date:       dataset.DateString(),
+		Identifier: dataset.Identifier,
+		Generator:  dataset.Generator,
+		Domains:    len(dataset.Domains),
+		Clients:    dataset.AllClientsCount,
+		Queries:    dataset.AllQueriesCount,
+		Signed:     dataset.extraSignature != nil,
+		Encrypted:  isEncryptedItem(item),
+		Imported:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if period := dataset.period(); period != nil {
+		entry.Period = period.String()
+	}
+	if dataset.Metadata != nil {
+		entry.Sources = dataset.Metadata.Sources
+		entry.Sites = dataset.Metadata.Sites
+	}
+
+	filename := archive.Path(entry)
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil { // #nosec G301
+		return ArchiveEntry{}, false, err
+	}
+	err = writeFileAtomically(filename, func(file io.Writer) error {
+		_, err := file.Write(item)
+		return err
+	})
+	if err != nil {
+		return ArchiveEntry{}, false, fmt.Errorf("failed to store dataset %s: %w", sourceFilename, err)
+	}
+
+	encoded, err := cbor.Marshal(entry)
+	if err != nil {
+		return ArchiveEntry{}, false, err
+	}
+	err = archive.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(archiveDatasetsBucket).Put([]byte(hash), encoded); err != nil {
+			return err
+		}
+		if err := tx.Bucket(archiveDatesBucket).Put(archiveKey(entry.Date, hash), nil); err != nil {
+			return err
+		}
+		for _, source := range entry.Sources {
+			if err := tx.Bucket(archiveSourcesBucket).Put(archiveKey(source, entry.Date, hash), nil); err != nil {
+				return err
+			}
+		}
+		if entry.Generator != "" {
+			if err := tx.Bucket(archiveGeneratorsBucket).Put(archiveKey(entry.Generator, entry.Date, hash), nil); err != nil {
+				return err
+			}
+		}
+		domains := tx.Bucket(archiveDomainsBucket)
+		for domain := range dataset.Domains {
+			if err := domains.Put(archiveKey(string(domain), entry.Date, hash), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return ArchiveEntry{}, false, fmt.Errorf("failed to index dataset %s: %w", sourceFilename, err)
+	}
+
+	return entry, false, nil
+}
+
+// isEncryptedItem checks if a dataset item is encrypted, before or after it was signed
+func isEncryptedItem(item []byte) bool {
+	if isSigned(item) {
+		if payload, _, err := openSigned(item, nil); err == nil {
+			return isEncrypted(payload)
+		}
+	}
+	return isEncrypted(item)
+}
+
+// archiveKey joins the parts of an index key with NUL bytes
+func archiveKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00"))
+}
+
+// archivePrefix returns the prefix of the index keys starting with parts, followed by a date, or any date
+// in a year or month
+func archivePrefix(date string, parts ...string) []byte {
+	var prefix strings.Builder
+	for _, part := range parts {
+		prefix.WriteString(part + "\x00")
+	}
+	switch {
+	case len(date) == len(time.DateOnly):
+		prefix.WriteString(date + "\x00")
+	case date != "":
+		prefix.WriteString(date + "-")
+	}
+	return []byte(prefix.String())
+}
+
+// Query returns the entries of the datasets matching a query, sorted by date, sources and hash
+func (archive *Archive) Query(query ArchiveQuery) ([]ArchiveEntry, error) {
+	if query.Date != "" && !archiveDateQuery.MatchString(query.Date) {
+		return nil, fmt.Errorf("invalid date %q (expected YYYY, YYYY-MM or YYYY-MM-DD)", query.Date)
+	}
+
+	// Scan the most selective index, and check the rest of the query on the entries
+	bucket, prefix := archiveDatesBucket, archivePrefix(query.Date)
+	switch {
+	case query.Domain != "":
+		domain := strings.TrimSuffix(strings.ToLower(query.Domain), ".")
+		bucket, prefix = archiveDomainsBucket, archivePrefix(query.Date, domain)
+	case query.Source != "":
+		bucket, prefix = archiveSourcesBucket, archivePrefix(query.Date, query.Source)
+	case query.Generator != "":
+		bucket, prefix = archiveGeneratorsBucket, archivePrefix(query.Date, query.Generator)
+	}
+
+	entries := []ArchiveEntry{}
+	err := archive.db.View(func(tx *bolt.Tx) error {
+		datasets := tx.Bucket(archiveDatasetsBucket)
+		cursor := tx.Bucket(bucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			hash := key[bytes.LastIndexByte(key, '\x00')+1:]
+			var entry ArchiveEntry
+			if err := cbor.Unmarshal(datasets.Get(hash), &entry); err != nil {
+				return fmt.Errorf("corrupt archive index entry %s: %w", hash, err)
+			}
+			if query.Source != "" && !slices.Contains(entry.Sources, query.Source) {
+				continue
+			}
+			if query.Generator != "" && entry.Generator != query.Generator {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(entries, func(a, b ArchiveEntry) int {
+		if c := strings.Compare(a.Date, b.Date); c != 0 {
+			return c
+		}
+		if c := slices.Compare(a.Sources, b.Sources); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Hash, b.Hash)
+	})
+	return entries, nil
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchiveTestFile writes datasets to a file, optionally encrypted to recipient
+func writeArchiveTestFile(t *testing.T, filename string, recipient *ecdh.PublicKey, datasets ...MagnitudeDataset) {
+	t.Helper()
+
+	for _, dataset := range datasets {
+		opts := WriteOptions{Recipient: recipient, Append: true}
+		if _, err := WriteDNSMagFileWithOptions(dataset, filename, nil, opts); err != nil {
+			t.Fatalf("Failed to write %s: %v", filename, err)
+		}
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "archive")
+
+	var datasets []MagnitudeDataset
+	for _, tt := range []struct {
+		day    int
+		source string
+		domain string
+	}{
+		{1, "example", "com"},
+		{2, "example", "org"},
+		{2, "other", "com"},
+	} {
+		dataset := newDiffDataset(t, tt.day, map[string]clientRange{tt.domain: {0, 9}})
+		dataset.Metadata = &DatasetMetadata{Sources: []string{tt.source}}
+		if tt.source == "other" {
+			dataset.Generator = "other-tool 1.0"
+		}
+		datasets = append(datasets, dataset)
+	}
+	october := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 9}})
+	octoberDate := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	october.SetDate(&octoberDate)
+	writeArchiveTestFile(t, filepath.Join(dir, "september.cbor"), nil, datasets...)
+	writeArchiveTestFile(t, filepath.Join(dir, "october.cbor"), nil, october)
+
+	if _, err := OpenArchive(root, true); err == nil {
+		t.Errorf("Expected an error opening a missing archive read-only")
+	}
+
+	archive, err := OpenArchive(root, false)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	added, existing, err := archive.ImportFile(filepath.Join(dir, "september.cbor"))
+	if err != nil || len(added) != 3 || existing != 0 {
+		t.Fatalf("Expected 3 datasets added, got %d added, %d existing (%v)", len(added), existing, err)
+	}
+	if _, _, err := archive.ImportFile(filepath.Join(dir, "october.cbor")); err != nil {
+		t.Fatalf("ImportFile failed: %v", err)
+	}
+
+	entry := added[0]
+	expectedPath := "year=2026/month=09/day=01/id=" + entry.Hash + ".cbor"
+	if entry.Path != expectedPath || !slices.Equal(entry.Sources, []string{"example"}) || entry.Domains != 1 || entry.Signed || entry.Encrypted {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if _, err := os.Stat(filepath.Join(root, expectedPath)); err != nil {
+		t.Errorf("Expected the dataset to be stored at %s: %v", expectedPath, err)
+	}
+
+	// Stored datasets can be loaded like any DNSMAG file
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagFile(archive.Path(entry)); err != nil || seq.Result.Identifier != datasets[0].Identifier {
+		t.Errorf("Failed to load the stored dataset: %v", err)
+	}
+
+	// Importing the same datasets again adds nothing
+	added, existing, err = archive.ImportFile(filepath.Join(dir, "september.cbor"))
+	if err != nil || len(added) != 0 || existing != 3 {
+		t.Errorf("Expected 3 existing datasets, got %d added, %d existing (%v)", len(added), existing, err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	archive, err = OpenArchive(root, true)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	defer func() { _ = archive.Close() }()
+
+	tests := []struct {
+		name     string
+		query    ArchiveQuery
+		expected []string // Dates and sources of the datasets found
+	}{
+		{"all", ArchiveQuery{}, []string{"2026-09-01 example", "2026-09-02 example", "2026-09-02 other", "2026-10-01 "}},
+		{"year", ArchiveQuery{Date: "2026"}, []string{"2026-09-01 example", "2026-09-02 example", "2026-09-02 other", "2026-10-01 "}},
+		{"month", ArchiveQuery{Date: "2026-09"}, []string{"2026-09-01 example", "2026-09-02 example", "2026-09-02 other"}},
+		{"day", ArchiveQuery{Date: "2026-09-02"}, []string{"2026-09-02 example", "2026-09-02 other"}},
+		{"month and source", ArchiveQuery{Date: "2026-09", Source: "example"}, []string{"2026-09-01 example", "2026-09-02 example"}},
+		{"source", ArchiveQuery{Source: "other"}, []string{"2026-09-02 other"}},
+		{"domain", ArchiveQuery{Domain: "COM."}, []string{"2026-09-01 example", "2026-09-02 other", "2026-10-01 "}},
+		{"domain and source", ArchiveQuery{Domain: "com", Source: "example"}, []string{"2026-09-01 example"}},
+		{"domain and day", ArchiveQuery{Domain: "org", Date: "2026-09-01"}, nil},
+		{"generator", ArchiveQuery{Generator: "other-tool 1.0"}, []string{"2026-09-02 other"}},
+		{"month and generator", ArchiveQuery{Date: "2026-09", Generator: "dnsmag " + Version}, []string{"2026-09-01 example", "2026-09-02 example"}},
+		{"domain and generator", ArchiveQuery{Domain: "com", Generator: "dnsmag " + Version}, []string{"2026-09-01 example", "2026-10-01 "}},
+		{"source and generator", ArchiveQuery{Source: "example", Generator: "other-tool 1.0"}, nil},
+		{"no match", ArchiveQuery{Date: "2025"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := archive.Query(tt.query)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			var found []string
+			for _, entry := range entries {
+				found = append(found, entry.Date+" "+strings.Join(entry.Sources, ","))
+			}
+			if strings.Join(found, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("Expected %v, got %v", tt.expected, found)
+			}
+		})
+	}
+
+	if _, err := archive.Query(ArchiveQuery{Date: "2026-9"}); err == nil {
+		t.Errorf("Expected an error for an invalid date")
+	}
+}
+
+func TestArchive_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	filename := filepath.Join(dir, "encrypted.cbor")
+	writeArchiveTestFile(t, filename, identity.PublicKey(), newDiffDataset(t, 1, map[string]clientRange{"com": {0, 9}}))
+
+	archive, err := OpenArchive(filepath.Join(dir, "archive"), false)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	defer func() { _ = archive.Close() }()
+
+	if _, _, err := archive.ImportFile(filename); err == nil {
+		t.Errorf("Expected an error importing an encrypted dataset without an identity")
+	}
+
+	archive.SetIdentity(identity)
+	added, _, err := archive.ImportFile(filename)
+	if err != nil || len(added) != 1 || !added[0].Encrypted {
+		t.Fatalf("Expected an encrypted dataset to be added, got %+v (%v)", added, err)
+	}
+
+	// The dataset is stored encrypted
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagFile(archive.Path(added[0])); err == nil {
+		t.Errorf("Expected an error loading the stored dataset without an identity")
+	}
+}
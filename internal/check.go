@@ -0,0 +1,159 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"crypto/ecdh"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/segmentio/go-hll"
+)
+
+// Severities of findings
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Finding is an inconsistency found in a dataset by CheckDatasets
+type Finding struct {
+	Dataset  string `json:"dataset"`          // Source filename and sequence number of the dataset
+	Domain   string `json:"domain,omitempty"` // Domain the finding is about, if any
+	Check    string `json:"check"`            // Identifier of the check, e.g. clients_count_mismatch
+	Severity string `json:"severity"`         // error or warning
+	Message  string `json:"message"`
+}
+
+func (f Finding) String() string {
+	if f.Domain != "" {
+		return fmt.Sprintf("%s: %s: %s %s: %s", f.Dataset, f.Severity, f.Check, f.Domain, f.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", f.Dataset, f.Severity, f.Check, f.Message)
+}
+
+// CheckDatasets checks the semantic consistency of every dataset in a CBOR sequence: that the stored
+// client counts match the HLL cardinalities, that every domain HLL is a subset of the global HLL and that
+// the domain counts do not exceed the totals. Encrypted datasets are decrypted with identity.
+// Sets Finding.Dataset to the filename plus a sequence number suffix, like LoadDNSMagSequenceFromReader.
+func CheckDatasets(reader io.Reader, filenameFmt string, identity *ecdh.PrivateKey) ([]Finding, error) {
+	var findings []Finding
+	seqNum := 1
+	err := forEachCBORItem(reader, func(item []byte) error {
+		sourceFilename := fmt.Sprintf(filenameFmt, seqNum)
+		seqNum++
+
+		dataset, err := decodeDatasetItem(item, sourceFilename, identity, nil)
+		if err != nil {
+			return err
+		}
+		findings = append(findings, checkDataset(&dataset)...)
+		return nil
+	})
+	return findings, err
+}
+
+// exceedsEstimate checks if the HLL cardinality estimate exceeds limit by more than three standard errors
+// of the estimate, 1.04/sqrt(m) for m registers
+func exceedsEstimate(cardinality, limit uint64) bool {
+	stdError := 1.04 / math.Sqrt(float64(uint64(1)<<hllSettings.Log2m))
+	return float64(cardinality) > float64(limit)*(1+3*stdError)
+}
+
+// datasetChecker collects the findings for a dataset
+type datasetChecker struct {
+	dataset  *MagnitudeDataset
+	findings []Finding
+}
+
+func (c *datasetChecker) add(severity, check, domain, format string, args ...any) {
+	c.findings = append(c.findings, Finding{
+		Dataset:  c.dataset.extraSourceFilename,
+		Domain:   domain,
+		Check:    check,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkDataset checks the consistency of a dataset as stored, before its statistics are recomputed
+func checkDataset(dataset *MagnitudeDataset) []Finding {
+	c := &datasetChecker{dataset: dataset}
+
+	if dataset.Partial {
+		c.add(SeverityWarning, "partial", "", "collection was interrupted while processing %q", dataset.LastFile)
+	}
+	if dataset.AllClientsHll == nil || dataset.AllClientsHll.Hll == nil {
+		c.add(SeverityError, "missing_hll", "", "dataset has no all_clients_hll")
+		return c.findings
+	}
+
+	global := dataset.AllClientsHll.Hll
+	globalCardinality := global.Cardinality()
+	if globalCardinality != dataset.AllClientsCount {
+		c.add(SeverityError, "clients_count_mismatch", "", "all_clients_count %d differs from the HLL cardinality %d",
+			dataset.AllClientsCount, globalCardinality)
+	}
+	if dataset.AllQueriesCount == 0 && len(dataset.Domains) > 0 {
+		c.add(SeverityWarning, "no_queries", "", "all_queries_count is 0, but there are %d domains", len(dataset.Domains))
+	}
+
+	domains := make([]DomainName, 0, len(dataset.Domains))
+	for domain := range dataset.Domains {
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+
+	globalBytes := global.ToBytes()
+	var domainQueries uint64
+	for _, domain := range domains {
+		data := dataset.Domains[domain]
+		name := string(domain)
+		domainQueries += data.QueriesCount
+
+		if data.QueriesCount == 0 {
+			c.add(SeverityWarning, "no_queries", name, "queries_count is 0")
+		}
+		if data.Hll == nil || data.Hll.Hll == nil {
+			c.add(SeverityError, "missing_hll", name, "domain has no clients_hll")
+			continue
+		}
+
+		cardinality := data.Hll.Cardinality()
+		if cardinality != data.ClientsCount {
+			c.add(SeverityError, "clients_count_mismatch", name, "clients_count %d differs from the HLL cardinality %d",
+				data.ClientsCount, cardinality)
+		}
+		if exceedsEstimate(cardinality, dataset.AllClientsCount) {
+			c.add(SeverityWarning, "clients_exceed_total", name, "%d clients, more than the %d clients in total",
+				cardinality, dataset.AllClientsCount)
+		}
+		if exceedsEstimate(cardinality, data.QueriesCount) {
+			c.add(SeverityWarning, "clients_exceed_queries", name, "%d clients, but only %d queries",
+				cardinality, data.QueriesCount)
+		}
+
+		// Adding a domain HLL to the global HLL must not change its cardinality. The encodings are not compared,
+		// as the same registers can be stored in different representations.
+		union, err := hll.FromBytes(globalBytes)
+		if err != nil {
+			c.add(SeverityError, "invalid_hll", "", "failed to copy all_clients_hll: %v", err)
+			return c.findings
+		}
+		if err := union.StrictUnion(*data.Hll.Hll); err != nil {
+			c.add(SeverityError, "hll_incompatible", name, "clients_hll can not be combined with all_clients_hll: %v", err)
+		} else if unionCardinality := union.Cardinality(); unionCardinality != globalCardinality {
+			c.add(SeverityError, "hll_not_subset", name, "clients_hll is not a subset of all_clients_hll (union cardinality %d, global %d)",
+				unionCardinality, globalCardinality)
+		}
+	}
+
+	if domainQueries > dataset.AllQueriesCount {
+		c.add(SeverityError, "queries_exceed_total", "", "sum of domain queries %d exceeds all_queries_count %d",
+			domainQueries, dataset.AllQueriesCount)
+	}
+
+	return c.findings
+}
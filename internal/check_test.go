@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/segmentio/go-hll"
+)
+
+// checkFindings returns the checks of the findings for a dataset, by domain
+func checkFindings(t *testing.T, dataset MagnitudeDataset) map[string][]string {
+	t.Helper()
+
+	findings, err := CheckDatasets(bytes.NewReader(mustMarshalDataset(t, dataset)), "test#%d", nil)
+	if err != nil {
+		t.Fatalf("CheckDatasets failed: %v", err)
+	}
+	res := make(map[string][]string)
+	for _, f := range findings {
+		if f.Dataset != "test#1" {
+			t.Errorf("Expected dataset test#1, got %s", f.Dataset)
+		}
+		res[f.Domain] = append(res[f.Domain], f.Check)
+	}
+	return res
+}
+
+// largeCheckDataset returns a dataset with domains queried by 3 to 5000 clients, so that its HLLs use
+// different storage types
+func largeCheckDataset(t *testing.T) MagnitudeDataset {
+	t.Helper()
+	return clientsCheckDataset(t, map[string]int{"com": 5000, "org": 500, "net": 3})
+}
+
+// clientsCheckDataset returns a dataset with domains queried by the given number of clients
+func clientsCheckDataset(t *testing.T, domains map[string]int) MagnitudeDataset {
+	t.Helper()
+
+	date := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	dataset := newDataset(&date)
+	for d, clients := range domains {
+		for c := range clients {
+			src, err := NewIPAddress(netip.AddrFrom4([4]byte{10, byte(c >> 8), byte(c), 1}))
+			if err != nil {
+				t.Fatalf("NewIPAddress failed: %v", err)
+			}
+			if err := dataset.updateStats(d, src, 2, false); err != nil {
+				t.Fatalf("updateStats failed: %v", err)
+			}
+		}
+	}
+	dataset.finaliseStats()
+	return dataset
+}
+
+// denseCheckDataset returns a dataset where the HLL of a domain with few clients is stored in the full
+// representation, while the global HLL with the same registers for them is sparse
+func denseCheckDataset(t *testing.T) MagnitudeDataset {
+	t.Helper()
+
+	dataset := clientsCheckDataset(t, map[string]int{"org": 50, "net": 3})
+	net := dataset.Domains["net"]
+	dense, err := hll.NewHll(hll.Settings{Log2m: hllSettings.Log2m, Regwidth: hllSettings.Regwidth, SparseEnabled: false})
+	if err != nil {
+		t.Fatalf("NewHll failed: %v", err)
+	}
+	if err := dense.StrictUnion(*net.Hll.Hll); err != nil {
+		t.Fatalf("StrictUnion failed: %v", err)
+	}
+	net.Hll = &HLLWrapper{Hll: &dense}
+	dataset.Domains["net"] = net
+	return dataset
+}
+
+func TestCheckDatasets_Consistent(t *testing.T) {
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := collector.ProcessFiles(context.Background(), []string{"../testdata/test1.pcap.gz"}, "pcap", nil, os.Stderr); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+	aggregated, err := AggregateDatasets([]MagnitudeDataset{largeCheckDataset(t), newMetadataDataset(t, "", nil)})
+	if err != nil {
+		t.Fatalf("AggregateDatasets failed: %v", err)
+	}
+	aggregated.finaliseStats()
+
+	for name, dataset := range map[string]MagnitudeDataset{
+		"pcap":       collector.Result,
+		"large":      largeCheckDataset(t),
+		"dense":      denseCheckDataset(t),
+		"aggregated": aggregated,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if findings := checkFindings(t, dataset); len(findings) != 0 {
+				t.Errorf("Expected no findings, got %v", findings)
+			}
+		})
+	}
+}
+
+func TestCheckDatasets_Inconsistent(t *testing.T) {
+	outsider, err := NewIPAddress(netip.MustParseAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("NewIPAddress failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		mutate   func(ds *MagnitudeDataset)
+		expected map[string][]string
+	}{
+		{"clients count", func(ds *MagnitudeDataset) {
+			com := ds.Domains["com"]
+			com.ClientsCount++
+			ds.Domains["com"] = com
+			ds.AllClientsCount = 1
+		}, map[string][]string{
+			"":    {"clients_count_mismatch"},
+			"com": {"clients_count_mismatch", "clients_exceed_total"},
+			"org": {"clients_exceed_total"},
+			"net": {"clients_exceed_total"},
+		}},
+		{"not a subset", func(ds *MagnitudeDataset) {
+			org := ds.Domains["org"]
+			org.Hll.AddRaw(outsider.hash)
+			org.ClientsCount = org.Hll.Cardinality()
+			ds.Domains["org"] = org
+		}, map[string][]string{
+			"org": {"hll_not_subset"},
+		}},
+		{"queries", func(ds *MagnitudeDataset) {
+			net := ds.Domains["net"]
+			net.QueriesCount = 1
+			ds.Domains["net"] = net
+			ds.AllQueriesCount = 100
+		}, map[string][]string{
+			"":    {"queries_exceed_total"},
+			"net": {"clients_exceed_queries"},
+		}},
+		{"partial", func(ds *MagnitudeDataset) {
+			ds.Partial = true
+			ds.LastFile = "input.pcap"
+		}, map[string][]string{
+			"": {"partial"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataset := largeCheckDataset(t)
+			tt.mutate(&dataset)
+
+			findings := checkFindings(t, dataset)
+			for domain := range findings {
+				slices.Sort(findings[domain])
+			}
+			for domain := range tt.expected {
+				slices.Sort(tt.expected[domain])
+				if !slices.Equal(findings[domain], tt.expected[domain]) {
+					t.Errorf("Expected findings %v for %q, got %v", tt.expected[domain], domain, findings[domain])
+				}
+			}
+			if len(findings) != len(tt.expected) {
+				t.Errorf("Expected findings %v, got %v", tt.expected, findings)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Version of the checkpoint file format
+const checkpointVersion = 2
+
+// checkpoint is the state of a collection run, saved periodically so that an interrupted run can be resumed.
+// Checkpoints are only saved between input files, so resuming is per file: a file that was being processed
+// when the run stopped is processed again from its start.
+type checkpoint struct {
+	Version            uint16           `cbor:"version"`
+	Filetype           string           `cbor:"filetype"`
+	Result             MagnitudeDataset `cbor:"result"`  // Collector.Result at the time of the checkpoint
+	Current            MagnitudeDataset `cbor:"current"` // Collector.current (the not yet migrated chunk)
+	Files              []checkpointFile `cbor:"files"`   // Input files that have been completely processed
+	RecordCount        uint             `cbor:"record_count"`
+	ChunkCount         uint             `cbor:"chunk_count"`
+	InvalidDomainCount uint             `cbor:"invalid_domain_count"`
+	InvalidRecordCount uint             `cbor:"invalid_record_count"`
+}
+
+// checkpointFile records a completely processed input file and its size, to detect if it changes before
+// the run is resumed
+type checkpointFile struct {
+	Name string `cbor:"name"`
+	Size int64  `cbor:"size"`
+}
+
+// countingReader counts the number of bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+// EnableCheckpoints makes ProcessFiles save a checkpoint to filename after completing an input file,
+// at most once per interval (an interval of 0 means after every input file).
+func (c *Collector) EnableCheckpoints(filename string, interval time.Duration) {
+	c.checkpointFilename = filename
+	c.checkpointInterval = interval
+}
+
+// Resume restores the collector state from a checkpoint written by an earlier run. Input files recorded
+// as completed in the checkpoint will be skipped by ProcessFiles.
+func (c *Collector) Resume(filename string) error {
+	data, err := os.ReadFile(filename) // #nosec G304
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	var cp checkpoint
+	if err := cbor.Unmarshal(data, &cp); err != nil {
+		return fmt.Errorf("failed to unmarshal checkpoint %s: %w", filename, err)
+	}
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d in %s", cp.Version, filename)
+	}
+
+	c.Result = restoreDataset(cp.Result)
+	c.current = restoreDataset(cp.Current)
+	if c.Result.Metadata == nil {
+		c.Result.Metadata = newMetadata("", nil)
+	}
+	c.completedFiles = cp.Files
+	c.resumedFiletype = cp.Filetype
+	c.recordCount = cp.RecordCount
+	c.chunkCount = cp.ChunkCount
+	c.invalidDomainCount = cp.InvalidDomainCount
+	c.invalidRecordCount = cp.InvalidRecordCount
+
+	// An explicitly provided date takes precedence over the one in the checkpoint
+	if c.dateProvided != nil {
+		c.SetDate(c.dateProvided)
+	}
+
+	return nil
+}
+
+// restoreDataset initialises the fields of a dataset loaded from a checkpoint that are not saved in CBOR,
+// so that more records can be added to it.
+func restoreDataset(dataset MagnitudeDataset) MagnitudeDataset {
+	dataset.extraAllClients = make(map[netip.Addr]struct{})
+	dataset.extraV6Clients = make(map[netip.Addr]struct{})
+	dataset.extraAllDomains = make(map[DomainName]struct{})
+	if dataset.Domains == nil {
+		dataset.Domains = make(map[DomainName]domainData)
+	}
+	for name, domain := range dataset.Domains {
+		domain.extraAllClients = make(map[netip.Addr]struct{})
+		dataset.Domains[name] = domain
+	}
+	return dataset
+}
+
+// isCompleted checks if an input file was completely processed according to a resumed checkpoint.
+// It is an error if the file has changed size since the checkpoint was written.
+func (c *Collector) isCompleted(filename string) (bool, error) {
+	idx := slices.IndexFunc(c.completedFiles, func(f checkpointFile) bool { return f.Name == filename })
+	if idx < 0 {
+		return false, nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != c.completedFiles[idx].Size {
+		return false, fmt.Errorf("input file %s has changed since the checkpoint was written (size %d, expected %d)",
+			filename, info.Size(), c.completedFiles[idx].Size)
+	}
+	return true, nil
+}
+
+// fileCompleted records that an input file has been completely processed, and saves a checkpoint if
+// checkpoints are enabled and the checkpoint interval has passed (or force is set).
+func (c *Collector) fileCompleted(filename string, size int64, force bool) error {
+	c.completedFiles = append(c.completedFiles, checkpointFile{Name: filename, Size: size})
+
+	if c.checkpointFilename == "" {
+		return nil
+	}
+	if !force && time.Since(c.lastCheckpoint) < c.checkpointInterval {
+		return nil
+	}
+	return c.saveCheckpoint()
+}
+
+// saveCheckpoint writes the collector state to the checkpoint file. The file is replaced atomically,
+// so that a crash while writing the checkpoint leaves the previous checkpoint intact.
+func (c *Collector) saveCheckpoint() error {
+	cp := checkpoint{
+		Version:            checkpointVersion,
+		Filetype:           c.filetype,
+		Result:             c.Result,
+		Current:            c.current,
+		Files:              c.completedFiles,
+		RecordCount:        c.recordCount,
+		ChunkCount:         c.chunkCount,
+		InvalidDomainCount: c.invalidDomainCount,
+		InvalidRecordCount: c.invalidRecordCount,
+	}
+
+	data, err := cbor.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+
+	err = writeFileAtomically(c.checkpointFilename, func(file io.Writer) error {
+		_, err := file.Write(data)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+
+	c.lastCheckpoint = time.Now()
+	return nil
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	InitStats()
+}
+
+// writeTempCSVFiles writes each CSV string to a file in a temporary directory and returns the filenames
+func writeTempCSVFiles(t *testing.T, csvData ...string) []string {
+	t.Helper()
+
+	dir := t.TempDir()
+	var files []string
+	for i, data := range csvData {
+		filename := filepath.Join(dir, string(rune('a'+i))+".csv")
+		if err := os.WriteFile(filename, []byte(data), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", filename, err)
+		}
+		files = append(files, filename)
+	}
+	return files
+}
+
+func TestCollector_CheckpointResume(t *testing.T) {
+	files := writeTempCSVFiles(t,
+		"192.168.1.1,example.com,5\n192.168.2.1,example.org,3\n",
+		"10.0.0.1,example.com,2\n10.0.1.1,example.net,7\n10.0.2.1,example.net\n",
+		"172.16.0.1,example.org,1\n2001:db8::1,example.se,4\n",
+	)
+	testDate := time.Date(2009, 12, 21, 0, 0, 0, 0, time.UTC)
+	checkpointFile := filepath.Join(t.TempDir(), "collect.checkpoint")
+
+	// Uninterrupted run over all files, for reference
+	reference := NewCollector(DefaultDomainCount, 2, false, &testDate, NewTimingStats())
+	if err := reference.ProcessFiles(context.Background(), files, "csv", nil, os.Stderr); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	// First run only gets through the first two files before being "interrupted"
+	first := NewCollector(DefaultDomainCount, 2, false, &testDate, NewTimingStats())
+	first.EnableCheckpoints(checkpointFile, 0)
+	if err := first.ProcessFiles(context.Background(), files[:2], "csv", nil, os.Stderr); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	// Resumed run is given all files, and should skip the first two
+	var stderr bytes.Buffer
+	resumed := NewCollector(DefaultDomainCount, 2, true, &testDate, NewTimingStats())
+	if err := resumed.Resume(checkpointFile); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if err := resumed.ProcessFiles(context.Background(), files, "csv", nil, &stderr); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	for _, skipped := range files[:2] {
+		if !strings.Contains(stderr.String(), "Skipping csv file already processed according to checkpoint: "+skipped) {
+			t.Errorf("Expected %s to be skipped, output:\n%s", skipped, stderr.String())
+		}
+	}
+
+	if resumed.recordCount != reference.recordCount {
+		t.Errorf("Expected %d records, got %d", reference.recordCount, resumed.recordCount)
+	}
+	if resumed.chunkCount != reference.chunkCount {
+		t.Errorf("Expected %d chunks, got %d", reference.chunkCount, resumed.chunkCount)
+	}
+
+	validateDatasetDomains(t, resumed.Result, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{
+			"com": 7,
+			"org": 4,
+			"net": 8,
+			"se":  4,
+		},
+	})
+
+	if resumed.Result.AllQueriesCount != reference.Result.AllQueriesCount {
+		t.Errorf("Expected %d queries, got %d", reference.Result.AllQueriesCount, resumed.Result.AllQueriesCount)
+	}
+	if !bytes.Equal(resumed.Result.AllClientsHll.ToBytes(), reference.Result.AllClientsHll.ToBytes()) {
+		t.Errorf("All clients HLL differs from uninterrupted run")
+	}
+	for name, domain := range reference.Result.Domains {
+		if !bytes.Equal(resumed.Result.Domains[name].Hll.ToBytes(), domain.Hll.ToBytes()) {
+			t.Errorf("HLL for domain %s differs from uninterrupted run", name)
+		}
+	}
+}
+
+func TestCollector_ResumeChangedFile(t *testing.T) {
+	files := writeTempCSVFiles(t, "192.168.1.1,example.com,5\n")
+	checkpointFile := filepath.Join(t.TempDir(), "collect.checkpoint")
+
+	first := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	first.EnableCheckpoints(checkpointFile, 0)
+	if err := first.ProcessFiles(context.Background(), files, "csv", nil, os.Stderr); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	// Append to the input file after it was checkpointed
+	if err := os.WriteFile(files[0], []byte("192.168.1.1,example.com,5\n10.0.0.1,example.org\n"), 0o600); err != nil {
+		t.Fatalf("Failed to rewrite %s: %v", files[0], err)
+	}
+
+	resumed := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := resumed.Resume(checkpointFile); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	err := resumed.ProcessFiles(context.Background(), files, "csv", nil, os.Stderr)
+	if err == nil || !strings.Contains(err.Error(), "has changed since the checkpoint was written") {
+		t.Errorf("Expected error about changed input file, got: %v", err)
+	}
+}
+
+func TestCollector_ResumeFiletypeMismatch(t *testing.T) {
+	files := writeTempCSVFiles(t, "192.168.1.1,example.com,5\n")
+	checkpointFile := filepath.Join(t.TempDir(), "collect.checkpoint")
+
+	first := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	first.EnableCheckpoints(checkpointFile, 0)
+	if err := first.ProcessFiles(context.Background(), files, "csv", nil, os.Stderr); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	resumed := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := resumed.Resume(checkpointFile); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	err := resumed.ProcessFiles(context.Background(), files, "tsv", nil, os.Stderr)
+	if err == nil || !strings.Contains(err.Error(), "does not match filetype csv in checkpoint") {
+		t.Errorf("Expected filetype mismatch error, got: %v", err)
+	}
+}
+
+func TestCollector_ResumeInvalidCheckpoint(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "invalid.checkpoint")
+	if err := os.WriteFile(filename, []byte("not a checkpoint"), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", filename, err)
+	}
+
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := collector.Resume(filename); err == nil {
+		t.Error("Expected error when resuming from invalid checkpoint, got nil")
+	}
+	if err := collector.Resume(filename + ".missing"); err == nil {
+		t.Error("Expected error when resuming from missing checkpoint, got nil")
+	}
+}
@@ -3,10 +3,13 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"slices"
 	"time"
 )
 
@@ -23,6 +26,13 @@ type Collector struct {
 	invalidRecordCount uint             // Count of invalid records encountered
 	filesLoaded        []string         // List of files that were successfully loaded
 	dateProvided       *time.Time       // Date explicitly provided for the dataset
+	filetype           string           // Type of the input files being processed
+	checkpointFilename string           // File to save checkpoints to, if any
+	checkpointInterval time.Duration    // Minimum time between checkpoints
+	lastCheckpoint     time.Time        // Time of the last saved checkpoint
+	completedFiles     []checkpointFile // Input files that have been completely processed
+	resumedFiletype    string           // Type of the input files in a resumed checkpoint
+	metrics            *Metrics         // Metrics to update while processing, if any
 }
 
 func NewCollector(topCount int, chunkSize uint, verbose bool, date *time.Time, timing *TimingStats) *Collector {
@@ -39,18 +49,44 @@ func NewCollector(topCount int, chunkSize uint, verbose bool, date *time.Time, t
 		filesLoaded:        nil,
 		dateProvided:       date,
 	}
+	c.Result.Metadata = newMetadata("", nil)
 	c.SetDate(date)
 	return c
 }
 
+// SetProvenance records the source and sites of the collected data in the dataset metadata
+func (c *Collector) SetProvenance(source string, sites []string) {
+	c.Result.Metadata.Sources = nil
+	if source != "" {
+		c.Result.Metadata.Sources = []string{source}
+	}
+	c.Result.Metadata.Sites = slices.Clone(sites)
+}
+
+// observeTimestamp extends the collection window in the dataset metadata to include a query timestamp
+func (c *Collector) observeTimestamp(ts time.Time) {
+	c.Result.Metadata.observe(ts.UTC())
+}
+
+// SetMetrics makes the collector update metrics while processing
+func (c *Collector) SetMetrics(metrics *Metrics) {
+	c.metrics = metrics
+}
+
 func (c *Collector) ProcessRecord(domainStr string, src IPAddress, queryCount uint64) error {
 	err := c.current.updateStats(domainStr, src, queryCount, c.verbose)
 	if err != nil {
 		c.invalidDomainCount++
+		if c.metrics != nil {
+			c.metrics.invalidDomains.Add(1)
+		}
 		return nil // Invalid domain is not a fatal error
 	}
 
 	c.recordCount++
+	if c.metrics != nil {
+		c.metrics.recordsProcessed.Add(1)
+	}
 	if c.chunkSize != 0 && c.recordCount%c.chunkSize == 0 {
 		if err := c.migrateCurrent(); err != nil {
 			return fmt.Errorf("failed to migrate current dataset: %w", err)
@@ -71,16 +107,31 @@ func (c *Collector) migrateCurrent() error {
 		return fmt.Errorf("failed to aggregate datasets: %w", err)
 	}
 	res.Truncate(c.topCount)
+	// Chunks are not parents of the result, it keeps the provenance recorded by the collector
+	res.Metadata = c.Result.Metadata
+	res.extraAggregated = false
 	c.Result = res
 	c.current = newDataset(&c.Result.Date.Time)
 
 	c.chunkCount++
+	if c.metrics != nil {
+		c.metrics.chunkFlushes.Add(1)
+		c.metrics.setDatasets(c, &c.Result)
+	}
 
 	// Run garbage collection to free memory
 	runtime.GC()
 	return nil
 }
 
+// countInvalidRecord counts a record that could not be parsed
+func (c *Collector) countInvalidRecord() {
+	c.invalidRecordCount++
+	if c.metrics != nil {
+		c.metrics.invalidRecords.Add(1)
+	}
+}
+
 // Since "current" is not public, we need a public method to set the date
 func (c *Collector) SetDate(date *time.Time) {
 	c.current.SetDate(date)
@@ -97,12 +148,38 @@ func (c *Collector) Finalise() error {
 	return nil
 }
 
-// ProcessFiles processes multiple input files into collector.Result
-func (c *Collector) ProcessFiles(files []string, filetype string, stdin io.Reader, stderr io.Writer) error {
+// ProcessFiles processes multiple input files into collector.Result. If the context is cancelled, the
+// records processed so far are finalised into collector.Result, which is then marked as partial, and
+// an error wrapping the context's error is returned.
+func (c *Collector) ProcessFiles(ctx context.Context, files []string, filetype string, stdin io.Reader, stderr io.Writer) error {
+	if c.resumedFiletype != "" && c.resumedFiletype != filetype {
+		return fmt.Errorf("filetype %s does not match filetype %s in checkpoint", filetype, c.resumedFiletype)
+	}
+	c.filetype = filetype
+	c.lastCheckpoint = time.Now()
+
 	c.timing.StartParsing()
 
 	// Process each input file
-	for _, inputFile := range files {
+	for i, inputFile := range files {
+		if ctx.Err() != nil {
+			// Interrupted between files, so no file was being processed
+			return c.interrupt(files[:i], "", ctx.Err())
+		}
+
+		if inputFile != "-" {
+			completed, err := c.isCompleted(inputFile)
+			if err != nil {
+				return fmt.Errorf("failed to resume %s file %s: %w", filetype, inputFile, err)
+			}
+			if completed {
+				if c.verbose {
+					fmt.Fprintf(stderr, "Skipping %s file already processed according to checkpoint: %s\n", filetype, inputFile)
+				}
+				continue
+			}
+		}
+
 		if c.verbose {
 			fmt.Fprintf(stderr, "Loading %s file: %s\n", filetype, inputFile)
 		}
@@ -121,17 +198,43 @@ func (c *Collector) ProcessFiles(files []string, filetype string, stdin io.Reade
 			}
 		}
 
+		fileStart := time.Now()
+		fileRecords := c.recordCount
+		digest := newDigestReader(reader)
+		counter := &countingReader{reader: digest}
 		if reader != nil {
 			if filetype == "csv" || filetype == "tsv" {
-				err = LoadCSVFromReader(reader, c, filetype)
+				err = LoadCSVFromReader(ctx, counter, c, filetype)
 			} else {
-				err = LoadPcap(reader, c)
+				err = LoadPcap(ctx, counter, c)
 			}
 		}
 
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return c.interrupt(files[:i+1], inputFile, err)
+		}
+		if errors.Is(err, errTruncatedPcap) {
+			fmt.Fprintf(stderr, "Warning: Ignoring the truncated last record of %s file %s\n", filetype, inputFile)
+			err = nil
+		}
 		if err != nil {
 			return fmt.Errorf("failed to load %s file %s: %w", filetype, inputFile, err)
 		}
+
+		c.Result.Metadata.InputFiles = append(c.Result.Metadata.InputFiles, InputFile{
+			Name:   inputFile,
+			Size:   counter.count,
+			SHA256: digest.hash.Sum(nil),
+		})
+
+		if c.metrics != nil {
+			c.metrics.fileCompleted(counter.count, c.recordCount-fileRecords, time.Since(fileStart))
+			c.metrics.setDatasets(c, &c.Result, &c.current)
+		}
+
+		if err := c.fileCompleted(inputFile, counter.count, i == len(files)-1); err != nil {
+			return fmt.Errorf("failed to save checkpoint: %w", err)
+		}
 	}
 
 	c.timing.StopParsing()
@@ -144,3 +247,31 @@ func (c *Collector) ProcessFiles(files []string, filetype string, stdin io.Reade
 
 	return nil
 }
+
+// interrupt finalises the records processed so far when collection is interrupted, and marks the
+// result as partial. lastFile is the input file that was being processed, if any.
+//
+// If checkpoints are enabled and the collection was interrupted between files, a checkpoint is saved
+// first. When a file was being processed, some of its records are already in the datasets, which a
+// checkpoint must not include since resuming is per file. The last saved checkpoint is kept instead.
+func (c *Collector) interrupt(files []string, lastFile string, cause error) error {
+	c.timing.StopParsing()
+
+	var checkpointErr error
+	if c.checkpointFilename != "" && lastFile == "" {
+		checkpointErr = c.saveCheckpoint()
+	}
+
+	if err := c.Finalise(); err != nil {
+		return fmt.Errorf("failed to finalise collection: %w", err)
+	}
+
+	c.Result.Partial = true
+	c.Result.LastFile = lastFile
+	c.filesLoaded = files
+
+	if checkpointErr != nil {
+		return fmt.Errorf("collection interrupted: %w, and failed to save checkpoint: %w", cause, checkpointErr)
+	}
+	return fmt.Errorf("collection interrupted: %w", cause)
+}
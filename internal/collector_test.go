@@ -1,10 +1,15 @@
 package internal
 
 import (
+	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -70,7 +75,7 @@ func TestCollectorChunking(t *testing.T) {
 			timing := NewTimingStats()
 			collector := NewCollector(DefaultDomainCount, chunkSize, true, &testDate, timing)
 
-			err = collector.ProcessFiles([]string{tmpFile.Name()}, "csv", nil, os.Stderr)
+			err = collector.ProcessFiles(context.Background(), []string{tmpFile.Name()}, "csv", nil, os.Stderr)
 			if err != nil {
 				t.Fatalf("ProcessFiles failed: %v", err)
 			}
@@ -117,7 +122,7 @@ func TestCollectorPcapLoading(t *testing.T) {
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 0, true, nil, timing)
 
-	err := collector.ProcessFiles([]string{"../testdata/test1.pcap.gz"}, "pcap", nil, os.Stderr)
+	err := collector.ProcessFiles(context.Background(), []string{"../testdata/test1.pcap.gz"}, "pcap", nil, os.Stderr)
 	if err != nil {
 		t.Fatalf("ProcessFiles failed for PCAP: %v", err)
 	}
@@ -153,6 +158,27 @@ func TestCollectorPcapLoading(t *testing.T) {
 	}
 }
 
+func TestCollectorTruncatedPcap(t *testing.T) {
+	// A capture cut off by rotation ends in the middle of its last record
+	pcap := writeTestPcap(t, 10)
+	filename := filepath.Join(t.TempDir(), "truncated.pcap")
+	if err := os.WriteFile(filename, pcap[:len(pcap)-5], 0o600); err != nil {
+		t.Fatalf("Failed to write PCAP: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := collector.ProcessFiles(context.Background(), []string{filename}, "pcap", nil, &stderr); err != nil {
+		t.Fatalf("ProcessFiles failed for truncated PCAP: %v", err)
+	}
+	if collector.Result.AllQueriesCount != 9 {
+		t.Errorf("Expected the 9 complete records, got %d queries", collector.Result.AllQueriesCount)
+	}
+	if !strings.Contains(stderr.String(), "Warning: Ignoring the truncated last record of pcap file "+filename) {
+		t.Errorf("Expected a warning about the truncated record, got %q", stderr.String())
+	}
+}
+
 func TestCollectorNonExistentFiles(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -191,7 +217,7 @@ func TestCollectorNonExistentFiles(t *testing.T) {
 			timing := NewTimingStats()
 			collector := NewCollector(DefaultDomainCount, 0, false, nil, timing)
 
-			err := collector.ProcessFiles(tt.files, tt.filetype, nil, os.Stderr)
+			err := collector.ProcessFiles(context.Background(), tt.files, tt.filetype, nil, os.Stderr)
 
 			if err == nil {
 				t.Error("Expected error for non-existent file, got nil")
@@ -270,7 +296,7 @@ func TestCollectorFileLoadingError(t *testing.T) {
 			// Modify the Result dataset version to make file loading fail
 			collector.Result.Version++
 
-			err := collector.ProcessFiles([]string{filename}, tt.filetype, nil, os.Stderr)
+			err := collector.ProcessFiles(context.Background(), []string{filename}, tt.filetype, nil, os.Stderr)
 
 			if err == nil {
 				t.Error("Expected version mismatch error, got nil")
@@ -311,7 +337,7 @@ func TestCollectorGzippedCSV(t *testing.T) {
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 0, true, &testDate, timing)
 
-	err = collector.ProcessFiles([]string{tmpFile.Name()}, "csv", nil, os.Stderr)
+	err = collector.ProcessFiles(context.Background(), []string{tmpFile.Name()}, "csv", nil, os.Stderr)
 	if err != nil {
 		t.Fatalf("ProcessFiles failed for gzipped CSV: %v", err)
 	}
@@ -339,3 +365,165 @@ func makeInt(u uint64) int {
 func abs(x int) int {
 	return max(x, -x)
 }
+
+// cancellingReader returns its chunks one per Read call, and cancels a context before returning the last one
+type cancellingReader struct {
+	chunks []string
+	cancel context.CancelFunc
+}
+
+func (cr *cancellingReader) Read(p []byte) (int, error) {
+	if len(cr.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if len(cr.chunks) == 1 {
+		cr.cancel()
+	}
+	n := copy(p, cr.chunks[0])
+	cr.chunks = cr.chunks[1:]
+	return n, nil
+}
+
+func TestCollectorInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stdin := &cancellingReader{
+		chunks: []string{
+			"192.168.1.1,example.com,5\n",
+			"192.168.2.1,example.org,3\n",
+			"192.168.3.1,example.net,1\n",
+		},
+		cancel: cancel,
+	}
+
+	testDate := time.Date(2009, 12, 21, 0, 0, 0, 0, time.UTC)
+	collector := NewCollector(DefaultDomainCount, 0, false, &testDate, NewTimingStats())
+
+	err := collector.ProcessFiles(ctx, []string{"-", "../testdata/test2.csv.gz"}, "csv", stdin, os.Stderr)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled error, got: %v", err)
+	}
+
+	if !collector.Result.Partial {
+		t.Error("Expected result to be marked as partial")
+	}
+	if collector.Result.LastFile != "<stdin>" {
+		t.Errorf("Expected last file <stdin>, got %q", collector.Result.LastFile)
+	}
+	if len(collector.filesLoaded) != 1 {
+		t.Errorf("Expected 1 file loaded, got %d", len(collector.filesLoaded))
+	}
+
+	// Records read before the cancellation are kept, the second input file is not processed
+	validateDatasetDomains(t, collector.Result, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{
+			"com": 5,
+			"org": 3,
+			"net": 1,
+		},
+	})
+	if collector.Result.AllClientsCount == 0 {
+		t.Error("Expected partial result to be finalised with a clients count")
+	}
+}
+
+func TestCollectorInterruptedBeforeStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	err := collector.ProcessFiles(ctx, []string{"../testdata/test1.pcap.gz"}, "pcap", nil, os.Stderr)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled error, got: %v", err)
+	}
+	if !collector.Result.Partial || collector.Result.LastFile != "" {
+		t.Errorf("Expected partial result without last file, got partial=%v last file %q",
+			collector.Result.Partial, collector.Result.LastFile)
+	}
+	if collector.Result.AllQueriesCount != 0 {
+		t.Errorf("Expected no queries, got %d", collector.Result.AllQueriesCount)
+	}
+}
+
+func TestLoadPcapCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	err := LoadPcap(ctx, readerFromFile(t, "../testdata/test1.pcap.gz"), collector)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled error, got: %v", err)
+	}
+}
+
+// cancelAfterReader reads from a reader and cancels a context once limit bytes or the end have been read
+type cancelAfterReader struct {
+	reader io.Reader
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (cr *cancelAfterReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	cr.limit -= n
+	if cr.limit <= 0 || err == io.EOF {
+		cr.cancel()
+	}
+	return n, err
+}
+
+func TestCollectorInterruptedBetweenFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The context is cancelled when the end of the first input is reached
+	stdin := &cancelAfterReader{reader: strings.NewReader("192.168.1.1,example.com,5\n"), limit: 1024, cancel: cancel}
+	files := append([]string{"-"}, writeTempCSVFiles(t, "10.0.0.1,example.org,3\n")...)
+	checkpointFile := filepath.Join(t.TempDir(), "collect.checkpoint")
+
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	collector.EnableCheckpoints(checkpointFile, time.Hour)
+	err := collector.ProcessFiles(ctx, files, "csv", stdin, os.Stderr)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled error, got: %v", err)
+	}
+	if !collector.Result.Partial || collector.Result.LastFile != "" {
+		t.Errorf("Expected partial result without last file, got partial=%v last file %q",
+			collector.Result.Partial, collector.Result.LastFile)
+	}
+
+	// A checkpoint is saved on interrupt, with the completed input
+	resumed := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := resumed.Resume(checkpointFile); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if len(resumed.completedFiles) != 1 || resumed.completedFiles[0].Name != "<stdin>" || resumed.recordCount != 1 {
+		t.Errorf("Unexpected checkpoint with files %v and %d records", resumed.completedFiles, resumed.recordCount)
+	}
+}
+
+func TestCollectorInterruptedKeepsCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stdin := &cancellingReader{
+		chunks: []string{"192.168.1.1,example.com,5\n", "192.168.2.1,example.org,3\n"},
+		cancel: cancel,
+	}
+	checkpointFile := filepath.Join(t.TempDir(), "collect.checkpoint")
+
+	// Records of an interrupted file must not end up in a checkpoint
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	collector.EnableCheckpoints(checkpointFile, 0)
+	err := collector.ProcessFiles(ctx, []string{"-"}, "csv", stdin, os.Stderr)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled error, got: %v", err)
+	}
+	if collector.Result.LastFile != "<stdin>" {
+		t.Errorf("Expected last file <stdin>, got %q", collector.Result.LastFile)
+	}
+	if _, err := os.Stat(checkpointFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no checkpoint, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"io"
 	"os"
 	"reflect"
@@ -130,7 +131,7 @@ func loadDatasetFromCSV(csvData string, dateStr string, verbose bool) (*Collecto
 
 	timing.StartParsing()
 
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		return nil, err
 	}
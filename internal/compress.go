@@ -0,0 +1,96 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression of dataset files
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCompression returns the compression of data starting with magic
+func detectCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// checkCompression returns an error if compression is not a known compression
+func checkCompression(compression string) error {
+	switch compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression '%s', must be '%s', '%s' or '%s'",
+			compression, CompressionNone, CompressionGzip, CompressionZstd)
+	}
+}
+
+// newDecompressingReader returns a reader for gzip or zstd compressed data, detected by its magic number.
+// Uncompressed data is read as is. Concatenated compressed streams, e.g. from appending datasets to a
+// compressed file, are read as one stream.
+func newDecompressingReader(reader io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(reader)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch detectCompression(magic) {
+	case CompressionGzip:
+		return gzip.NewReader(br)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// newCompressingWriter returns a writer compressing to writer. The returned writer must be closed to
+// flush the compressed stream, which does not close writer.
+func newCompressingWriter(writer io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(writer), nil
+	case CompressionZstd:
+		return zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+	case CompressionNone, "":
+		return nopWriteCloser{writer}, nil
+	default:
+		return nil, checkCompression(compression)
+	}
+}
+
+// nopWriteCloser adds a no-op Close method to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
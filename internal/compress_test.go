@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressingWriter_RoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("dnsmag dataset "), 1000)
+
+	for _, compression := range []string{"", CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			// Two concatenated streams are read as one
+			var buf bytes.Buffer
+			for range 2 {
+				writer, err := newCompressingWriter(&buf, compression)
+				if err != nil {
+					t.Fatalf("newCompressingWriter failed: %v", err)
+				}
+				if _, err := writer.Write(data); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				if err := writer.Close(); err != nil {
+					t.Fatalf("Close failed: %v", err)
+				}
+			}
+
+			expected := compression
+			if expected == "" {
+				expected = CompressionNone
+			}
+			if got := detectCompression(buf.Bytes()); got != expected {
+				t.Errorf("Expected compression %s to be detected, got %s", expected, got)
+			}
+			if expected != CompressionNone && buf.Len() >= len(data) {
+				t.Errorf("Expected compressed size below %d, got %d", len(data), buf.Len())
+			}
+
+			reader, err := newDecompressingReader(&buf)
+			if err != nil {
+				t.Fatalf("newDecompressingReader failed: %v", err)
+			}
+			defer reader.Close()
+			decompressed, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("ReadAll failed: %v", err)
+			}
+			if !bytes.Equal(decompressed, append(bytes.Clone(data), data...)) {
+				t.Errorf("Decompressed data differs, got %d bytes", len(decompressed))
+			}
+		})
+	}
+}
+
+func TestNewDecompressingReader_Short(t *testing.T) {
+	for _, data := range []string{"", "a"} {
+		reader, err := newDecompressingReader(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("newDecompressingReader failed for %q: %v", data, err)
+		}
+		if got, _ := io.ReadAll(reader); string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+}
+
+func TestNewCompressingWriter_Unknown(t *testing.T) {
+	if _, err := newCompressingWriter(io.Discard, "bzip2"); err == nil || !strings.Contains(err.Error(), "unknown compression 'bzip2'") {
+		t.Errorf("Expected unknown compression error, got: %v", err)
+	}
+}
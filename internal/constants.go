@@ -2,7 +2,13 @@
 
 package internal
 
-import "regexp"
+import (
+	"regexp"
+	"time"
+)
+
+// Version of the datasets written. Version 1 datasets (without metadata) can still be read.
+const DatasetVersion = 2
 
 // Default number of top domains to collect/require
 const DefaultDomainCount = 2500
@@ -13,6 +19,41 @@ const DefaultDNSDomainNameLabels = 1
 // Default number of (million) queries collected after which to aggregate results (to preserve memory)
 const DefaultCollectDomainsChunk = 0
 
+// Default minimum time between collection checkpoints
+const DefaultCheckpointInterval = 5 * time.Minute
+
+// Defaults for collecting from a spool directory (watch mode)
+const (
+	DefaultWatchPollInterval = 10 * time.Second
+	DefaultWatchSettle       = 30 * time.Second
+	DefaultWatchDayGrace     = time.Hour
+)
+
+// Default time between saves of the current day's dataset when ingesting records from a socket
+const DefaultIngestFlushInterval = 5 * time.Minute
+
+// Defaults for submitting files to a collection endpoint
+const (
+	DefaultSubmitChunkSize  = 8 * 1024 * 1024 // Files larger than this are uploaded resumably in chunks
+	DefaultSubmitRetries    = 5
+	DefaultSubmitBackoff    = time.Second
+	DefaultSubmitMaxBackoff = time.Minute
+	DefaultSubmitTimeout    = 5 * time.Minute // Timeout of each request
+)
+
+// Defaults for the collection server receiving submitted files
+const (
+	DefaultServeListen        = "127.0.0.1:8053"
+	DefaultServeMaxUploadSize = 256 * 1024 * 1024 // Largest file accepted
+	DefaultServeUploadExpiry  = 24 * time.Hour    // Time after which an unfinished resumable upload is discarded
+)
+
+// Defaults for the web UI
+const (
+	DefaultWebListen         = "127.0.0.1:8054"
+	DefaultWebRescanInterval = 30 * time.Second // Time between scans of the directory for changed files
+)
+
 // IP address truncation mask lengths
 const (
 	DefaultIPv4MaskLength = 24
@@ -0,0 +1,253 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE (RFC 9052) constants used for signed datasets
+const (
+	coseSign1Tag    = 18
+	coseHeaderAlg   = 1
+	coseHeaderKid   = 4
+	coseAlgEdDSA    = -8
+	coseSign1Prefix = 0xd2 // First byte of a CBOR item with tag 18
+)
+
+// coseSign1 is a COSE_Sign1 structure, without its tag
+type coseSign1 struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[any]any
+	Payload     []byte
+	Signature   []byte
+}
+
+// DatasetSignature describes the COSE_Sign1 signature of a loaded dataset
+type DatasetSignature struct {
+	KeyID    []byte // SHA-256 of the signer's Ed25519 public key
+	Verified bool   // Set if the signature was verified using a trusted key
+}
+
+func (sig DatasetSignature) String() string {
+	if sig.Verified {
+		return fmt.Sprintf("key %s (verified)", hex.EncodeToString(sig.KeyID))
+	}
+	return fmt.Sprintf("key %s (not verified)", hex.EncodeToString(sig.KeyID))
+}
+
+// coseEncMode encodes protected headers deterministically
+var coseEncMode, _ = cbor.CoreDetEncOptions().EncMode()
+
+// KeyID returns the key identifier of an Ed25519 public key, used in the kid header of signed datasets
+func KeyID(pub ed25519.PublicKey) []byte {
+	sum := sha256.Sum256(pub)
+	return sum[:]
+}
+
+// LoadSigningKey loads an Ed25519 private key from a PEM encoded PKCS #8 file, such as one created with
+// "openssl genpkey -algorithm ed25519".
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM encoded private key found in %s", filename)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key in %s: %w", filename, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is not an Ed25519 key", filename)
+	}
+	return edKey, nil
+}
+
+// LoadTrustedKeys loads one or more PEM encoded Ed25519 public keys from a file
+func LoadTrustedKeys(filename string) ([]ed25519.PublicKey, error) {
+	data, err := os.ReadFile(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ed25519.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key in %s: %w", filename, err)
+		}
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key in %s is not an Ed25519 key", filename)
+		}
+		keys = append(keys, edKey)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no PEM encoded public keys found in %s", filename)
+	}
+	return keys, nil
+}
+
+// sigStructure returns the data signed in a COSE_Sign1 without external additional authenticated data
+func sigStructure(protected, payload []byte) ([]byte, error) {
+	return cbor.Marshal([]any{"Signature1", protected, []byte{}, payload})
+}
+
+// isSigned checks if a CBOR item is a COSE_Sign1 structure
+func isSigned(item []byte) bool {
+	return len(item) > 0 && item[0] == coseSign1Prefix
+}
+
+// signDataset wraps an encoded dataset in a COSE_Sign1 structure signed with an Ed25519 key
+func signDataset(payload []byte, key ed25519.PrivateKey) ([]byte, error) {
+	pub, _ := key.Public().(ed25519.PublicKey)
+	protected, err := coseEncMode.Marshal(map[int]any{
+		coseHeaderAlg: coseAlgEdDSA,
+		coseHeaderKid: KeyID(pub),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode protected header: %w", err)
+	}
+
+	toBeSigned, err := sigStructure(protected, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signature structure: %w", err)
+	}
+
+	return cbor.Marshal(cbor.Tag{
+		Number: coseSign1Tag,
+		Content: coseSign1{
+			Protected:   protected,
+			Unprotected: map[any]any{},
+			Payload:     payload,
+			Signature:   ed25519.Sign(key, toBeSigned),
+		},
+	})
+}
+
+// openSigned returns the payload of a COSE_Sign1 structure. If trusted keys are given, the signature must
+// have been made by one of them. Without trusted keys, the signature is not verified.
+func openSigned(item []byte, trusted []ed25519.PublicKey) ([]byte, DatasetSignature, error) {
+	var sig DatasetSignature
+
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(item, &tag); err != nil || tag.Number != coseSign1Tag {
+		return nil, sig, fmt.Errorf("not a COSE_Sign1 structure")
+	}
+	var msg coseSign1
+	if err := cbor.Unmarshal(tag.Content, &msg); err != nil {
+		return nil, sig, fmt.Errorf("failed to decode COSE_Sign1 structure: %w", err)
+	}
+
+	var headers map[int]any
+	if err := cbor.Unmarshal(msg.Protected, &headers); err != nil {
+		return nil, sig, fmt.Errorf("failed to decode protected header: %w", err)
+	}
+	if alg, ok := headers[coseHeaderAlg].(int64); !ok || alg != coseAlgEdDSA {
+		return nil, sig, fmt.Errorf("unsupported signature algorithm %v", headers[coseHeaderAlg])
+	}
+	sig.KeyID, _ = headers[coseHeaderKid].([]byte)
+
+	if len(trusted) == 0 {
+		return msg.Payload, sig, nil
+	}
+
+	for _, key := range trusted {
+		if !bytes.Equal(KeyID(key), sig.KeyID) {
+			continue
+		}
+		toBeSigned, err := sigStructure(msg.Protected, msg.Payload)
+		if err != nil {
+			return nil, sig, fmt.Errorf("failed to encode signature structure: %w", err)
+		}
+		if !ed25519.Verify(key, toBeSigned, msg.Signature) {
+			return nil, sig, fmt.Errorf("invalid signature by key %s", hex.EncodeToString(sig.KeyID))
+		}
+		sig.Verified = true
+		return msg.Payload, sig, nil
+	}
+	return nil, sig, fmt.Errorf("signed by untrusted key %s", hex.EncodeToString(sig.KeyID))
+}
+
+// SignDatasets signs every dataset in a CBOR sequence, writing the signed datasets as a CBOR sequence.
+// Encrypted datasets are signed without decrypting them.
+func SignDatasets(reader io.Reader, writer io.Writer, key ed25519.PrivateKey) (int, error) {
+	count := 0
+	err := forEachCBORItem(reader, func(item []byte) error {
+		if isSigned(item) {
+			return fmt.Errorf("dataset %d is already signed", count+1)
+		}
+		// Encrypted datasets are signed as they are, without being decoded
+		if !isEncrypted(item) {
+			var dataset MagnitudeDataset
+			if err := cbor.Unmarshal(item, &dataset); err != nil {
+				return fmt.Errorf("failed to decode dataset %d: %w", count+1, err)
+			}
+		}
+
+		signed, err := signDataset(item, key)
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(signed); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// VerifyDatasets checks that every dataset in a CBOR sequence is signed by one of the trusted keys,
+// returning the signatures.
+func VerifyDatasets(reader io.Reader, trusted []ed25519.PublicKey) ([]DatasetSignature, error) {
+	if len(trusted) == 0 {
+		return nil, errors.New("no trusted keys")
+	}
+
+	var signatures []DatasetSignature
+	err := forEachCBORItem(reader, func(item []byte) error {
+		if !isSigned(item) {
+			return fmt.Errorf("dataset %d is not signed", len(signatures)+1)
+		}
+		payload, sig, err := openSigned(item, trusted)
+		if err != nil {
+			return fmt.Errorf("dataset %d: %w", len(signatures)+1, err)
+		}
+		if !isEncrypted(payload) {
+			var dataset MagnitudeDataset
+			if err := cbor.Unmarshal(payload, &dataset); err != nil {
+				return fmt.Errorf("failed to decode dataset %d: %w", len(signatures)+1, err)
+			}
+		}
+		signatures = append(signatures, sig)
+		return nil
+	})
+	return signatures, err
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func init() {
+	InitStats()
+}
+
+// writeTestKeys generates an Ed25519 key pair and writes it to PEM files in dir
+func writeTestKeys(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	privFile := filepath.Join(dir, name+".pem")
+	pubFile := filepath.Join(dir, name+".pub.pem")
+	if err := os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return privFile, pubFile
+}
+
+// signedTestDatasets returns two datasets as an unsigned CBOR sequence, and signed with the key
+func signedTestDatasets(t *testing.T, key ed25519.PrivateKey) ([]byte, []byte) {
+	t.Helper()
+
+	var unsigned bytes.Buffer
+	for _, csvData := range []string{"192.168.1.10,example.com,5\n", "10.0.0.1,example.org,3\n"} {
+		collector, err := loadDatasetFromCSV(csvData, "2026-09-01", false)
+		if err != nil {
+			t.Fatalf("loadDatasetFromCSV failed: %v", err)
+		}
+		unsigned.Write(mustMarshalDataset(t, collector.Result))
+	}
+
+	var signed bytes.Buffer
+	count, err := SignDatasets(bytes.NewReader(unsigned.Bytes()), &signed, key)
+	if err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 signed datasets, got %d", count)
+	}
+	return unsigned.Bytes(), signed.Bytes()
+}
+
+func TestSignAndVerifyDatasets(t *testing.T) {
+	dir := t.TempDir()
+	privFile, pubFile := writeTestKeys(t, dir, "signer")
+	_, otherPubFile := writeTestKeys(t, dir, "other")
+
+	key, err := LoadSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+	trusted, err := LoadTrustedKeys(pubFile)
+	if err != nil {
+		t.Fatalf("LoadTrustedKeys failed: %v", err)
+	}
+	other, err := LoadTrustedKeys(otherPubFile)
+	if err != nil {
+		t.Fatalf("LoadTrustedKeys failed: %v", err)
+	}
+
+	unsigned, signed := signedTestDatasets(t, key)
+
+	signatures, err := VerifyDatasets(bytes.NewReader(signed), append(other, trusted...))
+	if err != nil {
+		t.Fatalf("VerifyDatasets failed: %v", err)
+	}
+	if len(signatures) != 2 || !signatures[0].Verified || !bytes.Equal(signatures[0].KeyID, KeyID(trusted[0])) {
+		t.Errorf("Unexpected signatures %+v", signatures)
+	}
+
+	// Signing an already signed file fails
+	if _, err := SignDatasets(bytes.NewReader(signed), &bytes.Buffer{}, key); err == nil || !strings.Contains(err.Error(), "already signed") {
+		t.Errorf("Expected already signed error, got: %v", err)
+	}
+
+	tampered := bytes.Clone(signed)
+	idx := bytes.Index(tampered, []byte("dnsmag "))
+	tampered[idx] = 'D'
+
+	tests := []struct {
+		name    string
+		data    []byte
+		trusted []ed25519.PublicKey
+		errMsg  string
+	}{
+		{"untrusted key", signed, other, "signed by untrusted key"},
+		{"tampered payload", tampered, trusted, "invalid signature"},
+		{"unsigned", unsigned, trusted, "dataset 1 is not signed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyDatasets(bytes.NewReader(tt.data), tt.trusted)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestDatasetSequence_Signed(t *testing.T) {
+	dir := t.TempDir()
+	privFile, pubFile := writeTestKeys(t, dir, "signer")
+	key, err := LoadSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+	trusted, err := LoadTrustedKeys(pubFile)
+	if err != nil {
+		t.Fatalf("LoadTrustedKeys failed: %v", err)
+	}
+
+	unsigned, signed := signedTestDatasets(t, key)
+
+	// Signed datasets are accepted without trusted keys, but not verified
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(signed[:len(signed)/2+1]), "<a#%d>"); err == nil {
+		t.Error("Expected error loading truncated signed sequence")
+	}
+	seq = NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(signed), "<a#%d>"); err != nil {
+		t.Fatalf("Loading signed datasets failed: %v", err)
+	}
+	if seq.Count != 2 || seq.Result.AllQueriesCount != 8 {
+		t.Errorf("Expected 2 datasets with 8 queries, got %d datasets with %d queries", seq.Count, seq.Result.AllQueriesCount)
+	}
+
+	// A single signed dataset keeps its signature, shown in the statistics
+	seq = NewDatasetSequence(0, nil, false, nil)
+	seq.RequireSignatures(trusted)
+	var single bytes.Buffer
+	if _, err := SignDatasets(bytes.NewReader(mustMarshalDataset(t, newMetadataDataset(t, "", nil))), &single, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+	if err := seq.LoadDNSMagSequenceFromReader(&single, "<b#%d>"); err != nil {
+		t.Fatalf("Loading signed dataset failed: %v", err)
+	}
+	var stats bytes.Buffer
+	if err := OutputDatasetStats(&stats, seq.Result, false); err != nil {
+		t.Fatalf("OutputDatasetStats failed: %v", err)
+	}
+	if !strings.Contains(stats.String(), "Signed by") || !strings.Contains(stats.String(), "(verified)") {
+		t.Errorf("Expected verified signer in statistics:\n%s", stats.String())
+	}
+
+	// With trusted keys, unsigned datasets are rejected
+	seq = NewDatasetSequence(0, nil, false, nil)
+	seq.RequireSignatures(trusted)
+	err = seq.LoadDNSMagSequenceFromReader(bytes.NewReader(unsigned), "<c#%d>")
+	if err == nil || !strings.Contains(err.Error(), "dataset <c#1> is not signed") {
+		t.Errorf("Expected unsigned dataset error, got: %v", err)
+	}
+}
@@ -5,6 +5,7 @@ package internal
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
@@ -12,34 +13,31 @@ import (
 	"strings"
 )
 
-func LoadCSVFromReader(reader io.Reader, collector *Collector, filetype string) error {
+// LoadCSVFromReader loads CSV or TSV records from a reader into a collector. Loading stops with the
+// context's error if the context is cancelled.
+func LoadCSVFromReader(ctx context.Context, reader io.Reader, collector *Collector, filetype string) error {
 	reader1, err := getReader(reader)
 	if err != nil {
 		return fmt.Errorf("failed to get reader: %w", err)
 	}
 
-	// choose delimiter: if filetype == "tsv" use tab, otherwise default to comma
-	delimiter := ','
-	if filetype == "tsv" {
-		delimiter = '\t'
-	}
-
-	csvReader := csv.NewReader(reader1)
-	csvReader.Comment = '#'
-	csvReader.TrimLeadingSpace = true
-	csvReader.FieldsPerRecord = -1 // allow either 2 or 3 fields per record
-	csvReader.Comma = delimiter    // use configured or overridden delimiter
-	csvReader.LazyQuotes = true    // be forgiving with quotes
+	csvReader := newCSVReader(reader1, filetype)
 
 	firstLine := true
 
 	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
 		record, err := csvReader.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			collector.invalidRecordCount++
+			collector.countInvalidRecord()
 			continue
 		}
 
@@ -53,6 +51,24 @@ func LoadCSVFromReader(reader io.Reader, collector *Collector, filetype string)
 	return nil
 }
 
+// newCSVReader creates a CSV reader for the record format used in CSV and TSV input files
+func newCSVReader(reader io.Reader, filetype string) *csv.Reader {
+	// choose delimiter: if filetype == "tsv" use tab, otherwise default to comma
+	delimiter := ','
+	if filetype == "tsv" {
+		delimiter = '\t'
+	}
+
+	csvReader := csv.NewReader(reader)
+	csvReader.Comment = '#'
+	csvReader.TrimLeadingSpace = true
+	csvReader.FieldsPerRecord = -1 // allow either 2 or 3 fields per record
+	csvReader.Comma = delimiter    // use configured or overridden delimiter
+	csvReader.LazyQuotes = true    // be forgiving with quotes
+
+	return csvReader
+}
+
 // Get a reader from a file. If the file is gzipped, it will return a gzip reader.
 // This code is borrowed from the gopacket library (pcapgo).
 func getReader(reader io.Reader) (io.Reader, error) {
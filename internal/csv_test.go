@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"os"
 	"strings"
 	"testing"
@@ -25,7 +26,7 @@ func TestLoadCSVFromReader(t *testing.T) {
 	verbose := false
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, verbose, &testDate, timing)
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -68,7 +69,7 @@ func TestLoadCSVFromReader_VerboseMode(t *testing.T) {
 	verbose := true
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, verbose, &testDate, timing)
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -106,7 +107,7 @@ func TestLoadCSVFromReader_InvalidRecord(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, false, nil, timing)
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err == nil {
 		t.Error("Expected error for invalid CSV record, got nil")
 	}
@@ -149,7 +150,7 @@ func TestLoadCSVFile_InvalidFile(t *testing.T) {
 
 			reader := readerFromFile(t, tmpFile.Name())
 
-			err = LoadCSVFromReader(reader, collector, "csv")
+			err = LoadCSVFromReader(context.Background(), reader, collector, "csv")
 			if err == nil {
 				t.Error("Expected error for invalid CSV file, got nil")
 				return
@@ -244,7 +245,7 @@ func TestLoadCSVFromReader_CompleteDatasetVerification(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, true, &testDate, timing)
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -288,7 +289,7 @@ func TestLoadCSVFromReader_MixedValidInvalidRecords(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, false, nil, timing)
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -311,7 +312,7 @@ func TestLoadCSVFromReader_TrailingDot(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, false, nil, timing)
-	err := LoadCSVFromReader(reader, collector, "csv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "csv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -334,7 +335,7 @@ func TestLoadCSVFromReader_TestTabSeparated(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, false, nil, timing)
-	err := LoadCSVFromReader(reader, collector, "tsv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "tsv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -420,7 +421,7 @@ func TestLoadCSVFromReader_TestTabSeparatedStrangeDomain(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, false, nil, timing)
-	err := LoadCSVFromReader(reader, collector, "tsv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "tsv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -451,7 +452,7 @@ func TestLoadCSVFile_TSV_Normal_data(t *testing.T) {
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 0, false, nil, timing)
 
-	if err := LoadCSVFromReader(reader, collector, "tsv"); err != nil {
+	if err := LoadCSVFromReader(context.Background(), reader, collector, "tsv"); err != nil {
 		t.Fatalf("LoadCSVFile failed for %s: %v", path, err)
 	}
 
@@ -474,7 +475,7 @@ func TestLoadCSVFile_TSV_Strange_data(t *testing.T) {
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 0, false, nil, timing)
 
-	if err := LoadCSVFromReader(reader, collector, "tsv"); err != nil {
+	if err := LoadCSVFromReader(context.Background(), reader, collector, "tsv"); err != nil {
 		t.Fatalf("LoadCSVFile failed for %s: %v", path, err)
 	}
 
@@ -495,7 +496,7 @@ func TestLoadCSVFromReader_TestFirstLineIsHeader(t *testing.T) {
 
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 100000, false, nil, timing)
-	err := LoadCSVFromReader(reader, collector, "tsv")
+	err := LoadCSVFromReader(context.Background(), reader, collector, "tsv")
 	if err != nil {
 		t.Fatalf("LoadCSVFromReader failed: %v", err)
 	}
@@ -3,6 +3,7 @@
 package internal
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"math"
 	"net/netip"
@@ -23,6 +24,11 @@ type TimeWrapper struct {
 	time.Time
 }
 
+// TimestampWrapper wraps time.Time to provide custom CBOR marshaling as tag 1 (epoch-based date/time)
+type TimestampWrapper struct {
+	time.Time
+}
+
 // Main data structure for storing domain statistics. This matches the structure of the CBOR files.
 type MagnitudeDataset struct {
 	Version             uint16                    `cbor:"version"`
@@ -33,10 +39,16 @@ type MagnitudeDataset struct {
 	AllClientsCount     uint64                    `cbor:"all_clients_count"` // Cardinality of GlobalHll
 	AllQueriesCount     uint64                    `cbor:"all_queries_count"`
 	Domains             map[DomainName]domainData `cbor:"domains"`
+	Partial             bool                      `cbor:"partial,omitempty"`   // Set if collection was interrupted
+	LastFile            string                    `cbor:"last_file,omitempty"` // Input file being processed when interrupted
+	Metadata            *DatasetMetadata          `cbor:"metadata,omitempty"`  // Provenance of the dataset (version 2)
 	extraAllClients     map[netip.Addr]struct{}   // All clients, only used when printing stats in collect command
 	extraV6Clients      map[netip.Addr]struct{}   // IPv6 clients, only used when printing stats in collect command
 	extraAllDomains     map[DomainName]struct{}   // All domains before any truncation
 	extraSourceFilename string                    // Source filename when loaded from file
+	extraAggregated     bool                      // Set on the result of AggregateDatasets, until saved
+	extraSignature      *DatasetSignature         // Signature, when loaded from a signed file
+	extraDigest         [sha256.Size]byte         // SHA-256 of the encoded dataset, when loaded from file
 }
 
 // Per-domain data
@@ -54,19 +66,22 @@ type DomainMagnitude struct {
 	DomainHll *domainData
 }
 
+// HLL settings used for all HLLs, recorded in the dataset metadata
+var hllSettings = hll.Settings{
+	Log2m:             14, // chosen for < 1% error rate (~0.81%)
+	Regwidth:          5,  // 5 bits per register, should be fine for number of clients < 10**10
+	ExplicitThreshold: 0,
+	SparseEnabled:     true,
+}
+
 func InitStats() error {
 	// initialise the HLL defaults to not have to specify them every time we create a new HLL
-	return hll.Defaults(hll.Settings{
-		Log2m:             14, // chosen for < 1% error rate (~0.81%)
-		Regwidth:          5,  // 5 bits per register, should be fine for number of clients < 10**10
-		ExplicitThreshold: 0,
-		SparseEnabled:     true,
-	})
+	return hll.Defaults(hllSettings)
 }
 
 func newDataset(date *time.Time) MagnitudeDataset {
 	dataset := MagnitudeDataset{
-		Version:             1,
+		Version:             DatasetVersion,
 		Identifier:          uuid.New().String(),
 		Generator:           fmt.Sprintf("dnsmag %s", Version),
 		AllClientsHll:       &HLLWrapper{Hll: &hll.Hll{}},
@@ -103,13 +118,16 @@ func (dataset *MagnitudeDataset) SetDate(date *time.Time) {
 	dataset.Date = &TimeWrapper{Time: dateOnly}
 }
 
+// magnitude returns the magnitude of a domain queried by numSrcIPs of the clients in the dataset
+func (dataset *MagnitudeDataset) magnitude(numSrcIPs uint64) float64 {
+	return (math.Log(float64(numSrcIPs)) / math.Log(float64(dataset.AllClientsCount))) * 10
+}
+
 func (dataset *MagnitudeDataset) SortedByMagnitude() []DomainMagnitude {
 	var sorted []DomainMagnitude
 
 	for name, this := range dataset.Domains {
-		numSrcIPs := this.ClientsCount
-
-		magnitude := (math.Log(float64(numSrcIPs)) / math.Log(float64(dataset.AllClientsCount))) * 10
+		magnitude := dataset.magnitude(this.ClientsCount)
 
 		sorted = append(sorted, DomainMagnitude{name, magnitude, &this})
 	}
@@ -133,6 +151,16 @@ func (dataset *MagnitudeDataset) SortedByMagnitude() []DomainMagnitude {
 	return sorted
 }
 
+// rankedByMagnitude returns the domains in order of rank: by descending magnitude, and by name for equal
+// magnitudes, like SortedByMagnitude
+func (dataset *MagnitudeDataset) rankedByMagnitude() []DomainMagnitude {
+	sorted := dataset.SortedByMagnitude()
+	slices.SortStableFunc(sorted, func(a, b DomainMagnitude) int {
+		return int(b.Magnitude*1000) - int(a.Magnitude*1000)
+	})
+	return sorted
+}
+
 // keeps only the top N domains by magnitude
 func (dataset *MagnitudeDataset) Truncate(maxDomains int) {
 	if maxDomains <= 0 || len(dataset.Domains) <= maxDomains {
@@ -244,9 +272,25 @@ func AggregateDatasets(datasets []MagnitudeDataset) (MagnitudeDataset, error) {
 			e := fmt.Errorf("date mismatch: dataset %s has date %s, expected %s", dataset.extraSourceFilename, dataset.DateString(), datasets[0].DateString())
 			return MagnitudeDataset{}, e
 		}
+		if period := dataset.period(); period != nil {
+			return MagnitudeDataset{}, fmt.Errorf("dataset %s is a rollup of the period %s, and can only be aggregated into a rollup",
+				dataset.extraSourceFilename, period)
+		}
 	}
 
-	res := newDataset(&datasets[0].Date.Time)
+	return aggregateDatasets(datasets, datasets[0].Date.Time)
+}
+
+// aggregateDatasets aggregates datasets into a new dataset with the given date
+func aggregateDatasets(datasets []MagnitudeDataset, date time.Time) (MagnitudeDataset, error) {
+	res := newDataset(&date)
+	res.extraAggregated = true
+
+	metadata, err := mergeMetadata(datasets)
+	if err != nil {
+		return MagnitudeDataset{}, err
+	}
+	res.Metadata = metadata
 
 	// Aggregate global HLL
 	for _, dataset := range datasets {
@@ -271,6 +315,7 @@ func AggregateDatasets(datasets []MagnitudeDataset) (MagnitudeDataset, error) {
 	// Aggregate domain-level statistics
 	for _, dataset := range datasets {
 		res.AllQueriesCount += dataset.AllQueriesCount
+		res.Partial = res.Partial || dataset.Partial
 
 		for domain, domainData := range dataset.Domains {
 			// Fetch or initialise domainHll
@@ -506,8 +506,8 @@ func TestAggregateDatasets_Success(t *testing.T) {
 		t.Errorf("Expected date %v, got %v", date, result.Date.Time)
 	}
 
-	if result.Version != 1 {
-		t.Errorf("Expected version 1, got %d", result.Version)
+	if result.Version != DatasetVersion {
+		t.Errorf("Expected version %d, got %d", DatasetVersion, result.Version)
 	}
 }
 
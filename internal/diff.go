@@ -0,0 +1,269 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/segmentio/go-hll"
+)
+
+// ClientOverlap is the estimated overlap of two client populations, from the union of their HLLs and
+// inclusion-exclusion: |A ∩ B| = |A| + |B| - |A ∪ B|
+type ClientOverlap struct {
+	Union        uint64  `json:"union"`
+	Intersection uint64  `json:"intersection"`
+	OldOnly      uint64  `json:"oldOnly"`
+	NewOnly      uint64  `json:"newOnly"`
+	Jaccard      float64 `json:"jaccard"` // Intersection divided by union
+}
+
+// DomainState is the state of a domain in one of the datasets of a diff
+type DomainState struct {
+	Rank          int     `json:"rank"` // 1 for the domain with the highest magnitude
+	Magnitude     float64 `json:"magnitude"`
+	UniqueClients uint64  `json:"uniqueClients"`
+	QueryVolume   uint64  `json:"queryVolume"`
+}
+
+// DomainDiff is the change of a domain between two datasets. Old or New is nil if the domain is
+// not in that dataset.
+type DomainDiff struct {
+	Domain          string         `json:"domain"`
+	Old             *DomainState   `json:"old"`
+	New             *DomainState   `json:"new"`
+	MagnitudeChange float64        `json:"magnitudeChange"`
+	ClientsChange   int64          `json:"clientsChange"`
+	QueriesChange   int64          `json:"queriesChange"`
+	TopChange       string         `json:"topChange,omitempty"`     // "entered" or "left" the top-N
+	ClientOverlap   *ClientOverlap `json:"clientOverlap,omitempty"` // Only for domains in both datasets
+}
+
+// DatasetDiff is the difference between two datasets
+type DatasetDiff struct {
+	Old           DatasetStats  `json:"old"`
+	New           DatasetStats  `json:"new"`
+	ClientOverlap ClientOverlap `json:"clientOverlap"`
+	Top           int           `json:"top"`     // Number of domains in the top-N
+	Entered       []string      `json:"entered"` // Domains entering the top-N
+	Left          []string      `json:"left"`    // Domains leaving the top-N
+	Domains       []DomainDiff  `json:"domains"` // Sorted by the size of the magnitude change, largest first
+}
+
+// estimateOverlap estimates the overlap of the clients counted in two HLLs
+func estimateOverlap(oldHll, newHll *HLLWrapper) (ClientOverlap, error) {
+	union, err := hll.FromBytes(oldHll.ToBytes())
+	if err != nil {
+		return ClientOverlap{}, err
+	}
+	if err := union.StrictUnion(*newHll.Hll); err != nil {
+		return ClientOverlap{}, err
+	}
+
+	oldCount, newCount := oldHll.Cardinality(), newHll.Cardinality()
+	overlap := ClientOverlap{Union: union.Cardinality()}
+	// The estimates have errors, so the union can be estimated smaller than either set, or larger than
+	// both together
+	overlap.Union = min(max(overlap.Union, oldCount, newCount), oldCount+newCount)
+	overlap.Intersection = oldCount + newCount - overlap.Union
+	overlap.OldOnly = oldCount - overlap.Intersection
+	overlap.NewOnly = newCount - overlap.Intersection
+	if overlap.Union > 0 {
+		overlap.Jaccard = float64(overlap.Intersection) / float64(overlap.Union)
+	}
+	return overlap, nil
+}
+
+// domainStates returns the state of every domain in a dataset, ranked by magnitude
+func domainStates(dataset MagnitudeDataset) map[DomainName]*DomainState {
+	ranked := dataset.rankedByMagnitude()
+	res := make(map[DomainName]*DomainState, len(ranked))
+	for i, dm := range ranked {
+		res[dm.Domain] = &DomainState{
+			Rank:          i + 1,
+			Magnitude:     dm.Magnitude,
+			UniqueClients: dm.DomainHll.ClientsCount,
+			QueryVolume:   dm.DomainHll.QueriesCount,
+		}
+	}
+	return res
+}
+
+// DiffDatasets compares two datasets of any dates: per-domain changes in clients, queries and magnitude,
+// domains entering or leaving the top domains by magnitude and the estimated overlap of the clients
+func DiffDatasets(oldDataset, newDataset MagnitudeDataset, top int) (DatasetDiff, error) {
+	diff := DatasetDiff{
+		Old:     datasetStats(oldDataset),
+		New:     datasetStats(newDataset),
+		Top:     top,
+		Entered: []string{},
+		Left:    []string{},
+		Domains: []DomainDiff{},
+	}
+
+	overlap, err := estimateOverlap(oldDataset.AllClientsHll, newDataset.AllClientsHll)
+	if err != nil {
+		return DatasetDiff{}, fmt.Errorf("failed to estimate client overlap: %w", err)
+	}
+	diff.ClientOverlap = overlap
+
+	oldStates, newStates := domainStates(oldDataset), domainStates(newDataset)
+	inTop := func(state *DomainState) bool {
+		return state != nil && top > 0 && state.Rank <= top
+	}
+
+	domains := make(map[DomainName]struct{})
+	for domain := range oldStates {
+		domains[domain] = struct{}{}
+	}
+	for domain := range newStates {
+		domains[domain] = struct{}{}
+	}
+
+	for domain := range domains {
+		d := DomainDiff{Domain: string(domain), Old: oldStates[domain], New: newStates[domain]}
+		var before, after DomainState
+		if d.Old != nil {
+			before = *d.Old
+		}
+		if d.New != nil {
+			after = *d.New
+		}
+		d.MagnitudeChange = after.Magnitude - before.Magnitude
+		d.ClientsChange = int64(after.UniqueClients) - int64(before.UniqueClients)
+		d.QueriesChange = int64(after.QueryVolume) - int64(before.QueryVolume)
+
+		if d.Old != nil && d.New != nil {
+			overlap, err := estimateOverlap(oldDataset.Domains[domain].Hll, newDataset.Domains[domain].Hll)
+			if err != nil {
+				return DatasetDiff{}, fmt.Errorf("failed to estimate client overlap for domain %s: %w", domain, err)
+			}
+			d.ClientOverlap = &overlap
+		}
+
+		switch {
+		case inTop(d.New) && !inTop(d.Old):
+			d.TopChange = "entered"
+			diff.Entered = append(diff.Entered, d.Domain)
+		case inTop(d.Old) && !inTop(d.New):
+			d.TopChange = "left"
+			diff.Left = append(diff.Left, d.Domain)
+		}
+		diff.Domains = append(diff.Domains, d)
+	}
+
+	slices.Sort(diff.Entered)
+	slices.Sort(diff.Left)
+	slices.SortFunc(diff.Domains, func(a, b DomainDiff) int {
+		if c := cmp.Compare(math.Abs(b.MagnitudeChange), math.Abs(a.MagnitudeChange)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+
+	return diff, nil
+}
+
+// changeAsString returns a string with a count before and after, and the percent change
+// e.g. "3906 -> 4102 (+5.02%)"
+func changeAsString(before, after uint64) string {
+	if before == 0 {
+		return fmt.Sprintf("%d -> %d", before, after)
+	}
+	change := (float64(after) - float64(before)) / float64(before) * 100
+	return fmt.Sprintf("%d -> %d (%+.2f%%)", before, after, change)
+}
+
+// joinOrNone returns a comma separated list of domains, or "none"
+func joinOrNone(domains []string) string {
+	if len(domains) == 0 {
+		return "none"
+	}
+	return strings.Join(domains, ", ")
+}
+
+// formatDomainDiff formats the change of a domain as one line
+func formatDomainDiff(d DomainDiff, top int) string {
+	var before, after DomainState
+	if d.Old != nil {
+		before = *d.Old
+	}
+	if d.New != nil {
+		after = *d.New
+	}
+
+	var notes []string
+	switch {
+	case d.Old == nil:
+		notes = append(notes, "new")
+	case d.New == nil:
+		notes = append(notes, "gone")
+	}
+	if d.TopChange != "" {
+		notes = append(notes, fmt.Sprintf("%s top %d", d.TopChange, top))
+	}
+	if d.ClientOverlap != nil {
+		notes = append(notes, fmt.Sprintf("client overlap %.1f%%", d.ClientOverlap.Jaccard*100))
+	}
+
+	line := fmt.Sprintf("%-33s magnitude: %.3f -> %.3f (%+.3f), queries %s, clients %s",
+		d.Domain,
+		before.Magnitude,
+		after.Magnitude,
+		d.MagnitudeChange,
+		changeAsString(before.QueryVolume, after.QueryVolume),
+		changeAsString(before.UniqueClients, after.UniqueClients),
+	)
+	if len(notes) > 0 {
+		line += " [" + strings.Join(notes, ", ") + "]"
+	}
+	return line
+}
+
+// OutputDatasetDiff formats and prints the difference between two datasets as a table, followed by
+// the changed domains
+func OutputDatasetDiff(w io.Writer, diff DatasetDiff) error {
+	overlap := diff.ClientOverlap
+	table := []TableRow{
+		{"Dataset difference", ""},
+		{"Date", fmt.Sprintf("%s -> %s", diff.Old.Date, diff.New.Date)},
+		{"Id", fmt.Sprintf("%s -> %s", diff.Old.ID, diff.New.ID)},
+		{"Total queries", changeAsString(diff.Old.TotalQueryVolume, diff.New.TotalQueryVolume)},
+		{"Total unique source IPs", changeAsString(diff.Old.TotalUniqueClients, diff.New.TotalUniqueClients)},
+		{"Total domains", changeAsString(diff.Old.TotalDomainCount, diff.New.TotalDomainCount)},
+		{"Clients in both (estimated)", fmt.Sprintf("%d (%.1f%% of %d in either)", overlap.Intersection, overlap.Jaccard*100, overlap.Union)},
+		{"Clients only in old (estimated)", fmt.Sprintf("%d", overlap.OldOnly)},
+		{"Clients only in new (estimated)", fmt.Sprintf("%d", overlap.NewOnly)},
+	}
+	if diff.Top > 0 {
+		table = append(table,
+			TableRow{fmt.Sprintf("Entered top %d", diff.Top), joinOrNone(diff.Entered)},
+			TableRow{fmt.Sprintf("Left top %d", diff.Top), joinOrNone(diff.Left)},
+		)
+	}
+	if err := printTable(w, table); err != nil {
+		return err
+	}
+
+	if len(diff.Domains) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Domain changes:")
+		for _, d := range diff.Domains {
+			fmt.Fprintln(w, formatDomainDiff(d, diff.Top))
+		}
+	}
+	return nil
+}
+
+// OutputDatasetDiffJSON prints the difference between two datasets as JSON
+func OutputDatasetDiffJSON(w io.Writer, diff DatasetDiff) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(diff)
+}
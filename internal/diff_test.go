@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientRange is a range of client numbers querying a domain
+type clientRange struct {
+	first, last int
+}
+
+// newDiffDataset returns a dataset with domains queried by ranges of numbered clients
+func newDiffDataset(t *testing.T, day int, domains map[string]clientRange) MagnitudeDataset {
+	t.Helper()
+
+	date := time.Date(2026, 9, day, 0, 0, 0, 0, time.UTC)
+	dataset := newDataset(&date)
+	for domain, clients := range domains {
+		for c := clients.first; c <= clients.last; c++ {
+			src, err := NewIPAddress(netip.AddrFrom4([4]byte{10, byte(c >> 8), byte(c), 1}))
+			if err != nil {
+				t.Fatalf("NewIPAddress failed: %v", err)
+			}
+			if err := dataset.updateStats(domain, src, 1, false); err != nil {
+				t.Fatalf("updateStats failed: %v", err)
+			}
+		}
+	}
+	dataset.finaliseStats()
+	return dataset
+}
+
+// withinPercent checks if an estimate is within percent of the expected value
+func withinPercent(estimate uint64, expected, percent float64) bool {
+	return float64(estimate) >= expected*(1-percent/100) && float64(estimate) <= expected*(1+percent/100)
+}
+
+func TestDiffDatasets(t *testing.T) {
+	oldDataset := newDiffDataset(t, 1, map[string]clientRange{
+		"com": {0, 1999},
+		"org": {0, 999},
+		"net": {0, 9},
+	})
+	newDataset := newDiffDataset(t, 2, map[string]clientRange{
+		"com": {1000, 2999},
+		"net": {1000, 2499},
+		"se":  {2000, 2499},
+	})
+
+	diff, err := DiffDatasets(oldDataset, newDataset, 2)
+	if err != nil {
+		t.Fatalf("DiffDatasets failed: %v", err)
+	}
+
+	if diff.Old.Date != "2026-09-01" || diff.New.Date != "2026-09-02" {
+		t.Errorf("Expected dates 2026-09-01 and 2026-09-02, got %s and %s", diff.Old.Date, diff.New.Date)
+	}
+
+	// Clients 1000-1999 are in both datasets, of 0-2999 in either
+	overlap := diff.ClientOverlap
+	if !withinPercent(overlap.Union, 3000, 3) || !withinPercent(overlap.Intersection, 1000, 10) {
+		t.Errorf("Expected union ~3000 and intersection ~1000, got %+v", overlap)
+	}
+	if !withinPercent(overlap.OldOnly, 1000, 10) || !withinPercent(overlap.NewOnly, 1000, 10) {
+		t.Errorf("Expected ~1000 clients only in each dataset, got %+v", overlap)
+	}
+
+	// Top 2 is com and org in the old dataset, and com and net in the new
+	if !slices.Equal(diff.Entered, []string{"net"}) {
+		t.Errorf("Expected net to enter the top 2, got %v", diff.Entered)
+	}
+	if !slices.Equal(diff.Left, []string{"org"}) {
+		t.Errorf("Expected org to leave the top 2, got %v", diff.Left)
+	}
+
+	domains := make(map[string]DomainDiff)
+	for _, d := range diff.Domains {
+		domains[d.Domain] = d
+	}
+	if len(domains) != 4 {
+		t.Fatalf("Expected 4 domains, got %d", len(domains))
+	}
+	if d := domains["org"]; d.New != nil || d.Old == nil || d.ClientsChange != -int64(d.Old.UniqueClients) || d.TopChange != "left" {
+		t.Errorf("Unexpected diff for org: %+v", d)
+	}
+	if d := domains["se"]; d.Old != nil || d.New == nil || d.ClientOverlap != nil || d.TopChange != "" {
+		t.Errorf("Unexpected diff for se: %+v", d)
+	}
+	if d := domains["net"]; d.QueriesChange != 1490 || d.ClientOverlap == nil || !withinPercent(d.ClientOverlap.NewOnly, 1500, 5) || d.TopChange != "entered" {
+		t.Errorf("Unexpected diff for net: %+v", d)
+	}
+	if d := domains["com"]; d.ClientOverlap == nil || !withinPercent(d.ClientOverlap.Intersection, 1000, 10) {
+		t.Errorf("Unexpected diff for com: %+v", d)
+	}
+
+	for i := 1; i < len(diff.Domains); i++ {
+		if math.Abs(diff.Domains[i].MagnitudeChange) > math.Abs(diff.Domains[i-1].MagnitudeChange) {
+			t.Errorf("Domains not sorted by magnitude change: %s before %s", diff.Domains[i-1].Domain, diff.Domains[i].Domain)
+		}
+	}
+
+	// Without a top-N, no domains enter or leave it
+	diff, err = DiffDatasets(oldDataset, newDataset, 0)
+	if err != nil {
+		t.Fatalf("DiffDatasets failed: %v", err)
+	}
+	if len(diff.Entered) != 0 || len(diff.Left) != 0 {
+		t.Errorf("Expected no domains entering or leaving, got %v and %v", diff.Entered, diff.Left)
+	}
+}
+
+func TestDiffDatasets_RankTies(t *testing.T) {
+	// net and org have the same magnitude, and are ranked by name below com
+	dataset := newDiffDataset(t, 1, map[string]clientRange{
+		"com": {0, 99},
+		"org": {0, 9},
+		"net": {0, 9},
+	})
+
+	diff, err := DiffDatasets(dataset, dataset, 2)
+	if err != nil {
+		t.Fatalf("DiffDatasets failed: %v", err)
+	}
+	ranks := make(map[string]int)
+	for _, d := range diff.Domains {
+		ranks[d.Domain] = d.New.Rank
+	}
+	if ranks["com"] != 1 || ranks["net"] != 2 || ranks["org"] != 3 {
+		t.Errorf("Expected ranks com=1, net=2 and org=3, got %v", ranks)
+	}
+	if len(diff.Entered) != 0 || len(diff.Left) != 0 {
+		t.Errorf("Expected no domains entering or leaving, got %v and %v", diff.Entered, diff.Left)
+	}
+}
+
+func TestDiffDatasets_DisjointClients(t *testing.T) {
+	// The union of these disjoint HLLs is estimated larger than the sum of their estimates
+	oldDataset := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 161}})
+	newDataset := newDiffDataset(t, 2, map[string]clientRange{"com": {162, 519}})
+
+	diff, err := DiffDatasets(oldDataset, newDataset, 10)
+	if err != nil {
+		t.Fatalf("DiffDatasets failed: %v", err)
+	}
+	oldCount, newCount := oldDataset.AllClientsHll.Cardinality(), newDataset.AllClientsHll.Cardinality()
+	expected := ClientOverlap{Union: oldCount + newCount, OldOnly: oldCount, NewOnly: newCount}
+	if diff.ClientOverlap != expected {
+		t.Errorf("Expected overlap %+v, got %+v", expected, diff.ClientOverlap)
+	}
+	if len(diff.Domains) != 1 || diff.Domains[0].ClientOverlap == nil || *diff.Domains[0].ClientOverlap != expected {
+		t.Errorf("Expected overlap %+v for com, got %+v", expected, diff.Domains)
+	}
+}
+
+func TestOutputDatasetDiff(t *testing.T) {
+	oldDataset := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 99}, "org": {0, 9}})
+	newDataset := newDiffDataset(t, 2, map[string]clientRange{"com": {0, 99}, "net": {100, 149}})
+
+	diff, err := DiffDatasets(oldDataset, newDataset, 1)
+	if err != nil {
+		t.Fatalf("DiffDatasets failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := OutputDatasetDiff(&buf, diff); err != nil {
+		t.Fatalf("OutputDatasetDiff failed: %v", err)
+	}
+	for _, expected := range []string{
+		"Date                            : 2026-09-01 -> 2026-09-02",
+		"Total queries                   : 110 -> 150 (+36.36%)",
+		"Clients in both (estimated)     : 100 (66.7% of 150 in either)",
+		"Entered top 1                   : none",
+		"queries 10 -> 0 (-100.00%), clients 11 -> 0 (-100.00%) [gone]",
+		"queries 0 -> 50, clients 0 -> 51 [new]",
+		"queries 100 -> 100 (+0.00%), clients 100 -> 100 (+0.00%) [client overlap 100.0%]",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in output:\n%s", expected, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := OutputDatasetDiffJSON(&buf, diff); err != nil {
+		t.Fatalf("OutputDatasetDiffJSON failed: %v", err)
+	}
+	var decoded DatasetDiff
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to parse JSON diff: %v\n%s", err, buf.String())
+	}
+	if decoded.ClientOverlap != diff.ClientOverlap || len(decoded.Domains) != 3 || decoded.Old.ID != oldDataset.Identifier {
+		t.Errorf("Unexpected JSON diff:\n%s", buf.String())
+	}
+}
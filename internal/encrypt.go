@@ -0,0 +1,273 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE (RFC 9052/9053) constants used for encrypted datasets
+const (
+	coseEncryptTag      = 96
+	coseHeaderIV        = 5
+	coseHeaderEphemeral = -1
+	coseAlgA256GCM      = 3
+	coseAlgECDHESHKDF   = -25
+	coseKeyKty          = 1
+	coseKeyCrv          = -1
+	coseKeyX            = -2
+	coseKtyOKP          = 1
+	coseCrvX25519       = 4
+)
+
+// coseEncryptPrefix is the start of a CBOR item with tag 96
+var coseEncryptPrefix = []byte{0xd8, coseEncryptTag}
+
+// coseEncrypt is a COSE_Encrypt structure, without its tag
+type coseEncrypt struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[int]any
+	Ciphertext  []byte
+	Recipients  []coseRecipient
+}
+
+// coseRecipient is a COSE_recipient structure
+type coseRecipient struct {
+	_           struct{} `cbor:",toarray"`
+	Protected   []byte
+	Unprotected map[int]any
+	Ciphertext  []byte
+}
+
+// LoadRecipientKey loads an X25519 public key to encrypt datasets to from a PEM encoded file, such as one
+// created with "openssl pkey -in key.pem -pubout".
+func LoadRecipientKey(filename string) (*ecdh.PublicKey, error) {
+	data, err := os.ReadFile(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("no PEM encoded public key found in %s", filename)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key in %s: %w", filename, err)
+	}
+	xKey, ok := key.(*ecdh.PublicKey)
+	if !ok || xKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("public key in %s is not an X25519 key", filename)
+	}
+	return xKey, nil
+}
+
+// LoadIdentity loads an X25519 private key to decrypt datasets with from a PEM encoded PKCS #8 file, such as
+// one created with "openssl genpkey -algorithm x25519".
+func LoadIdentity(filename string) (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("no PEM encoded private key found in %s", filename)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key in %s: %w", filename, err)
+	}
+	xKey, ok := key.(*ecdh.PrivateKey)
+	if !ok || xKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("private key in %s is not an X25519 key", filename)
+	}
+	return xKey, nil
+}
+
+// isEncrypted checks if a CBOR item is a COSE_Encrypt structure
+func isEncrypted(item []byte) bool {
+	return bytes.HasPrefix(item, coseEncryptPrefix)
+}
+
+// deriveContentKey derives the content encryption key from an ECDH shared secret (RFC 9053 section 6.3.1)
+func deriveContentKey(secret, recipientProtected []byte) ([]byte, error) {
+	kdfContext, err := cbor.Marshal([]any{
+		coseAlgA256GCM,
+		[]any{nil, nil, nil}, // PartyUInfo
+		[]any{nil, nil, nil}, // PartyVInfo
+		[]any{256, recipientProtected},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hkdfSHA256(secret, kdfContext), nil
+}
+
+// hkdfSHA256 derives a 32 byte key with HKDF-SHA-256 (RFC 5869) without salt
+func hkdfSHA256(secret, info []byte) []byte {
+	extract := hmac.New(sha256.New, make([]byte, sha256.Size))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	// A single block of output is enough for a 32 byte key
+	expand := hmac.New(sha256.New, prk)
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// encStructure returns the additional authenticated data of a COSE_Encrypt
+func encStructure(protected []byte) ([]byte, error) {
+	return cbor.Marshal([]any{"Encrypt", protected, []byte{}})
+}
+
+// newGCM returns an AES-256-GCM cipher for a key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptItem wraps a CBOR item (e.g. an encoded dataset) in a COSE_Encrypt structure for an X25519 recipient,
+// using ECDH-ES with HKDF-SHA-256 key agreement and AES-256-GCM.
+func encryptItem(plaintext []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+
+	protected, err := coseEncMode.Marshal(map[int]any{coseHeaderAlg: coseAlgA256GCM})
+	if err != nil {
+		return nil, err
+	}
+	recipientProtected, err := coseEncMode.Marshal(map[int]any{coseHeaderAlg: coseAlgECDHESHKDF})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveContentKey(secret, recipientProtected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive content key: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	aad, err := encStructure(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	return cbor.Marshal(cbor.Tag{
+		Number: coseEncryptTag,
+		Content: coseEncrypt{
+			Protected:   protected,
+			Unprotected: map[int]any{coseHeaderIV: iv},
+			Ciphertext:  gcm.Seal(nil, iv, plaintext, aad),
+			Recipients: []coseRecipient{{
+				Protected: recipientProtected,
+				Unprotected: map[int]any{
+					coseHeaderEphemeral: map[int]any{
+						coseKeyKty: coseKtyOKP,
+						coseKeyCrv: coseCrvX25519,
+						coseKeyX:   ephemeral.PublicKey().Bytes(),
+					},
+					coseHeaderKid: KeyID(recipient.Bytes()),
+				},
+				Ciphertext: []byte{},
+			}},
+		},
+	})
+}
+
+// ErrNoIdentity is returned when an encrypted dataset is loaded without an identity to decrypt it
+var ErrNoIdentity = errors.New("dataset is encrypted, an identity is required to decrypt it")
+
+// decryptItem returns the plaintext of a COSE_Encrypt structure encrypted to identity
+func decryptItem(item []byte, identity *ecdh.PrivateKey) ([]byte, error) {
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(item, &tag); err != nil || tag.Number != coseEncryptTag {
+		return nil, fmt.Errorf("not a COSE_Encrypt structure")
+	}
+	var msg coseEncrypt
+	if err := cbor.Unmarshal(tag.Content, &msg); err != nil {
+		return nil, fmt.Errorf("failed to decode COSE_Encrypt structure: %w", err)
+	}
+	if identity == nil {
+		return nil, ErrNoIdentity
+	}
+
+	var headers map[int]any
+	if err := cbor.Unmarshal(msg.Protected, &headers); err != nil {
+		return nil, fmt.Errorf("failed to decode protected header: %w", err)
+	}
+	if alg, ok := headers[coseHeaderAlg].(uint64); !ok || alg != coseAlgA256GCM {
+		return nil, fmt.Errorf("unsupported content encryption algorithm %v", headers[coseHeaderAlg])
+	}
+	iv, _ := msg.Unprotected[coseHeaderIV].([]byte)
+
+	kid := KeyID(identity.PublicKey().Bytes())
+	for _, recipient := range msg.Recipients {
+		if rkid, _ := recipient.Unprotected[coseHeaderKid].([]byte); !bytes.Equal(rkid, kid) {
+			continue
+		}
+
+		ephemeralKey, _ := recipient.Unprotected[coseHeaderEphemeral].(map[any]any)
+		x, _ := ephemeralKey[int64(coseKeyX)].([]byte)
+		ephemeral, err := ecdh.X25519().NewPublicKey(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+		}
+		secret, err := identity.ECDH(ephemeral)
+		if err != nil {
+			return nil, fmt.Errorf("key agreement failed: %w", err)
+		}
+		key, err := deriveContentKey(secret, recipient.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive content key: %w", err)
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(iv) != gcm.NonceSize() {
+			return nil, fmt.Errorf("invalid IV length %d", len(iv))
+		}
+		aad, err := encStructure(msg.Protected)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := gcm.Open(nil, iv, msg.Ciphertext, aad)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("dataset is not encrypted to identity %s", hex.EncodeToString(kid))
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// writeTestIdentity generates an X25519 key pair and writes it to PEM files in dir
+func writeTestIdentity(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(priv.PublicKey())
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+
+	privFile := filepath.Join(dir, name+".pem")
+	pubFile := filepath.Join(dir, name+".pub.pem")
+	if err := os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return privFile, pubFile
+}
+
+// loadTestIdentity creates an X25519 key pair and loads it back from the PEM files
+func loadTestIdentity(t *testing.T, dir, name string) (*ecdh.PrivateKey, *ecdh.PublicKey) {
+	t.Helper()
+
+	privFile, pubFile := writeTestIdentity(t, dir, name)
+	identity, err := LoadIdentity(privFile)
+	if err != nil {
+		t.Fatalf("LoadIdentity failed: %v", err)
+	}
+	recipient, err := LoadRecipientKey(pubFile)
+	if err != nil {
+		t.Fatalf("LoadRecipientKey failed: %v", err)
+	}
+	return identity, recipient
+}
+
+func TestLoadIdentity_Errors(t *testing.T) {
+	dir := t.TempDir()
+	ed25519Priv, ed25519Pub := writeTestKeys(t, dir, "signer")
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := LoadIdentity(ed25519Priv); err == nil || !strings.Contains(err.Error(), "not an X25519 key") {
+		t.Errorf("Expected not an X25519 key error, got: %v", err)
+	}
+	if _, err := LoadRecipientKey(ed25519Pub); err == nil || !strings.Contains(err.Error(), "not an X25519 key") {
+		t.Errorf("Expected not an X25519 key error, got: %v", err)
+	}
+	if _, err := LoadIdentity(garbage); err == nil || !strings.Contains(err.Error(), "no PEM encoded private key") {
+		t.Errorf("Expected no private key error, got: %v", err)
+	}
+	if _, err := LoadRecipientKey(garbage); err == nil || !strings.Contains(err.Error(), "no PEM encoded public key") {
+		t.Errorf("Expected no public key error, got: %v", err)
+	}
+}
+
+func TestEncryptDecryptItem(t *testing.T) {
+	dir := t.TempDir()
+	identity, recipient := loadTestIdentity(t, dir, "collector")
+	other, _ := loadTestIdentity(t, dir, "other")
+
+	plaintext := mustMarshalDataset(t, newMetadataDataset(t, "example", nil))
+	encrypted, err := encryptItem(plaintext, recipient)
+	if err != nil {
+		t.Fatalf("encryptItem failed: %v", err)
+	}
+	if !isEncrypted(encrypted) {
+		t.Fatal("Expected a COSE_Encrypt structure")
+	}
+	if bytes.Contains(encrypted, []byte("example")) {
+		t.Error("Encrypted item contains plaintext")
+	}
+
+	decrypted, err := decryptItem(encrypted, identity)
+	if err != nil {
+		t.Fatalf("decryptItem failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Error("Decrypted item differs from plaintext")
+	}
+
+	var tag cbor.RawTag
+	var msg coseEncrypt
+	if err := cbor.Unmarshal(encrypted, &tag); err != nil {
+		t.Fatalf("Failed to decode tag: %v", err)
+	}
+	if err := cbor.Unmarshal(tag.Content, &msg); err != nil {
+		t.Fatalf("Failed to decode COSE_Encrypt: %v", err)
+	}
+	msg.Ciphertext[0] ^= 0xff
+	tampered, err := cbor.Marshal(cbor.Tag{Number: coseEncryptTag, Content: msg})
+	if err != nil {
+		t.Fatalf("Failed to encode COSE_Encrypt: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		identity *ecdh.PrivateKey
+		errMsg   string
+	}{
+		{"no identity", encrypted, nil, "an identity is required"},
+		{"wrong identity", encrypted, other, "not encrypted to identity"},
+		{"tampered ciphertext", tampered, identity, "decryption failed"},
+		{"not encrypted", plaintext, identity, "not a COSE_Encrypt structure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decryptItem(tt.data, tt.identity)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestDatasetSequence_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	identity, recipient := loadTestIdentity(t, dir, "collector")
+	privFile, pubFile := writeTestKeys(t, dir, "signer")
+	key, err := LoadSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+	trusted, err := LoadTrustedKeys(pubFile)
+	if err != nil {
+		t.Fatalf("LoadTrustedKeys failed: %v", err)
+	}
+
+	filename := filepath.Join(dir, "encrypted.cbor")
+	if _, err := WriteDNSMagFileWithOptions(newMetadataDataset(t, "example", nil), filename, nil, WriteOptions{Recipient: recipient}); err != nil {
+		t.Fatalf("WriteDNSMagFileWithOptions failed: %v", err)
+	}
+	encrypted, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	// Without an identity, encrypted datasets can not be loaded
+	seq := NewDatasetSequence(0, nil, false, nil)
+	err = seq.LoadDNSMagSequenceFromReader(bytes.NewReader(encrypted), "<a#%d>")
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt dataset <a#1>") {
+		t.Errorf("Expected decryption error, got: %v", err)
+	}
+
+	seq = NewDatasetSequence(0, nil, false, nil)
+	seq.SetIdentity(identity)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(encrypted), "<b#%d>"); err != nil {
+		t.Fatalf("Loading encrypted dataset failed: %v", err)
+	}
+	if seq.Result.Metadata == nil || !slices.Equal(seq.Result.Metadata.Sources, []string{"example"}) {
+		t.Errorf("Expected decrypted metadata, got %+v", seq.Result.Metadata)
+	}
+
+	// Encrypted datasets can be signed, and signed datasets encrypted
+	var signedEncrypted bytes.Buffer
+	if _, err := SignDatasets(bytes.NewReader(encrypted), &signedEncrypted, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+	var signed bytes.Buffer
+	if _, err := SignDatasets(bytes.NewReader(mustMarshalDataset(t, newMetadataDataset(t, "example", nil))), &signed, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+	encryptedSigned, err := encryptItem(signed.Bytes(), recipient)
+	if err != nil {
+		t.Fatalf("encryptItem failed: %v", err)
+	}
+
+	for name, data := range map[string][]byte{
+		"sign-then-encrypt": encryptedSigned,
+		"encrypt-then-sign": signedEncrypted.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			seq := NewDatasetSequence(0, nil, false, nil)
+			seq.SetIdentity(identity)
+			seq.RequireSignatures(trusted)
+			if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(data), "<c#%d>"); err != nil {
+				t.Fatalf("Loading dataset failed: %v", err)
+			}
+			if seq.Result.extraSignature == nil || !seq.Result.extraSignature.Verified {
+				t.Errorf("Expected verified signature, got %v", seq.Result.extraSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DomainFilter selects the domains kept by FilterDataset. A domain is kept if it is in the include list
+// or matches the include pattern (or neither is set), and it is neither in the exclude list nor matches
+// the exclude pattern. It is recorded in the metadata of the filtered dataset.
+type DomainFilter struct {
+	Include        []string `cbor:"include,omitempty"`         // Domains to keep
+	IncludePattern string   `cbor:"include_pattern,omitempty"` // Regular expression matching domains to keep
+	Exclude        []string `cbor:"exclude,omitempty"`         // Domains to remove
+	ExcludePattern string   `cbor:"exclude_pattern,omitempty"` // Regular expression matching domains to remove
+	includeRegexp  *regexp.Regexp
+	excludeRegexp  *regexp.Regexp
+}
+
+// NewDomainFilter returns a filter keeping the domains in include or matching includePattern, except those
+// in exclude or matching excludePattern. Domain names are compared lowercased, without a trailing dot.
+// Patterns are RE2 regular expressions, matching anywhere in the domain name unless anchored.
+func NewDomainFilter(include []string, includePattern string, exclude []string, excludePattern string) (*DomainFilter, error) {
+	filter := &DomainFilter{
+		Include:        normaliseDomains(include),
+		IncludePattern: includePattern,
+		Exclude:        normaliseDomains(exclude),
+		ExcludePattern: excludePattern,
+	}
+	if len(filter.Include) == 0 && includePattern == "" && len(filter.Exclude) == 0 && excludePattern == "" {
+		return nil, fmt.Errorf("empty filter, no domains or patterns to include or exclude")
+	}
+
+	var err error
+	if includePattern != "" {
+		if filter.includeRegexp, err = regexp.Compile(includePattern); err != nil {
+			return nil, fmt.Errorf("invalid include pattern: %w", err)
+		}
+	}
+	if excludePattern != "" {
+		if filter.excludeRegexp, err = regexp.Compile(excludePattern); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+// normaliseDomains lowercases domain names and removes trailing dots, returning them sorted and unique
+func normaliseDomains(domains []string) []string {
+	var res []string
+	for _, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain != "" {
+			res = append(res, domain)
+		}
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// LoadDomainList reads domain names from a file, one per line. Empty lines and lines starting with '#'
+// are ignored.
+func LoadDomainList(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return domains, nil
+}
+
+// Match checks if a domain is kept by the filter
+func (filter *DomainFilter) Match(domain DomainName) bool {
+	name := string(domain)
+	if len(filter.Include) > 0 || filter.includeRegexp != nil {
+		_, included := slices.BinarySearch(filter.Include, name)
+		if !included && (filter.includeRegexp == nil || !filter.includeRegexp.MatchString(name)) {
+			return false
+		}
+	}
+	if _, excluded := slices.BinarySearch(filter.Exclude, name); excluded {
+		return false
+	}
+	return filter.excludeRegexp == nil || !filter.excludeRegexp.MatchString(name)
+}
+
+func (filter DomainFilter) String() string {
+	var parts []string
+	if len(filter.Include) > 0 {
+		parts = append(parts, fmt.Sprintf("include %d domains", len(filter.Include)))
+	}
+	if filter.IncludePattern != "" {
+		parts = append(parts, fmt.Sprintf("include /%s/", filter.IncludePattern))
+	}
+	if len(filter.Exclude) > 0 {
+		parts = append(parts, fmt.Sprintf("exclude %d domains", len(filter.Exclude)))
+	}
+	if filter.ExcludePattern != "" {
+		parts = append(parts, fmt.Sprintf("exclude /%s/", filter.ExcludePattern))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// equal compares the recorded fields of two filters
+func (filter *DomainFilter) equal(other DomainFilter) bool {
+	return slices.Equal(filter.Include, other.Include) && filter.IncludePattern == other.IncludePattern &&
+		slices.Equal(filter.Exclude, other.Exclude) && filter.ExcludePattern == other.ExcludePattern
+}
+
+// FilterDataset returns a new dataset with only the domains kept by filter. The global client HLL and
+// counts are kept intact, so magnitudes are unchanged. The filter is added to the metadata, and the
+// dataset filtered becomes the parent of the new dataset.
+func FilterDataset(dataset MagnitudeDataset, filter *DomainFilter) (MagnitudeDataset, error) {
+	metadata, err := mergeMetadata([]MagnitudeDataset{dataset})
+	if err != nil {
+		return MagnitudeDataset{}, err
+	}
+
+	res := dataset
+	res.Version = DatasetVersion
+	res.Identifier = uuid.New().String()
+	res.Generator = fmt.Sprintf("dnsmag %s", Version)
+	res.Metadata = metadata
+	res.Domains = make(map[DomainName]domainData)
+	res.extraAllDomains = nil
+	res.extraAggregated = false
+	res.extraSignature = nil
+
+	for domain, data := range dataset.Domains {
+		if filter.Match(domain) {
+			res.Domains[domain] = data
+		}
+	}
+	if !slices.ContainsFunc(res.Metadata.Filters, filter.equal) {
+		res.Metadata.Filters = append(res.Metadata.Filters, *filter)
+	}
+
+	return res, nil
+}
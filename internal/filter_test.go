@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDomainFilter_Match(t *testing.T) {
+	domains := []DomainName{"com", "org", "net", "local", "home", "corp"}
+
+	tests := []struct {
+		name           string
+		include        []string
+		includePattern string
+		exclude        []string
+		excludePattern string
+		expected       []DomainName
+	}{
+		{"include list", []string{"COM.", " org", "nonexistent"}, "", nil, "", []DomainName{"com", "org"}},
+		{"include pattern", nil, "^(local|home)$", nil, "", []DomainName{"local", "home"}},
+		{"include list or pattern", []string{"com"}, "^h", nil, "", []DomainName{"com", "home"}},
+		{"exclude list", nil, "", []string{"local", "home", "corp"}, "", []DomainName{"com", "org", "net"}},
+		{"exclude pattern", nil, "", nil, "o", []DomainName{"net"}},
+		{"include and exclude", []string{"com", "org", "home"}, "", nil, "^h", []DomainName{"com", "org"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewDomainFilter(tt.include, tt.includePattern, tt.exclude, tt.excludePattern)
+			if err != nil {
+				t.Fatalf("NewDomainFilter failed: %v", err)
+			}
+			var kept []DomainName
+			for _, domain := range domains {
+				if filter.Match(domain) {
+					kept = append(kept, domain)
+				}
+			}
+			if !slices.Equal(kept, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, kept)
+			}
+		})
+	}
+
+	if _, err := NewDomainFilter(nil, "", []string{""}, ""); err == nil {
+		t.Error("Expected error for empty filter")
+	}
+	if _, err := NewDomainFilter(nil, "(", nil, ""); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
+
+func TestLoadDomainList(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(filename, []byte("# noisy names\ncom\n\n  local  \n"), 0o600); err != nil {
+		t.Fatalf("Failed to write domain list: %v", err)
+	}
+
+	domains, err := LoadDomainList(filename)
+	if err != nil {
+		t.Fatalf("LoadDomainList failed: %v", err)
+	}
+	if !slices.Equal(domains, []string{"com", "local"}) {
+		t.Errorf("Expected [com local], got %v", domains)
+	}
+
+	if _, err := LoadDomainList(filename + ".missing"); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestFilterDataset(t *testing.T) {
+	dataset := newDiffDataset(t, 1, map[string]clientRange{
+		"com":   {0, 999},
+		"org":   {0, 99},
+		"local": {500, 599},
+	})
+	dataset.Metadata = newMetadata("example", nil)
+
+	filter, err := NewDomainFilter(nil, "", []string{"local"}, "")
+	if err != nil {
+		t.Fatalf("NewDomainFilter failed: %v", err)
+	}
+	filtered, err := FilterDataset(dataset, filter)
+	if err != nil {
+		t.Fatalf("FilterDataset failed: %v", err)
+	}
+
+	if len(filtered.Domains) != 2 || filtered.Domains["com"].ClientsCount != dataset.Domains["com"].ClientsCount {
+		t.Errorf("Expected com and org to be kept, got %v", filtered.Domains)
+	}
+	if len(dataset.Domains) != 3 {
+		t.Errorf("Expected the original dataset to be unchanged, got %d domains", len(dataset.Domains))
+	}
+	if filtered.AllClientsCount != dataset.AllClientsCount || filtered.AllQueriesCount != dataset.AllQueriesCount ||
+		!bytes.Equal(filtered.AllClientsHll.ToBytes(), dataset.AllClientsHll.ToBytes()) {
+		t.Error("Expected the all clients HLL and counts to be intact")
+	}
+	if filtered.Identifier == dataset.Identifier {
+		t.Error("Expected a new identifier")
+	}
+	if md := filtered.Metadata; !slices.Equal(md.Sources, []string{"example"}) || !slices.Equal(md.Parents, []string{dataset.Identifier}) ||
+		len(md.Filters) != 1 || !slices.Equal(md.Filters[0].Exclude, []string{"local"}) {
+		t.Errorf("Unexpected metadata: %+v", md)
+	}
+
+	// Magnitudes of the remaining domains are unchanged
+	magnitudes := make(map[DomainName]float64)
+	for _, dm := range dataset.SortedByMagnitude() {
+		magnitudes[dm.Domain] = dm.Magnitude
+	}
+	for _, dm := range filtered.SortedByMagnitude() {
+		if dm.Magnitude != magnitudes[dm.Domain] {
+			t.Errorf("Expected magnitude %f for %s, got %f", magnitudes[dm.Domain], dm.Domain, dm.Magnitude)
+		}
+	}
+
+	// The filter is recorded once when applied again, and passes through encoding and validation
+	filtered, err = FilterDataset(filtered, filter)
+	if err != nil {
+		t.Fatalf("FilterDataset failed: %v", err)
+	}
+	if len(filtered.Metadata.Filters) != 1 {
+		t.Errorf("Expected one filter, got %v", filtered.Metadata.Filters)
+	}
+	_, errs, err := ValidateDatasets(bytes.NewReader(mustMarshalDataset(t, filtered)), nil)
+	if err != nil || len(errs) != 0 {
+		t.Errorf("Expected filtered dataset to be valid, got %v %v", err, errs)
+	}
+	if findings := checkFindings(t, filtered); len(findings) != 0 {
+		t.Errorf("Expected filtered dataset to be consistent, got %v", findings)
+	}
+}
@@ -0,0 +1,304 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// IngestOptions configures an Ingester
+type IngestOptions struct {
+	Filetype      string        // Record format: csv or tsv
+	TopCount      int           // Number of domains to keep in each day's dataset
+	ChunkSize     uint          // Number of queries to process in one go (0 = unlimited)
+	OutputDir     string        // Directory to write the day's datasets to
+	FlushInterval time.Duration // Time between writes of the current day's dataset
+	Metrics       *Metrics      // Metrics to update, if any
+	Source        string        // Source recorded in the dataset metadata
+	Sites         []string      // Sites recorded in the dataset metadata
+}
+
+// Ingester aggregates CSV/TSV records received over network connections into per-day datasets.
+// Records are attributed to the UTC day they are received. The current day's dataset is written
+// periodically (marked as partial), and a final dataset is written when the day has ended.
+type Ingester struct {
+	opts    IngestOptions
+	verbose bool
+	logger  io.Writer
+	now     func() time.Time
+
+	mu     sync.Mutex
+	days   map[string]*Collector // Collectors of open days, by date
+	conns  map[net.Conn]struct{} // Active connections
+	closed bool                  // Set when shutting down, no more connections are accepted
+	wg     sync.WaitGroup        // Running connection handlers
+}
+
+func NewIngester(opts IngestOptions, verbose bool, logger io.Writer) (*Ingester, error) {
+	if opts.Filetype != "csv" && opts.Filetype != "tsv" {
+		return nil, fmt.Errorf("invalid filetype '%s', must be 'csv' or 'tsv'", opts.Filetype)
+	}
+	if opts.FlushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive")
+	}
+
+	return &Ingester{
+		opts:    opts,
+		verbose: verbose,
+		logger:  logger,
+		now:     time.Now,
+		days:    make(map[string]*Collector),
+		conns:   make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Listen creates a listener from an address like tcp://127.0.0.1:5300 or unix:///run/dnsmag.sock.
+// A stale Unix socket file left behind by an earlier run is removed, but it is an error if another process
+// is still listening on it.
+func Listen(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %w", address, err)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		return net.Listen("tcp", u.Host)
+	case "unix":
+		if info, err := os.Stat(u.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial("unix", u.Path)
+			if err == nil {
+				_ = conn.Close()
+				return nil, fmt.Errorf("socket %s is in use by another process", u.Path)
+			}
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				return nil, fmt.Errorf("failed to check socket %s: %w", u.Path, err)
+			}
+			_ = os.Remove(u.Path)
+		}
+		return net.Listen("unix", u.Path)
+	}
+	return nil, fmt.Errorf("invalid listen address '%s', must start with tcp:// or unix://", address)
+}
+
+// Serve accepts connections on the listener until the context is cancelled. On cancellation, the listener
+// and all connections are closed and the datasets of open days are written, marked as partial.
+func (ing *Ingester) Serve(ctx context.Context, listener net.Listener) error {
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			ing.addConn(conn)
+		}
+	}()
+
+	ticker := time.NewTicker(ing.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var err error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case err = <-acceptErr:
+			break loop
+		case <-ticker.C:
+			if err = ing.Flush(false); err != nil {
+				break loop
+			}
+		}
+	}
+
+	_ = listener.Close()
+	ing.closeConns()
+	ing.wg.Wait()
+
+	if flushErr := ing.Flush(true); flushErr != nil {
+		return flushErr
+	}
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to accept connection: %w", err)
+	}
+	return nil
+}
+
+func (ing *Ingester) addConn(conn net.Conn) {
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+
+	if ing.closed {
+		_ = conn.Close()
+		return
+	}
+	ing.conns[conn] = struct{}{}
+	ing.wg.Add(1)
+	go ing.handleConn(conn)
+}
+
+func (ing *Ingester) closeConns() {
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+
+	ing.closed = true
+	for conn := range ing.conns {
+		_ = conn.Close()
+	}
+}
+
+// handleConn reads records from a connection until it is closed
+func (ing *Ingester) handleConn(conn net.Conn) {
+	defer ing.wg.Done()
+	defer func() {
+		ing.mu.Lock()
+		delete(ing.conns, conn)
+		ing.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	if ing.verbose {
+		fmt.Fprintf(ing.logger, "Accepted connection from %s\n", conn.RemoteAddr())
+	}
+
+	csvReader := newCSVReader(conn, ing.opts.Filetype)
+	firstLine := true
+
+	for {
+		record, err := csvReader.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				ing.invalidRecord()
+				continue
+			}
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintf(ing.logger, "Failed to read from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if err := ing.processRecord(record, firstLine); err != nil {
+			fmt.Fprintf(ing.logger, "Closing connection from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		firstLine = false
+	}
+}
+
+// processRecord adds a record to the dataset of the current day. Invalid records are counted, but do not
+// cause the connection to be closed.
+func (ing *Ingester) processRecord(record []string, firstLine bool) error {
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+
+	collector, err := ing.dayCollector(ing.now().UTC())
+	if err != nil {
+		return err
+	}
+	if err := processCSVRecord(collector, record, firstLine); err != nil {
+		collector.countInvalidRecord()
+	}
+	return nil
+}
+
+func (ing *Ingester) invalidRecord() {
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+
+	if collector, err := ing.dayCollector(ing.now().UTC()); err == nil {
+		collector.countInvalidRecord()
+	}
+}
+
+// dayCollector returns the collector for a date, continuing from a previously written dataset if there is one.
+// Must be called with ing.mu held.
+func (ing *Ingester) dayCollector(now time.Time) (*Collector, error) {
+	date := now.Format(time.DateOnly)
+	if collector, found := ing.days[date]; found {
+		return collector, nil
+	}
+
+	collector := NewCollector(ing.opts.TopCount, ing.opts.ChunkSize, false, &now, NewTimingStats())
+	collector.SetMetrics(ing.opts.Metrics)
+	collector.SetProvenance(ing.opts.Source, ing.opts.Sites)
+	reopened, err := loadDailyDataset(ing.opts.OutputDir, date, ing.opts.TopCount, ing.logger)
+	if err != nil {
+		return nil, err
+	}
+	if reopened != nil {
+		if ing.verbose {
+			fmt.Fprintf(ing.logger, "Reopened dataset for %s from %s\n", date, dailyDatasetFilename(ing.opts.OutputDir, date))
+		}
+		metadata := collector.Result.Metadata
+		collector.Result = restoreDataset(*reopened)
+		if collector.Result.Metadata == nil {
+			// Reopened a version 1 dataset
+			collector.Result.Metadata = metadata
+		}
+	}
+
+	ing.days[date] = collector
+	return collector, nil
+}
+
+// Flush writes the datasets of all open days. Datasets of days that have ended are final and are removed
+// from memory, the current day's dataset is marked as partial. With shutdown set, the current day's dataset
+// is removed from memory as well.
+func (ing *Ingester) Flush(shutdown bool) error {
+	ing.mu.Lock()
+	defer ing.mu.Unlock()
+
+	today := ing.now().UTC().Format(time.DateOnly)
+
+	var dates []string
+	for date := range ing.days {
+		dates = append(dates, date)
+	}
+	slices.Sort(dates)
+
+	for _, date := range dates {
+		collector := ing.days[date]
+		if err := collector.Finalise(); err != nil {
+			return fmt.Errorf("failed to finalise dataset for %s: %w", date, err)
+		}
+
+		ended := date < today
+		collector.Result.Partial = !ended
+
+		filename, err := WriteDNSMagFile(collector.Result, dailyDatasetFilename(ing.opts.OutputDir, date), nil)
+		if err != nil {
+			return fmt.Errorf("failed to write dataset for %s: %w", date, err)
+		}
+
+		if ended {
+			fmt.Fprintf(ing.logger, "Saved dataset for %s to %s (%d records, %d invalid)\n",
+				date, filename, collector.recordCount, collector.invalidRecordCount)
+		} else if ing.verbose || shutdown {
+			fmt.Fprintf(ing.logger, "Saved partial dataset for %s to %s (%d records, %d invalid)\n",
+				date, filename, collector.recordCount, collector.invalidRecordCount)
+		}
+
+		ing.opts.Metrics.datasetWritten()
+
+		if ended || shutdown {
+			ing.opts.Metrics.removeDatasets(collector)
+			delete(ing.days, date)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	InitStats()
+}
+
+// syncBuffer is a bytes.Buffer safe for use as a logger from multiple goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+// sendRecords connects to the listener, writes the data and waits for the ingester to have counted
+// the expected total number of (valid and invalid) records
+func sendRecords(t *testing.T, ing *Ingester, listener net.Listener, data string, expected uint) {
+	t.Helper()
+
+	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatalf("Failed to write records: %v", err)
+	}
+	conn.Close()
+
+	// Wait for the connection to be accepted and handled
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ing.mu.Lock()
+		records := uint(0)
+		for _, collector := range ing.days {
+			records += collector.recordCount + collector.invalidRecordCount
+		}
+		active := len(ing.conns)
+		ing.mu.Unlock()
+		if active == 0 && records >= expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timeout waiting for records to be ingested")
+}
+
+func newTestIngester(t *testing.T, outputDir string) (*Ingester, *syncBuffer) {
+	t.Helper()
+
+	logger := &syncBuffer{}
+	ing, err := NewIngester(IngestOptions{
+		Filetype:      "csv",
+		TopCount:      DefaultDomainCount,
+		OutputDir:     outputDir,
+		FlushInterval: time.Hour,
+	}, true, logger)
+	if err != nil {
+		t.Fatalf("NewIngester failed: %v", err)
+	}
+	return ing, logger
+}
+
+func TestIngester_ServeAndShutdown(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			outputDir := t.TempDir()
+			ing, logger := newTestIngester(t, outputDir)
+			now := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+			ing.now = func() time.Time { return now }
+
+			address := "tcp://127.0.0.1:0"
+			if network == "unix" {
+				address = "unix://" + filepath.Join(t.TempDir(), "ingest.sock")
+			}
+			listener, err := Listen(address)
+			if err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- ing.Serve(ctx, listener) }()
+
+			sendRecords(t, ing, listener, "client,domain,count\n192.168.1.1,example.com,5\n10.0.0.1,example.org,3\n", 2)
+			sendRecords(t, ing, listener, "192.168.2.1,example.com,2\nnot-an-ip,example.net,1\n", 4)
+
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Serve failed: %v", err)
+			}
+
+			dataset := loadWatchOutput(t, outputDir, "2026-09-01")
+			validateDatasetDomains(t, dataset, DatasetDomainsExpected{
+				expectedDomains: map[DomainName]uint64{"com": 7, "org": 3},
+			})
+			if !dataset.Partial {
+				t.Error("Expected dataset of current day to be partial after shutdown")
+			}
+			if !strings.Contains(logger.String(), "Saved partial dataset for 2026-09-01") {
+				t.Errorf("Expected saved partial dataset message in output:\n%s", logger.String())
+			}
+			if !strings.Contains(logger.String(), "1 invalid") {
+				t.Errorf("Expected one invalid record in output:\n%s", logger.String())
+			}
+		})
+	}
+}
+
+func TestIngester_DayRotation(t *testing.T) {
+	outputDir := t.TempDir()
+	ing, _ := newTestIngester(t, outputDir)
+	now := time.Date(2026, 9, 1, 23, 59, 0, 0, time.UTC)
+	ing.now = func() time.Time { return now }
+
+	if err := ing.processRecord([]string{"192.168.1.1", "example.com", "5"}, false); err != nil {
+		t.Fatalf("processRecord failed: %v", err)
+	}
+
+	// Periodic flush during the day writes a partial dataset, and keeps the day open
+	if err := ing.Flush(false); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if !loadWatchOutput(t, outputDir, "2026-09-01").Partial {
+		t.Error("Expected partial dataset during the day")
+	}
+
+	if err := ing.processRecord([]string{"10.0.0.1", "example.com", "2"}, false); err != nil {
+		t.Fatalf("processRecord failed: %v", err)
+	}
+
+	// After midnight, records go to the next day and the previous day's dataset is final
+	now = now.Add(2 * time.Minute)
+	if err := ing.processRecord([]string{"10.0.0.1", "example.org", "1"}, false); err != nil {
+		t.Fatalf("processRecord failed: %v", err)
+	}
+	if err := ing.Flush(false); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	dataset := loadWatchOutput(t, outputDir, "2026-09-01")
+	if dataset.Partial {
+		t.Error("Expected final dataset after the day has ended")
+	}
+	validateDatasetDomains(t, dataset, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{"com": 7},
+	})
+	if _, found := ing.days["2026-09-01"]; found {
+		t.Error("Expected ended day to be removed")
+	}
+
+	dataset = loadWatchOutput(t, outputDir, "2026-09-02")
+	validateDatasetDomains(t, dataset, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{"org": 1},
+	})
+
+	// A restarted ingester continues from the partial dataset of the current day
+	ing, _ = newTestIngester(t, outputDir)
+	ing.now = func() time.Time { return now }
+	if err := ing.processRecord([]string{"10.0.0.1", "example.org", "4"}, false); err != nil {
+		t.Fatalf("processRecord failed: %v", err)
+	}
+	if err := ing.Flush(true); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	validateDatasetDomains(t, loadWatchOutput(t, outputDir, "2026-09-02"), DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{"org": 5},
+	})
+}
+
+func TestIngester_InvalidOptions(t *testing.T) {
+	if _, err := NewIngester(IngestOptions{Filetype: "pcap", FlushInterval: time.Second}, false, nil); err == nil {
+		t.Error("Expected error for pcap filetype, got nil")
+	}
+	if _, err := NewIngester(IngestOptions{Filetype: "csv"}, false, nil); err == nil {
+		t.Error("Expected error for missing flush interval, got nil")
+	}
+	if _, err := Listen("udp://127.0.0.1:0"); err == nil {
+		t.Error("Expected error for udp listen address, got nil")
+	}
+}
+
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ingest.sock")
+
+	listener, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// The socket of a running ingester is not taken over
+	if _, err := Listen("unix://" + path); err == nil || !strings.Contains(err.Error(), "in use by another process") {
+		t.Errorf("Expected an error for a socket in use, got %v", err)
+	}
+
+	// A stale socket is replaced
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = listener.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected a stale socket: %v", err)
+	}
+	listener, err = Listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("Listen with a stale socket failed: %v", err)
+	}
+	_ = listener.Close()
+}
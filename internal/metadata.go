@@ -0,0 +1,184 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DatasetMetadata records the provenance of a dataset: who collected it, from where, from what input and
+// with which settings. It was added in dataset version 2, and is absent in datasets loaded from version 1.
+type DatasetMetadata struct {
+	Sources      []string           `cbor:"sources,omitempty"`       // Organisations or operators that collected the data
+	Sites        []string           `cbor:"sites,omitempty"`         // Sites (e.g. resolver instances) the data was collected at
+	Window       *CollectionWindow  `cbor:"window,omitempty"`        // Time span of the collected queries, if known
+	InputFiles   []InputFile        `cbor:"input_files,omitempty"`   // Input files the dataset was collected from
+	Truncation   *TruncationLengths `cbor:"truncation,omitempty"`    // Client address prefix lengths
+	Hll          *HllParameters     `cbor:"hll,omitempty"`           // HyperLogLog parameters
+	DomainLabels int                `cbor:"domain_labels,omitempty"` // Number of domain name labels kept
+	Parents      []string           `cbor:"parents,omitempty"`       // Identifiers of the datasets aggregated into this one, at any depth
+	Filters      []DomainFilter     `cbor:"filters,omitempty"`       // Domain filters applied to the dataset
+	Period       *DatasetPeriod     `cbor:"period,omitempty"`        // Days covered by a multi-day rollup
+}
+
+// CollectionWindow is the time span of the queries in a dataset
+type CollectionWindow struct {
+	Start TimestampWrapper `cbor:"start"`
+	End   TimestampWrapper `cbor:"end"`
+}
+
+// InputFile identifies an input file by name, size and SHA-256 digest
+type InputFile struct {
+	Name   string `cbor:"name"`
+	Size   int64  `cbor:"size"`
+	SHA256 []byte `cbor:"sha256"`
+}
+
+// TruncationLengths are the prefix lengths client addresses are truncated to before being counted
+type TruncationLengths struct {
+	IPv4 int `cbor:"ipv4"`
+	IPv6 int `cbor:"ipv6"`
+}
+
+// HllParameters are the settings of the HLLs in a dataset
+type HllParameters struct {
+	Log2m    int `cbor:"log2m"`
+	Regwidth int `cbor:"regwidth"`
+}
+
+// newMetadata returns the metadata of a dataset collected by this software
+func newMetadata(source string, sites []string) *DatasetMetadata {
+	md := &DatasetMetadata{
+		Sites: slices.Clone(sites),
+		Truncation: &TruncationLengths{
+			IPv4: DefaultIPv4MaskLength,
+			IPv6: DefaultIPv6MaskLength,
+		},
+		Hll: &HllParameters{
+			Log2m:    hllSettings.Log2m,
+			Regwidth: hllSettings.Regwidth,
+		},
+		DomainLabels: DefaultDNSDomainNameLabels,
+	}
+	if source != "" {
+		md.Sources = []string{source}
+	}
+	return md
+}
+
+// sourceString returns the sources of a dataset joined for display
+func (md *DatasetMetadata) sourceString() string {
+	if md == nil {
+		return ""
+	}
+	return strings.Join(md.Sources, ", ")
+}
+
+// observe extends the collection window to include a timestamp
+func (md *DatasetMetadata) observe(ts time.Time) {
+	if md.Window == nil {
+		md.Window = &CollectionWindow{Start: TimestampWrapper{ts}, End: TimestampWrapper{ts}}
+		return
+	}
+	if ts.Before(md.Window.Start.Time) {
+		md.Window.Start.Time = ts
+	}
+	if ts.After(md.Window.End.Time) {
+		md.Window.End.Time = ts
+	}
+}
+
+// mergeMetadata merges the provenance of datasets being aggregated. The parents are the datasets and
+// their own parents. Datasets without metadata (version 1) only contribute their identifier to the
+// parents. It is an error to merge datasets collected with different truncation lengths, HLL parameters
+// or number of domain labels.
+func mergeMetadata(datasets []MagnitudeDataset) (*DatasetMetadata, error) {
+	res := &DatasetMetadata{}
+
+	for _, dataset := range datasets {
+		// Datasets aggregated in memory (but not yet saved) are represented by their parents. The parents
+		// of saved datasets are kept as well, so that every dataset aggregated at any depth is a parent.
+		if !dataset.extraAggregated || dataset.Metadata == nil || len(dataset.Metadata.Parents) == 0 {
+			res.Parents = append(res.Parents, dataset.Identifier)
+		}
+		if dataset.Metadata != nil {
+			res.Parents = append(res.Parents, dataset.Metadata.Parents...)
+		}
+
+		md := dataset.Metadata
+		if md == nil {
+			continue
+		}
+
+		for _, source := range md.Sources {
+			if !slices.Contains(res.Sources, source) {
+				res.Sources = append(res.Sources, source)
+			}
+		}
+		for _, site := range md.Sites {
+			if !slices.Contains(res.Sites, site) {
+				res.Sites = append(res.Sites, site)
+			}
+		}
+		if md.Window != nil {
+			res.observe(md.Window.Start.Time)
+			res.observe(md.Window.End.Time)
+		}
+		res.InputFiles = append(res.InputFiles, md.InputFiles...)
+
+		if md.Truncation != nil {
+			if res.Truncation != nil && *res.Truncation != *md.Truncation {
+				return nil, fmt.Errorf("truncation length mismatch: dataset %s has /%d and /%d, expected /%d and /%d",
+					dataset.extraSourceFilename, md.Truncation.IPv4, md.Truncation.IPv6, res.Truncation.IPv4, res.Truncation.IPv6)
+			}
+			res.Truncation = md.Truncation
+		}
+		if md.Hll != nil {
+			if res.Hll != nil && *res.Hll != *md.Hll {
+				return nil, fmt.Errorf("HLL parameter mismatch: dataset %s has log2m %d and regwidth %d, expected %d and %d",
+					dataset.extraSourceFilename, md.Hll.Log2m, md.Hll.Regwidth, res.Hll.Log2m, res.Hll.Regwidth)
+			}
+			res.Hll = md.Hll
+		}
+		if md.DomainLabels != 0 {
+			if res.DomainLabels != 0 && res.DomainLabels != md.DomainLabels {
+				return nil, fmt.Errorf("domain labels mismatch: dataset %s has %d, expected %d",
+					dataset.extraSourceFilename, md.DomainLabels, res.DomainLabels)
+			}
+			res.DomainLabels = md.DomainLabels
+		}
+		for _, filter := range md.Filters {
+			if !slices.ContainsFunc(res.Filters, filter.equal) {
+				res.Filters = append(res.Filters, filter)
+			}
+		}
+	}
+
+	slices.Sort(res.Sources)
+	slices.Sort(res.Sites)
+	res.Parents = slices.Compact(slices.Sorted(slices.Values(res.Parents)))
+
+	return res, nil
+}
+
+// digestReader computes the SHA-256 digest of the data read through it
+type digestReader struct {
+	reader io.Reader
+	hash   hash.Hash
+}
+
+func newDigestReader(reader io.Reader) *digestReader {
+	return &digestReader{reader: reader, hash: sha256.New()}
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.reader.Read(p)
+	dr.hash.Write(p[:n])
+	return n, err
+}
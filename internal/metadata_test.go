@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	InitStats()
+}
+
+func TestCollector_Metadata(t *testing.T) {
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	collector.SetProvenance("Example Operator", []string{"ams1", "fra1"})
+	if err := collector.ProcessFiles(context.Background(), []string{"../testdata/test1.pcap.gz"}, "pcap", nil, io.Discard); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	md := collector.Result.Metadata
+	if md == nil {
+		t.Fatal("Expected metadata in collected dataset")
+	}
+	if !slices.Equal(md.Sources, []string{"Example Operator"}) || !slices.Equal(md.Sites, []string{"ams1", "fra1"}) {
+		t.Errorf("Unexpected sources/sites: %q %v", md.Sources, md.Sites)
+	}
+
+	data, err := os.ReadFile("../testdata/test1.pcap.gz")
+	if err != nil {
+		t.Fatalf("Failed to read test file: %v", err)
+	}
+	digest := sha256.Sum256(data)
+	if len(md.InputFiles) != 1 {
+		t.Fatalf("Expected 1 input file, got %d", len(md.InputFiles))
+	}
+	if md.InputFiles[0].Size != int64(len(data)) || !bytes.Equal(md.InputFiles[0].SHA256, digest[:]) {
+		t.Errorf("Unexpected input file %+v", md.InputFiles[0])
+	}
+
+	if md.Window == nil || md.Window.Start.IsZero() || md.Window.End.Before(md.Window.Start.Time) {
+		t.Errorf("Expected collection window from packet timestamps, got %+v", md.Window)
+	}
+	if *md.Truncation != (TruncationLengths{IPv4: 24, IPv6: 48}) {
+		t.Errorf("Unexpected truncation lengths %+v", md.Truncation)
+	}
+	if *md.Hll != (HllParameters{Log2m: 14, Regwidth: 5}) {
+		t.Errorf("Unexpected HLL parameters %+v", md.Hll)
+	}
+	if md.DomainLabels != DefaultDNSDomainNameLabels {
+		t.Errorf("Expected %d domain labels, got %d", DefaultDNSDomainNameLabels, md.DomainLabels)
+	}
+	if len(md.Parents) != 0 {
+		t.Errorf("Expected no parents of collected dataset, got %v", md.Parents)
+	}
+}
+
+func TestCollector_MetadataChunked(t *testing.T) {
+	// Chunks aggregated during collection are not recorded as parents
+	collector := NewCollector(DefaultDomainCount, 10, false, nil, NewTimingStats())
+	if err := collector.ProcessFiles(context.Background(), []string{"../testdata/test2.tsv"}, "tsv", nil, io.Discard); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+	if collector.chunkCount == 0 {
+		t.Fatal("Expected chunks to be processed")
+	}
+	if md := collector.Result.Metadata; len(md.Parents) != 0 || len(md.InputFiles) != 1 {
+		t.Errorf("Unexpected metadata after chunked collection: %+v", md)
+	}
+}
+
+// newMetadataDataset creates a dataset with some queries and the given provenance
+func newMetadataDataset(t *testing.T, source string, sites []string, window ...time.Time) MagnitudeDataset {
+	t.Helper()
+
+	collector, err := loadDatasetFromCSV("192.168.1.10,example.com,5\n", "2026-09-01", false)
+	if err != nil {
+		t.Fatalf("loadDatasetFromCSV failed: %v", err)
+	}
+	collector.SetProvenance(source, sites)
+	for _, ts := range window {
+		collector.observeTimestamp(ts)
+	}
+	return collector.Result
+}
+
+func TestAggregateDatasets_Metadata(t *testing.T) {
+	t1 := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	t3 := time.Date(2026, 9, 1, 23, 59, 59, 0, time.UTC)
+
+	datasets := []MagnitudeDataset{
+		newMetadataDataset(t, "Operator B", []string{"fra1"}, t2, t3),
+		newMetadataDataset(t, "Operator A", []string{"ams1", "fra1"}, t1),
+		newMetadataDataset(t, "Operator A", nil),
+	}
+	// A version 1 dataset without metadata
+	v1 := newMetadataDataset(t, "", nil)
+	v1.Metadata = nil
+	datasets = append(datasets, v1)
+
+	// Aggregate one at a time, like DatasetSequence does
+	seq := NewDatasetSequence(0, nil, false, nil)
+	var ids []string
+	for _, dataset := range datasets {
+		ids = append(ids, dataset.Identifier)
+		if err := seq.addDataset(dataset); err != nil {
+			t.Fatalf("addDataset failed: %v", err)
+		}
+	}
+
+	md := seq.Result.Metadata
+	slices.Sort(ids)
+	if !slices.Equal(md.Parents, ids) {
+		t.Errorf("Expected parents %v, got %v", ids, md.Parents)
+	}
+	if !slices.Equal(md.Sources, []string{"Operator A", "Operator B"}) {
+		t.Errorf("Unexpected sources %q", md.Sources)
+	}
+	if !slices.Equal(md.Sites, []string{"ams1", "fra1"}) {
+		t.Errorf("Unexpected sites %v", md.Sites)
+	}
+	if md.Window == nil || !md.Window.Start.Equal(t1) || !md.Window.End.Equal(t3) {
+		t.Errorf("Unexpected collection window %+v", md.Window)
+	}
+	if md.Truncation == nil || md.Hll == nil || md.DomainLabels != DefaultDNSDomainNameLabels {
+		t.Errorf("Expected collection settings to be preserved, got %+v", md)
+	}
+
+	// Once saved and loaded again, the aggregate and its parents are the parents of a further aggregate
+	var buf bytes.Buffer
+	if _, err := WriteDNSMagFile(seq.Result, "-", &buf); err != nil {
+		t.Fatalf("WriteDNSMagFile failed: %v", err)
+	}
+	more := newMetadataDataset(t, "Operator C", nil)
+	buf.Write(mustMarshalDataset(t, more))
+
+	seq2 := NewDatasetSequence(0, nil, false, nil)
+	if err := seq2.LoadDNSMagSequenceFromReader(&buf, "<buffer#%d>"); err != nil {
+		t.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+	}
+	expected := append([]string{seq.Result.Identifier, more.Identifier}, ids...)
+	slices.Sort(expected)
+	if !slices.Equal(seq2.Result.Metadata.Parents, expected) {
+		t.Errorf("Expected parents %v, got %v", expected, seq2.Result.Metadata.Parents)
+	}
+	if !slices.Equal(seq2.Result.Metadata.Sources, []string{"Operator A", "Operator B", "Operator C"}) {
+		t.Errorf("Unexpected sources %q", seq2.Result.Metadata.Sources)
+	}
+}
+
+func TestAggregateDatasets_MetadataMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(md *DatasetMetadata)
+		errMsg string
+	}{
+		{"truncation", func(md *DatasetMetadata) { md.Truncation = &TruncationLengths{IPv4: 16, IPv6: 48} }, "truncation length mismatch"},
+		{"hll", func(md *DatasetMetadata) { md.Hll = &HllParameters{Log2m: 11, Regwidth: 5} }, "HLL parameter mismatch"},
+		{"domain labels", func(md *DatasetMetadata) { md.DomainLabels = 2 }, "domain labels mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newMetadataDataset(t, "", nil)
+			b := newMetadataDataset(t, "", nil)
+			tt.modify(b.Metadata)
+
+			_, err := AggregateDatasets([]MagnitudeDataset{a, b})
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func mustMarshalDataset(t *testing.T, dataset MagnitudeDataset) []byte {
+	t.Helper()
+
+	data, err := MarshalDatasetToCBOR(dataset)
+	if err != nil {
+		t.Fatalf("Failed to marshal dataset: %v", err)
+	}
+	return data
+}
@@ -0,0 +1,209 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics holds counters and gauges of long-running collections, exposed in OpenMetrics format.
+// A single Metrics can be shared by several collectors, e.g. one per day or per input file.
+type Metrics struct {
+	recordsProcessed atomic.Uint64
+	invalidRecords   atomic.Uint64
+	invalidDomains   atomic.Uint64
+	chunkFlushes     atomic.Uint64
+	filesProcessed   atomic.Uint64
+	bytesProcessed   atomic.Uint64
+	datasetsWritten  atomic.Uint64
+
+	mu              sync.Mutex
+	fileSeconds     float64               // Total time spent processing input files
+	lastFileRecords float64               // Records per second of the last processed input file
+	lastFileBytes   float64               // Bytes per second of the last processed input file
+	datasets        map[any]datasetGauges // Gauges of datasets in memory, by owner
+}
+
+// datasetGauges is the size of a dataset held in memory by a collector (or other owner)
+type datasetGauges struct {
+	domains  int
+	hllBytes int
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		datasets: make(map[any]datasetGauges),
+	}
+}
+
+// fileCompleted records the throughput of a processed input file
+func (m *Metrics) fileCompleted(bytes int64, records uint, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.filesProcessed.Add(1)
+	if bytes > 0 {
+		m.bytesProcessed.Add(uint64(bytes))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fileSeconds += elapsed.Seconds()
+	if elapsed > 0 {
+		m.lastFileRecords = float64(records) / elapsed.Seconds()
+		m.lastFileBytes = float64(bytes) / elapsed.Seconds()
+	}
+}
+
+// datasetWritten counts a written dataset
+func (m *Metrics) datasetWritten() {
+	if m == nil {
+		return
+	}
+	m.datasetsWritten.Add(1)
+}
+
+// setDatasets records the number of domains and HLL storage size of datasets held in memory by owner
+func (m *Metrics) setDatasets(owner any, datasets ...*MagnitudeDataset) {
+	if m == nil {
+		return
+	}
+
+	var gauges datasetGauges
+	seen := make(map[DomainName]struct{})
+	for _, dataset := range datasets {
+		gauges.hllBytes += len(dataset.AllClientsHll.ToBytes())
+		for name, domain := range dataset.Domains {
+			seen[name] = struct{}{}
+			gauges.hllBytes += len(domain.Hll.ToBytes())
+		}
+	}
+	gauges.domains = len(seen)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.datasets[owner] = gauges
+}
+
+// removeDatasets forgets about the datasets of an owner no longer holding them in memory
+func (m *Metrics) removeDatasets(owner any) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.datasets, owner)
+}
+
+// metricFamily is a single OpenMetrics metric family with one sample
+type metricFamily struct {
+	name   string
+	kind   string // counter or gauge
+	help   string
+	value  float64
+	labels string
+}
+
+// WriteOpenMetrics writes all metrics in OpenMetrics text format
+func (m *Metrics) WriteOpenMetrics(w io.Writer) error {
+	m.mu.Lock()
+	var domains, hllBytes int
+	for _, gauges := range m.datasets {
+		domains += gauges.domains
+		hllBytes += gauges.hllBytes
+	}
+	fileSeconds, lastFileRecords, lastFileBytes := m.fileSeconds, m.lastFileRecords, m.lastFileBytes
+	m.mu.Unlock()
+
+	families := []metricFamily{
+		{"dnsmag_build_info", "gauge", "Version of dnsmag", 1, fmt.Sprintf(`version="%s"`, escapeLabelValue(Version))},
+		{"dnsmag_records_processed", "counter", "Number of records processed", float64(m.recordsProcessed.Load()), ""},
+		{"dnsmag_invalid_records", "counter", "Number of invalid records encountered", float64(m.invalidRecords.Load()), ""},
+		{"dnsmag_invalid_domains", "counter", "Number of invalid domains encountered", float64(m.invalidDomains.Load()), ""},
+		{"dnsmag_chunk_flushes", "counter", "Number of chunks aggregated into the result", float64(m.chunkFlushes.Load()), ""},
+		{"dnsmag_input_files", "counter", "Number of input files processed", float64(m.filesProcessed.Load()), ""},
+		{"dnsmag_input_bytes", "counter", "Number of bytes read from input files", float64(m.bytesProcessed.Load()), ""},
+		{"dnsmag_input_file_processing_seconds", "counter", "Time spent processing input files", fileSeconds, ""},
+		{"dnsmag_last_input_file_records_per_second", "gauge", "Records processed per second in the last input file", lastFileRecords, ""},
+		{"dnsmag_last_input_file_bytes_per_second", "gauge", "Bytes read per second in the last input file", lastFileBytes, ""},
+		{"dnsmag_datasets_written", "counter", "Number of datasets written", float64(m.datasetsWritten.Load()), ""},
+		{"dnsmag_tracked_domains", "gauge", "Number of domains in datasets held in memory", float64(domains), ""},
+		{"dnsmag_hll_storage_bytes", "gauge", "HLL storage size of datasets held in memory", float64(hllBytes), ""},
+	}
+
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.name, f.kind)
+		fmt.Fprintf(&b, "# HELP %s %s.\n", f.name, f.help)
+
+		sample := f.name
+		if f.kind == "counter" {
+			sample += "_total"
+		}
+		if f.labels != "" {
+			sample += "{" + f.labels + "}"
+		}
+		fmt.Fprintf(&b, "%s %s\n", sample, formatMetricValue(f.value))
+	}
+	b.WriteString("# EOF\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatMetricValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// ServeHTTP serves the metrics in OpenMetrics text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	_ = m.WriteOpenMetrics(w)
+}
+
+// ServeMetrics serves the metrics on /metrics at the listen address until the context is cancelled.
+// Returns once the listener is open, the server runs in the background.
+func ServeMetrics(ctx context.Context, address string, m *Metrics, logger io.Writer) (net.Addr, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(logger, "Metrics server failed: %v\n", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	return listener.Addr(), nil
+}
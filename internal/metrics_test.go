@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	InitStats()
+}
+
+func TestMetrics_Collect(t *testing.T) {
+	metrics := NewMetrics()
+
+	date := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	collector := NewCollector(DefaultDomainCount, 10, false, &date, NewTimingStats())
+	collector.SetMetrics(metrics)
+	if err := collector.ProcessFiles(context.Background(), []string{"../testdata/test2.tsv"}, "tsv", nil, io.Discard); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := metrics.WriteOpenMetrics(&buf); err != nil {
+		t.Fatalf("WriteOpenMetrics failed: %v", err)
+	}
+	output := buf.String()
+
+	for _, expected := range []string{
+		`(?m)^dnsmag_build_info\{version=".+"\} 1$`,
+		`(?m)^dnsmag_records_processed_total 26$`,
+		`(?m)^dnsmag_invalid_records_total 0$`,
+		`(?m)^dnsmag_chunk_flushes_total [1-9]\d*$`,
+		`(?m)^dnsmag_input_files_total 1$`,
+		`(?m)^dnsmag_input_bytes_total [1-9]\d*$`,
+		`(?m)^dnsmag_tracked_domains [1-9]\d*$`,
+		`(?m)^dnsmag_hll_storage_bytes [1-9]\d*$`,
+		`(?m)^# TYPE dnsmag_records_processed counter$`,
+		`(?m)^# TYPE dnsmag_tracked_domains gauge$`,
+	} {
+		if !regexp.MustCompile(expected).MatchString(output) {
+			t.Errorf("Expected output to match %s, got:\n%s", expected, output)
+		}
+	}
+	if !strings.HasSuffix(output, "# EOF\n") {
+		t.Errorf("Expected output to end with # EOF, got:\n%s", output)
+	}
+
+	// Gauges of datasets no longer held in memory are dropped
+	metrics.removeDatasets(collector)
+	buf.Reset()
+	_ = metrics.WriteOpenMetrics(&buf)
+	if !regexp.MustCompile(`(?m)^dnsmag_tracked_domains 0$`).MatchString(buf.String()) {
+		t.Errorf("Expected no tracked domains after removal, got:\n%s", buf.String())
+	}
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	// Collectors without metrics must work as before
+	var metrics *Metrics
+	metrics.fileCompleted(100, 10, time.Second)
+	metrics.datasetWritten()
+	metrics.setDatasets("owner")
+	metrics.removeDatasets("owner")
+
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	collector.SetMetrics(nil)
+	if err := collector.ProcessFiles(context.Background(), []string{"../testdata/test2.tsv"}, "tsv", nil, io.Discard); err != nil {
+		t.Fatalf("ProcessFiles failed: %v", err)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := NewMetrics()
+	metrics.datasetWritten()
+
+	addr, err := ServeMetrics(ctx, "127.0.0.1:0", metrics, io.Discard)
+	if err != nil {
+		t.Fatalf("ServeMetrics failed: %v", err)
+	}
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/openmetrics-text") {
+		t.Errorf("Unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(string(body), "dnsmag_datasets_written_total 1\n") {
+		t.Errorf("Expected datasets written counter in response:\n%s", body)
+	}
+
+	// The server is stopped when the context is cancelled
+	cancel()
+	for range 100 {
+		if _, err = http.Get("http://" + addr.String() + "/metrics"); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err == nil {
+		t.Error("Expected metrics server to be stopped after cancelling the context")
+	}
+}
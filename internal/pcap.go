@@ -3,6 +3,8 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/netip"
@@ -12,13 +14,19 @@ import (
 	"github.com/google/gopacket/pcapgo"
 )
 
-func LoadPcap(reader io.Reader, collector *Collector) error {
+// errTruncatedPcap is returned by LoadPcap if the capture ends in the middle of a record, as a capture cut
+// off by rotation does. The packets before the truncated record are loaded.
+var errTruncatedPcap = errors.New("capture ends with a truncated record")
+
+// LoadPcap loads DNS queries from a (possibly gzipped) PCAP reader into a collector. Loading stops with
+// the context's error if the context is cancelled.
+func LoadPcap(ctx context.Context, reader io.Reader, collector *Collector) error {
 	pcapReader, err := pcapgo.NewReader(reader)
 	if err != nil {
 		return fmt.Errorf("failed to create pcap reader: %w", err)
 	}
 
-	err = processPackets(pcapReader, collector)
+	err = processPackets(ctx, pcapReader, collector)
 	if err != nil {
 		return fmt.Errorf("failed to process packets: %w", err)
 	}
@@ -27,11 +35,28 @@ func LoadPcap(reader io.Reader, collector *Collector) error {
 }
 
 // Count DNS domain queries per domain and unique source IPs
-func processPackets(reader *pcapgo.Reader, collector *Collector) error {
+func processPackets(ctx context.Context, reader *pcapgo.Reader, collector *Collector) error {
 	firstPacket := true
 
+	// Packets are read in this goroutine rather than from PacketSource.Packets(), which would leave its
+	// reading goroutine blocked if loading stops early
 	packetSource := gopacket.NewPacketSource(reader, reader.LinkType())
-	for packet := range packetSource.Packets() {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		packet, err := packetSource.NextPacket()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return errTruncatedPcap
+		}
+		if err != nil {
+			return err
+		}
+
 		if firstPacket {
 			// Set the dataset date from first packet's timestamp if no date was set in the collector
 			if collector.dateProvided == nil {
@@ -40,13 +65,14 @@ func processPackets(reader *pcapgo.Reader, collector *Collector) error {
 			}
 			firstPacket = false
 		}
+		collector.observeTimestamp(packet.Metadata().Timestamp)
 
 		if dnsLayer := packet.Layer(layers.LayerTypeDNS); dnsLayer != nil {
 			dns, _ := dnsLayer.(*layers.DNS)
 
 			src, err := extractSrcIP(packet)
 			if err != nil {
-				collector.invalidRecordCount++
+				collector.countInvalidRecord()
 				continue
 			}
 
@@ -59,8 +85,6 @@ func processPackets(reader *pcapgo.Reader, collector *Collector) error {
 			}
 		}
 	}
-
-	return nil
 }
 
 // extractSrcIP extracts the source IP address from a packet as IPAddress (masked)
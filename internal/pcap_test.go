@@ -1,8 +1,18 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
 	"testing"
 	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 )
 
 func init() {
@@ -48,7 +58,7 @@ func TestLoadPcap_TestData(t *testing.T) {
 			reader := readerFromFile(t, tt.pcapFile)
 
 			// Load and process the PCAP file
-			err := LoadPcap(reader, collector)
+			err := LoadPcap(context.Background(), reader, collector)
 
 			if tt.expectError {
 				if err == nil {
@@ -92,3 +102,85 @@ func TestLoadPcap_TestData(t *testing.T) {
 		})
 	}
 }
+
+// writeTestPcap returns a PCAP with count DNS queries for a domain from different clients
+func writeTestPcap(t *testing.T, count int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writer := pcapgo.NewWriter(&buf)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatalf("Failed to write PCAP header: %v", err)
+	}
+	for i := range count {
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolUDP,
+			SrcIP:    net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+			DstIP:    net.IPv4(192, 0, 2, 53),
+		}
+		udp := &layers.UDP{SrcPort: 12345, DstPort: 53}
+		if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+			t.Fatalf("Failed to set network layer: %v", err)
+		}
+		dns := &layers.DNS{
+			ID:        uint16(i),
+			RD:        true,
+			Questions: []layers.DNSQuestion{{Name: []byte(fmt.Sprintf("q%d.example.com", i)), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		}
+
+		packet := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(packet, opts, eth, ip, udp, dns); err != nil {
+			t.Fatalf("Failed to serialize packet: %v", err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: time.Date(2026, 9, 1, 0, 0, i, 0, time.UTC), CaptureLength: len(packet.Bytes()), Length: len(packet.Bytes())}
+		if err := writer.WritePacket(ci, packet.Bytes()); err != nil {
+			t.Fatalf("Failed to write packet: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestLoadPcap_CancelledWhileReading(t *testing.T) {
+	pcap := writeTestPcap(t, 5000)
+
+	before := runtime.NumGoroutine()
+	for range 5 {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader := &cancelAfterReader{reader: bytes.NewReader(pcap), limit: 64 * 1024, cancel: cancel}
+		collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+		if err := LoadPcap(ctx, reader, collector); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected context.Canceled error, got: %v", err)
+		}
+		if collector.recordCount == 0 || collector.recordCount >= 5000 {
+			t.Errorf("Expected loading to stop after some records, got %d", collector.recordCount)
+		}
+		cancel()
+	}
+
+	// No goroutines reading packets are left behind
+	time.Sleep(50 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected no leaked goroutines, had %d before and %d after", before, after)
+	}
+}
+
+func TestLoadPcap_Generated(t *testing.T) {
+	collector := NewCollector(DefaultDomainCount, 0, false, nil, NewTimingStats())
+	if err := LoadPcap(context.Background(), bytes.NewReader(writeTestPcap(t, 300)), collector); err != nil {
+		t.Fatalf("LoadPcap failed: %v", err)
+	}
+	if err := collector.Finalise(); err != nil {
+		t.Fatalf("Finalise failed: %v", err)
+	}
+	if collector.Result.AllQueriesCount != 300 || collector.Result.Domains["com"].QueriesCount != 300 {
+		t.Errorf("Expected 300 queries for com, got %d", collector.Result.AllQueriesCount)
+	}
+}
@@ -0,0 +1,93 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"context"
+	"crypto/md5" // #nosec G501 -- S3 ETags are MD5 digests, not used for security
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// md5ETag matches the ETags of objects uploaded in a single part without KMS encryption, which are the
+// hex encoded MD5 of the object
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// PublishKey returns the object key of a DNSMAG file in a bucket, under prefix, the same as
+// examples/dataset2bucket.sh: year=YYYY/month=MM/day=DD/id=<hex encoded SHA-256 of the file>
+func PublishKey(prefix string, date time.Time, data []byte) string {
+	digest := sha256.Sum256(data)
+	key := fmt.Sprintf("year=%04d/month=%02d/day=%02d/id=%s", date.Year(), date.Month(), date.Day(), hex.EncodeToString(digest[:]))
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+	return key
+}
+
+// PublishResult is the outcome of publishing a file
+type PublishResult struct {
+	Key      string
+	Size     int
+	Existing bool // An identical object was already published
+}
+
+// PublishFile uploads data to key, unless an identical object is already there and force is not set.
+// The uploaded object is verified against the size and digest of data.
+func PublishFile(ctx context.Context, client *S3Client, key string, data []byte, force bool) (PublishResult, error) {
+	res := PublishResult{Key: key, Size: len(data)}
+
+	if !force {
+		object, err := client.HeadObject(ctx, key)
+		if err != nil {
+			return res, fmt.Errorf("failed to check for %s: %w", client.URL(key), err)
+		}
+		if object != nil && verifyObject(object, data) == nil {
+			res.Existing = true
+			return res, nil
+		}
+	}
+
+	if err := client.PutObject(ctx, key, data); err != nil {
+		return res, fmt.Errorf("failed to upload %s: %w", client.URL(key), err)
+	}
+
+	object, err := client.HeadObject(ctx, key)
+	if err != nil {
+		return res, fmt.Errorf("failed to verify %s: %w", client.URL(key), err)
+	}
+	if object == nil {
+		return res, fmt.Errorf("failed to verify %s: not found after upload", client.URL(key))
+	}
+	if err := verifyObject(object, data); err != nil {
+		return res, fmt.Errorf("failed to verify %s: %w", client.URL(key), err)
+	}
+	return res, nil
+}
+
+// verifyObject checks that an object has the size and the SHA-256 checksum of data, or if the service
+// did not return a checksum, an ETag with the MD5 digest of data
+func verifyObject(object *S3Object, data []byte) error {
+	if object.Size != int64(len(data)) {
+		return fmt.Errorf("size %d, expected %d", object.Size, len(data))
+	}
+	if object.ChecksumSHA256 != "" {
+		digest := sha256.Sum256(data)
+		if expected := base64.StdEncoding.EncodeToString(digest[:]); object.ChecksumSHA256 != expected {
+			return fmt.Errorf("SHA-256 checksum %s, expected %s", object.ChecksumSHA256, expected)
+		}
+		return nil
+	}
+	if md5ETag.MatchString(object.ETag) {
+		digest := md5.Sum(data) // #nosec G401
+		if expected := hex.EncodeToString(digest[:]); object.ETag != expected {
+			return fmt.Errorf("ETag %s, expected the MD5 digest %s", object.ETag, expected)
+		}
+		return nil
+	}
+	return fmt.Errorf("no digest to verify the object with, ETag %q and no SHA-256 checksum", object.ETag)
+}
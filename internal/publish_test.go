@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishKey(t *testing.T) {
+	date := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	// The SHA-256 of "dataset"
+	id := "id=b277fd623676a525c29b9eb155afc8c9010681814ceafb2d7627f47b9a232576"
+
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{"", "year=2026/month=09/day=01/" + id},
+		{"datasets", "datasets/year=2026/month=09/day=01/" + id},
+		{"/datasets/", "datasets/year=2026/month=09/day=01/" + id},
+	}
+	for _, tt := range tests {
+		if key := PublishKey(tt.prefix, date, []byte("dataset")); key != tt.expected {
+			t.Errorf("Expected key %s, got %s", tt.expected, key)
+		}
+	}
+}
+
+func TestPublishFile(t *testing.T) {
+	for _, checksums := range []bool{true, false} {
+		fake, client := newFakeS3(t, checksums)
+		ctx := context.Background()
+		data := []byte("dataset")
+		key := PublishKey("", time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), data)
+
+		res, err := PublishFile(ctx, client, key, data, false)
+		if err != nil || res.Existing || res.Key != key || res.Size != len(data) || fake.puts != 1 {
+			t.Fatalf("Expected the file to be uploaded, got %+v (%v)", res, err)
+		}
+
+		// Publishing again finds the object, unless forced
+		res, err = PublishFile(ctx, client, key, data, false)
+		if err != nil || !res.Existing || fake.puts != 1 {
+			t.Errorf("Expected the file to be published already, got %+v (%v)", res, err)
+		}
+		res, err = PublishFile(ctx, client, key, data, true)
+		if err != nil || res.Existing || fake.puts != 2 {
+			t.Errorf("Expected the file to be uploaded again, got %+v (%v)", res, err)
+		}
+
+		// A corrupted upload is detected, and replaced when publishing again
+		fake.corrupt = true
+		if _, err := PublishFile(ctx, client, key, data, true); err == nil || !strings.Contains(err.Error(), "failed to verify") {
+			t.Errorf("Expected a verification error, got %v", err)
+		}
+		fake.corrupt = false
+		res, err = PublishFile(ctx, client, key, data, false)
+		if err != nil || res.Existing || string(fake.objects[key]) != "dataset" {
+			t.Errorf("Expected the corrupted object to be replaced, got %+v (%v)", res, err)
+		}
+	}
+}
+
+func TestVerifyObject(t *testing.T) {
+	data := []byte("dataset")
+	tests := []struct {
+		name   string
+		object S3Object
+		valid  bool
+	}{
+		{"checksum", S3Object{Size: 7, ChecksumSHA256: "snf9YjZ2pSXCm56xVa/IyQEGgYFM6vstdif0e5ojJXY="}, true},
+		{"wrong checksum", S3Object{Size: 7, ChecksumSHA256: "AAAA"}, false},
+		{"etag", S3Object{Size: 7, ETag: "3c4d09e4ef50b370ae0efacdb43ec2dd"}, true},
+		{"wrong etag", S3Object{Size: 7, ETag: "f2e6b4e5e6e2ba7b3bd8b51d9d5dbb34"}, false},
+		{"wrong size", S3Object{Size: 8, ChecksumSHA256: "snf9YjZ2pSXCm56xVa/IyQEGgYFM6vstdif0e5ojJXY="}, false},
+		{"multipart etag", S3Object{Size: 7, ETag: "3c4d09e4ef50b370ae0efacdb43ec2dd-2"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyObject(&tt.object, data); (err == nil) != tt.valid {
+				t.Errorf("Expected valid %v, got %v", tt.valid, err)
+			}
+		})
+	}
+}
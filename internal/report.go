@@ -3,42 +3,143 @@
 package internal
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/google/uuid"
 )
 
+// Formats reports can be written in
+var ReportFormats = []string{"json", "csv", "tsv", "markdown", "html", "cbor"}
+
 type Report struct {
-	Identifier         string          `json:"id"`
-	Generator          string          `json:"generator"`
-	Date               string          `json:"date"`
-	Source             string          `json:"source"`
-	SourceType         string          `json:"sourceType"`
-	TotalUniqueClients uint64          `json:"totalUniqueClients"`
-	TotalQueryVolume   uint64          `json:"totalQueryVolume"`
-	MagnitudeData      []MagnitudeData `json:"magnitudeData"`
+	Identifier              string          `json:"id"`
+	Generator               string          `json:"generator"`
+	Date                    string          `json:"date,omitempty"`   // Day of a report from a single day
+	Period                  *ReportPeriod   `json:"period,omitempty"` // Days of a report from a multi-day rollup
+	Source                  string          `json:"source"`
+	SourceType              string          `json:"sourceType"`
+	ConfidenceLevel         float64         `json:"confidenceLevel,omitempty"` // Confidence level of the intervals, if included
+	TotalUniqueClients      uint64          `json:"totalUniqueClients"`
+	TotalUniqueClientsLower *uint64         `json:"totalUniqueClientsLower,omitempty"`
+	TotalUniqueClientsUpper *uint64         `json:"totalUniqueClientsUpper,omitempty"`
+	TotalQueryVolume        uint64          `json:"totalQueryVolume"`
+	MagnitudeData           []MagnitudeData `json:"magnitudeData"`
+}
+
+// ReportPeriod is the range of days covered by a report from a multi-day rollup
+type ReportPeriod struct {
+	Start        string   `json:"start"`
+	End          string   `json:"end"`
+	Days         int      `json:"days"`
+	MissingDates []string `json:"missingDates,omitempty"` // Days in the period without any data
 }
 
 type MagnitudeData struct {
-	Domain        string  `json:"domain"`
-	Magnitude     float64 `json:"magnitude"`
-	UniqueClients uint64  `json:"uniqueClients"`
-	QueryVolume   uint64  `json:"queryVolume"`
+	Domain             string   `json:"domain"`
+	Magnitude          float64  `json:"magnitude"`
+	MagnitudeLower     *float64 `json:"magnitudeLower,omitempty"`
+	MagnitudeUpper     *float64 `json:"magnitudeUpper,omitempty"`
+	UniqueClients      uint64   `json:"uniqueClients"`
+	UniqueClientsLower *uint64  `json:"uniqueClientsLower,omitempty"`
+	UniqueClientsUpper *uint64  `json:"uniqueClientsUpper,omitempty"`
+	QueryVolume        uint64   `json:"queryVolume"`
+}
+
+// ReportOptions are optional settings for generating reports
+type ReportOptions struct {
+	ConfidenceLevel float64 // Include intervals of the unique clients and magnitudes at this level, e.g. 0.95 (0 = no intervals)
+}
+
+// CheckConfidenceLevel returns an error if level can not be used as ReportOptions.ConfidenceLevel
+func CheckConfidenceLevel(level float64) error {
+	if !(level >= 0 && level < 1) {
+		return fmt.Errorf("invalid confidence level %v, must be at least 0 and less than 1", level)
+	}
+	return nil
+}
+
+// hllRelativeError returns the relative error of the HLL estimates of a dataset at a confidence level.
+// The standard error of an HLL with m registers is 1.04/sqrt(m), about 0.81% with the default log2m 14.
+// Small cardinalities are estimated with linear counting, which is more accurate, so the error is an
+// upper bound for them.
+func hllRelativeError(stats MagnitudeDataset, level float64) float64 {
+	log2m := hllSettings.Log2m
+	if stats.Metadata != nil && stats.Metadata.Hll != nil {
+		log2m = stats.Metadata.Hll.Log2m
+	}
+	z := math.Sqrt2 * math.Erfinv(level) // Two-sided quantile of the normal distribution
+	return z * 1.04 / math.Sqrt(float64(uint64(1)<<log2m))
+}
+
+// clientsInterval returns the bounds of the true number of clients of an estimate with a relative error.
+// A non-zero estimate means that at least one client was seen.
+func clientsInterval(estimate uint64, relErr float64) (uint64, uint64) {
+	if estimate == 0 {
+		return 0, 0
+	}
+	lower := math.Max(math.Floor(float64(estimate)*(1-relErr)), 1)
+	upper := math.Ceil(float64(estimate) * (1 + relErr))
+	return uint64(lower), uint64(upper)
+}
+
+// magnitudeInterval returns the bounds of the magnitude of a domain from the bounds of its clients and of
+// all clients. The errors of both estimates are propagated as worst cases: the lower bound has the fewest
+// clients of the domain out of the most clients in total, and the upper bound the opposite.
+func magnitudeInterval(domainLower, domainUpper, allLower, allUpper uint64) (float64, float64) {
+	magnitude := func(domain, all uint64) float64 {
+		if all <= 1 {
+			return 10
+		}
+		return min(max(math.Log(float64(domain))/math.Log(float64(all))*10, 0), 10)
+	}
+	return magnitude(domainLower, allUpper), magnitude(domainUpper, allLower)
 }
 
 // GenerateReport creates a JSON report from a MagnitudeDataset
 func GenerateReport(stats MagnitudeDataset, source, sourceType string) Report {
+	return GenerateReportWithOptions(stats, source, sourceType, ReportOptions{})
+}
+
+// GenerateReportWithOptions creates a JSON report from a MagnitudeDataset, with intervals of the estimates
+// if opts.ConfidenceLevel is set
+func GenerateReportWithOptions(stats MagnitudeDataset, source, sourceType string, opts ReportOptions) Report {
 	var magnitudeData []MagnitudeData
 
 	sortedDomains := stats.SortedByMagnitude()
 
+	var relErr float64
+	var allLower, allUpper uint64
+	if opts.ConfidenceLevel > 0 {
+		relErr = hllRelativeError(stats, opts.ConfidenceLevel)
+		allLower, allUpper = clientsInterval(stats.AllClientsCount, relErr)
+	}
+
 	for _, dm := range sortedDomains {
-		magnitudeData = append(magnitudeData, MagnitudeData{
+		data := MagnitudeData{
 			Domain:        string(dm.Domain),
 			Magnitude:     dm.Magnitude,
 			UniqueClients: dm.DomainHll.ClientsCount,
 			QueryVolume:   dm.DomainHll.QueriesCount,
-		})
+		}
+		if opts.ConfidenceLevel > 0 {
+			// A domain can not have more clients than there are in total
+			lower, upper := clientsInterval(dm.DomainHll.ClientsCount, relErr)
+			upper = min(upper, allUpper)
+			magnitudeLower, magnitudeUpper := magnitudeInterval(lower, upper, allLower, allUpper)
+			data.UniqueClientsLower, data.UniqueClientsUpper = &lower, &upper
+			data.MagnitudeLower, data.MagnitudeUpper = &magnitudeLower, &magnitudeUpper
+		}
+		magnitudeData = append(magnitudeData, data)
 	}
 
 	report := Report{
@@ -51,6 +152,216 @@ func GenerateReport(stats MagnitudeDataset, source, sourceType string) Report {
 		TotalQueryVolume:   stats.AllQueriesCount,
 		MagnitudeData:      magnitudeData,
 	}
+	if opts.ConfidenceLevel > 0 {
+		report.ConfidenceLevel = opts.ConfidenceLevel
+		report.TotalUniqueClientsLower, report.TotalUniqueClientsUpper = &allLower, &allUpper
+	}
+
+	if period := stats.period(); period != nil {
+		report.Date = ""
+		report.Period = &ReportPeriod{
+			Start: period.Start.Format(time.DateOnly),
+			End:   period.End.Format(time.DateOnly),
+			Days:  period.Days(),
+		}
+		for _, day := range period.Missing {
+			report.Period.MissingDates = append(report.Period.MissingDates, day.Format(time.DateOnly))
+		}
+	}
 
 	return report
 }
+
+// CheckReportFormat returns an error if format is not one of ReportFormats
+func CheckReportFormat(format string) error {
+	if !slices.Contains(ReportFormats, format) {
+		return fmt.Errorf("invalid format '%s', must be one of %s", format, strings.Join(ReportFormats, ", "))
+	}
+	return nil
+}
+
+// WriteReport writes a report in one of ReportFormats. JSON and CBOR contain the whole report as described
+// by the report schema, CSV and TSV a table of the magnitude data with a header, and Markdown and HTML a
+// summary of the report followed by a table of the magnitude data.
+func WriteReport(w io.Writer, report Report, format string) error {
+	switch format {
+	case "json":
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "csv":
+		return writeReportTable(w, report, ',')
+	case "tsv":
+		return writeReportTable(w, report, '\t')
+	case "markdown":
+		return writeReportMarkdown(w, report)
+	case "html":
+		return reportHTMLTemplate.Execute(w, reportSummary(report))
+	case "cbor":
+		// The field names are the same as in JSON, from the json struct tags
+		data, err := cbor.Marshal(report)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return CheckReportFormat(format)
+}
+
+// reportHeader returns the columns of the tables of magnitude data, matching the fields of MagnitudeData.
+// The columns of the intervals are only included if the report has them.
+func reportHeader(report Report) []string {
+	if report.ConfidenceLevel > 0 {
+		return []string{"domain", "magnitude", "magnitudeLower", "magnitudeUpper",
+			"uniqueClients", "uniqueClientsLower", "uniqueClientsUpper", "queryVolume"}
+	}
+	return []string{"domain", "magnitude", "uniqueClients", "queryVolume"}
+}
+
+func (m MagnitudeData) row(intervals bool) []string {
+	formatFloat := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	formatUint := func(u uint64) string { return strconv.FormatUint(u, 10) }
+	if intervals && m.MagnitudeLower != nil && m.UniqueClientsLower != nil {
+		return []string{
+			m.Domain,
+			formatFloat(m.Magnitude), formatFloat(*m.MagnitudeLower), formatFloat(*m.MagnitudeUpper),
+			formatUint(m.UniqueClients), formatUint(*m.UniqueClientsLower), formatUint(*m.UniqueClientsUpper),
+			formatUint(m.QueryVolume),
+		}
+	}
+	return []string{m.Domain, formatFloat(m.Magnitude), formatUint(m.UniqueClients), formatUint(m.QueryVolume)}
+}
+
+// writeReportTable writes the magnitude data of a report as CSV, separated by comma, or as TSV
+func writeReportTable(w io.Writer, report Report, comma rune) error {
+	writer := csv.NewWriter(w)
+	writer.Comma = comma
+	if err := writer.Write(reportHeader(report)); err != nil {
+		return err
+	}
+	for _, m := range report.MagnitudeData {
+		if err := writer.Write(m.row(report.ConfidenceLevel > 0)); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// reportSummaryItem is a line of the summary preceding the magnitude data in Markdown and HTML reports
+type reportSummaryItem struct {
+	Name  string
+	Value string
+}
+
+type reportDocument struct {
+	Title   string
+	Summary []reportSummaryItem
+	Header  []string
+	Rows    [][]string
+}
+
+func reportSummary(report Report) reportDocument {
+	doc := reportDocument{Header: reportHeader(report)}
+	if report.Period != nil {
+		doc.Title = fmt.Sprintf("DNS Magnitude report for %s to %s", report.Period.Start, report.Period.End)
+		doc.Summary = append(doc.Summary, reportSummaryItem{"Days", strconv.Itoa(report.Period.Days)})
+		if len(report.Period.MissingDates) > 0 {
+			doc.Summary = append(doc.Summary, reportSummaryItem{"Missing dates", strings.Join(report.Period.MissingDates, ", ")})
+		}
+	} else {
+		doc.Title = "DNS Magnitude report for " + report.Date
+	}
+	doc.Summary = append(doc.Summary,
+		reportSummaryItem{"Source", report.Source},
+		reportSummaryItem{"Source type", report.SourceType},
+		reportSummaryItem{"Total unique clients", strconv.FormatUint(report.TotalUniqueClients, 10)},
+	)
+	if report.TotalUniqueClientsLower != nil && report.TotalUniqueClientsUpper != nil {
+		doc.Summary = append(doc.Summary, reportSummaryItem{
+			fmt.Sprintf("Total unique clients (%.4g%% confidence)", report.ConfidenceLevel*100),
+			fmt.Sprintf("%d to %d", *report.TotalUniqueClientsLower, *report.TotalUniqueClientsUpper),
+		})
+	}
+	doc.Summary = append(doc.Summary,
+		reportSummaryItem{"Total query volume", strconv.FormatUint(report.TotalQueryVolume, 10)},
+		reportSummaryItem{"Identifier", report.Identifier},
+		reportSummaryItem{"Generator", report.Generator},
+	)
+	for _, m := range report.MagnitudeData {
+		doc.Rows = append(doc.Rows, m.row(report.ConfidenceLevel > 0))
+	}
+	return doc
+}
+
+// markdownEscaper escapes the characters that have a meaning in Markdown text and tables
+var markdownEscaper = strings.NewReplacer(
+	"\\", "\\\\", "|", "\\|", "*", "\\*", "_", "\\_", "`", "\\`", "[", "\\[", "]", "\\]", "<", "&lt;", ">", "&gt;",
+	"\n", " ",
+)
+
+func markdownRow(cells []string) string {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = markdownEscaper.Replace(cell)
+	}
+	return "| " + strings.Join(escaped, " | ") + " |\n"
+}
+
+// writeReportMarkdown writes a report as a Markdown document with a GitHub flavoured table
+func writeReportMarkdown(w io.Writer, report Report) error {
+	doc := reportSummary(report)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", markdownEscaper.Replace(doc.Title))
+	for _, item := range doc.Summary {
+		fmt.Fprintf(&b, "- **%s:** %s\n", item.Name, markdownEscaper.Replace(item.Value))
+	}
+	b.WriteString("\n")
+	b.WriteString(markdownRow(doc.Header))
+	b.WriteString("|:---|" + strings.Repeat("---:|", len(doc.Header)-1) + "\n")
+	for _, row := range doc.Rows {
+		b.WriteString(markdownRow(row))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var reportHTMLTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 1.5rem; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2rem 0.6rem; border-bottom: 1px solid #d9e2ec; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+dt { font-weight: 600; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<dl>
+{{- range .Summary}}
+<dt>{{.Name}}</dt><dd>{{.Value}}</dd>
+{{- end}}
+</dl>
+<table>
+<thead>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+</thead>
+<tbody>
+{{- range .Rows}}
+<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
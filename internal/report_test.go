@@ -1,8 +1,13 @@
 package internal
 
 import (
+	"bytes"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/fxamacker/cbor/v2"
 )
 
 func init() {
@@ -68,3 +73,194 @@ func TestGenerateReport_HardcodedComparison(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteReport(t *testing.T) {
+	report := Report{
+		Identifier:         "3fa85f64-5717-4562-b3fc-2c963f66afa6",
+		Generator:          "dnsmag undefined",
+		Date:               "2026-09-01",
+		Source:             "a|b <example>",
+		SourceType:         "recursive",
+		TotalUniqueClients: 4,
+		TotalQueryVolume:   10,
+		MagnitudeData: []MagnitudeData{
+			{Domain: "org", Magnitude: 5, UniqueClients: 2, QueryVolume: 3},
+			{Domain: "com", Magnitude: 7.92481250360578, UniqueClients: 3, QueryVolume: 7},
+		},
+	}
+
+	tests := []struct {
+		format   string
+		expected []string
+	}{
+		{"json", []string{`"sourceType": "recursive"`, `"magnitude": 7.92481250360578`}},
+		{"csv", []string{"domain,magnitude,uniqueClients,queryVolume\norg,5,2,3\ncom,7.92481250360578,3,7\n"}},
+		{"tsv", []string{"domain\tmagnitude\tuniqueClients\tqueryVolume\norg\t5\t2\t3\ncom\t7.92481250360578\t3\t7\n"}},
+		{"markdown", []string{
+			"# DNS Magnitude report for 2026-09-01\n",
+			"- **Source:** a\\|b &lt;example&gt;\n",
+			"| domain | magnitude | uniqueClients | queryVolume |\n|:---|---:|---:|---:|\n| org | 5 | 2 | 3 |\n",
+		}},
+		{"html", []string{
+			"<title>DNS Magnitude report for 2026-09-01</title>",
+			"<dt>Source</dt><dd>a|b &lt;example&gt;</dd>",
+			"<tr><td>com</td><td>7.92481250360578</td><td>3</td><td>7</td></tr>",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteReport(&buf, report, tt.format); err != nil {
+				t.Fatalf("WriteReport failed: %v", err)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(buf.String(), expected) {
+					t.Errorf("Expected %q in:\n%s", expected, buf.String())
+				}
+			}
+		})
+	}
+
+	// CBOR has the same content and field names as JSON
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, report, "cbor"); err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	var fields map[string]any
+	if err := cbor.Unmarshal(buf.Bytes(), &fields); err != nil || fields["totalQueryVolume"] != uint64(10) {
+		t.Errorf("Unexpected CBOR report %v (%v)", fields, err)
+	}
+	var decoded Report
+	if err := cbor.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, report) {
+		t.Errorf("CBOR report mismatch: %+v (%v)", decoded, err)
+	}
+
+	// Rollups have a period
+	report.Date = ""
+	report.Period = &ReportPeriod{Start: "2026-09-01", End: "2026-09-30", Days: 30, MissingDates: []string{"2026-09-02"}}
+	buf.Reset()
+	if err := WriteReport(&buf, report, "markdown"); err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	for _, expected := range []string{"report for 2026-09-01 to 2026-09-30", "- **Days:** 30\n", "- **Missing dates:** 2026-09-02\n"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in:\n%s", expected, buf.String())
+		}
+	}
+
+	if err := WriteReport(&buf, report, "xml"); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestClientsInterval(t *testing.T) {
+	tests := []struct {
+		estimate     uint64
+		relErr       float64
+		lower, upper uint64
+	}{
+		{0, 0.02, 0, 0},
+		{1, 0.02, 1, 2},
+		{1000, 0.0159, 984, 1016},
+		{1000000, 0.0159, 984100, 1015900},
+	}
+	for _, tt := range tests {
+		lower, upper := clientsInterval(tt.estimate, tt.relErr)
+		if lower != tt.lower || upper != tt.upper {
+			t.Errorf("clientsInterval(%d, %v) = %d, %d, expected %d, %d", tt.estimate, tt.relErr, lower, upper, tt.lower, tt.upper)
+		}
+	}
+}
+
+func TestMagnitudeInterval(t *testing.T) {
+	tests := []struct {
+		domainLower, domainUpper, allLower, allUpper uint64
+		lower, upper                                 float64
+	}{
+		{100, 100, 10000, 10000, 5, 5},
+		{90, 110, 9000, 11000, 4.8356, 5.1625},
+		{1, 2, 1, 3, 0, 10},            // Too few clients in total for an upper bound
+		{95, 105, 95, 105, 9.7849, 10}, // A domain can not have a magnitude above 10
+	}
+	for _, tt := range tests {
+		lower, upper := magnitudeInterval(tt.domainLower, tt.domainUpper, tt.allLower, tt.allUpper)
+		if math.Abs(lower-tt.lower) > 0.0001 || math.Abs(upper-tt.upper) > 0.0001 {
+			t.Errorf("magnitudeInterval(%d, %d, %d, %d) = %v, %v, expected %v, %v",
+				tt.domainLower, tt.domainUpper, tt.allLower, tt.allUpper, lower, upper, tt.lower, tt.upper)
+		}
+	}
+}
+
+func TestGenerateReportWithOptions_ConfidenceLevel(t *testing.T) {
+	dataset := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 4999}, "net": {0, 99}})
+
+	if report := GenerateReport(dataset, "test-source", "recursive"); report.ConfidenceLevel != 0 ||
+		report.TotalUniqueClientsLower != nil || report.MagnitudeData[0].MagnitudeLower != nil {
+		t.Errorf("Expected no intervals by default, got %+v", report)
+	}
+
+	var previous float64
+	for _, level := range []float64{0.68, 0.95, 0.99} {
+		report := GenerateReportWithOptions(dataset, "test-source", "recursive", ReportOptions{ConfidenceLevel: level})
+		if report.ConfidenceLevel != level || report.TotalUniqueClientsLower == nil || report.TotalUniqueClientsUpper == nil {
+			t.Fatalf("Expected intervals at %v, got %+v", level, report)
+		}
+		total := float64(report.TotalUniqueClients)
+		if float64(*report.TotalUniqueClientsLower) >= total || float64(*report.TotalUniqueClientsUpper) <= total {
+			t.Errorf("Total %v not within %d to %d", total, *report.TotalUniqueClientsLower, *report.TotalUniqueClientsUpper)
+		}
+
+		// The relative width of the interval follows the standard error of 0.81% with log2m 14
+		width := float64(*report.TotalUniqueClientsUpper-*report.TotalUniqueClientsLower) / total / 2
+		expected := math.Sqrt2 * math.Erfinv(level) * 0.008125
+		if math.Abs(width-expected) > 0.001 {
+			t.Errorf("Relative width at %v is %v, expected about %v", level, width, expected)
+		}
+		if width <= previous {
+			t.Errorf("Expected a wider interval at %v than %v", level, previous)
+		}
+		previous = width
+
+		for _, m := range report.MagnitudeData {
+			if *m.UniqueClientsLower > m.UniqueClients || *m.UniqueClientsUpper < m.UniqueClients ||
+				*m.UniqueClientsUpper > *report.TotalUniqueClientsUpper {
+				t.Errorf("Unexpected client bounds of %s: %+v", m.Domain, m)
+			}
+			if *m.MagnitudeLower > m.Magnitude || *m.MagnitudeUpper < m.Magnitude || *m.MagnitudeUpper > 10 {
+				t.Errorf("Unexpected magnitude bounds of %s: %v <= %v <= %v", m.Domain, *m.MagnitudeLower, m.Magnitude, *m.MagnitudeUpper)
+			}
+		}
+	}
+
+	// The intervals are included in the other formats
+	report := GenerateReportWithOptions(dataset, "test-source", "recursive", ReportOptions{ConfidenceLevel: 0.95})
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, report, "csv"); err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "domain,magnitude,magnitudeLower,magnitudeUpper,uniqueClients,uniqueClientsLower,uniqueClientsUpper,queryVolume\n") ||
+		strings.Count(strings.Split(buf.String(), "\n")[1], ",") != 7 {
+		t.Errorf("Unexpected CSV with intervals:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := WriteReport(&buf, report, "markdown"); err != nil {
+		t.Fatalf("WriteReport failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), "- **Total unique clients (95% confidence):** ") ||
+		!strings.Contains(buf.String(), "|:---|---:|---:|---:|---:|---:|---:|---:|\n") {
+		t.Errorf("Unexpected Markdown with intervals:\n%s", buf.String())
+	}
+}
+
+func TestCheckConfidenceLevel(t *testing.T) {
+	for _, level := range []float64{0, 0.5, 0.95, 0.999} {
+		if err := CheckConfidenceLevel(level); err != nil {
+			t.Errorf("CheckConfidenceLevel(%v) failed: %v", level, err)
+		}
+	}
+	for _, level := range []float64{-0.1, 1, 95, math.NaN()} {
+		if err := CheckConfidenceLevel(level); err == nil {
+			t.Errorf("Expected an error for confidence level %v", level)
+		}
+	}
+}
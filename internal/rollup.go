@@ -0,0 +1,136 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DatasetPeriod is the range of days covered by a rollup of datasets from several days
+type DatasetPeriod struct {
+	Start   TimeWrapper   `cbor:"start"`             // First day of the period
+	End     TimeWrapper   `cbor:"end"`               // Last day of the period, inclusive
+	Missing []TimeWrapper `cbor:"missing,omitempty"` // Days in the period without any data
+}
+
+// NewDatasetPeriod returns the period from the day of start to the day of end, inclusive
+func NewDatasetPeriod(start, end time.Time) (*DatasetPeriod, error) {
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	if end.Before(start) {
+		return nil, fmt.Errorf("period ends %s, before it starts %s", end.Format(time.DateOnly), start.Format(time.DateOnly))
+	}
+	return &DatasetPeriod{Start: TimeWrapper{start}, End: TimeWrapper{end}}, nil
+}
+
+// ParsePeriod parses a period given as two dates, YYYY-MM-DD/YYYY-MM-DD, or as a month, YYYY-MM
+func ParsePeriod(s string) (*DatasetPeriod, error) {
+	if startStr, endStr, found := strings.Cut(s, "/"); found {
+		start, err := time.Parse(time.DateOnly, startStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid period start %q (expected YYYY-MM-DD)", startStr)
+		}
+		end, err := time.Parse(time.DateOnly, endStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid period end %q (expected YYYY-MM-DD)", endStr)
+		}
+		return NewDatasetPeriod(start, end)
+	}
+
+	month, err := time.Parse("2006-01", s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period %q (expected YYYY-MM-DD/YYYY-MM-DD or YYYY-MM)", s)
+	}
+	return NewDatasetPeriod(month, month.AddDate(0, 1, -1))
+}
+
+func (period *DatasetPeriod) String() string {
+	return fmt.Sprintf("%s/%s", period.Start.Format(time.DateOnly), period.End.Format(time.DateOnly))
+}
+
+// Days returns the number of days in the period
+func (period *DatasetPeriod) Days() int {
+	return int(period.End.Sub(period.Start.Time).Hours()/24) + 1
+}
+
+// contains checks if a day is in the period
+func (period *DatasetPeriod) contains(day time.Time) bool {
+	return !day.Before(period.Start.Time) && !day.After(period.End.Time)
+}
+
+// describe returns the period with the number of days, and days without data, if any
+func (period *DatasetPeriod) describe() string {
+	if len(period.Missing) == 0 {
+		return fmt.Sprintf("%s - %s (%d days)", period.Start.Format(time.DateOnly), period.End.Format(time.DateOnly), period.Days())
+	}
+	return fmt.Sprintf("%s - %s (%d days, %d without data)", period.Start.Format(time.DateOnly), period.End.Format(time.DateOnly),
+		period.Days(), len(period.Missing))
+}
+
+// period returns the period covered by a rollup dataset, or nil for a dataset of a single day
+func (dataset *MagnitudeDataset) period() *DatasetPeriod {
+	if dataset.Metadata == nil {
+		return nil
+	}
+	return dataset.Metadata.Period
+}
+
+// coveredDays returns the days a dataset has data for
+func coveredDays(dataset MagnitudeDataset) []time.Time {
+	period := dataset.period()
+	if period == nil {
+		return []time.Time{dataset.Date.Time}
+	}
+
+	missing := make(map[string]struct{})
+	for _, day := range period.Missing {
+		missing[day.Format(time.DateOnly)] = struct{}{}
+	}
+	var days []time.Time
+	for day := period.Start.Time; !day.After(period.End.Time); day = day.AddDate(0, 0, 1) {
+		if _, found := missing[day.Format(time.DateOnly)]; !found {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// RollupDatasets aggregates datasets from any days in a period, e.g. a week or a month, into one dataset
+// with the clients of all days. The date of the result is the first day of the period, and its metadata
+// records the period and the days in it without data. Rollups can be rolled up into longer periods.
+func RollupDatasets(datasets []MagnitudeDataset, period *DatasetPeriod) (MagnitudeDataset, error) {
+	if len(datasets) == 0 {
+		return MagnitudeDataset{}, fmt.Errorf("no datasets to roll up")
+	}
+
+	covered := make(map[string]struct{})
+	for _, dataset := range datasets {
+		if dataset.Version != datasets[0].Version {
+			e := fmt.Errorf("version mismatch: dataset %s has version %d, expected %d", dataset.extraSourceFilename, dataset.Version, datasets[0].Version)
+			return MagnitudeDataset{}, e
+		}
+		for _, day := range coveredDays(dataset) {
+			if !period.contains(day) {
+				return MagnitudeDataset{}, fmt.Errorf("dataset %s has data for %s, outside the period %s",
+					dataset.extraSourceFilename, day.Format(time.DateOnly), period)
+			}
+			covered[day.Format(time.DateOnly)] = struct{}{}
+		}
+	}
+
+	res, err := aggregateDatasets(datasets, period.Start.Time)
+	if err != nil {
+		return MagnitudeDataset{}, err
+	}
+
+	res.Metadata.Period = &DatasetPeriod{Start: period.Start, End: period.End}
+	for day := period.Start.Time; !day.After(period.End.Time); day = day.AddDate(0, 0, 1) {
+		if _, found := covered[day.Format(time.DateOnly)]; !found {
+			res.Metadata.Period.Missing = append(res.Metadata.Period.Missing, TimeWrapper{day})
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		days     int
+		errMsg   string
+	}{
+		{"2026-09-01/2026-09-07", "2026-09-01/2026-09-07", 7, ""},
+		{"2026-09-01/2026-09-01", "2026-09-01/2026-09-01", 1, ""},
+		{"2026-02", "2026-02-01/2026-02-28", 28, ""},
+		{"2026-12", "2026-12-01/2026-12-31", 31, ""},
+		{"2026-09-07/2026-09-01", "", 0, "before it starts"},
+		{"2026-09-01/", "", 0, "invalid period end"},
+		{"2026-13", "", 0, "invalid period"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			period, err := ParsePeriod(tt.input)
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("Expected error containing %q, got %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePeriod failed: %v", err)
+			}
+			if period.String() != tt.expected || period.Days() != tt.days {
+				t.Errorf("Expected %s with %d days, got %s with %d days", tt.expected, tt.days, period, period.Days())
+			}
+		})
+	}
+}
+
+func TestRollupDatasets(t *testing.T) {
+	// Clients 0-999 on each of three days of a week, 500 of them on every day
+	day1 := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 999}})
+	day2 := newDiffDataset(t, 2, map[string]clientRange{"com": {500, 1499}, "org": {0, 9}})
+	day4 := newDiffDataset(t, 4, map[string]clientRange{"com": {500, 999}, "net": {0, 99}})
+	week, err := ParsePeriod("2026-09-01/2026-09-07")
+	if err != nil {
+		t.Fatalf("ParsePeriod failed: %v", err)
+	}
+
+	rollup, err := RollupDatasets([]MagnitudeDataset{day1, day2, day4}, week)
+	if err != nil {
+		t.Fatalf("RollupDatasets failed: %v", err)
+	}
+
+	if rollup.DateString() != "2026-09-01" {
+		t.Errorf("Expected date 2026-09-01, got %s", rollup.DateString())
+	}
+	if !withinPercent(rollup.AllClientsCount, 1500, 3) {
+		t.Errorf("Expected ~1500 clients in the week, got %d", rollup.AllClientsCount)
+	}
+	if rollup.AllQueriesCount != day1.AllQueriesCount+day2.AllQueriesCount+day4.AllQueriesCount {
+		t.Errorf("Expected the queries of all days, got %d", rollup.AllQueriesCount)
+	}
+	period := rollup.period()
+	if period == nil || period.String() != "2026-09-01/2026-09-07" {
+		t.Fatalf("Expected the week to be recorded, got %+v", period)
+	}
+	var missing []string
+	for _, day := range period.Missing {
+		missing = append(missing, day.Format(time.DateOnly))
+	}
+	if strings.Join(missing, " ") != "2026-09-03 2026-09-05 2026-09-06 2026-09-07" {
+		t.Errorf("Unexpected missing days %v", missing)
+	}
+	if len(rollup.Metadata.Parents) != 3 {
+		t.Errorf("Expected 3 parents, got %v", rollup.Metadata.Parents)
+	}
+
+	// Rollups pass through encoding and validation, and can be rolled up into longer periods
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(mustMarshalDataset(t, rollup)), "week#%d"); err != nil {
+		t.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+	}
+	loaded := seq.Result
+	_, errs, err := ValidateDatasets(bytes.NewReader(mustMarshalDataset(t, rollup)), nil)
+	if err != nil || len(errs) != 0 {
+		t.Errorf("Expected rollup to be valid, got %v %v", err, errs)
+	}
+
+	month, err := ParsePeriod("2026-09")
+	if err != nil {
+		t.Fatalf("ParsePeriod failed: %v", err)
+	}
+	day10 := newDiffDataset(t, 10, map[string]clientRange{"com": {0, 9}})
+	monthly, err := RollupDatasets([]MagnitudeDataset{loaded, day10}, month)
+	if err != nil {
+		t.Fatalf("RollupDatasets failed: %v", err)
+	}
+	if days := len(coveredDays(monthly)); days != 4 || len(monthly.period().Missing) != 26 {
+		t.Errorf("Expected 4 days with data and 26 without, got %d and %d", days, len(monthly.period().Missing))
+	}
+
+	// Datasets outside the period and rollups in same-day aggregation are rejected
+	if _, err := RollupDatasets([]MagnitudeDataset{day10, rollup}, week); err == nil || !strings.Contains(err.Error(), "outside the period") {
+		t.Errorf("Expected error for dataset outside the period, got %v", err)
+	}
+	if _, err := RollupDatasets([]MagnitudeDataset{monthly}, week); err == nil {
+		t.Error("Expected error for a rollup of a longer period")
+	}
+	if _, err := AggregateDatasets([]MagnitudeDataset{day1, rollup}); err == nil || !strings.Contains(err.Error(), "is a rollup") {
+		t.Errorf("Expected error aggregating a rollup, got %v", err)
+	}
+}
+
+func TestDatasetSequence_Period(t *testing.T) {
+	var sequence bytes.Buffer
+	for day := 1; day <= 3; day++ {
+		sequence.Write(mustMarshalDataset(t, newDiffDataset(t, day, map[string]clientRange{"com": {0, 99}})))
+	}
+
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(sequence.Bytes()), "test#%d"); err == nil {
+		t.Error("Expected date mismatch without a period")
+	}
+
+	period, err := ParsePeriod("2026-09-01/2026-09-03")
+	if err != nil {
+		t.Fatalf("ParsePeriod failed: %v", err)
+	}
+	seq = NewDatasetSequence(0, nil, false, nil)
+	seq.SetPeriod(period)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(sequence.Bytes()), "test#%d"); err != nil {
+		t.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+	}
+	if seq.Count != 3 || seq.Result.AllClientsCount != 100 || seq.Result.AllQueriesCount != 300 {
+		t.Errorf("Expected 3 days with the same 100 clients, got %d datasets, %d clients and %d queries",
+			seq.Count, seq.Result.AllClientsCount, seq.Result.AllQueriesCount)
+	}
+	if len(seq.Result.period().Missing) != 0 {
+		t.Errorf("Expected no missing days, got %v", seq.Result.period().Missing)
+	}
+}
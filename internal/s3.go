@@ -0,0 +1,297 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5" // #nosec G501 -- Content-MD5 is required by S3 for integrity checks, not used for security
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultS3Region is the region used if none is configured
+const DefaultS3Region = "us-east-1"
+
+// S3Config configures an S3Client. Endpoint is the URL of an S3-compatible service, e.g.
+// http://localhost:9000, or empty for AWS S3 in the region.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	PathStyle       bool // Address the bucket in the path instead of the host name, as most S3-compatible services need
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // Optional, for temporary credentials
+}
+
+// S3ConfigFromEnv returns an S3 configuration for bucket with the credentials, region and endpoint in the
+// environment variables used by the AWS CLI: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+// AWS_REGION or AWS_DEFAULT_REGION, and AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL.
+func S3ConfigFromEnv(bucket string) (S3Config, error) {
+	config := S3Config{
+		Bucket:          bucket,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Region:          firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		Endpoint:        firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return config, fmt.Errorf("no S3 credentials, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return config, nil
+}
+
+// firstEnv returns the value of the first of the environment variables that is set
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// S3Client uploads objects to a bucket using the S3 REST API, with requests signed with AWS Signature
+// Version 4
+type S3Client struct {
+	config     S3Config
+	endpoint   *url.URL
+	httpClient *http.Client
+	now        func() time.Time
+}
+
+// S3Object is the metadata of an object in a bucket
+type S3Object struct {
+	Size           int64
+	ETag           string // Without quotes. The hex encoded MD5 of the object for single part uploads without KMS
+	ChecksumSHA256 string // Base64 encoded SHA-256 of the object, if stored with one
+}
+
+// S3Error is an error response from an S3 service
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 request failed with status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// NewS3Client returns a client for the bucket in config
+func NewS3Client(config S3Config) (*S3Client, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("no S3 bucket")
+	}
+	if config.Region == "" {
+		config.Region = DefaultS3Region
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+
+	return &S3Client{
+		config:     config,
+		endpoint:   endpoint,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		now:        time.Now,
+	}, nil
+}
+
+// URL returns the s3:// URL of an object
+func (client *S3Client) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", client.config.Bucket, key)
+}
+
+// objectURL returns the HTTP URL of an object, with the key encoded as in the canonical request
+func (client *S3Client) objectURL(key string) *url.URL {
+	u := *client.endpoint
+	path := "/" + key
+	if client.config.PathStyle {
+		path = "/" + client.config.Bucket + path
+	} else {
+		u.Host = client.config.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = s3EscapePath(u.Path)
+	return &u
+}
+
+// PutObject uploads an object. The Content-MD5 and SHA-256 checksum of the data are sent along, so that
+// the service rejects the upload if the data was corrupted on the way.
+func (client *S3Client) PutObject(ctx context.Context, key string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, client.objectURL(key).String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	md5Sum := md5.Sum(data) // #nosec G401
+	sha256Sum := sha256.Sum256(data)
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Type", "application/cbor")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]))
+	req.Header.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sha256Sum[:]))
+	client.sign(req, hex.EncodeToString(sha256Sum[:]))
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return s3ErrorFromResponse(resp)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// HeadObject returns the metadata of an object, or nil if there is no such object
+func (client *S3Client) HeadObject(ctx context.Context, key string) (*S3Object, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, client.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Amz-Checksum-Mode", "ENABLED")
+	client.sign(req, emptyPayloadSHA256)
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, s3ErrorFromResponse(resp)
+	}
+
+	return &S3Object{
+		Size:           resp.ContentLength,
+		ETag:           strings.Trim(resp.Header.Get("ETag"), `"`),
+		ChecksumSHA256: resp.Header.Get("X-Amz-Checksum-Sha256"),
+	}, nil
+}
+
+// s3ErrorFromResponse returns the error in a failed response
+func s3ErrorFromResponse(resp *http.Response) error {
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	_ = xml.Unmarshal(body, s3Err)
+	return s3Err
+}
+
+// emptyPayloadSHA256 is the hex encoded SHA-256 of an empty request body
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds the headers of AWS Signature Version 4 to a request with a body with the hex encoded
+// SHA-256 payloadHash. All headers set on the request are signed.
+func (client *S3Client) sign(req *http.Request, payloadHash string) {
+	now := client.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if client.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", client.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, client.config.Region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+client.config.SecretAccessKey), day)
+	key = hmacSHA256(key, client.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		client.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of RFC 3986, as SigV4 requires
+func s3Escape(s string) string {
+	var res strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' {
+			res.WriteByte(b)
+		} else {
+			fmt.Fprintf(&res, "%%%02X", b)
+		}
+	}
+	return res.String()
+}
+
+// s3EscapePath encodes each segment of a path with s3Escape
+func s3EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery returns the query parameters sorted and encoded with s3Escape
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name)+"="+s3Escape(value))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,607 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ServerOptions configures a collection Server
+type ServerOptions struct {
+	Tokens        map[string]string // Source of each API token
+	MaxUploadSize int64             // Largest file accepted
+	ReportSource  string            // Source of the reports, or empty for the sources of the datasets
+	SourceType    string            // Source type of the reports
+	Logger        io.Writer         // Where to log uploads and errors, if anywhere
+}
+
+// UploadReceipt is the response to a successful upload
+type UploadReceipt struct {
+	Source   string         `json:"source"`
+	SHA256   string         `json:"sha256"` // Hex encoded SHA-256 of the uploaded data
+	Size     int            `json:"size"`
+	Received string         `json:"received"` // Time of the upload, in RFC 3339 format
+	Datasets []ArchiveEntry `json:"datasets"` // Datasets added to the archive
+	Existing int            `json:"existing"` // Number of datasets already in the archive
+}
+
+// serverUpload is a resumable upload in progress, spooled to a file
+type serverUpload struct {
+	mu      sync.Mutex // Held while the upload is being written to
+	source  string
+	path    string // Empty once the upload is complete or expired
+	length  int64
+	offset  int64
+	updated time.Time
+}
+
+// Server is a collection server. Sources upload DNSMAG files, authenticated with their API tokens, and the
+// datasets are validated and stored in an archive, which indexes them by source and date. The datasets
+// of a day are served aggregated, as a dataset or a JSON report. Large files can be uploaded resumably,
+// as by the submit command.
+type Server struct {
+	opts        ServerOptions
+	archive     *Archive
+	spoolDir    string
+	identity    *ecdh.PrivateKey    // Key to decrypt encrypted datasets with, if any
+	trustedKeys []ed25519.PublicKey // Keys datasets must be signed by, if any
+	mux         *http.ServeMux
+	importMu    sync.Mutex // Serialises validating uploads and importing them into the archive
+	mu          sync.Mutex // Protects uploads
+	uploads     map[string]*serverUpload
+}
+
+// LoadServerTokens loads the API tokens of sources from a file with a source and its token on each line,
+// separated by whitespace. Empty lines and lines starting with # are ignored. A source may have several
+// tokens, e.g. while rotating them.
+func LoadServerTokens(filename string) (map[string]string, error) {
+	file, err := os.Open(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a source and a token", filename, lineNum)
+		}
+		source, token := strings.TrimSpace(line[:i]), line[i+1:]
+		if len(token) < 16 {
+			return nil, fmt.Errorf("%s:%d: token of %s is too short, use at least 16 characters", filename, lineNum, source)
+		}
+		if _, found := tokens[token]; found {
+			return nil, fmt.Errorf("%s:%d: token of %s is already used", filename, lineNum, source)
+		}
+		tokens[token] = source
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", filename)
+	}
+	return tokens, nil
+}
+
+// NewServer returns a server storing datasets in archive, and unfinished resumable uploads in spoolDir.
+// Uploads left in spoolDir by an earlier server can not be resumed, and are removed.
+func NewServer(archive *Archive, spoolDir string, opts ServerOptions) (*Server, error) {
+	if len(opts.Tokens) == 0 {
+		return nil, fmt.Errorf("no API tokens")
+	}
+	if opts.MaxUploadSize <= 0 {
+		opts.MaxUploadSize = DefaultServeMaxUploadSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = io.Discard
+	}
+
+	if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+		return nil, err
+	}
+	leftovers, err := filepath.Glob(filepath.Join(spoolDir, "*.part"))
+	if err != nil {
+		return nil, err
+	}
+	for _, leftover := range leftovers {
+		_ = os.Remove(leftover)
+	}
+
+	s := &Server{
+		opts:     opts,
+		archive:  archive,
+		spoolDir: spoolDir,
+		mux:      http.NewServeMux(),
+		uploads:  make(map[string]*serverUpload),
+	}
+	s.mux.HandleFunc("POST /v1/datasets", s.handleUpload)
+	s.mux.HandleFunc("HEAD /v1/uploads/{id}", s.handleUploadOffset)
+	s.mux.HandleFunc("PATCH /v1/uploads/{id}", s.handleUploadChunk)
+	s.mux.HandleFunc("GET /v1/datasets/{date}", s.handleDataset)
+	s.mux.HandleFunc("GET /v1/reports/{date}", s.handleReport)
+	return s, nil
+}
+
+// SetIdentity sets the key to decrypt encrypted datasets with
+func (s *Server) SetIdentity(identity *ecdh.PrivateKey) {
+	s.identity = identity
+	s.archive.SetIdentity(identity)
+}
+
+// RequireSignatures requires uploaded datasets to be signed by one of the trusted keys
+func (s *Server) RequireSignatures(trusted []ed25519.PublicKey) {
+	s.trustedKeys = trusted
+	s.archive.RequireSignatures(trusted)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Serve serves HTTP, or HTTPS if certFile and keyFile are given, on listener until the context is
+// cancelled, and then waits a while for the requests in progress to finish
+func (s *Server) Serve(ctx context.Context, listener net.Listener, certFile, keyFile string) error {
+	server := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			done <- server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			done <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// authenticate returns the source of the API token of a request, or responds with an error
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		for known, source := range s.opts.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+				return source, true
+			}
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="dnsmag"`)
+	http.Error(w, "invalid or missing API token", http.StatusUnauthorized)
+	return "", false
+}
+
+// handleUpload accepts a file in the body of the request, or the first part of a resumable upload
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Upload-Complete") == "?0" {
+		s.createUpload(w, r, source)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.opts.MaxUploadSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("file larger than %d bytes", s.opts.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "failed to read file", http.StatusBadRequest)
+		}
+		return
+	}
+	s.store(w, r, source, data)
+}
+
+// createUpload starts a resumable upload with the first part of a file
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, source string) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > s.opts.MaxUploadSize {
+		http.Error(w, fmt.Sprintf("file larger than %d bytes", s.opts.MaxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var idBytes [16]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes[:])
+	upload := &serverUpload{source: source, path: filepath.Join(s.spoolDir, id+".part"), length: length}
+
+	file, err := os.OpenFile(upload.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		fmt.Fprintf(s.opts.Logger, "Failed to create upload: %v\n", err)
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(file, io.LimitReader(r.Body, length+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || n > length {
+		// Without the location of the upload, the client has to start over
+		_ = os.Remove(upload.path)
+		if n > length {
+			http.Error(w, "more data than Upload-Length", http.StatusBadRequest)
+		} else {
+			http.Error(w, "failed to read upload", http.StatusBadRequest)
+		}
+		return
+	}
+	upload.offset, upload.updated = n, time.Now()
+
+	s.mu.Lock()
+	s.expireUploads()
+	s.uploads[id] = upload
+	s.mu.Unlock()
+
+	w.Header().Set("Location", "/v1/uploads/"+id)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// expireUploads discards the uploads that have not been written to for too long. s.mu must be held.
+func (s *Server) expireUploads() {
+	for id, upload := range s.uploads {
+		if !upload.mu.TryLock() {
+			continue // Being written to
+		}
+		if time.Since(upload.updated) > DefaultServeUploadExpiry {
+			fmt.Fprintf(s.opts.Logger, "Discarding unfinished upload %s from %s\n", id, upload.source)
+			delete(s.uploads, id)
+			_ = os.Remove(upload.path)
+			upload.path = ""
+		}
+		upload.mu.Unlock()
+	}
+}
+
+// lookupUpload returns the upload in the path of a request, locked, or responds with an error if the
+// source has no such upload
+func (s *Server) lookupUpload(w http.ResponseWriter, r *http.Request, source string) (string, *serverUpload, bool) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	upload := s.uploads[id]
+	s.mu.Unlock()
+
+	if upload != nil && upload.source == source {
+		upload.mu.Lock()
+		if upload.path != "" {
+			return id, upload, true
+		}
+		upload.mu.Unlock()
+	}
+	http.Error(w, "no such upload", http.StatusNotFound)
+	return "", nil, false
+}
+
+// handleUploadOffset responds with how much of a resumable upload has been received
+func (s *Server) handleUploadOffset(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	_, upload, ok := s.lookupUpload(w, r, source)
+	if !ok {
+		return
+	}
+	defer upload.mu.Unlock()
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUploadChunk appends a part of a file to a resumable upload, and stores the file once complete
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	source, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	id, upload, ok := s.lookupUpload(w, r, source)
+	if !ok {
+		return
+	}
+	defer upload.mu.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		http.Error(w, fmt.Sprintf("upload is at offset %d", upload.offset), http.StatusConflict)
+		return
+	}
+
+	file, err := os.OpenFile(upload.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		fmt.Fprintf(s.opts.Logger, "Failed to open upload %s: %v\n", id, err)
+		http.Error(w, "failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	n, err := io.Copy(file, io.LimitReader(r.Body, upload.length-upload.offset+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	upload.offset += n
+	upload.updated = time.Now()
+	if upload.offset > upload.length {
+		s.removeUpload(id, upload)
+		http.Error(w, "more data than Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// Whatever was received is kept, the client asks for the offset before continuing
+		http.Error(w, "failed to read upload", http.StatusBadRequest)
+		return
+	}
+
+	if r.Header.Get("Upload-Complete") != "?1" {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if upload.offset != upload.length {
+		http.Error(w, fmt.Sprintf("upload incomplete, received %d of %d bytes", upload.offset, upload.length), http.StatusBadRequest)
+		return
+	}
+
+	data, err := os.ReadFile(upload.path)
+	s.removeUpload(id, upload)
+	if err != nil {
+		fmt.Fprintf(s.opts.Logger, "Failed to read upload %s: %v\n", id, err)
+		http.Error(w, "failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	s.store(w, r, source, data)
+}
+
+// removeUpload removes a finished upload. upload.mu must be held.
+func (s *Server) removeUpload(id string, upload *serverUpload) {
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	_ = os.Remove(upload.path)
+	upload.path = ""
+}
+
+// store validates the datasets in an uploaded file and adds them to the archive, responding with a receipt
+func (s *Server) store(w http.ResponseWriter, r *http.Request, source string, data []byte) {
+	digest := sha256.Sum256(data)
+	if !matchesReprDigest(r.Header.Get("Repr-Digest"), digest) {
+		http.Error(w, "file does not match Repr-Digest", http.StatusBadRequest)
+		return
+	}
+
+	// Validate and import under the same lock, so that concurrent uploads are not both checked against the
+	// stored datasets before either of them is stored
+	s.importMu.Lock()
+	if err := s.validate(data, source); err != nil {
+		s.importMu.Unlock()
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	added, existing, err := s.archive.ImportFromReader(bytes.NewReader(data), "upload#%d")
+	s.importMu.Unlock()
+	if err != nil {
+		fmt.Fprintf(s.opts.Logger, "Failed to store datasets from %s: %v\n", source, err)
+		http.Error(w, "failed to store datasets", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(s.opts.Logger, "Stored %d datasets from %s (%d already stored)\n", len(added), source, existing)
+
+	receipt := UploadReceipt{
+		Source:   source,
+		SHA256:   hex.EncodeToString(digest[:]),
+		Size:     len(data),
+		Received: time.Now().UTC().Format(time.RFC3339),
+		Datasets: added,
+		Existing: existing,
+	}
+	if receipt.Datasets == nil {
+		receipt.Datasets = []ArchiveEntry{}
+	}
+	status := http.StatusCreated
+	if len(added) == 0 {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, receipt)
+}
+
+// matchesReprDigest checks data with the SHA-256 digest in a Repr-Digest header, if any, like
+// "sha-256=:<base64>:"
+func matchesReprDigest(header string, digest [sha256.Size]byte) bool {
+	for _, member := range strings.Split(header, ",") {
+		if value, found := strings.CutPrefix(strings.TrimSpace(member), "sha-256="); found {
+			return value == ":"+base64.StdEncoding.EncodeToString(digest[:])+":"
+		}
+	}
+	return true
+}
+
+// validate loads the datasets in a file like loadDatasets does, and checks that they are daily
+// datasets from the source. The datasets of the source already stored for the day are loaded first,
+// so that datasets with the identifier of a stored dataset but different contents, or datasets
+// containing stored datasets, are rejected instead of making the day impossible to aggregate.
+func (s *Server) validate(data []byte, source string) error {
+	seq := NewDatasetSequence(0, nil, false, nil)
+	seq.SetIdentity(s.identity)
+	seq.RequireSignatures(s.trustedKeys)
+
+	loadedStored := false
+	seq.check = func(dataset MagnitudeDataset) error {
+		if period := dataset.period(); period != nil {
+			return fmt.Errorf("dataset %s is a rollup of the period %s, only daily datasets are accepted",
+				dataset.extraSourceFilename, period)
+		}
+		if dataset.Metadata == nil || !slices.Equal(dataset.Metadata.Sources, []string{source}) {
+			return fmt.Errorf("dataset %s has sources %q, expected %q",
+				dataset.extraSourceFilename, dataset.Metadata.sourceString(), source)
+		}
+
+		if loadedStored {
+			return nil
+		}
+		loadedStored = true
+		entries, err := s.archive.Query(ArchiveQuery{Date: dataset.DateString(), Source: source})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Period != "" {
+				continue
+			}
+			if err := seq.LoadDNSMagFile(s.archive.Path(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(data), "upload#%d"); err != nil {
+		return err
+	}
+	if seq.Count == 0 {
+		return fmt.Errorf("no datasets in file")
+	}
+	return nil
+}
+
+// loadDay aggregates the daily datasets of the date in the path of a request, of the source in the query
+// or of all sources, or responds with an error
+func (s *Server) loadDay(w http.ResponseWriter, r *http.Request) (*DatasetSequence, bool) {
+	date := r.PathValue("date")
+	if _, err := time.Parse(time.DateOnly, date); err != nil {
+		http.Error(w, fmt.Sprintf("invalid date %q (expected YYYY-MM-DD)", date), http.StatusBadRequest)
+		return nil, false
+	}
+	source := r.URL.Query().Get("source")
+
+	entries, err := s.archive.Query(ArchiveQuery{Date: date, Source: source})
+	if err != nil {
+		fmt.Fprintf(s.opts.Logger, "Failed to query archive: %v\n", err)
+		http.Error(w, "failed to query archive", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	seq := NewDatasetSequence(0, nil, false, s.opts.Logger)
+	seq.SetIdentity(s.identity)
+	for _, entry := range entries {
+		if entry.Period != "" {
+			continue // Rollups imported into the archive by other means
+		}
+		if err := seq.LoadDNSMagFile(s.archive.Path(entry)); err != nil {
+			fmt.Fprintf(s.opts.Logger, "Failed to aggregate datasets of %s: %v\n", date, err)
+			http.Error(w, "failed to aggregate datasets", http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	if seq.Count == 0 {
+		http.Error(w, fmt.Sprintf("no datasets for %s", date), http.StatusNotFound)
+		return nil, false
+	}
+	return seq, true
+}
+
+// handleDataset responds with the aggregated dataset of a day
+func (s *Server) handleDataset(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+	seq, ok := s.loadDay(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := cbor.Marshal(seq.Result)
+	if err != nil {
+		http.Error(w, "failed to encode dataset", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/cbor")
+	_, _ = w.Write(data)
+}
+
+// handleReport responds with the JSON report of the aggregated dataset of a day
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+	seq, ok := s.loadDay(w, r)
+	if !ok {
+		return
+	}
+
+	source := s.opts.ReportSource
+	if source == "" {
+		source = seq.Result.Metadata.sourceString()
+	}
+	writeJSON(w, http.StatusOK, GenerateReport(seq.Result, source, s.opts.SourceType))
+}
+
+// writeJSON responds with a value encoded as indented JSON
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
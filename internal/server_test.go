@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadServerTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "sources and tokens",
+			content: "# source token\nexample.net 0123456789abcdef\n\nExample Org\tfedcba9876543210\nexample.net 0123456789abcdefgh\n",
+			want: map[string]string{
+				"0123456789abcdef":   "example.net",
+				"fedcba9876543210":   "Example Org",
+				"0123456789abcdefgh": "example.net",
+			},
+		},
+		{name: "missing token", content: "example.net\n", wantErr: "expected a source and a token"},
+		{name: "short token", content: "example.net secret\n", wantErr: "too short"},
+		{name: "reused token", content: "a 0123456789abcdef\nb 0123456789abcdef\n", wantErr: "already used"},
+		{name: "empty", content: "# nothing here\n", wantErr: "no tokens"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "tokens")
+			if err := os.WriteFile(filename, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("Failed to write tokens: %v", err)
+			}
+			got, err := LoadServerTokens(filename)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadServerTokens failed: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Expected %d tokens, got %v", len(tt.want), got)
+			}
+			for token, source := range tt.want {
+				if got[token] != source {
+					t.Errorf("Expected token %s for %q, got %q", token, source, got[token])
+				}
+			}
+		})
+	}
+}
+
+// newTestServer returns a collection server for the sources example and other, and its URL
+func newTestServer(t *testing.T) (*Server, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	archive, err := OpenArchive(filepath.Join(dir, "archive"), false)
+	if err != nil {
+		t.Fatalf("OpenArchive failed: %v", err)
+	}
+	t.Cleanup(func() { _ = archive.Close() })
+
+	server, err := NewServer(archive, filepath.Join(dir, "uploads"), ServerOptions{
+		Tokens: map[string]string{
+			"example-token-0001": "example",
+			"other-token-000001": "other",
+		},
+		SourceType: "recursive",
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer.URL
+}
+
+// writeTestUpload writes datasets to a file to submit
+func writeTestUpload(t *testing.T, datasets ...MagnitudeDataset) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "datasets.cbor")
+	writeArchiveTestFile(t, filename, nil, datasets...)
+	return filename
+}
+
+// submitToTestServer submits a file to a test server with the token, in chunks of chunkSize bytes
+func submitToTestServer(t *testing.T, url, token string, chunkSize int, filename string) (*SubmissionReceipt, error) {
+	t.Helper()
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filename, err)
+	}
+	submitter, err := NewSubmitter(SubmitOptions{URL: url + "/v1/datasets", Token: token, ChunkSize: chunkSize})
+	if err != nil {
+		t.Fatalf("NewSubmitter failed: %v", err)
+	}
+	return submitter.SubmitFile(context.Background(), filename, data)
+}
+
+// getFromTestServer sends a GET request to a test server with the token, returning the status and body
+func getFromTestServer(t *testing.T, url, token string) (int, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestServer(t *testing.T) {
+	server, url := newTestServer(t)
+
+	newSourceDataset := func(day int, source string, domains map[string]clientRange) MagnitudeDataset {
+		dataset := newDiffDataset(t, day, domains)
+		dataset.Metadata = &DatasetMetadata{Sources: []string{source}}
+		return dataset
+	}
+	example := newSourceDataset(1, "example", map[string]clientRange{"com": {0, 99}, "org": {0, 9}})
+	other := newSourceDataset(1, "other", map[string]clientRange{"com": {100, 199}, "net": {0, 49}})
+	changed := newSourceDataset(1, "example", map[string]clientRange{"com": {0, 49}})
+	changed.Identifier = example.Identifier
+
+	// A file in one request
+	exampleFile := writeTestUpload(t, example)
+	receipt, err := submitToTestServer(t, url, "example-token-0001", DefaultSubmitChunkSize, exampleFile)
+	if err != nil {
+		t.Fatalf("Submission failed: %v", err)
+	}
+	var uploaded UploadReceipt
+	if err := json.Unmarshal([]byte(receipt.Receipt), &uploaded); err != nil {
+		t.Fatalf("Invalid receipt %s: %v", receipt.Receipt, err)
+	}
+	if receipt.Status != http.StatusCreated || uploaded.Source != "example" || len(uploaded.Datasets) != 1 ||
+		uploaded.Datasets[0].Identifier != example.Identifier || uploaded.SHA256 != receipt.SHA256 {
+		t.Errorf("Unexpected receipt %d %+v", receipt.Status, uploaded)
+	}
+
+	// The same file again
+	receipt, err = submitToTestServer(t, url, "example-token-0001", DefaultSubmitChunkSize, exampleFile)
+	if err != nil || receipt.Status != http.StatusOK || !strings.Contains(receipt.Receipt, `"existing": 1`) {
+		t.Errorf("Expected the datasets to exist already, got %+v (%v)", receipt, err)
+	}
+
+	// A file in chunks
+	receipt, err = submitToTestServer(t, url, "other-token-000001", 100, writeTestUpload(t, other))
+	if err != nil || receipt.Status != http.StatusCreated {
+		t.Fatalf("Chunked submission failed: %+v (%v)", receipt, err)
+	}
+	if uploads, _ := filepath.Glob(filepath.Join(server.spoolDir, "*")); len(uploads) != 0 {
+		t.Errorf("Expected finished uploads to be removed, got %v", uploads)
+	}
+
+	rejected := []struct {
+		name     string
+		token    string
+		datasets []MagnitudeDataset
+		wantErr  string
+	}{
+		{"invalid token", "invalid-token-0001", []MagnitudeDataset{example}, "status 401"},
+		{"other source", "other-token-000001", []MagnitudeDataset{example}, `has sources "example", expected "other"`},
+		{"no source", "other-token-000001", []MagnitudeDataset{newDiffDataset(t, 2, map[string]clientRange{"com": {0, 9}})}, `has sources ""`},
+		{"different dates", "other-token-000001", []MagnitudeDataset{newSourceDataset(2, "other", map[string]clientRange{"com": {0, 9}}), other}, "date mismatch"},
+		{"stored identifier", "example-token-0001", []MagnitudeDataset{changed}, "but different contents"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := submitToTestServer(t, url, tt.token, DefaultSubmitChunkSize, writeTestUpload(t, tt.datasets...)); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	// Reports of all sources and of one
+	status, body := getFromTestServer(t, url+"/v1/reports/2026-09-01", "other-token-000001")
+	var report Report
+	if err := json.Unmarshal(body, &report); status != http.StatusOK || err != nil {
+		t.Fatalf("Expected a report, got %d %s (%v)", status, body, err)
+	}
+	if report.Source != "example, other" || report.SourceType != "recursive" || len(report.MagnitudeData) != 3 ||
+		!withinPercent(report.TotalUniqueClients, 200, 5) {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	status, body = getFromTestServer(t, url+"/v1/reports/2026-09-01?source=example", "other-token-000001")
+	if err := json.Unmarshal(body, &report); status != http.StatusOK || err != nil || report.Source != "example" || len(report.MagnitudeData) != 2 {
+		t.Errorf("Expected a report of example, got %d %s (%v)", status, body, err)
+	}
+
+	// The aggregated dataset
+	status, body = getFromTestServer(t, url+"/v1/datasets/2026-09-01", "example-token-0001")
+	if status != http.StatusOK {
+		t.Fatalf("Expected a dataset, got %d %s", status, body)
+	}
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(body), "response#%d"); err != nil {
+		t.Fatalf("Invalid dataset: %v", err)
+	}
+	if len(seq.Result.Domains) != 3 || len(seq.Result.Metadata.Parents) != 2 {
+		t.Errorf("Expected an aggregate of 2 datasets with 3 domains, got %d domains and parents %v",
+			len(seq.Result.Domains), seq.Result.Metadata.Parents)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/v1/datasets/2026-09-02", "example-token-0001", http.StatusNotFound},
+		{"/v1/reports/2026-09-01?source=nobody", "example-token-0001", http.StatusNotFound},
+		{"/v1/reports/yesterday", "example-token-0001", http.StatusBadRequest},
+		{"/v1/reports/2026-09-01", "invalid-token-0001", http.StatusUnauthorized},
+	} {
+		if status, body := getFromTestServer(t, url+tt.path, tt.token); status != tt.status {
+			t.Errorf("GET %s: expected status %d, got %d %s", tt.path, tt.status, status, body)
+		}
+	}
+}
+
+func TestServer_ConcurrentConflicts(t *testing.T) {
+	_, url := newTestServer(t)
+
+	// Datasets with the same identifier but different contents, of which only one can be stored
+	var files []string
+	var identifier string
+	for i := range 8 {
+		dataset := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 10 * (i + 1)}})
+		dataset.Metadata = &DatasetMetadata{Sources: []string{"example"}}
+		if identifier == "" {
+			identifier = dataset.Identifier
+		}
+		dataset.Identifier = identifier
+		files = append(files, writeTestUpload(t, dataset))
+	}
+
+	submitter, err := NewSubmitter(SubmitOptions{URL: url + "/v1/datasets", Token: "example-token-0001", ChunkSize: DefaultSubmitChunkSize})
+	if err != nil {
+		t.Fatalf("NewSubmitter failed: %v", err)
+	}
+	errs := make(chan error, len(files))
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", filename, err)
+		}
+		go func() {
+			_, err := submitter.SubmitFile(context.Background(), filename, data)
+			errs <- err
+		}()
+	}
+	stored := 0
+	for range files {
+		if err := <-errs; err == nil {
+			stored++
+		} else if !strings.Contains(err.Error(), "different contents") {
+			t.Errorf("Expected a conflict, got %v", err)
+		}
+	}
+	if stored != 1 {
+		t.Errorf("Expected 1 of the conflicting uploads to be stored, got %d", stored)
+	}
+}
+
+func TestServer_ResumableUploads(t *testing.T) {
+	server, url := newTestServer(t)
+
+	send := func(method, target, token string, body string, headers map[string]string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, url+target, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, target, err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := send(http.MethodPost, "/v1/datasets", "example-token-0001", "0123", map[string]string{
+		"Upload-Complete": "?0",
+		"Upload-Length":   "10",
+	})
+	location := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusCreated || location == "" || resp.Header.Get("Upload-Offset") != "4" {
+		t.Fatalf("Expected an upload to be created, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		token      string
+		body       string
+		headers    map[string]string
+		wantStatus int
+		wantOffset string
+	}{
+		{"offset", http.MethodHead, "example-token-0001", "", nil, http.StatusNoContent, "4"},
+		{"other source", http.MethodHead, "other-token-000001", "", nil, http.StatusNotFound, ""},
+		{"wrong offset", http.MethodPatch, "example-token-0001", "456", map[string]string{"Upload-Offset": "3", "Upload-Complete": "?0"}, http.StatusConflict, "4"},
+		{"chunk", http.MethodPatch, "example-token-0001", "456", map[string]string{"Upload-Offset": "4", "Upload-Complete": "?0"}, http.StatusNoContent, "7"},
+		{"incomplete", http.MethodPatch, "example-token-0001", "7", map[string]string{"Upload-Offset": "7", "Upload-Complete": "?1"}, http.StatusBadRequest, ""},
+		{"too long", http.MethodPatch, "example-token-0001", "89ab", map[string]string{"Upload-Offset": "8", "Upload-Complete": "?1"}, http.StatusBadRequest, ""},
+		{"removed", http.MethodHead, "example-token-0001", "", nil, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := send(tt.method, location, tt.token, tt.body, tt.headers)
+			if resp.StatusCode != tt.wantStatus || resp.Header.Get("Upload-Offset") != tt.wantOffset {
+				t.Errorf("Expected status %d and offset %q, got %d and %q", tt.wantStatus, tt.wantOffset,
+					resp.StatusCode, resp.Header.Get("Upload-Offset"))
+			}
+		})
+	}
+
+	// Unfinished uploads expire
+	resp = send(http.MethodPost, "/v1/datasets", "example-token-0001", "0123", map[string]string{
+		"Upload-Complete": "?0",
+		"Upload-Length":   "10",
+	})
+	server.mu.Lock()
+	for _, upload := range server.uploads {
+		upload.updated = time.Now().Add(-DefaultServeUploadExpiry - time.Minute)
+	}
+	server.expireUploads()
+	server.mu.Unlock()
+	if resp := send(http.MethodHead, resp.Header.Get("Location"), "example-token-0001", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the upload to have expired, got %d", resp.StatusCode)
+	}
+	if uploads, _ := filepath.Glob(filepath.Join(server.spoolDir, "*")); len(uploads) != 0 {
+		t.Errorf("Expected expired uploads to be removed, got %v", uploads)
+	}
+
+	// Files larger than the limit
+	server.opts.MaxUploadSize = 4
+	resp = send(http.MethodPost, "/v1/datasets", "example-token-0001", "01234", nil)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", resp.StatusCode)
+	}
+}
@@ -3,11 +3,13 @@
 package internal
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -87,9 +89,24 @@ func formatGeneralStats(dataset MagnitudeDataset) []TableRow {
 	var table []TableRow
 
 	table = append(table, TableRow{"Dataset statistics", ""})
-	table = append(table, TableRow{"Date", dataset.DateString()})
+	if period := dataset.period(); period != nil {
+		table = append(table, TableRow{"Period", period.describe()})
+	} else {
+		table = append(table, TableRow{"Date", dataset.DateString()})
+	}
 	table = append(table, TableRow{"Id", dataset.Identifier})
 	table = append(table, TableRow{"Generator", dataset.Generator})
+	if dataset.extraSignature != nil {
+		table = append(table, TableRow{"Signed by", dataset.extraSignature.String()})
+	}
+	table = append(table, formatMetadata(dataset.Metadata)...)
+	if dataset.Partial {
+		partial := "yes"
+		if dataset.LastFile != "" {
+			partial = fmt.Sprintf("yes (interrupted while processing %s)", dataset.LastFile)
+		}
+		table = append(table, TableRow{"Partial dataset", partial})
+	}
 	table = append(table, TableRow{"Total queries", fmt.Sprintf("%d", dataset.AllQueriesCount)})
 
 	numDomains := uint64(len(dataset.Domains))
@@ -113,6 +130,45 @@ func formatGeneralStats(dataset MagnitudeDataset) []TableRow {
 	return table
 }
 
+// formatMetadata builds table rows describing the provenance of a dataset
+func formatMetadata(md *DatasetMetadata) []TableRow {
+	var table []TableRow
+	if md == nil {
+		return table
+	}
+
+	if len(md.Sources) > 0 {
+		table = append(table, TableRow{"Sources", md.sourceString()})
+	}
+	if len(md.Sites) > 0 {
+		table = append(table, TableRow{"Sites", strings.Join(md.Sites, ", ")})
+	}
+	if md.Window != nil {
+		table = append(table, TableRow{"Collection window", fmt.Sprintf("%s - %s",
+			md.Window.Start.Format(time.RFC3339), md.Window.End.Format(time.RFC3339))})
+	}
+	if len(md.InputFiles) > 0 {
+		table = append(table, TableRow{"Input files", fmt.Sprintf("%d", len(md.InputFiles))})
+	}
+	if md.Truncation != nil {
+		table = append(table, TableRow{"Client prefix lengths", fmt.Sprintf("IPv4 /%d, IPv6 /%d", md.Truncation.IPv4, md.Truncation.IPv6)})
+	}
+	if md.Hll != nil {
+		table = append(table, TableRow{"HLL parameters", fmt.Sprintf("log2m %d, regwidth %d", md.Hll.Log2m, md.Hll.Regwidth)})
+	}
+	if md.DomainLabels != 0 {
+		table = append(table, TableRow{"Domain labels", fmt.Sprintf("%d", md.DomainLabels)})
+	}
+	if len(md.Parents) > 0 {
+		table = append(table, TableRow{"Parent datasets", fmt.Sprintf("%d", len(md.Parents))})
+	}
+	for _, filter := range md.Filters {
+		table = append(table, TableRow{"Domain filter", filter.String()})
+	}
+
+	return table
+}
+
 // formatDatasetStats prepares domain statistics for printing.
 func formatDatasetStats(dataset MagnitudeDataset) ([]TableRow, []string) {
 	domainTable, domains := formatDomainRecords(dataset)
@@ -193,12 +249,18 @@ func OutputDatasetStats(w io.Writer, dataset MagnitudeDataset, verbose bool) err
 
 // DatasetStats represents the nested dataset statistics
 type DatasetStats struct {
-	ID                 string `json:"id"`
-	Generator          string `json:"generator"`
-	Date               string `json:"date"`
-	TotalUniqueClients uint64 `json:"totalUniqueClients"`
-	TotalQueryVolume   uint64 `json:"totalQueryVolume"`
-	TotalDomainCount   uint64 `json:"totalDomainCount"`
+	ID                 string   `json:"id"`
+	Generator          string   `json:"generator"`
+	Date               string   `json:"date"`
+	Period             string   `json:"period,omitempty"` // Start and end date of a rollup, e.g. 2026-09-01/2026-09-07
+	TotalUniqueClients uint64   `json:"totalUniqueClients"`
+	TotalQueryVolume   uint64   `json:"totalQueryVolume"`
+	TotalDomainCount   uint64   `json:"totalDomainCount"`
+	Partial            bool     `json:"partial,omitempty"`
+	LastFile           string   `json:"lastFile,omitempty"`
+	Sources            []string `json:"sources,omitempty"`
+	SignerKeyID        string   `json:"signerKeyId,omitempty"`
+	SignatureVerified  bool     `json:"signatureVerified,omitempty"`
 }
 
 // DatasetStatsJSON represents the JSON output format for dataset statistics
@@ -206,23 +268,39 @@ type DatasetStatsJSON struct {
 	DatasetStatistics DatasetStats `json:"datasetStatistics"`
 }
 
-// OutputDatasetStatsJSON formats and prints dataset statistics as JSON
-func OutputDatasetStatsJSON(w io.Writer, dataset MagnitudeDataset) error {
+// datasetStats returns the statistics of a dataset for JSON output
+func datasetStats(dataset MagnitudeDataset) DatasetStats {
 	dateStr := ""
 	if dataset.Date != nil {
 		dateStr = dataset.Date.Format("2006-01-02")
 	}
 
-	stats := DatasetStatsJSON{
-		DatasetStatistics: DatasetStats{
-			ID:                 dataset.Identifier,
-			Generator:          dataset.Generator,
-			Date:               dateStr,
-			TotalUniqueClients: dataset.AllClientsCount,
-			TotalQueryVolume:   dataset.AllQueriesCount,
-			TotalDomainCount:   uint64(len(dataset.Domains)),
-		},
+	stats := DatasetStats{
+		ID:                 dataset.Identifier,
+		Generator:          dataset.Generator,
+		Date:               dateStr,
+		TotalUniqueClients: dataset.AllClientsCount,
+		TotalQueryVolume:   dataset.AllQueriesCount,
+		TotalDomainCount:   uint64(len(dataset.Domains)),
+		Partial:            dataset.Partial,
+		LastFile:           dataset.LastFile,
 	}
+	if dataset.Metadata != nil {
+		stats.Sources = dataset.Metadata.Sources
+	}
+	if period := dataset.period(); period != nil {
+		stats.Period = period.String()
+	}
+	if dataset.extraSignature != nil {
+		stats.SignerKeyID = hex.EncodeToString(dataset.extraSignature.KeyID)
+		stats.SignatureVerified = dataset.extraSignature.Verified
+	}
+	return stats
+}
+
+// OutputDatasetStatsJSON formats and prints dataset statistics as JSON
+func OutputDatasetStatsJSON(w io.Writer, dataset MagnitudeDataset) error {
+	stats := DatasetStatsJSON{DatasetStatistics: datasetStats(dataset)}
 
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -198,7 +199,7 @@ func TestOutputDatasetStatsJSON(t *testing.T) {
 		},
 	}
 
-	if stats != expected {
+	if !reflect.DeepEqual(stats, expected) {
 		t.Errorf("JSON output mismatch.\nGot:      %+v\nExpected: %+v", stats, expected)
 	}
 }
@@ -3,9 +3,16 @@
 package internal
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -58,41 +65,205 @@ func (tw *TimeWrapper) UnmarshalCBOR(data []byte) error {
 	return fmt.Errorf("unable to unmarshal TimeWrapper")
 }
 
+// Timestamps are encoded as CBOR tag 1 with integer seconds since the epoch
+func (tw TimestampWrapper) MarshalCBOR() ([]byte, error) {
+	return cbor.Marshal(cbor.Tag{Number: 1, Content: tw.Unix()})
+}
+
+func (tw *TimestampWrapper) UnmarshalCBOR(data []byte) error {
+	if err := cbor.Unmarshal(data, &tw.Time); err != nil {
+		return fmt.Errorf("unable to unmarshal TimestampWrapper: %w", err)
+	}
+	tw.Time = tw.UTC()
+	return nil
+}
+
+// upgradeDataset converts a dataset loaded from an older version of the format to the current version.
+// Version 1 datasets lack metadata, but are otherwise identical to version 2.
+func upgradeDataset(dataset *MagnitudeDataset) error {
+	switch dataset.Version {
+	case 1:
+		dataset.Version = DatasetVersion
+	case DatasetVersion:
+	default:
+		return fmt.Errorf("unsupported dataset version %d", dataset.Version)
+	}
+	return nil
+}
+
+// WriteOptions configures how WriteDNSMagFileWithOptions writes a dataset
+type WriteOptions struct {
+	Recipient   *ecdh.PublicKey // Key to encrypt the dataset to, if any
+	Compression string          // none, gzip or zstd. If empty, none, or that of the existing file when appending
+	Append      bool            // Add the dataset to the CBOR sequence in an existing file
+}
+
 // WriteDNSMagFile writes the magnitudeDataset to a file in CBOR format.
 // If filename is "-", writes to the provided stdout writer and returns "STDOUT".
 func WriteDNSMagFile(stats MagnitudeDataset, filename string, stdout io.Writer) (string, error) {
-	var file io.Writer
-	var closeFunc func() error
+	return WriteDNSMagFileWithOptions(stats, filename, stdout, WriteOptions{})
+}
 
-	if filename == "-" {
-		file = stdout
-		closeFunc = func() error { return nil }
-	} else {
-		f, err := os.Create(filename)
-		if err != nil {
-			return "", err
+// WriteDNSMagFileWithOptions writes the magnitudeDataset to a file in CBOR format, optionally encrypted to
+// a recipient in a COSE_Encrypt structure, compressed and/or appended to an existing CBOR sequence file.
+// The file is replaced atomically, so a crash never leaves a truncated file behind.
+// If filename is "-", writes to the provided stdout writer and returns "STDOUT".
+func WriteDNSMagFileWithOptions(stats MagnitudeDataset, filename string, stdout io.Writer, opts WriteOptions) (string, error) {
+	if opts.Compression != "" {
+		if err := checkCompression(opts.Compression); err != nil {
+			return filename, err
+		}
+	}
+
+	data, err := cbor.Marshal(stats)
+	if err != nil {
+		return filename, err
+	}
+	if opts.Recipient != nil {
+		if data, err = encryptItem(data, opts.Recipient); err != nil {
+			return filename, fmt.Errorf("failed to encrypt dataset: %w", err)
 		}
-		file = f
-		closeFunc = f.Close
 	}
-	defer func() { _ = closeFunc() }()
 
-	enc := cbor.NewEncoder(file)
-	err := enc.Encode(stats)
 	if filename == "-" {
-		return "STDOUT", err
+		if opts.Append {
+			return "STDOUT", fmt.Errorf("can not append to STDOUT")
+		}
+		return "STDOUT", writeCompressed(stdout, data, opts.Compression)
+	}
+
+	return filename, writeFileAtomically(filename, func(file io.Writer) error {
+		compression := opts.Compression
+		if opts.Append {
+			existing, err := copyExistingFile(file, filename)
+			if err != nil {
+				return err
+			}
+			if compression == "" {
+				compression = existing
+			} else if existing != "" && compression != existing {
+				return fmt.Errorf("can not append %s compressed dataset to %s with compression %s", compression, filename, existing)
+			}
+		}
+		return writeCompressed(file, data, compression)
+	})
+}
+
+// writeCompressed writes data to writer as a compressed stream
+func writeCompressed(writer io.Writer, data []byte, compression string) error {
+	compressor, err := newCompressingWriter(writer, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := compressor.Write(data); err != nil {
+		return err
 	}
-	return filename, err
+	return compressor.Close()
+}
+
+// copyExistingFile copies the contents of filename to writer, returning its compression.
+// For a missing or empty file, the compression is "".
+func copyExistingFile(writer io.Writer, filename string) (string, error) {
+	existing, err := os.Open(filename) // #nosec G304
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = existing.Close() }()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(existing, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := writer.Write(magic[:n]); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(writer, existing); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return detectCompression(magic[:n]), nil
+}
+
+// writeFileAtomically writes a file by calling write with a temporary file in the same directory,
+// which is synced to disk and renamed to filename if write succeeds. An existing file keeps its
+// permissions, and a new file gets the permissions allowed by the umask, like os.Create.
+func writeFileAtomically(filename string, write func(file io.Writer) error) error {
+	tmp, err := createTemp(filename)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if err := write(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if info, err := os.Stat(filename); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	// Sync the directory as well, for the rename to survive a crash. Not all platforms support this.
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
+
+// createTemp creates a new temporary file next to filename. Unlike os.CreateTemp, the file is created with
+// mode 0o666 before the umask, so the renamed file gets the same permissions as a file created directly.
+func createTemp(filename string) (*os.File, error) {
+	for range 100 {
+		name := fmt.Sprintf("%s.%d.tmp", filename, rand.Uint32())
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666) // #nosec G302
+		if !errors.Is(err, fs.ErrExist) {
+			return file, err
+		}
+	}
+	return nil, fmt.Errorf("failed to create a temporary file for %s", filename)
 }
 
 // This structure is used when loading a sequence of datasets to avoid having them all in memory.
 // Every loaded dataset is aggregated into the Result.
 type DatasetSequence struct {
-	numDomains int
-	Count      int
-	Result     MagnitudeDataset
-	forceDate  bool
-	logger     io.Writer
+	numDomains       int
+	Count            int
+	Result           MagnitudeDataset
+	forceDate        bool
+	logger           io.Writer
+	trustedKeys      []ed25519.PublicKey          // Keys datasets must be signed by, if any
+	identity         *ecdh.PrivateKey             // Key to decrypt encrypted datasets with, if any
+	period           *DatasetPeriod               // Period to roll up datasets of different days into, if any
+	seen             map[string]seenDataset       // Datasets added, and the datasets aggregated into them, by identifier
+	rejectDuplicates bool                         // Reject duplicate datasets, instead of skipping them
+	Duplicates       int                          // Number of duplicate datasets skipped
+	check            func(MagnitudeDataset) error // Checks every dataset before it is added, if set
+}
+
+// seenDataset records where a dataset added to a sequence came from
+type seenDataset struct {
+	source string            // Source filename of the dataset, or of the dataset it was aggregated into
+	digest [sha256.Size]byte // SHA-256 of the encoded dataset
+	parent bool              // Only known as a parent of a dataset added
 }
 
 func NewDatasetSequence(numDomains int, date *time.Time, forceDate bool, logger io.Writer) *DatasetSequence {
@@ -118,60 +289,148 @@ func (seq *DatasetSequence) LoadDNSMagFile(filename string) error {
 
 // LoadDNSMagSequenceFromReader loads all MagnitudeDatasets from a CBOR sequence reader.
 // Sets extraSourceFilename to the filename plus a sequence number suffix for each dataset.
+// Datasets signed with COSE_Sign1 are accepted, and required if trusted keys have been set.
+// Datasets encrypted with COSE_Encrypt are decrypted using the identity, if one has been set.
 func (seq *DatasetSequence) LoadDNSMagSequenceFromReader(reader io.Reader, filenameFmt string) error {
-	var buffer []byte
-	readBuffer := make([]byte, 1024*1024) // 1MB read buffer to start with
-
 	seqNum := 1
-	for {
-		// Try to read more data
-		n, readErr := reader.Read(readBuffer)
-		if n > 0 {
-			buffer = append(buffer, readBuffer[:n]...)
+	return forEachCBORItem(reader, func(item []byte) error {
+		sourceFilename := fmt.Sprintf(filenameFmt, seqNum)
+		seqNum++
+
+		this, err := decodeDatasetItem(item, sourceFilename, seq.identity, seq.trustedKeys)
+		if err != nil {
+			return err
 		}
 
-		// Try to unmarshal a dataset from the read buffer
-		for len(buffer) > 0 {
-			var this MagnitudeDataset
+		this.finaliseStats()
 
-			remaining, err := cbor.UnmarshalFirst(buffer, &this)
-			if err != nil {
-				// If we can't unmarshal and have reached EOF, we fail
-				if readErr == io.EOF {
-					return fmt.Errorf("failed to unmarshal CBOR: %w", err)
-				}
-				// If we can't unmarshal but haven't hit EOF, we should read more data
-				break
+		if err := upgradeDataset(&this); err != nil {
+			return fmt.Errorf("failed to load dataset %s: %w", this.extraSourceFilename, err)
+		}
+		if seq.check != nil {
+			if err := seq.check(this); err != nil {
+				return err
 			}
+		}
 
-			this.finaliseStats()
-			this.extraSourceFilename = fmt.Sprintf(filenameFmt, seqNum)
-			seqNum++
+		return seq.addDataset(this)
+	})
+}
 
-			if err := seq.addDataset(this); err != nil {
-				return err
-			}
+// decodeDatasetItem decodes a dataset from an item in a CBOR sequence, decrypting it with identity and
+// verifying its signature with trustedKeys as necessary. Signatures are required if trustedKeys is set.
+// The dataset is returned as stored, without recomputing its statistics.
+func decodeDatasetItem(item []byte, sourceFilename string, identity *ecdh.PrivateKey, trustedKeys []ed25519.PublicKey) (MagnitudeDataset, error) {
+	var this MagnitudeDataset
 
-			buffer = remaining
+	decrypt := func() error {
+		plaintext, err := decryptItem(item, identity)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt dataset %s: %w", sourceFilename, err)
 		}
+		item = plaintext
+		return nil
+	}
 
-		if readErr == io.EOF {
-			break
+	// Datasets can be signed before or after they are encrypted
+	if isEncrypted(item) {
+		if err := decrypt(); err != nil {
+			return this, err
 		}
-		if readErr != nil {
-			return fmt.Errorf("failed to read data: %w", readErr)
+	}
+
+	var signature *DatasetSignature
+	if isSigned(item) {
+		payload, sig, err := openSigned(item, trustedKeys)
+		if err != nil {
+			return this, fmt.Errorf("failed to verify dataset %s: %w", sourceFilename, err)
+		}
+		item = payload
+		signature = &sig
+	} else if len(trustedKeys) > 0 {
+		return this, fmt.Errorf("dataset %s is not signed", sourceFilename)
+	}
+	if signature != nil && isEncrypted(item) {
+		if err := decrypt(); err != nil {
+			return this, err
 		}
 	}
 
-	// Check if there's any remaining data that couldn't be parsed
-	if len(buffer) > 0 {
-		return fmt.Errorf("remaining %d bytes in buffer could not be parsed as CBOR", len(buffer))
+	if err := cbor.Unmarshal(item, &this); err != nil {
+		return this, fmt.Errorf("failed to unmarshal CBOR: %w", err)
 	}
+	this.extraSourceFilename = sourceFilename
+	this.extraSignature = signature
+	this.extraDigest = sha256.Sum256(item)
+	return this, nil
+}
 
-	return nil
+// forEachCBORItem calls fn with each item in a CBOR sequence read from reader, which may be gzip or zstd compressed.
+// Items are decoded one at a time, so memory use is bounded by the size of the largest item.
+func forEachCBORItem(reader io.Reader, fn func(item []byte) error) error {
+	decompressed, err := newDecompressingReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read data: %w", err)
+	}
+	defer func() { _ = decompressed.Close() }()
+
+	decoder := cbor.NewDecoder(&fillingReader{reader: decompressed})
+
+	for {
+		var item cbor.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to unmarshal CBOR at offset %d: %w", decoder.NumBytesRead(), err)
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+}
+
+// fillingReader fills the buffers passed to Read as far as possible. The CBOR decoder checks the
+// buffered part of an item after every read, which is quadratic in the item size with short reads.
+type fillingReader struct {
+	reader io.Reader
+}
+
+func (r *fillingReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// SetPeriod makes the sequence roll up datasets from any days in period, instead of requiring
+// all datasets to have the same date
+func (seq *DatasetSequence) SetPeriod(period *DatasetPeriod) {
+	seq.period = period
+}
+
+// RejectDuplicates makes the sequence fail on duplicate datasets, instead of skipping them with a warning
+func (seq *DatasetSequence) RejectDuplicates() {
+	seq.rejectDuplicates = true
+}
+
+// SetIdentity sets the key used to decrypt encrypted datasets
+func (seq *DatasetSequence) SetIdentity(identity *ecdh.PrivateKey) {
+	seq.identity = identity
+}
+
+// RequireSignatures makes the sequence only accept datasets signed by one of the trusted keys
+func (seq *DatasetSequence) RequireSignatures(trusted []ed25519.PublicKey) {
+	seq.trustedKeys = trusted
 }
 
 func (seq *DatasetSequence) addDataset(dataset MagnitudeDataset) error {
+	if duplicate, err := seq.checkDuplicate(dataset); err != nil || duplicate {
+		return err
+	}
+
 	// If forceDate is true and the dataset has a different date, log a warning and override it
 	if seq.forceDate && dataset.Date != nil && seq.Result.Date != nil {
 		if dataset.DateString() != seq.Result.DateString() {
@@ -183,6 +442,22 @@ func (seq *DatasetSequence) addDataset(dataset MagnitudeDataset) error {
 		}
 	}
 
+	if seq.period != nil {
+		datasets := []MagnitudeDataset{dataset}
+		if seq.Count > 0 {
+			datasets = []MagnitudeDataset{seq.Result, dataset}
+		}
+		rollup, err := RollupDatasets(datasets, seq.period)
+		if err != nil {
+			return fmt.Errorf("failed to roll up datasets: %w", err)
+		}
+		rollup.Truncate(seq.numDomains)
+
+		seq.Result = rollup
+		seq.Count++
+		return nil
+	}
+
 	if seq.Count == 0 {
 		seq.Result = dataset
 		seq.Count = 1
@@ -203,6 +478,56 @@ func (seq *DatasetSequence) addDataset(dataset MagnitudeDataset) error {
 	return nil
 }
 
+// checkDuplicate checks if a dataset, or a dataset aggregated into it, has already been added to the
+// sequence, as aggregating it again would count its queries twice. Returns true if the dataset is a
+// duplicate of a dataset already added, to be skipped. Partial overlaps, where only some of the datasets
+// aggregated into a dataset have been added, can not be skipped and are errors.
+func (seq *DatasetSequence) checkDuplicate(dataset MagnitudeDataset) (bool, error) {
+	if dataset.Identifier == "" {
+		return false, nil
+	}
+	if seq.seen == nil {
+		seq.seen = make(map[string]seenDataset)
+	}
+
+	if seen, found := seq.seen[dataset.Identifier]; found {
+		switch {
+		case seen.parent:
+			return false, fmt.Errorf("dataset %s (id %s) has already been aggregated into dataset %s",
+				dataset.extraSourceFilename, dataset.Identifier, seen.source)
+		case seen.digest != dataset.extraDigest:
+			return false, fmt.Errorf("dataset %s has the same id %s as dataset %s, but different contents",
+				dataset.extraSourceFilename, dataset.Identifier, seen.source)
+		case seq.rejectDuplicates:
+			return false, fmt.Errorf("dataset %s is a duplicate of dataset %s (id %s)",
+				dataset.extraSourceFilename, seen.source, dataset.Identifier)
+		}
+		if seq.logger != nil {
+			fmt.Fprintf(seq.logger, "Warning: Skipping dataset %s, a duplicate of dataset %s (id %s)\n",
+				dataset.extraSourceFilename, seen.source, dataset.Identifier)
+		}
+		seq.Duplicates++
+		return true, nil
+	}
+
+	var parents []string
+	if dataset.Metadata != nil {
+		parents = dataset.Metadata.Parents
+	}
+	for _, parent := range parents {
+		if seen, found := seq.seen[parent]; found {
+			return false, fmt.Errorf("dataset %s contains dataset %s, which has already been added from %s",
+				dataset.extraSourceFilename, parent, seen.source)
+		}
+	}
+
+	seq.seen[dataset.Identifier] = seenDataset{source: dataset.extraSourceFilename, digest: dataset.extraDigest}
+	for _, parent := range parents {
+		seq.seen[parent] = seenDataset{source: dataset.extraSourceFilename, parent: true}
+	}
+	return false, nil
+}
+
 // MarshalDatasetToCBOR marshals a dataset to CBOR bytes for testing
 func MarshalDatasetToCBOR(dataset MagnitudeDataset) ([]byte, error) {
 	return cbor.Marshal(dataset)
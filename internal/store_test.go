@@ -2,10 +2,16 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net/netip"
 	"os"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -363,7 +369,7 @@ func TestWriteDNSMagFile_WriteToStdout(t *testing.T) {
 	// Load test1.pcap.gz file using a Collector
 	timing := NewTimingStats()
 	collector := NewCollector(DefaultDomainCount, 0, false, nil, timing)
-	err := collector.ProcessFiles([]string{"../testdata/test1.pcap.gz"}, "pcap", nil, os.Stderr)
+	err := collector.ProcessFiles(context.Background(), []string{"../testdata/test1.pcap.gz"}, "pcap", nil, os.Stderr)
 	if err != nil {
 		t.Fatalf("ProcessFiles failed: %v", err)
 	}
@@ -405,3 +411,441 @@ func TestWriteDNSMagFile_WriteToStdout(t *testing.T) {
 		},
 	})
 }
+
+func TestLoadDNSMagSequence_Versions(t *testing.T) {
+	collector, err := loadDatasetFromCSV("192.168.1.10,example.com,5\n", "2026-09-01", false)
+	if err != nil {
+		t.Fatalf("loadDatasetFromCSV failed: %v", err)
+	}
+	v2 := collector.Result
+
+	// A version 1 dataset has no metadata
+	v1 := v2
+	v1.Identifier = "v1-dataset"
+	v1.Version = 1
+	v1.Metadata = nil
+
+	var buf bytes.Buffer
+	for _, dataset := range []MagnitudeDataset{v1, v2} {
+		data, err := MarshalDatasetToCBOR(dataset)
+		if err != nil {
+			t.Fatalf("MarshalDatasetToCBOR failed: %v", err)
+		}
+		buf.Write(data)
+	}
+
+	// Both versions can be loaded and aggregated
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagSequenceFromReader(&buf, "<buffer#%d>"); err != nil {
+		t.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+	}
+	if seq.Count != 2 || seq.Result.Version != DatasetVersion {
+		t.Errorf("Expected 2 datasets aggregated into version %d, got %d datasets with version %d",
+			DatasetVersion, seq.Count, seq.Result.Version)
+	}
+	if seq.Result.AllQueriesCount != 10 {
+		t.Errorf("Expected 10 queries, got %d", seq.Result.AllQueriesCount)
+	}
+	if !slices.Contains(seq.Result.Metadata.Parents, "v1-dataset") {
+		t.Errorf("Expected version 1 dataset among parents, got %v", seq.Result.Metadata.Parents)
+	}
+
+	// Unknown versions are rejected
+	v3 := v2
+	v3.Version = 3
+	data, err := MarshalDatasetToCBOR(v3)
+	if err != nil {
+		t.Fatalf("MarshalDatasetToCBOR failed: %v", err)
+	}
+	seq = NewDatasetSequence(0, nil, false, nil)
+	err = seq.LoadDNSMagSequenceFromReader(bytes.NewReader(data), "<buffer#%d>")
+	if err == nil || !strings.Contains(err.Error(), "unsupported dataset version 3") {
+		t.Errorf("Expected unsupported version error, got: %v", err)
+	}
+}
+
+func TestTimestampWrapper_MarshalUnmarshal(t *testing.T) {
+	ts := TimestampWrapper{time.Date(2026, 9, 1, 12, 34, 56, 0, time.UTC)}
+
+	data, err := cbor.Marshal(ts)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	// Tag 1 (0xc1) followed by an integer
+	if data[0] != 0xc1 {
+		t.Errorf("Expected CBOR tag 1, got % x", data)
+	}
+
+	var decoded TimestampWrapper
+	if err := cbor.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !decoded.Equal(ts.Time) {
+		t.Errorf("Expected %v, got %v", ts.Time, decoded.Time)
+	}
+}
+
+func TestLoadDNSMagSequenceFromReader_ShortReads(t *testing.T) {
+	var sequence []byte
+	for _, csv := range []string{"192.168.1.1,org,7", "10.0.0.1,com,3", "10.0.1.1,net,1"} {
+		collector, err := loadDatasetFromCSV(csv, "2007-09-01", false)
+		if err != nil {
+			t.Fatalf("loadDatasetFromCSV failed: %v", err)
+		}
+		sequence = append(sequence, mustMarshalDataset(t, collector.Result)...)
+	}
+
+	for name, reader := range map[string]io.Reader{
+		"one byte": iotest.OneByteReader(bytes.NewReader(sequence)),
+		"half":     iotest.HalfReader(bytes.NewReader(sequence)),
+		"data EOF": iotest.DataErrReader(bytes.NewReader(sequence)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			seq := NewDatasetSequence(100, nil, false, nil)
+			if err := seq.LoadDNSMagSequenceFromReader(reader, "testfile#%d"); err != nil {
+				t.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+			}
+			if seq.Count != 3 || seq.Result.AllQueriesCount != 11 {
+				t.Errorf("Expected 3 datasets with 11 queries, got %d datasets with %d queries", seq.Count, seq.Result.AllQueriesCount)
+			}
+		})
+	}
+
+	// A truncated item after complete ones is reported with its offset
+	seq := NewDatasetSequence(100, nil, false, nil)
+	err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(sequence[:len(sequence)-1]), "testfile#%d")
+	if err == nil || !strings.Contains(err.Error(), "failed to unmarshal CBOR at offset") {
+		t.Errorf("Expected error with offset, got: %v", err)
+	}
+	if seq.Count != 2 {
+		t.Errorf("Expected the 2 complete datasets to be loaded, got %d", seq.Count)
+	}
+}
+
+// benchmarkDataset returns an encoded dataset with domains domains, each queried from clients different /24s
+func benchmarkDataset(b *testing.B, domains, clients int) []byte {
+	b.Helper()
+
+	date := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	dataset := newDataset(&date)
+	for d := range domains {
+		for c := range clients {
+			src, err := NewIPAddress(netip.AddrFrom4([4]byte{10, byte(c >> 8), byte(c), 1}))
+			if err != nil {
+				b.Fatalf("NewIPAddress failed: %v", err)
+			}
+			if err := dataset.updateStats(fmt.Sprintf("tld%d", d), src, 1, false); err != nil {
+				b.Fatalf("updateStats failed: %v", err)
+			}
+		}
+	}
+	dataset.finaliseStats()
+
+	data, err := cbor.Marshal(dataset)
+	if err != nil {
+		b.Fatalf("Marshal failed: %v", err)
+	}
+	return data
+}
+
+// repeatReader returns the same CBOR item count times, without holding the sequence in memory
+type repeatReader struct {
+	item  []byte
+	count int
+	pos   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && r.count > 0 {
+		c := copy(p[n:], r.item[r.pos:])
+		n += c
+		r.pos += c
+		if r.pos == len(r.item) {
+			r.pos = 0
+			r.count--
+		}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// BenchmarkForEachCBORItem decodes synthetic multi-gigabyte CBOR sequences, reporting the peak heap use.
+// Run with e.g. "go test -run ^$ -bench ForEachCBORItem -benchtime 1x ./internal".
+func BenchmarkForEachCBORItem(b *testing.B) {
+	item := benchmarkDataset(b, DefaultDomainCount, 1000)
+
+	for _, size := range []int64{256 << 20, 4 << 30} {
+		count := int(size / int64(len(item)))
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(int64(count * len(item)))
+			b.ReportAllocs()
+
+			var peakHeap uint64
+			var stats runtime.MemStats
+			for range b.N {
+				items := 0
+				err := forEachCBORItem(&repeatReader{item: item, count: count}, func([]byte) error {
+					if items++; items%16 == 0 {
+						runtime.ReadMemStats(&stats)
+						peakHeap = max(peakHeap, stats.HeapInuse)
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatalf("forEachCBORItem failed: %v", err)
+				}
+				if items != count {
+					b.Fatalf("Expected %d items, got %d", count, items)
+				}
+			}
+			b.ReportMetric(float64(peakHeap)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+// BenchmarkLoadDNSMagSequenceFromReader loads and aggregates a sequence of b.N datasets
+func BenchmarkLoadDNSMagSequenceFromReader(b *testing.B) {
+	item := benchmarkDataset(b, DefaultDomainCount, 100)
+	b.SetBytes(int64(len(item)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	seq := NewDatasetSequence(DefaultDomainCount, nil, false, nil)
+	for range b.N {
+		// Aggregate the same dataset repeatedly, instead of skipping it as a duplicate
+		seq.seen = nil
+		if err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(item), "bench#%d"); err != nil {
+			b.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+		}
+	}
+}
+
+func TestWriteDNSMagFileWithOptions_Append(t *testing.T) {
+	first := newMetadataDataset(t, "first", nil)
+	second := newMetadataDataset(t, "second", nil)
+
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := dir + "/data.cbor"
+
+			// Appending to a missing file creates it
+			for _, dataset := range []MagnitudeDataset{first, second} {
+				if _, err := WriteDNSMagFileWithOptions(dataset, filename, nil, WriteOptions{Compression: compression, Append: true}); err != nil {
+					t.Fatalf("WriteDNSMagFileWithOptions failed: %v", err)
+				}
+			}
+
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if got := detectCompression(data); got != compression {
+				t.Errorf("Expected %s compressed file, got %s", compression, got)
+			}
+
+			seq := NewDatasetSequence(0, nil, false, nil)
+			if err := seq.LoadDNSMagFile(filename); err != nil {
+				t.Fatalf("LoadDNSMagFile failed: %v", err)
+			}
+			if seq.Count != 2 || !slices.Equal(seq.Result.Metadata.Sources, []string{"first", "second"}) {
+				t.Errorf("Expected 2 datasets from first and second, got %d datasets from %q", seq.Count, seq.Result.Metadata.Sources)
+			}
+
+			// Without --append the file is replaced
+			if _, err := WriteDNSMagFileWithOptions(first, filename, nil, WriteOptions{Compression: compression}); err != nil {
+				t.Fatalf("WriteDNSMagFileWithOptions failed: %v", err)
+			}
+			seq = NewDatasetSequence(0, nil, false, nil)
+			if err := seq.LoadDNSMagFile(filename); err != nil {
+				t.Fatalf("LoadDNSMagFile failed: %v", err)
+			}
+			if seq.Count != 1 {
+				t.Errorf("Expected 1 dataset, got %d", seq.Count)
+			}
+		})
+	}
+}
+
+func TestWriteDNSMagFileWithOptions_Errors(t *testing.T) {
+	dataset := newMetadataDataset(t, "example", nil)
+	dir := t.TempDir()
+	filename := dir + "/data.cbor"
+	if _, err := WriteDNSMagFileWithOptions(dataset, filename, nil, WriteOptions{Compression: CompressionGzip}); err != nil {
+		t.Fatalf("WriteDNSMagFileWithOptions failed: %v", err)
+	}
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		opts     WriteOptions
+		errMsg   string
+	}{
+		{"compression mismatch", filename, WriteOptions{Compression: CompressionZstd, Append: true}, "can not append zstd compressed dataset"},
+		{"unknown compression", filename, WriteOptions{Compression: "lz4"}, "unknown compression 'lz4'"},
+		{"append to stdout", "-", WriteOptions{Append: true}, "can not append to STDOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := WriteDNSMagFileWithOptions(dataset, tt.filename, io.Discard, tt.opts)
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, err)
+			}
+		})
+	}
+
+	// Failed writes leave the existing file untouched, and no temporary files behind
+	data, err := os.ReadFile(filename)
+	if err != nil || !bytes.Equal(data, original) {
+		t.Errorf("Expected file to be unchanged, err %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected only the dataset file in %s, got %v (err %v)", dir, entries, err)
+	}
+}
+
+func TestDatasetSequence_Duplicates(t *testing.T) {
+	privFile, _ := writeTestKeys(t, t.TempDir(), "signer")
+	key, err := LoadSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+
+	x := newMetadataDataset(t, "x", nil)
+	y := newMetadataDataset(t, "y", nil)
+	encodedX := mustMarshalDataset(t, x)
+	var signedX bytes.Buffer
+	if _, err := SignDatasets(bytes.NewReader(encodedX), &signedX, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+	aggregated, err := AggregateDatasets([]MagnitudeDataset{x, y})
+	if err != nil {
+		t.Fatalf("AggregateDatasets failed: %v", err)
+	}
+	// An aggregate of the saved aggregate and another dataset
+	saved := aggregated
+	saved.extraAggregated = false
+	nested, err := AggregateDatasets([]MagnitudeDataset{saved, newMetadataDataset(t, "z", nil)})
+	if err != nil {
+		t.Fatalf("AggregateDatasets failed: %v", err)
+	}
+	changedX := x
+	changedX.AllQueriesCount++
+
+	sequence := func(items ...[]byte) []byte {
+		return bytes.Join(items, nil)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		reject     bool
+		duplicates int
+		errMsg     string
+	}{
+		{"distinct", sequence(encodedX, mustMarshalDataset(t, y)), false, 0, ""},
+		{"same dataset twice", sequence(encodedX, mustMarshalDataset(t, y), encodedX), false, 1, ""},
+		{"signed copy", sequence(encodedX, signedX.Bytes()), false, 1, ""},
+		{"rejected", sequence(encodedX, encodedX), true, 0, "is a duplicate of dataset test#1"},
+		{"different contents", sequence(encodedX, mustMarshalDataset(t, changedX)), false, 0, "but different contents"},
+		{"aggregate after parent", sequence(encodedX, mustMarshalDataset(t, aggregated)), false, 0, "which has already been added from test#1"},
+		{"parent after aggregate", sequence(mustMarshalDataset(t, aggregated), encodedX), false, 0, "has already been aggregated into dataset test#1"},
+		{"nested aggregate after parent", sequence(encodedX, mustMarshalDataset(t, nested)), false, 0, "which has already been added from test#1"},
+		{"parent after nested aggregate", sequence(mustMarshalDataset(t, nested), encodedX), false, 0, "has already been aggregated into dataset test#1"},
+		{"aggregate after nested aggregate", sequence(mustMarshalDataset(t, nested), mustMarshalDataset(t, aggregated)), false, 0, "has already been aggregated into dataset test#1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logger bytes.Buffer
+			seq := NewDatasetSequence(0, nil, false, &logger)
+			if tt.reject {
+				seq.RejectDuplicates()
+			}
+			err := seq.LoadDNSMagSequenceFromReader(bytes.NewReader(tt.data), "test#%d")
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("Expected error containing %q, got %v", tt.errMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadDNSMagSequenceFromReader failed: %v", err)
+			}
+			if seq.Duplicates != tt.duplicates {
+				t.Errorf("Expected %d duplicates, got %d", tt.duplicates, seq.Duplicates)
+			}
+			if tt.duplicates > 0 && !strings.Contains(logger.String(), "Warning: Skipping dataset") {
+				t.Errorf("Expected a warning, got %q", logger.String())
+			}
+			// Queries are only counted once for each dataset
+			expected := x.AllQueriesCount
+			if seq.Count > 1 {
+				expected += y.AllQueriesCount
+				if !slices.Equal(seq.Result.Metadata.Parents, slices.Sorted(slices.Values([]string{x.Identifier, y.Identifier}))) {
+					t.Errorf("Expected parents x and y, got %v", seq.Result.Metadata.Parents)
+				}
+			}
+			if seq.Result.AllQueriesCount != expected {
+				t.Errorf("Expected %d queries, got %d", expected, seq.Result.AllQueriesCount)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomically_Permissions(t *testing.T) {
+	dir := t.TempDir()
+	write := func(file io.Writer) error {
+		_, err := file.Write([]byte("data"))
+		return err
+	}
+
+	// A new file gets the same permissions as a file created directly
+	reference, err := os.Create(dir + "/reference")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	_ = reference.Close()
+	if err := writeFileAtomically(dir+"/new", write); err != nil {
+		t.Fatalf("writeFileAtomically failed: %v", err)
+	}
+	expected, _ := os.Stat(dir + "/reference")
+	info, err := os.Stat(dir + "/new")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode() != expected.Mode() {
+		t.Errorf("Expected mode %v for a new file, got %v", expected.Mode(), info.Mode())
+	}
+
+	// An existing file keeps its permissions
+	if err := os.WriteFile(dir+"/existing", nil, 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.Chmod(dir+"/existing", 0o640); err != nil {
+		t.Fatalf("Chmod failed: %v", err)
+	}
+	if err := writeFileAtomically(dir+"/existing", write); err != nil {
+		t.Fatalf("writeFileAtomically failed: %v", err)
+	}
+	info, err = os.Stat(dir + "/existing")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("Expected mode 0640 for an existing file, got %v", info.Mode())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("Expected no temporary files left, got %v", entries)
+	}
+}
@@ -0,0 +1,459 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SubmitOptions configures a Submitter
+type SubmitOptions struct {
+	URL        string        // Collection endpoint to POST files to
+	Token      string        // Bearer token to authenticate with, if any
+	TLSConfig  *tls.Config   // Client certificate and trusted CAs for mutual TLS, if any
+	ChunkSize  int           // Files larger than this are uploaded in chunks that can be resumed
+	Retries    int           // Maximum number of retries after a failed request
+	Backoff    time.Duration // Delay before the first retry, doubled for every following retry, or 0 for the default
+	MaxBackoff time.Duration // Maximum delay between retries, or 0 for the default
+	Logger     io.Writer     // Where to log retries, if anywhere
+}
+
+// SubmissionReceipt is the proof of a submission, stored next to the submitted file
+type SubmissionReceipt struct {
+	File      string `json:"file"`
+	Size      int    `json:"size"`
+	SHA256    string `json:"sha256"` // Hex encoded SHA-256 of the submitted data
+	URL       string `json:"url"`
+	Submitted string `json:"submitted"` // Time of the submission, in RFC 3339 format
+	Status    int    `json:"status"`    // HTTP status of the final response
+	Receipt   string `json:"receipt"`   // Body of the final response, verbatim
+}
+
+// submitState is the state of a resumable upload, stored next to the file until the upload is complete
+type submitState struct {
+	URL      string `json:"url"`
+	SHA256   string `json:"sha256"`
+	Size     int    `json:"size"`
+	Location string `json:"location"` // URL of the upload resource
+}
+
+// submitResponse is a response read in full
+type submitResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Submitter submits DNSMAG files to a collection endpoint over HTTP
+type Submitter struct {
+	opts   SubmitOptions
+	client *http.Client
+}
+
+// ReceiptFilename returns the name of the receipt of a submitted file
+func ReceiptFilename(filename string) string {
+	return filename + ".receipt.json"
+}
+
+// submitStateFilename returns the name of the state of a resumable upload of a file
+func submitStateFilename(filename string) string {
+	return filename + ".submit-state.json"
+}
+
+// LoadClientTLSConfig returns a TLS configuration with a client certificate for mutual TLS and, if caFile
+// is given, the CAs to verify the server with instead of the system CAs
+func LoadClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile) // #nosec G304
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+// NewSubmitter returns a submitter with the options
+func NewSubmitter(opts SubmitOptions) (*Submitter, error) {
+	endpoint, err := url.Parse(opts.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid submission URL %q", opts.URL)
+	}
+	if opts.ChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size %d, must be positive", opts.ChunkSize)
+	}
+	if opts.Retries < 0 {
+		return nil, fmt.Errorf("invalid number of retries %d, must not be negative", opts.Retries)
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = DefaultSubmitBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = max(DefaultSubmitMaxBackoff, opts.Backoff)
+	}
+	if opts.Backoff < 0 || opts.MaxBackoff < opts.Backoff {
+		return nil, fmt.Errorf("invalid backoff %v and maximum backoff %v, must be positive and the maximum at least the backoff",
+			opts.Backoff, opts.MaxBackoff)
+	}
+	if opts.Logger == nil {
+		opts.Logger = io.Discard
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig
+	}
+	return &Submitter{
+		opts:   opts,
+		client: &http.Client{Transport: transport, Timeout: DefaultSubmitTimeout},
+	}, nil
+}
+
+// SubmitFile submits the data of a file, e.g. the file signed, and stores the receipt of the server next
+// to the file. Files up to the chunk size are sent in a single POST request. Larger files are uploaded
+// resumably, like in the IETF draft on resumable uploads for HTTP: the first chunk is POSTed with
+// "Upload-Complete: ?0" and the server responds with the Location of the upload resource, and the rest
+// is sent in PATCH requests with the Upload-Offset of each chunk, the last one with "Upload-Complete: ?1".
+// After a failure, the offset the server has received up to is requested with HEAD, and the upload
+// continues from there, also in a later run. Failed requests are retried with exponential backoff.
+// Every request has the SHA-256 of the whole file in the Repr-Digest and Idempotency-Key headers.
+func (s *Submitter) SubmitFile(ctx context.Context, filename string, data []byte) (*SubmissionReceipt, error) {
+	digest := sha256.Sum256(data)
+	sum := hex.EncodeToString(digest[:])
+	header := http.Header{}
+	header.Set("User-Agent", "dnsmag/"+Version)
+	header.Set("Idempotency-Key", sum)
+	header.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+	if s.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+s.opts.Token)
+	}
+
+	var resp *submitResponse
+	var err error
+	if len(data) <= s.opts.ChunkSize {
+		resp, err = s.submitWhole(ctx, header, data)
+	} else {
+		state := submitState{URL: s.opts.URL, SHA256: sum, Size: len(data)}
+		resp, err = s.submitResumable(ctx, header, data, submitStateFilename(filename), state)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &SubmissionReceipt{
+		File:      filename,
+		Size:      len(data),
+		SHA256:    sum,
+		URL:       s.opts.URL,
+		Submitted: time.Now().UTC().Format(time.RFC3339),
+		Status:    resp.status,
+		Receipt:   string(resp.body),
+	}
+	encoded, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomically(ReceiptFilename(filename), func(file io.Writer) error {
+		_, err := file.Write(append(encoded, '\n'))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store receipt: %w", err)
+	}
+	return receipt, nil
+}
+
+// LoadReceipt loads the receipt of a submitted file, or returns nil if there is none
+func LoadReceipt(filename string) (*SubmissionReceipt, error) {
+	data, err := os.ReadFile(ReceiptFilename(filename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var receipt SubmissionReceipt
+	if err := json.Unmarshal(data, &receipt); err != nil {
+		return nil, fmt.Errorf("invalid receipt %s: %w", ReceiptFilename(filename), err)
+	}
+	return &receipt, nil
+}
+
+// submitWhole POSTs all of data in one request
+func (s *Submitter) submitWhole(ctx context.Context, header http.Header, data []byte) (*submitResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.send(ctx, http.MethodPost, s.opts.URL, header, data, map[string]string{
+			"Content-Type":    "application/cbor-seq",
+			"Upload-Complete": "?1",
+		})
+		if err == nil && resp.status/100 == 2 {
+			return resp, nil
+		}
+		if err := s.retry(ctx, attempt, resp, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// submitResumable uploads data in chunks, resuming the upload in state if it is for the same data
+func (s *Submitter) submitResumable(ctx context.Context, header http.Header, data []byte, stateFilename string, state submitState) (*submitResponse, error) {
+	offset := 0
+	if saved, err := os.ReadFile(stateFilename); err == nil {
+		var previous submitState
+		if json.Unmarshal(saved, &previous) == nil && previous.URL == state.URL && previous.SHA256 == state.SHA256 &&
+			previous.Size == state.Size && previous.Location != "" {
+			if err := s.checkLocation(previous.Location); err != nil {
+				return nil, fmt.Errorf("can not resume the upload in %s: %w", stateFilename, err)
+			}
+			fmt.Fprintf(s.opts.Logger, "Resuming upload to %s\n", previous.Location)
+			state.Location = previous.Location
+			offset = -1 // Unknown until asked
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var resp *submitResponse
+		var err error
+		switch {
+		case state.Location == "":
+			// Create the upload resource with the first chunk
+			end := min(s.opts.ChunkSize, len(data))
+			resp, err = s.send(ctx, http.MethodPost, s.opts.URL, header, data[:end], map[string]string{
+				"Content-Type":    "application/cbor-seq",
+				"Upload-Complete": "?0",
+				"Upload-Length":   strconv.Itoa(len(data)),
+			})
+			if err == nil && resp.status/100 == 2 {
+				location, err := s.uploadLocation(resp)
+				if err != nil {
+					return nil, err
+				}
+				state.Location = location
+				if err := saveSubmitState(stateFilename, state); err != nil {
+					return nil, err
+				}
+				if offset, err = uploadOffset(resp, end); err != nil {
+					return nil, err
+				}
+				attempt = -1
+				continue
+			}
+
+		case offset < 0:
+			// Ask how much of the upload the server has received
+			resp, err = s.send(ctx, http.MethodHead, state.Location, header, nil, nil)
+			if err == nil && (resp.status == http.StatusNotFound || resp.status == http.StatusGone) {
+				fmt.Fprintf(s.opts.Logger, "Upload %s has expired, starting over\n", state.Location)
+				state.Location, offset = "", 0
+				_ = os.Remove(stateFilename)
+				continue
+			}
+			if err == nil && resp.status/100 == 2 {
+				if offset, err = uploadOffset(resp, -1); err != nil {
+					return nil, err
+				}
+				if offset > len(data) {
+					return nil, fmt.Errorf("server has received %d bytes of %d", offset, len(data))
+				}
+				continue
+			}
+
+		default:
+			end := min(offset+s.opts.ChunkSize, len(data))
+			complete := "?0"
+			if end == len(data) {
+				complete = "?1"
+			}
+			resp, err = s.send(ctx, http.MethodPatch, state.Location, header, data[offset:end], map[string]string{
+				"Content-Type":    "application/partial-upload",
+				"Upload-Offset":   strconv.Itoa(offset),
+				"Upload-Complete": complete,
+			})
+			if err == nil && resp.status/100 == 2 {
+				if end == len(data) {
+					_ = os.Remove(stateFilename)
+					return resp, nil
+				}
+				if offset, err = uploadOffset(resp, end); err != nil {
+					return nil, err
+				}
+				attempt = -1
+				continue
+			}
+			// The server may have received some or none of the chunk, ask before continuing
+			offset = -1
+			if err == nil && resp.status == http.StatusConflict {
+				resp, err = nil, fmt.Errorf("upload offset conflict")
+			}
+		}
+
+		if err := s.retry(ctx, attempt, resp, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// send sends a request with the common header and extra headers, and reads the response
+func (s *Submitter) send(ctx context.Context, method, target string, header http.Header, body []byte, extra map[string]string) (*submitResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	for name, value := range extra {
+		req.Header.Set(name, value)
+	}
+	if body != nil {
+		digest := sha256.Sum256(body)
+		req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	return &submitResponse{status: resp.StatusCode, header: resp.Header, body: respBody}, nil
+}
+
+// retry waits before retrying a failed request, or returns an error if it can not be retried
+func (s *Submitter) retry(ctx context.Context, attempt int, resp *submitResponse, err error) error {
+	if err == nil {
+		err = fmt.Errorf("server responded with status %d: %s", resp.status, strings.TrimSpace(string(resp.body)))
+		switch resp.status {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return fmt.Errorf("submission failed: %w", err)
+		}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if attempt >= s.opts.Retries {
+		return fmt.Errorf("submission failed after %d attempts: %w", attempt+1, err)
+	}
+
+	// Exponential backoff with up to 25% jitter, or the delay the server asks for if longer. The delay stops
+	// doubling at the maximum, so that it can not overflow.
+	delay := s.opts.Backoff
+	for i := 0; i < attempt && delay < s.opts.MaxBackoff; i++ {
+		delay = min(delay, s.opts.MaxBackoff/2) * 2
+	}
+	delay = min(delay, s.opts.MaxBackoff)
+	delay += time.Duration(rand.Int64N(int64(delay)/4 + 1))
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.header.Get("Retry-After")); err == nil {
+			delay = max(delay, min(time.Duration(seconds)*time.Second, s.opts.MaxBackoff))
+		}
+	}
+	fmt.Fprintf(s.opts.Logger, "Warning: %v, retrying in %v\n", err, delay.Round(time.Millisecond))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// uploadLocation returns the URL of the upload resource in the Location header of a response
+func (s *Submitter) uploadLocation(resp *submitResponse) (string, error) {
+	location := resp.header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("server did not return the location of the upload")
+	}
+	base, err := url.Parse(s.opts.URL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	resolved := base.ResolveReference(ref).String()
+	if err := s.checkLocation(resolved); err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// checkLocation checks that an upload location has the same origin as the submission URL, as the token
+// is sent along with every request to it
+func (s *Submitter) checkLocation(location string) error {
+	base, err := url.Parse(s.opts.URL)
+	if err != nil {
+		return err
+	}
+	target, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	if !strings.EqualFold(target.Scheme, base.Scheme) || !strings.EqualFold(target.Host, base.Host) {
+		return fmt.Errorf("upload location %s is not on the submission server %s://%s", location, base.Scheme, base.Host)
+	}
+	return nil
+}
+
+// uploadOffset returns the Upload-Offset of a response, or def if there is none. A negative def makes
+// the header required.
+func uploadOffset(resp *submitResponse, def int) (int, error) {
+	value := resp.header.Get("Upload-Offset")
+	if value == "" {
+		if def < 0 {
+			return 0, fmt.Errorf("server did not return the upload offset")
+		}
+		return def, nil
+	}
+	offset, err := strconv.Atoi(value)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid upload offset %q", value)
+	}
+	return offset, nil
+}
+
+// saveSubmitState stores the state of a resumable upload
+func saveSubmitState(filename string, state submitState) error {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filename, func(file io.Writer) error {
+		_, err := file.Write(encoded)
+		return err
+	})
+}
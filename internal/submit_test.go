@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCollector is a collection endpoint accepting whole and resumable uploads
+type fakeCollector struct {
+	mu         sync.Mutex
+	token      string
+	failures   int    // Number of requests to fail with 503 before handling them
+	lostPatch  int    // Number of PATCH requests to handle, but respond to with 503
+	failPatch  bool   // Fail all PATCH requests
+	otherHost  string // Host of the upload locations, if not the collector itself
+	uploads    map[string][]byte
+	received   [][]byte
+	posts      int
+	nextUpload int
+}
+
+func sha256Header(data []byte) string {
+	digest := sha256.Sum256(data)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(digest[:]) + ":"
+}
+
+func (fake *fakeCollector) complete(w http.ResponseWriter, r *http.Request, data []byte, status int) {
+	if r.Header.Get("Repr-Digest") != sha256Header(data) {
+		http.Error(w, "digest mismatch", http.StatusBadRequest)
+		return
+	}
+	fake.received = append(fake.received, data)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"submission": %d, "size": %d}`, len(fake.received), len(data))
+}
+
+func (fake *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if fake.token != "" && r.Header.Get("Authorization") != "Bearer "+fake.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if fake.failures > 0 {
+		fake.failures--
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Method != http.MethodHead && r.Header.Get("Content-Digest") != sha256Header(body) {
+		http.Error(w, "content digest mismatch", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/submit":
+		fake.posts++
+		if r.Header.Get("Upload-Complete") == "?1" {
+			fake.complete(w, r, body, http.StatusCreated)
+			return
+		}
+		fake.nextUpload++
+		id := fmt.Sprintf("/uploads/%d", fake.nextUpload)
+		fake.uploads[id] = body
+		if fake.otherHost != "" {
+			w.Header().Set("Location", "http://"+fake.otherHost+id)
+		} else {
+			w.Header().Set("Location", id)
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead:
+		data, found := fake.uploads[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+	case r.Method == http.MethodPatch:
+		data, found := fake.uploads[r.URL.Path]
+		if !found {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		if fake.failPatch {
+			http.Error(w, "failing", http.StatusBadGateway)
+			return
+		}
+		if r.Header.Get("Upload-Offset") != strconv.Itoa(len(data)) {
+			http.Error(w, "offset mismatch", http.StatusConflict)
+			return
+		}
+		data = append(data, body...)
+		fake.uploads[r.URL.Path] = data
+		if fake.lostPatch > 0 {
+			fake.lostPatch--
+			http.Error(w, "lost", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Upload-Complete") == "?1" {
+			delete(fake.uploads, r.URL.Path)
+			fake.complete(w, r, data, http.StatusOK)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// newTestSubmitter returns a collector and a submitter for it, with a file to submit
+func newTestSubmitter(t *testing.T, chunkSize, retries int) (*fakeCollector, *Submitter, string) {
+	t.Helper()
+
+	fake := &fakeCollector{token: "secret", uploads: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	submitter, err := NewSubmitter(SubmitOptions{
+		URL:        server.URL + "/submit",
+		Token:      "secret",
+		ChunkSize:  chunkSize,
+		Retries:    retries,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSubmitter failed: %v", err)
+	}
+	return fake, submitter, filepath.Join(t.TempDir(), "dataset.cbor")
+}
+
+func TestSubmitter_Whole(t *testing.T) {
+	fake, submitter, filename := newTestSubmitter(t, DefaultSubmitChunkSize, 3)
+	fake.failures = 2
+	data := []byte("a small dataset")
+
+	receipt, err := submitter.SubmitFile(context.Background(), filename, data)
+	if err != nil {
+		t.Fatalf("SubmitFile failed: %v", err)
+	}
+	if len(fake.received) != 1 || !bytes.Equal(fake.received[0], data) || fake.posts != 1 {
+		t.Errorf("Expected the data to be received once, got %q", fake.received)
+	}
+	if receipt.Status != http.StatusCreated || receipt.Receipt != `{"submission": 1, "size": 15}` || receipt.Size != len(data) {
+		t.Errorf("Unexpected receipt %+v", receipt)
+	}
+
+	stored, err := LoadReceipt(filename)
+	if err != nil || stored == nil || stored.SHA256 != receipt.SHA256 || stored.Receipt != receipt.Receipt {
+		t.Errorf("Expected the receipt to be stored next to the file, got %+v (%v)", stored, err)
+	}
+	if receipt, err := LoadReceipt(filename + ".missing"); err != nil || receipt != nil {
+		t.Errorf("Expected no receipt for a file not submitted, got %+v (%v)", receipt, err)
+	}
+
+	// Too many failures
+	fake.failures = 4
+	if _, err := submitter.SubmitFile(context.Background(), filename, data); err == nil || !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Errorf("Expected an error after 4 attempts, got %v", err)
+	}
+
+	// Client errors are not retried
+	fake.failures = 0
+	submitter.opts.Token = "wrong"
+	if _, err := submitter.SubmitFile(context.Background(), filename, data); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Errorf("Expected an authorization error, got %v", err)
+	}
+}
+
+func TestSubmitter_Resumable(t *testing.T) {
+	fake, submitter, filename := newTestSubmitter(t, 10, 3)
+	fake.lostPatch = 1
+	data := []byte("a dataset of more than three chunks")
+
+	receipt, err := submitter.SubmitFile(context.Background(), filename, data)
+	if err != nil {
+		t.Fatalf("SubmitFile failed: %v", err)
+	}
+	if len(fake.received) != 1 || !bytes.Equal(fake.received[0], data) || fake.posts != 1 {
+		t.Errorf("Expected the data to be received once, got %q in %d uploads", fake.received, fake.posts)
+	}
+	var body struct{ Size int }
+	if err := json.Unmarshal([]byte(receipt.Receipt), &body); err != nil || body.Size != len(data) || receipt.Status != http.StatusOK {
+		t.Errorf("Unexpected receipt %+v", receipt)
+	}
+	if _, err := os.Stat(submitStateFilename(filename)); !os.IsNotExist(err) {
+		t.Errorf("Expected the upload state to be removed, got %v", err)
+	}
+}
+
+func TestSubmitter_ResumeLater(t *testing.T) {
+	fake, submitter, filename := newTestSubmitter(t, 10, 1)
+	fake.failPatch = true
+	data := []byte("a dataset of more than three chunks")
+
+	if _, err := submitter.SubmitFile(context.Background(), filename, data); err == nil {
+		t.Fatalf("Expected the submission to fail")
+	}
+	if _, err := os.Stat(submitStateFilename(filename)); err != nil {
+		t.Fatalf("Expected the upload state to be stored: %v", err)
+	}
+
+	// A later submission of the same data continues the upload
+	fake.failPatch = false
+	if _, err := submitter.SubmitFile(context.Background(), filename, data); err != nil {
+		t.Fatalf("SubmitFile failed: %v", err)
+	}
+	if len(fake.received) != 1 || !bytes.Equal(fake.received[0], data) || fake.posts != 1 {
+		t.Errorf("Expected the upload to be resumed, got %q in %d uploads", fake.received, fake.posts)
+	}
+
+	// An expired upload is started over
+	fake.failPatch = true
+	other := []byte("another dataset of more than three chunks")
+	if _, err := submitter.SubmitFile(context.Background(), filename, other); err == nil {
+		t.Fatalf("Expected the submission to fail")
+	}
+	fake.failPatch = false
+	clear(fake.uploads)
+	if _, err := submitter.SubmitFile(context.Background(), filename, other); err != nil {
+		t.Fatalf("SubmitFile failed: %v", err)
+	}
+	if len(fake.received) != 2 || !bytes.Equal(fake.received[1], other) || fake.posts != 3 {
+		t.Errorf("Expected the upload to start over, got %q in %d uploads", fake.received, fake.posts)
+	}
+}
+
+func TestSubmitter_OtherHost(t *testing.T) {
+	fake, submitter, filename := newTestSubmitter(t, 10, 1)
+	data := []byte("a dataset of more than three chunks")
+
+	// The token is not sent to an upload location on another host
+	fake.otherHost = "attacker.example"
+	if _, err := submitter.SubmitFile(context.Background(), filename, data); err == nil || !strings.Contains(err.Error(), "is not on the submission server") {
+		t.Errorf("Expected an error for an upload location on another host, got %v", err)
+	}
+	if _, err := os.Stat(submitStateFilename(filename)); !os.IsNotExist(err) {
+		t.Errorf("Expected no upload state to be stored, got %v", err)
+	}
+
+	// Nor to one in the upload state
+	digest := sha256.Sum256(data)
+	state := submitState{URL: submitter.opts.URL, SHA256: fmt.Sprintf("%x", digest), Size: len(data), Location: "http://attacker.example/uploads/1"}
+	if err := saveSubmitState(submitStateFilename(filename), state); err != nil {
+		t.Fatalf("saveSubmitState failed: %v", err)
+	}
+	fake.otherHost = ""
+	if _, err := submitter.SubmitFile(context.Background(), filename, data); err == nil || !strings.Contains(err.Error(), "can not resume the upload") {
+		t.Errorf("Expected an error for an upload state with another host, got %v", err)
+	}
+	if len(fake.received) != 0 {
+		t.Errorf("Expected nothing to be received, got %q", fake.received)
+	}
+}
+
+func TestSubmitter_RetryBackoff(t *testing.T) {
+	var logger bytes.Buffer
+	submitter, err := NewSubmitter(SubmitOptions{
+		URL:        "http://localhost/submit",
+		ChunkSize:  1,
+		Retries:    1000,
+		Backoff:    time.Microsecond,
+		MaxBackoff: time.Millisecond,
+		Logger:     &logger,
+	})
+	if err != nil {
+		t.Fatalf("NewSubmitter failed: %v", err)
+	}
+
+	// The delay stays within the maximum (and its jitter) for any number of attempts
+	for _, attempt := range []int{0, 1, 10, 53, 54, 62, 63, 64, 100, 999} {
+		logger.Reset()
+		if err := submitter.retry(context.Background(), attempt, nil, fmt.Errorf("failed")); err != nil {
+			t.Fatalf("retry failed: %v", err)
+		}
+		_, after, _ := strings.Cut(strings.TrimSpace(logger.String()), "retrying in ")
+		delay, err := time.ParseDuration(after)
+		if err != nil || delay < 0 || delay > 1250*time.Microsecond {
+			t.Errorf("Attempt %d: unexpected delay in %q (%v)", attempt, logger.String(), err)
+		}
+	}
+}
+
+func TestNewSubmitter(t *testing.T) {
+	for _, opts := range []SubmitOptions{
+		{URL: "ftp://example.com/", ChunkSize: 1, Backoff: time.Second, MaxBackoff: time.Second},
+		{URL: "https://example.com/", ChunkSize: 0, Backoff: time.Second, MaxBackoff: time.Second},
+		{URL: "https://example.com/", ChunkSize: 1, Backoff: -time.Second, MaxBackoff: time.Second},
+		{URL: "https://example.com/", ChunkSize: 1, Backoff: 2 * time.Second, MaxBackoff: time.Second},
+		{URL: "https://example.com/", ChunkSize: 1, Retries: -1, Backoff: time.Second, MaxBackoff: time.Second},
+	} {
+		if _, err := NewSubmitter(opts); err == nil {
+			t.Errorf("Expected an error for %+v", opts)
+		}
+	}
+
+	if _, err := LoadClientTLSConfig("missing.pem", "missing.key", ""); err == nil {
+		t.Errorf("Expected an error for a missing client certificate")
+	}
+}
@@ -0,0 +1,182 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Metrics of a time series
+const (
+	MetricMagnitude = "magnitude"
+	MetricClients   = "clients"
+	MetricQueries   = "queries"
+)
+
+// TimeSeriesMetrics are all the metrics of a time series, in output order
+var TimeSeriesMetrics = []string{MetricMagnitude, MetricClients, MetricQueries}
+
+// TimeSeriesTotals are the totals of the dataset of one day in a time series
+type TimeSeriesTotals struct {
+	Date               string `json:"date"`
+	TotalUniqueClients uint64 `json:"totalUniqueClients"`
+	TotalQueryVolume   uint64 `json:"totalQueryVolume"`
+}
+
+// DomainTimeSeries are the values of a domain for each day of a time series, nil on days without the domain
+type DomainTimeSeries struct {
+	Domain        string     `json:"domain"`
+	Magnitude     []*float64 `json:"magnitude"`
+	UniqueClients []*uint64  `json:"uniqueClients"`
+	QueryVolume   []*uint64  `json:"queryVolume"`
+	maxMagnitude  float64
+}
+
+// TimeSeries is the magnitude, clients and queries of every domain on each day of a set of daily datasets
+type TimeSeries struct {
+	Dates   []string           `json:"dates"`
+	Totals  []TimeSeriesTotals `json:"totals"`  // Totals for each date
+	Domains []DomainTimeSeries `json:"domains"` // Sorted by the highest magnitude on any day, highest first
+}
+
+// NewTimeSeries builds a time series from datasets of different days. Domains are included if they are
+// among the top domains by magnitude on at least one day, or all domains if top is 0.
+func NewTimeSeries(datasets []MagnitudeDataset, top int) (TimeSeries, error) {
+	datasets = slices.Clone(datasets)
+	slices.SortFunc(datasets, func(a, b MagnitudeDataset) int {
+		return a.Date.Compare(b.Date.Time)
+	})
+
+	ts := TimeSeries{Dates: []string{}, Totals: []TimeSeriesTotals{}, Domains: []DomainTimeSeries{}}
+	for i, dataset := range datasets {
+		if period := dataset.period(); period != nil {
+			return TimeSeries{}, fmt.Errorf("dataset %s is a rollup of the period %s, not of a single day",
+				dataset.extraSourceFilename, period)
+		}
+		if i > 0 && dataset.DateString() == datasets[i-1].DateString() {
+			return TimeSeries{}, fmt.Errorf("datasets %s and %s are both for %s, aggregate them first",
+				datasets[i-1].extraSourceFilename, dataset.extraSourceFilename, dataset.DateString())
+		}
+		ts.Dates = append(ts.Dates, dataset.DateString())
+		ts.Totals = append(ts.Totals, TimeSeriesTotals{
+			Date:               dataset.DateString(),
+			TotalUniqueClients: dataset.AllClientsCount,
+			TotalQueryVolume:   dataset.AllQueriesCount,
+		})
+	}
+
+	// Select the domains among the top domains on at least one day
+	byDomain := make(map[DomainName]*DomainTimeSeries)
+	for _, dataset := range datasets {
+		ranked := dataset.rankedByMagnitude()
+		if top > 0 {
+			ranked = ranked[:min(top, len(ranked))]
+		}
+		for _, dm := range ranked {
+			byDomain[dm.Domain] = &DomainTimeSeries{
+				Domain:        string(dm.Domain),
+				Magnitude:     make([]*float64, len(datasets)),
+				UniqueClients: make([]*uint64, len(datasets)),
+				QueryVolume:   make([]*uint64, len(datasets)),
+			}
+		}
+	}
+
+	for i, dataset := range datasets {
+		for name, domain := range byDomain {
+			data, found := dataset.Domains[name]
+			if !found {
+				continue
+			}
+			magnitude := dataset.magnitude(data.ClientsCount)
+			clients, queries := data.ClientsCount, data.QueriesCount
+			domain.Magnitude[i] = &magnitude
+			domain.UniqueClients[i] = &clients
+			domain.QueryVolume[i] = &queries
+			domain.maxMagnitude = max(domain.maxMagnitude, magnitude)
+		}
+	}
+
+	for _, domain := range byDomain {
+		ts.Domains = append(ts.Domains, *domain)
+	}
+	slices.SortFunc(ts.Domains, func(a, b DomainTimeSeries) int {
+		if c := cmp.Compare(b.maxMagnitude, a.maxMagnitude); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+
+	return ts, nil
+}
+
+// CheckTimeSeriesMetrics returns an error if a metric is not one of TimeSeriesMetrics
+func CheckTimeSeriesMetrics(metrics []string) error {
+	if len(metrics) == 0 {
+		return fmt.Errorf("no metrics")
+	}
+	for _, metric := range metrics {
+		if !slices.Contains(TimeSeriesMetrics, metric) {
+			return fmt.Errorf("unknown metric '%s', must be one of %s", metric, strings.Join(TimeSeriesMetrics, ", "))
+		}
+	}
+	return nil
+}
+
+// OutputTimeSeriesCSV writes a time series as a wide CSV table, with a row for each domain and a column
+// for each metric on each day, e.g. "2026-09-01 magnitude". Cells are empty on days without the domain.
+func OutputTimeSeriesCSV(w io.Writer, ts TimeSeries, metrics []string) error {
+	if err := CheckTimeSeriesMetrics(metrics); err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	header := []string{"domain"}
+	for _, date := range ts.Dates {
+		for _, metric := range metrics {
+			header = append(header, date+" "+metric)
+		}
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, domain := range ts.Domains {
+		row := []string{domain.Domain}
+		for i := range ts.Dates {
+			for _, metric := range metrics {
+				var cell string
+				switch {
+				case domain.Magnitude[i] == nil:
+				case metric == MetricMagnitude:
+					cell = strconv.FormatFloat(*domain.Magnitude[i], 'f', -1, 64)
+				case metric == MetricClients:
+					cell = strconv.FormatUint(*domain.UniqueClients[i], 10)
+				case metric == MetricQueries:
+					cell = strconv.FormatUint(*domain.QueryVolume[i], 10)
+				}
+				row = append(row, cell)
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// OutputTimeSeriesJSON writes a time series as JSON, with arrays of values aligned with the dates
+func OutputTimeSeriesJSON(w io.Writer, ts TimeSeries) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ts)
+}
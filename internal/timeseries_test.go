@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTimeSeries(t *testing.T) {
+	datasets := []MagnitudeDataset{
+		newDiffDataset(t, 3, map[string]clientRange{"com": {0, 99}, "org": {0, 49}, "net": {0, 9}}),
+		newDiffDataset(t, 1, map[string]clientRange{"com": {0, 99}, "org": {0, 9}}),
+		newDiffDataset(t, 2, map[string]clientRange{"com": {0, 99}, "net": {0, 49}, "se": {0, 4}}),
+	}
+
+	ts, err := NewTimeSeries(datasets, 0)
+	if err != nil {
+		t.Fatalf("NewTimeSeries failed: %v", err)
+	}
+	if !slices.Equal(ts.Dates, []string{"2026-09-01", "2026-09-02", "2026-09-03"}) {
+		t.Errorf("Expected dates sorted, got %v", ts.Dates)
+	}
+	if ts.Totals[0].TotalQueryVolume != 110 || ts.Totals[1].TotalQueryVolume != 155 {
+		t.Errorf("Unexpected totals %+v", ts.Totals)
+	}
+	var domains []string
+	for _, domain := range ts.Domains {
+		domains = append(domains, domain.Domain)
+	}
+	if !slices.Equal(domains, []string{"com", "net", "org", "se"}) {
+		t.Errorf("Expected domains sorted by highest magnitude, got %v", domains)
+	}
+
+	org := ts.Domains[2]
+	if org.Magnitude[1] != nil || org.UniqueClients[1] != nil || org.QueryVolume[1] != nil {
+		t.Errorf("Expected no values for org on 2026-09-02, got %+v", org)
+	}
+	if org.Magnitude[0] == nil || *org.QueryVolume[0] != 10 || *org.QueryVolume[2] != 50 {
+		t.Errorf("Unexpected values for org: %+v", org)
+	}
+	if *ts.Domains[0].Magnitude[0] != 10 {
+		t.Errorf("Expected magnitude 10 for com, got %v", *ts.Domains[0].Magnitude[0])
+	}
+
+	// With a top 2, the domains in the top 2 on any day are included, with their values on days they
+	// were not in the top 2
+	ts, err = NewTimeSeries(datasets, 2)
+	if err != nil {
+		t.Fatalf("NewTimeSeries failed: %v", err)
+	}
+	domains = nil
+	for _, domain := range ts.Domains {
+		domains = append(domains, domain.Domain)
+	}
+	if !slices.Equal(domains, []string{"com", "net", "org"}) {
+		t.Errorf("Expected com, net and org in the top 2 on any day, got %v", domains)
+	}
+	if net := ts.Domains[1]; net.QueryVolume[2] == nil || *net.QueryVolume[2] != 10 {
+		t.Errorf("Expected the values of net on 2026-09-03, got %+v", net)
+	}
+}
+
+func TestNewTimeSeries_Errors(t *testing.T) {
+	day1 := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 9}})
+	day2 := newDiffDataset(t, 2, map[string]clientRange{"com": {0, 9}})
+
+	if _, err := NewTimeSeries([]MagnitudeDataset{day1, day2, day1}, 0); err == nil || !strings.Contains(err.Error(), "aggregate them first") {
+		t.Errorf("Expected an error for two datasets of the same day, got %v", err)
+	}
+
+	period, err := NewDatasetPeriod(time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 9, 7, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("NewDatasetPeriod failed: %v", err)
+	}
+	rollup, err := RollupDatasets([]MagnitudeDataset{day1, day2}, period)
+	if err != nil {
+		t.Fatalf("RollupDatasets failed: %v", err)
+	}
+	if _, err := NewTimeSeries([]MagnitudeDataset{rollup}, 0); err == nil || !strings.Contains(err.Error(), "is a rollup") {
+		t.Errorf("Expected an error for a rollup, got %v", err)
+	}
+}
+
+func TestOutputTimeSeries(t *testing.T) {
+	ts, err := NewTimeSeries([]MagnitudeDataset{
+		newDiffDataset(t, 1, map[string]clientRange{"com": {0, 99}, "org": {0, 9}}),
+		newDiffDataset(t, 2, map[string]clientRange{"com": {0, 99}}),
+	}, 0)
+	if err != nil {
+		t.Fatalf("NewTimeSeries failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := OutputTimeSeriesCSV(&buf, ts, []string{MetricQueries, MetricMagnitude}); err != nil {
+		t.Fatalf("OutputTimeSeriesCSV failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	expected := [][]string{
+		{"domain", "2026-09-01 queries", "2026-09-01 magnitude", "2026-09-02 queries", "2026-09-02 magnitude"},
+		{"com", "100", "10", "100", "10"},
+	}
+	if len(records) != 3 || !slices.Equal(records[0], expected[0]) || !slices.Equal(records[1], expected[1]) {
+		t.Fatalf("Unexpected CSV output: %v", records)
+	}
+	if org := records[2]; org[0] != "org" || org[1] != "10" || org[3] != "" || org[4] != "" {
+		t.Errorf("Expected empty cells for org on 2026-09-02, got %v", org)
+	}
+
+	if err := OutputTimeSeriesCSV(&buf, ts, []string{"volume"}); err == nil {
+		t.Errorf("Expected an error for an unknown metric")
+	}
+
+	buf.Reset()
+	if err := OutputTimeSeriesJSON(&buf, ts); err != nil {
+		t.Fatalf("OutputTimeSeriesJSON failed: %v", err)
+	}
+	var decoded struct {
+		Dates   []string
+		Domains []struct {
+			Domain      string
+			QueryVolume []*uint64
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to parse JSON: %v\n%s", err, buf.String())
+	}
+	if len(decoded.Dates) != 2 || len(decoded.Domains) != 2 || decoded.Domains[1].QueryVolume[1] != nil {
+		t.Errorf("Unexpected JSON output:\n%s", buf.String())
+	}
+}
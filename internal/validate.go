@@ -0,0 +1,528 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/segmentio/go-hll"
+)
+
+// CBOR major types
+const (
+	cborUnsigned   = 0
+	cborNegative   = 1
+	cborByteString = 2
+	cborTextString = 3
+	cborArray      = 4
+	cborMap        = 5
+	cborTag        = 6
+	cborSimple     = 7
+)
+
+// Sizes of the COSE byte strings, as bstr .size in schema/dataset.cddl
+const (
+	coseKidSize       = sha256.Size
+	coseSignatureSize = ed25519.SignatureSize
+	coseIVSize        = 12 // A256GCM nonce
+	coseX25519Size    = 32
+)
+
+var cborTypeNames = []string{"uint", "nint", "bstr", "tstr", "array", "map", "tag", "simple value or float"}
+
+// validateDecMode rejects duplicate map keys, which the CDDL does not allow
+var validateDecMode, _ = cbor.DecOptions{
+	DupMapKey:      cbor.DupMapKeyEnforcedAPF,
+	DefaultMapType: reflect.TypeOf(map[any]cbor.RawMessage{}),
+}.DecMode()
+
+// ValidationError is a violation of the dataset schema, at a path in the dataset
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+// schemaValidator checks CBOR items against the rules in schema/dataset.cddl
+type schemaValidator struct {
+	identity *ecdh.PrivateKey
+	errors   []ValidationError
+}
+
+// ValidateDatasets checks every dataset in a CBOR sequence against the dataset schema (schema/dataset.cddl),
+// including that the HLLs decode with the expected parameters. Signed datasets are validated including
+// their payload. Encrypted datasets are decrypted if an identity is given, otherwise only the COSE_Encrypt
+// structure is validated. Returns the number of datasets and the schema violations found.
+func ValidateDatasets(reader io.Reader, identity *ecdh.PrivateKey) (int, []ValidationError, error) {
+	v := &schemaValidator{identity: identity}
+	count := 0
+	err := forEachCBORItem(reader, func(item []byte) error {
+		count++
+		v.item(fmt.Sprintf("dataset[%d]", count), item)
+		return nil
+	})
+	return count, v.errors, err
+}
+
+func (v *schemaValidator) fail(path, format string, args ...any) {
+	v.errors = append(v.errors, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// item validates a magnitude_dataset, signed_magnitude_dataset or encrypted_magnitude_dataset
+func (v *schemaValidator) item(path string, item []byte) {
+	switch {
+	case isSigned(item):
+		v.signed(path, item)
+	case isEncrypted(item):
+		v.encrypted(path, item)
+	default:
+		v.dataset(path, item)
+	}
+}
+
+// majorType checks the CBOR major type of raw, returning false if it is not one of expected
+func (v *schemaValidator) majorType(path string, raw []byte, expected ...byte) bool {
+	if len(raw) == 0 {
+		v.fail(path, "missing value")
+		return false
+	}
+	got := raw[0] >> 5
+	if !slices.Contains(expected, got) {
+		names := make([]string, len(expected))
+		for i, t := range expected {
+			names[i] = cborTypeNames[t]
+		}
+		v.fail(path, "expected %s, got %s", joinOr(names), cborTypeNames[got])
+		return false
+	}
+	return true
+}
+
+// decode decodes raw into dest, which must succeed after the major type has been checked
+func (v *schemaValidator) decode(path string, raw []byte, dest any) bool {
+	if err := validateDecMode.Unmarshal(raw, dest); err != nil {
+		v.fail(path, "%v", err)
+		return false
+	}
+	return true
+}
+
+// fields describes the members of a CDDL map with text string keys
+type fields map[string]struct {
+	required bool
+	check    func(path string, raw []byte)
+}
+
+// mapWithFields validates a map with text string keys, its required and optional members,
+// and that there are no other members
+func (v *schemaValidator) mapWithFields(path string, raw []byte, members fields) {
+	if !v.majorType(path, raw, cborMap) {
+		return
+	}
+	var m map[any]cbor.RawMessage
+	if !v.decode(path, raw, &m) {
+		return
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		name, ok := key.(string)
+		if !ok {
+			v.fail(path, "key %v is not a text string", key)
+			continue
+		}
+		keys = append(keys, name)
+	}
+	slices.Sort(keys)
+
+	for _, name := range keys {
+		member, ok := members[name]
+		if !ok {
+			v.fail(path, "unexpected key %q", name)
+			continue
+		}
+		member.check(path+"."+name, m[name])
+	}
+
+	names := make([]string, 0, len(members))
+	for name, member := range members {
+		if _, found := m[name]; member.required && !found {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		v.fail(path, "missing required key %q", name)
+	}
+}
+
+func (v *schemaValidator) textString(path string, raw []byte) {
+	var s string
+	if v.majorType(path, raw, cborTextString) {
+		v.decode(path, raw, &s)
+	}
+}
+
+func (v *schemaValidator) byteString(path string, raw []byte) {
+	var b []byte
+	if v.majorType(path, raw, cborByteString) {
+		v.decode(path, raw, &b)
+	}
+}
+
+// sizedByteString validates a byte string of exactly size bytes
+func (v *schemaValidator) sizedByteString(size int) func(path string, raw []byte) {
+	return func(path string, raw []byte) {
+		var b []byte
+		if v.majorType(path, raw, cborByteString) && v.decode(path, raw, &b) && len(b) != size {
+			v.fail(path, "expected %d bytes, got %d", size, len(b))
+		}
+	}
+}
+
+func (v *schemaValidator) unsigned(path string, raw []byte) {
+	var u uint64
+	if v.majorType(path, raw, cborUnsigned) {
+		v.decode(path, raw, &u)
+	}
+}
+
+func (v *schemaValidator) boolean(path string, raw []byte) {
+	if len(raw) == 0 {
+		v.fail(path, "missing value")
+	} else if raw[0] != 0xf4 && raw[0] != 0xf5 {
+		v.fail(path, "expected bool, got %s", cborTypeNames[raw[0]>>5])
+	}
+}
+
+// arrayOf validates an array, and each element with check
+func (v *schemaValidator) arrayOf(check func(path string, raw []byte)) func(path string, raw []byte) {
+	return func(path string, raw []byte) {
+		var elements []cbor.RawMessage
+		if !v.majorType(path, raw, cborArray) || !v.decode(path, raw, &elements) {
+			return
+		}
+		for i, element := range elements {
+			check(fmt.Sprintf("%s[%d]", path, i), element)
+		}
+	}
+}
+
+// tag validates a tag with the given number, returning its content
+func (v *schemaValidator) tag(path string, raw []byte, number uint64) ([]byte, bool) {
+	var tag cbor.RawTag
+	if !v.majorType(path, raw, cborTag) || !v.decode(path, raw, &tag) {
+		return nil, false
+	}
+	if tag.Number != number {
+		v.fail(path, "expected tag %d, got tag %d", number, tag.Number)
+		return nil, false
+	}
+	return tag.Content, true
+}
+
+// calendarDate validates a tcaldate, an RFC 3339 full-date with tag 1004
+func (v *schemaValidator) calendarDate(path string, raw []byte) {
+	content, ok := v.tag(path, raw, 1004)
+	if !ok {
+		return
+	}
+	var s string
+	if !v.majorType(path, content, cborTextString) || !v.decode(path, content, &s) {
+		return
+	}
+	if _, err := time.Parse(time.DateOnly, s); err != nil {
+		v.fail(path, "invalid full-date %q", s)
+	}
+}
+
+// timestamp validates a time, epoch seconds with tag 1
+func (v *schemaValidator) timestamp(path string, raw []byte) {
+	content, ok := v.tag(path, raw, 1)
+	if !ok {
+		return
+	}
+	if !v.majorType(path, content, cborUnsigned, cborNegative, cborSimple) {
+		return
+	}
+	var seconds float64
+	v.decode(path, content, &seconds)
+}
+
+// version validates the dataset version
+func (v *schemaValidator) version(path string, raw []byte) {
+	var version uint64
+	if !v.majorType(path, raw, cborUnsigned) || !v.decode(path, raw, &version) {
+		return
+	}
+	if version != 1 && version != DatasetVersion {
+		v.fail(path, "unsupported version %d", version)
+	}
+}
+
+// hll validates an HLL, which must decode with the HLL parameters used by this toolkit
+func (v *schemaValidator) hll(path string, raw []byte) {
+	var data []byte
+	if !v.majorType(path, raw, cborByteString) || !v.decode(path, raw, &data) {
+		return
+	}
+	h, err := hll.FromBytes(data)
+	if err != nil {
+		v.fail(path, "invalid HLL: %v", err)
+		return
+	}
+	settings := h.Settings()
+	if settings.Log2m != hllSettings.Log2m || settings.Regwidth != hllSettings.Regwidth {
+		v.fail(path, "HLL has log2m %d and regwidth %d, expected log2m %d and regwidth %d",
+			settings.Log2m, settings.Regwidth, hllSettings.Log2m, hllSettings.Regwidth)
+	}
+}
+
+// dataset validates a magnitude_dataset
+func (v *schemaValidator) dataset(path string, raw []byte) {
+	v.mapWithFields(path, raw, fields{
+		"version":           {true, v.version},
+		"id":                {true, v.textString},
+		"generator":         {false, v.textString},
+		"date":              {true, v.calendarDate},
+		"all_clients_hll":   {true, v.hll},
+		"all_clients_count": {true, v.unsigned},
+		"all_queries_count": {true, v.unsigned},
+		"domains":           {true, v.domains},
+		"partial":           {false, v.boolean},
+		"last_file":         {false, v.textString},
+		"metadata":          {false, v.metadata},
+	})
+}
+
+// domains validates the map of domain_data by domain name
+func (v *schemaValidator) domains(path string, raw []byte) {
+	var m map[any]cbor.RawMessage
+	if !v.majorType(path, raw, cborMap) || !v.decode(path, raw, &m) {
+		return
+	}
+
+	names := make([]string, 0, len(m))
+	for key := range m {
+		name, ok := key.(string)
+		if !ok {
+			v.fail(path, "key %v is not a text string", key)
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		v.mapWithFields(path+"["+strconv.Quote(name)+"]", m[name], fields{
+			"clients_hll":   {true, v.hll},
+			"clients_count": {true, v.unsigned},
+			"queries_count": {true, v.unsigned},
+		})
+	}
+}
+
+// metadata validates a dataset_metadata
+func (v *schemaValidator) metadata(path string, raw []byte) {
+	v.mapWithFields(path, raw, fields{
+		"sources": {false, v.arrayOf(v.textString)},
+		"sites":   {false, v.arrayOf(v.textString)},
+		"window": {false, func(path string, raw []byte) {
+			v.mapWithFields(path, raw, fields{
+				"start": {true, v.timestamp},
+				"end":   {true, v.timestamp},
+			})
+		}},
+		"input_files": {false, v.arrayOf(func(path string, raw []byte) {
+			v.mapWithFields(path, raw, fields{
+				"name":   {true, v.textString},
+				"size":   {true, v.unsigned},
+				"sha256": {true, v.byteString},
+			})
+		})},
+		"truncation": {false, func(path string, raw []byte) {
+			v.mapWithFields(path, raw, fields{
+				"ipv4": {true, v.unsigned},
+				"ipv6": {true, v.unsigned},
+			})
+		}},
+		"hll": {false, func(path string, raw []byte) {
+			v.mapWithFields(path, raw, fields{
+				"log2m":    {true, v.unsigned},
+				"regwidth": {true, v.unsigned},
+			})
+		}},
+		"domain_labels": {false, v.unsigned},
+		"parents":       {false, v.arrayOf(v.textString)},
+		"filters": {false, v.arrayOf(func(path string, raw []byte) {
+			v.mapWithFields(path, raw, fields{
+				"include":         {false, v.arrayOf(v.textString)},
+				"include_pattern": {false, v.textString},
+				"exclude":         {false, v.arrayOf(v.textString)},
+				"exclude_pattern": {false, v.textString},
+			})
+		})},
+		"period": {false, func(path string, raw []byte) {
+			v.mapWithFields(path, raw, fields{
+				"start":   {true, v.calendarDate},
+				"end":     {true, v.calendarDate},
+				"missing": {false, v.arrayOf(v.calendarDate)},
+			})
+		}},
+	})
+}
+
+// coseArray validates a tagged COSE array of n elements, returning the elements
+func (v *schemaValidator) coseArray(path string, raw []byte, number uint64, n int) ([]cbor.RawMessage, bool) {
+	content, ok := v.tag(path, raw, number)
+	if !ok {
+		return nil, false
+	}
+	return v.array(path, content, n)
+}
+
+// array validates an array of n elements, returning the elements
+func (v *schemaValidator) array(path string, raw []byte, n int) ([]cbor.RawMessage, bool) {
+	var elements []cbor.RawMessage
+	if !v.majorType(path, raw, cborArray) || !v.decode(path, raw, &elements) {
+		return nil, false
+	}
+	if len(elements) != n {
+		v.fail(path, "expected array of %d elements, got %d", n, len(elements))
+		return nil, false
+	}
+	return elements, true
+}
+
+// headers validates a COSE header map, and that it has the expected integer values.
+// Other members must be byte strings of the given sizes by label (e.g. kid).
+func (v *schemaValidator) headers(path string, raw []byte, expected map[int64]int64, byteStrings map[int64]int) {
+	var m map[any]cbor.RawMessage
+	if !v.majorType(path, raw, cborMap) || !v.decode(path, raw, &m) {
+		return
+	}
+	for label, value := range expected {
+		var got int64
+		if _, found := m[toHeaderKey(label)]; !found {
+			v.fail(path, "missing header %d", label)
+		} else if err := validateDecMode.Unmarshal(m[toHeaderKey(label)], &got); err != nil || got != value {
+			v.fail(fmt.Sprintf("%s[%d]", path, label), "expected %d", value)
+		}
+	}
+	for label, size := range byteStrings {
+		if value, found := m[toHeaderKey(label)]; !found {
+			v.fail(path, "missing header %d", label)
+		} else {
+			v.sizedByteString(size)(fmt.Sprintf("%s[%d]", path, label), value)
+		}
+	}
+	if len(m) != len(expected)+len(byteStrings) {
+		v.fail(path, "unexpected headers")
+	}
+}
+
+// toHeaderKey returns a COSE header label as decoded into a map key
+func toHeaderKey(label int64) any {
+	if label < 0 {
+		return label
+	}
+	return uint64(label)
+}
+
+// protectedHeaders validates a protected header, a byte string containing a COSE header map
+func (v *schemaValidator) protectedHeaders(path string, raw []byte, expected map[int64]int64, byteStrings map[int64]int) {
+	var encoded []byte
+	if v.majorType(path, raw, cborByteString) && v.decode(path, raw, &encoded) {
+		v.headers(path, encoded, expected, byteStrings)
+	}
+}
+
+// signed validates a signed_magnitude_dataset, including its payload
+func (v *schemaValidator) signed(path string, raw []byte) {
+	elements, ok := v.coseArray(path, raw, coseSign1Tag, 4)
+	if !ok {
+		return
+	}
+	v.protectedHeaders(path+".protected", elements[0], map[int64]int64{coseHeaderAlg: coseAlgEdDSA},
+		map[int64]int{coseHeaderKid: coseKidSize})
+	v.headers(path+".unprotected", elements[1], nil, nil)
+	v.sizedByteString(coseSignatureSize)(path+".signature", elements[3])
+
+	var payload []byte
+	if v.majorType(path+".payload", elements[2], cborByteString) && v.decode(path+".payload", elements[2], &payload) {
+		if isEncrypted(payload) {
+			v.encrypted(path+".payload", payload)
+		} else {
+			v.dataset(path+".payload", payload)
+		}
+	}
+}
+
+// encrypted validates an encrypted_magnitude_dataset, and its plaintext if an identity is set
+func (v *schemaValidator) encrypted(path string, raw []byte) {
+	elements, ok := v.coseArray(path, raw, coseEncryptTag, 4)
+	if !ok {
+		return
+	}
+	v.protectedHeaders(path+".protected", elements[0], map[int64]int64{coseHeaderAlg: coseAlgA256GCM}, nil)
+	v.headers(path+".unprotected", elements[1], nil, map[int64]int{coseHeaderIV: coseIVSize})
+	v.byteString(path+".ciphertext", elements[2])
+	v.arrayOf(func(path string, raw []byte) {
+		recipient, ok := v.array(path, raw, 3)
+		if !ok {
+			return
+		}
+		v.protectedHeaders(path+".protected", recipient[0], map[int64]int64{coseHeaderAlg: coseAlgECDHESHKDF}, nil)
+		v.sizedByteString(0)(path+".ciphertext", recipient[2])
+
+		var m map[any]cbor.RawMessage
+		if !v.majorType(path+".unprotected", recipient[1], cborMap) || !v.decode(path+".unprotected", recipient[1], &m) {
+			return
+		}
+		if key, found := m[int64(coseHeaderEphemeral)]; found {
+			v.headers(fmt.Sprintf("%s.unprotected[%d]", path, coseHeaderEphemeral), key,
+				map[int64]int64{coseKeyKty: coseKtyOKP, coseKeyCrv: coseCrvX25519}, map[int64]int{coseKeyX: coseX25519Size})
+		} else {
+			v.fail(path+".unprotected", "missing header %d", coseHeaderEphemeral)
+		}
+		if kid, found := m[uint64(coseHeaderKid)]; found {
+			v.sizedByteString(coseKidSize)(fmt.Sprintf("%s.unprotected[%d]", path, coseHeaderKid), kid)
+		} else {
+			v.fail(path+".unprotected", "missing header %d", coseHeaderKid)
+		}
+	})(path+".recipients", elements[3])
+
+	if v.identity == nil {
+		return
+	}
+	plaintext, err := decryptItem(raw, v.identity)
+	if err != nil {
+		v.fail(path, "%v", err)
+		return
+	}
+	v.item(path+".plaintext", plaintext)
+}
+
+// joinOr joins names as "a, b or c"
+func joinOr(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+	s := names[0]
+	for _, name := range names[1 : len(names)-1] {
+		s += ", " + name
+	}
+	return s + " or " + names[len(names)-1]
+}
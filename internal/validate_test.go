@@ -0,0 +1,256 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/segmentio/go-hll"
+)
+
+// mutateDataset returns an encoded dataset, changed by mutate
+func mutateDataset(t *testing.T, dataset MagnitudeDataset, mutate func(m map[string]cbor.RawMessage)) []byte {
+	t.Helper()
+
+	var m map[string]cbor.RawMessage
+	if err := cbor.Unmarshal(mustMarshalDataset(t, dataset), &m); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	mutate(m)
+	data, err := cbor.Marshal(m)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	return data
+}
+
+// mustMarshal encodes a value for mutateDataset
+func mustMarshal(t *testing.T, v any) cbor.RawMessage {
+	t.Helper()
+
+	data, err := cbor.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	return data
+}
+
+// mutateCOSE returns a tagged COSE structure, decoded as a T and changed by mutate
+func mutateCOSE[T any](t *testing.T, data []byte, mutate func(cose *T)) []byte {
+	t.Helper()
+
+	var tag cbor.RawTag
+	if err := cbor.Unmarshal(data, &tag); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	var cose T
+	if err := cbor.Unmarshal(tag.Content, &cose); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	mutate(&cose)
+	return mustMarshal(t, cbor.Tag{Number: tag.Number, Content: cose})
+}
+
+func TestValidateDatasets_Valid(t *testing.T) {
+	dir := t.TempDir()
+	identity, recipient := loadTestIdentity(t, dir, "collector")
+	privFile, _ := writeTestKeys(t, dir, "signer")
+	key, err := LoadSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+
+	start := time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC)
+	dataset := newMetadataDataset(t, "example", []string{"ams1"}, start, start.Add(time.Hour))
+	v1 := newMetadataDataset(t, "", nil)
+	v1.Version = 1
+	v1.Metadata = nil
+	partial := newMetadataDataset(t, "", nil)
+	partial.Partial = true
+	partial.LastFile = "input.pcap"
+
+	var sequence bytes.Buffer
+	for _, ds := range []MagnitudeDataset{dataset, v1, partial} {
+		sequence.Write(mustMarshalDataset(t, ds))
+	}
+	if _, err := SignDatasets(bytes.NewReader(mustMarshalDataset(t, dataset)), &sequence, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+	encrypted, err := encryptItem(mustMarshalDataset(t, dataset), recipient)
+	if err != nil {
+		t.Fatalf("encryptItem failed: %v", err)
+	}
+	sequence.Write(encrypted)
+	if _, err := SignDatasets(bytes.NewReader(encrypted), &sequence, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+
+	for name, id := range map[string]*ecdh.PrivateKey{"without identity": nil, "with identity": identity} {
+		t.Run(name, func(t *testing.T) {
+			count, errs, err := ValidateDatasets(bytes.NewReader(sequence.Bytes()), id)
+			if err != nil {
+				t.Fatalf("ValidateDatasets failed: %v", err)
+			}
+			if count != 6 {
+				t.Errorf("Expected 6 datasets, got %d", count)
+			}
+			for _, e := range errs {
+				t.Errorf("Unexpected validation error: %v", e)
+			}
+		})
+	}
+}
+
+func TestValidateDatasets_Invalid(t *testing.T) {
+	dataset := newMetadataDataset(t, "example", nil)
+	otherHll, err := hll.NewHll(hll.Settings{Log2m: 11, Regwidth: 5, ExplicitThreshold: hll.AutoExplicitThreshold, SparseEnabled: true})
+	if err != nil {
+		t.Fatalf("NewHll failed: %v", err)
+	}
+	otherHll.AddRaw(1)
+
+	tests := []struct {
+		name   string
+		mutate func(m map[string]cbor.RawMessage)
+		errMsg string
+	}{
+		{"missing key", func(m map[string]cbor.RawMessage) {
+			delete(m, "id")
+		}, `dataset[1]: missing required key "id"`},
+		{"unexpected key", func(m map[string]cbor.RawMessage) {
+			m["extra"] = mustMarshal(t, 1)
+		}, `dataset[1]: unexpected key "extra"`},
+		{"wrong type", func(m map[string]cbor.RawMessage) {
+			m["all_queries_count"] = mustMarshal(t, "5")
+		}, `dataset[1].all_queries_count: expected uint, got tstr`},
+		{"negative count", func(m map[string]cbor.RawMessage) {
+			m["all_clients_count"] = mustMarshal(t, -1)
+		}, `dataset[1].all_clients_count: expected uint, got nint`},
+		{"version", func(m map[string]cbor.RawMessage) {
+			m["version"] = mustMarshal(t, 3)
+		}, `dataset[1].version: unsupported version 3`},
+		{"untagged date", func(m map[string]cbor.RawMessage) {
+			m["date"] = mustMarshal(t, "2026-09-01")
+		}, `dataset[1].date: expected tag, got tstr`},
+		{"date tag", func(m map[string]cbor.RawMessage) {
+			m["date"] = mustMarshal(t, cbor.Tag{Number: 0, Content: "2026-09-01T00:00:00Z"})
+		}, `dataset[1].date: expected tag 1004, got tag 0`},
+		{"invalid date", func(m map[string]cbor.RawMessage) {
+			m["date"] = mustMarshal(t, cbor.Tag{Number: 1004, Content: "2026-13-01"})
+		}, `dataset[1].date: invalid full-date "2026-13-01"`},
+		{"invalid HLL", func(m map[string]cbor.RawMessage) {
+			m["all_clients_hll"] = mustMarshal(t, []byte{0xff})
+		}, `dataset[1].all_clients_hll: invalid HLL`},
+		{"HLL parameters", func(m map[string]cbor.RawMessage) {
+			m["all_clients_hll"] = mustMarshal(t, otherHll.ToBytes())
+		}, `dataset[1].all_clients_hll: HLL has log2m 11 and regwidth 5, expected log2m 14 and regwidth 5`},
+		{"domain HLL", func(m map[string]cbor.RawMessage) {
+			m["domains"] = mustMarshal(t, map[string]any{"com": map[string]any{
+				"clients_hll": otherHll.ToBytes(), "clients_count": 1, "queries_count": 1,
+			}})
+		}, `dataset[1].domains["com"].clients_hll: HLL has log2m 11`},
+		{"domain data", func(m map[string]cbor.RawMessage) {
+			m["domains"] = mustMarshal(t, map[string]any{"com": map[string]any{"queries_count": 1}})
+		}, `dataset[1].domains["com"]: missing required key "clients_count"`},
+		{"domain key", func(m map[string]cbor.RawMessage) {
+			m["domains"] = mustMarshal(t, map[any]any{1: map[string]any{}})
+		}, `dataset[1].domains: key 1 is not a text string`},
+		{"partial", func(m map[string]cbor.RawMessage) {
+			m["partial"] = mustMarshal(t, 1)
+		}, `dataset[1].partial: expected bool, got uint`},
+		{"metadata", func(m map[string]cbor.RawMessage) {
+			m["metadata"] = mustMarshal(t, map[string]any{"sites": []any{"ams1", 2}})
+		}, `dataset[1].metadata.sites[1]: expected tstr, got uint`},
+		{"window", func(m map[string]cbor.RawMessage) {
+			m["metadata"] = mustMarshal(t, map[string]any{"window": map[string]any{"start": 1, "end": cbor.Tag{Number: 1, Content: 2}}})
+		}, `dataset[1].metadata.window.start: expected tag, got uint`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs, err := ValidateDatasets(bytes.NewReader(mutateDataset(t, dataset, tt.mutate)), nil)
+			if err != nil {
+				t.Fatalf("ValidateDatasets failed: %v", err)
+			}
+			found := false
+			for _, e := range errs {
+				found = found || strings.Contains(e.Error(), tt.errMsg)
+			}
+			if !found {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, errs)
+			}
+		})
+	}
+}
+
+func TestValidateDatasets_Structure(t *testing.T) {
+	dir := t.TempDir()
+	_, recipient := loadTestIdentity(t, dir, "collector")
+	other, _ := loadTestIdentity(t, dir, "other")
+	privFile, _ := writeTestKeys(t, dir, "signer")
+	key, err := LoadSigningKey(privFile)
+	if err != nil {
+		t.Fatalf("LoadSigningKey failed: %v", err)
+	}
+
+	encrypted, err := encryptItem(mustMarshalDataset(t, newMetadataDataset(t, "", nil)), recipient)
+	if err != nil {
+		t.Fatalf("encryptItem failed: %v", err)
+	}
+	var signed bytes.Buffer
+	if _, err := SignDatasets(bytes.NewReader(mustMarshalDataset(t, newMetadataDataset(t, "", nil))), &signed, key); err != nil {
+		t.Fatalf("SignDatasets failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		identity *ecdh.PrivateKey
+		errMsg   string
+	}{
+		{"not a map", mustMarshal(t, []int{1, 2}), nil, "dataset[1]: expected map, got array"},
+		{"duplicate keys", []byte{0xa2, 0x61, 'a', 0x01, 0x61, 'a', 0x02}, nil, "dataset[1]: cbor: found duplicate map key"},
+		{"signed array", mustMarshal(t, cbor.Tag{Number: coseSign1Tag, Content: []int{1}}), nil, "dataset[1]: expected array of 4 elements, got 1"},
+		{"signed headers", mustMarshal(t, cbor.Tag{Number: coseSign1Tag, Content: []any{[]byte{0xa0}, map[int]int{}, []byte{0xa0}, []byte{}}}), nil, "dataset[1].protected: missing header 1"},
+		{"signed payload", mustMarshal(t, cbor.Tag{Number: coseSign1Tag, Content: []any{[]byte{0xa0}, map[int]int{}, []byte{0xa0}, []byte{}}}), nil, `dataset[1].payload: missing required key "version"`},
+		{"wrong identity", encrypted, other, "dataset[1]: dataset is not encrypted to identity"},
+		{"signature size", mutateCOSE(t, signed.Bytes(), func(s *coseSign1) { s.Signature = s.Signature[:63] }), nil,
+			"dataset[1].signature: expected 64 bytes, got 63"},
+		{"signer kid size", mutateCOSE(t, signed.Bytes(), func(s *coseSign1) {
+			s.Protected = mustMarshal(t, map[int]any{coseHeaderAlg: coseAlgEdDSA, coseHeaderKid: []byte{1}})
+		}), nil, "dataset[1].protected[4]: expected 32 bytes, got 1"},
+		{"IV size", mutateCOSE(t, encrypted, func(e *coseEncrypt) { e.Unprotected[coseHeaderIV] = make([]byte, 8) }), nil,
+			"dataset[1].unprotected[5]: expected 12 bytes, got 8"},
+		{"recipient kid size", mutateCOSE(t, encrypted, func(e *coseEncrypt) { e.Recipients[0].Unprotected[coseHeaderKid] = []byte{1} }), nil,
+			"dataset[1].recipients[0].unprotected[4]: expected 32 bytes, got 1"},
+		{"ephemeral key size", mutateCOSE(t, encrypted, func(e *coseEncrypt) {
+			e.Recipients[0].Unprotected[coseHeaderEphemeral] = map[int]any{coseKeyKty: coseKtyOKP, coseKeyCrv: coseCrvX25519, coseKeyX: make([]byte, 31)}
+		}), nil, "dataset[1].recipients[0].unprotected[-1][-2]: expected 32 bytes, got 31"},
+		{"recipient ciphertext size", mutateCOSE(t, encrypted, func(e *coseEncrypt) { e.Recipients[0].Ciphertext = []byte{0} }), nil,
+			"dataset[1].recipients[0].ciphertext: expected 0 bytes, got 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, errs, err := ValidateDatasets(bytes.NewReader(tt.data), tt.identity)
+			if err != nil {
+				t.Fatalf("ValidateDatasets failed: %v", err)
+			}
+			found := false
+			for _, e := range errs {
+				found = found || strings.Contains(e.Error(), tt.errMsg)
+			}
+			if !found {
+				t.Errorf("Expected error containing %q, got: %v", tt.errMsg, errs)
+			}
+		})
+	}
+
+	// CBOR that is not well-formed can not be validated
+	if _, _, err := ValidateDatasets(bytes.NewReader([]byte{0xa1, 0x61}), nil); err == nil {
+		t.Error("Expected error for truncated CBOR")
+	}
+}
@@ -0,0 +1,380 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// What to do with input files after they have been processed in watch mode
+const (
+	ProcessedKeep   = "keep"
+	ProcessedDelete = "delete"
+	ProcessedMove   = "move"
+)
+
+// WatchOptions configures a Watcher
+type WatchOptions struct {
+	Dir          string        // Spool directory to watch for input files
+	Pattern      string        // Glob pattern input files must match (default "*")
+	Filetype     string        // Input file type: pcap, csv or tsv
+	TopCount     int           // Number of domains to keep in each day's dataset
+	ChunkSize    uint          // Number of queries to process in one go (0 = unlimited)
+	OutputDir    string        // Directory to write the day's datasets to
+	PollInterval time.Duration // Time between directory scans
+	Settle       time.Duration // Time a file must be unchanged before it is considered complete
+	DayGrace     time.Duration // Time to wait after the end of a UTC day for late files before writing the dataset
+	Processed    string        // What to do with processed files: keep, delete or move
+	MoveTo       string        // Directory to move processed files to
+	Metrics      *Metrics      // Metrics to update, if any
+	Source       string        // Source recorded in the dataset metadata
+	Sites        []string      // Sites recorded in the dataset metadata
+}
+
+// watchDay identifies the dataset of a day in Metrics
+type watchDay string
+
+// watchedFile tracks an input file until it is complete
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // When the file was first seen with this size and modification time
+}
+
+// Watcher continuously collects completed input files appearing in a spool directory into per-day datasets.
+// A day's dataset is written when the day has closed, i.e. DayGrace after the end of the UTC day.
+type Watcher struct {
+	opts     WatchOptions
+	verbose  bool
+	logger   io.Writer
+	now      func() time.Time
+	pending  map[string]watchedFile       // Input files not yet complete
+	done     map[string]struct{}          // Input files processed (or failed) while running, that are still present
+	awaiting map[string][]string          // Processed input files by date, to delete or move once the day is written
+	days     map[string]*MagnitudeDataset // Open datasets by date
+}
+
+func NewWatcher(opts WatchOptions, verbose bool, logger io.Writer) (*Watcher, error) {
+	if opts.Pattern == "" {
+		opts.Pattern = "*"
+	}
+	if _, err := filepath.Match(opts.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", opts.Pattern, err)
+	}
+	if opts.PollInterval <= 0 {
+		return nil, fmt.Errorf("poll interval must be positive")
+	}
+	switch opts.Processed {
+	case ProcessedKeep, ProcessedDelete:
+	case ProcessedMove:
+		if opts.MoveTo == "" {
+			return nil, fmt.Errorf("a directory to move processed files to is required")
+		}
+	default:
+		return nil, fmt.Errorf("invalid processed file action '%s', must be 'keep', 'delete' or 'move'", opts.Processed)
+	}
+
+	return &Watcher{
+		opts:     opts,
+		verbose:  verbose,
+		logger:   logger,
+		now:      time.Now,
+		pending:  make(map[string]watchedFile),
+		done:     make(map[string]struct{}),
+		awaiting: make(map[string][]string),
+		days:     make(map[string]*MagnitudeDataset),
+	}, nil
+}
+
+// Run scans the spool directory until the context is cancelled. On cancellation, the datasets of days
+// that are still open are written marked as partial, and picked up again when the watcher is restarted.
+func (w *Watcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Poll(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return w.Shutdown()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll scans the spool directory once, processes all completed input files and writes the datasets of
+// days that have closed.
+func (w *Watcher) Poll(ctx context.Context) error {
+	files, err := w.completedFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range files {
+		if err := w.processFile(ctx, filename); err != nil {
+			return err
+		}
+	}
+
+	return w.closeDays(false)
+}
+
+// Shutdown writes the datasets of all open days, marked as partial
+func (w *Watcher) Shutdown() error {
+	return w.closeDays(true)
+}
+
+// completedFiles returns the input files in the spool directory that have not changed for the settle time
+func (w *Watcher) completedFiles() ([]string, error) {
+	entries, err := os.ReadDir(w.opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", w.opts.Dir, err)
+	}
+
+	now := w.now()
+	present := make(map[string]struct{})
+	var completed []string
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if match, _ := filepath.Match(w.opts.Pattern, entry.Name()); !match {
+			continue
+		}
+
+		filename := filepath.Join(w.opts.Dir, entry.Name())
+		if _, found := w.done[filename]; found {
+			continue
+		}
+		present[filename] = struct{}{}
+
+		info, err := entry.Info()
+		if err != nil {
+			// File removed since the directory was read
+			continue
+		}
+
+		prev, found := w.pending[filename]
+		if !found || prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+			prev = watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+			w.pending[filename] = prev
+		}
+		if now.Sub(prev.since) >= w.opts.Settle {
+			completed = append(completed, filename)
+		}
+	}
+
+	// Forget about files that have disappeared
+	for filename := range w.pending {
+		if _, found := present[filename]; !found {
+			delete(w.pending, filename)
+		}
+	}
+
+	slices.Sort(completed)
+	return completed, nil
+}
+
+// processFile collects a single input file and adds the result to the dataset of its day
+func (w *Watcher) processFile(ctx context.Context, filename string) error {
+	if w.verbose {
+		fmt.Fprintf(w.logger, "Processing %s file: %s\n", w.opts.Filetype, filename)
+	}
+
+	// CSV files carry no timestamps, so they are attributed to the day they were last modified
+	var date *time.Time
+	if w.opts.Filetype != "pcap" {
+		modTime := w.pending[filename].modTime.UTC()
+		date = &modTime
+	}
+
+	collector := NewCollector(w.opts.TopCount, w.opts.ChunkSize, false, date, NewTimingStats())
+	collector.SetMetrics(w.opts.Metrics)
+	collector.SetProvenance(w.opts.Source, w.opts.Sites)
+	err := collector.ProcessFiles(ctx, []string{filename}, w.opts.Filetype, nil, w.logger)
+	w.opts.Metrics.removeDatasets(collector)
+	if err != nil {
+		if errors.Is(err, ctx.Err()) {
+			// Interrupted. Discard the partial result, the file will be processed again on restart.
+			return err
+		}
+		// A broken input file should not stop the watcher
+		fmt.Fprintf(w.logger, "Failed to process %s: %v\n", filename, err)
+		delete(w.pending, filename)
+		w.done[filename] = struct{}{}
+		return nil
+	}
+
+	added, err := w.addDataset(collector.Result)
+	if err != nil {
+		return err
+	}
+
+	delete(w.pending, filename)
+	w.done[filename] = struct{}{}
+	day := collector.Result.DateString()
+	if !added {
+		fmt.Fprintf(w.logger, "Skipping %s, already collected into the dataset for %s\n", filename, day)
+		if _, open := w.days[day]; !open {
+			return w.processed(filename)
+		}
+	}
+
+	// The file is deleted or moved once the dataset of its day has been written, so that its data is not
+	// lost if the watcher is killed before then
+	w.awaiting[day] = append(w.awaiting[day], filename)
+	return nil
+}
+
+// addDataset aggregates a dataset collected from an input file into the open dataset for its day. If the
+// day has already been written, the written dataset is reopened so that late files are not lost.
+// Returns false if the input file has already been collected into the dataset of the day, e.g. a kept
+// file seen again after a restart.
+func (w *Watcher) addDataset(dataset MagnitudeDataset) (bool, error) {
+	date := dataset.DateString()
+
+	day, found := w.days[date]
+	if !found {
+		reopened, err := loadDailyDataset(w.opts.OutputDir, date, w.opts.TopCount, w.logger)
+		if err != nil {
+			return false, err
+		}
+		if reopened != nil && w.verbose {
+			fmt.Fprintf(w.logger, "Reopened dataset for %s from %s\n", date, dailyDatasetFilename(w.opts.OutputDir, date))
+		}
+		day = reopened
+	}
+
+	if day != nil && collectedFrom(*day, dataset) {
+		return false, nil
+	}
+
+	if day == nil {
+		w.days[date] = &dataset
+	} else {
+		res, err := AggregateDatasets([]MagnitudeDataset{*day, dataset})
+		if err != nil {
+			return false, fmt.Errorf("failed to aggregate dataset for %s: %w", date, err)
+		}
+		res.Truncate(w.opts.TopCount)
+		w.days[date] = &res
+	}
+
+	w.opts.Metrics.setDatasets(watchDay(date), w.days[date])
+	return true, nil
+}
+
+// collectedFrom checks if the input files of a dataset, identified by name and digest, have already been
+// collected into the dataset of a day
+func collectedFrom(day, dataset MagnitudeDataset) bool {
+	if day.Metadata == nil || dataset.Metadata == nil || len(dataset.Metadata.InputFiles) == 0 {
+		return false
+	}
+	for _, input := range dataset.Metadata.InputFiles {
+		if !slices.ContainsFunc(day.Metadata.InputFiles, func(f InputFile) bool {
+			return f.Name == input.Name && bytes.Equal(f.SHA256, input.SHA256)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// processed keeps, deletes or moves an input file after the dataset of its day has been written
+func (w *Watcher) processed(filename string) error {
+	switch w.opts.Processed {
+	case ProcessedDelete:
+		if err := os.Remove(filename); err != nil {
+			return fmt.Errorf("failed to delete processed file %s: %w", filename, err)
+		}
+		delete(w.done, filename)
+	case ProcessedMove:
+		dest := filepath.Join(w.opts.MoveTo, filepath.Base(filename))
+		if err := os.Rename(filename, dest); err != nil {
+			return fmt.Errorf("failed to move processed file %s: %w", filename, err)
+		}
+		delete(w.done, filename)
+	}
+	return nil
+}
+
+// closeDays writes the datasets of days that have closed (or of all open days if all is set)
+func (w *Watcher) closeDays(all bool) error {
+	now := w.now()
+
+	var dates []string
+	for date := range w.days {
+		dates = append(dates, date)
+	}
+	slices.Sort(dates)
+
+	for _, date := range dates {
+		day := w.days[date]
+		closed := now.Sub(day.Date.AddDate(0, 0, 1)) >= w.opts.DayGrace
+		if !closed && !all {
+			continue
+		}
+
+		day.Partial = !closed
+		day.Truncate(w.opts.TopCount)
+		day.finaliseStats()
+
+		filename, err := WriteDNSMagFile(*day, dailyDatasetFilename(w.opts.OutputDir, date), nil)
+		if err != nil {
+			return fmt.Errorf("failed to write dataset for %s: %w", date, err)
+		}
+		if day.Partial {
+			fmt.Fprintf(w.logger, "Saved partial dataset for %s to %s\n", date, filename)
+		} else {
+			fmt.Fprintf(w.logger, "Saved dataset for %s to %s\n", date, filename)
+		}
+
+		w.opts.Metrics.datasetWritten()
+		w.opts.Metrics.removeDatasets(watchDay(date))
+		delete(w.days, date)
+
+		for _, processed := range w.awaiting[date] {
+			if err := w.processed(processed); err != nil {
+				return err
+			}
+		}
+		delete(w.awaiting, date)
+	}
+	return nil
+}
+
+// dailyDatasetFilename returns the filename of the dataset for a date in an output directory
+func dailyDatasetFilename(dir, date string) string {
+	return filepath.Join(dir, fmt.Sprintf("dnsmag-%s.cbor", date))
+}
+
+// loadDailyDataset loads a previously written dataset for a date, so that more data can be added to it.
+// Returns nil if no dataset has been written for the date.
+func loadDailyDataset(dir, date string, topCount int, logger io.Writer) (*MagnitudeDataset, error) {
+	filename := dailyDatasetFilename(dir, date)
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to reopen dataset %s: %w", filename, err)
+	}
+
+	seq := NewDatasetSequence(topCount, nil, false, logger)
+	if err := seq.LoadDNSMagFile(filename); err != nil {
+		return nil, fmt.Errorf("failed to reopen dataset %s: %w", filename, err)
+	}
+	// The dataset is no longer partial, as more data is being added to it
+	seq.Result.Partial = false
+	return &seq.Result, nil
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	InitStats()
+}
+
+// writeSpoolFile writes a CSV file to the spool directory with its modification time set to mtime
+func writeSpoolFile(t *testing.T, dir, name, data string, mtime time.Time) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", filename, err)
+	}
+	if err := os.Chtimes(filename, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set times on %s: %v", filename, err)
+	}
+	return filename
+}
+
+// newTestWatcher creates a watcher for CSV files with a controllable clock
+func newTestWatcher(t *testing.T, spool, outputDir string, processed string, now *time.Time) (*Watcher, *bytes.Buffer) {
+	t.Helper()
+
+	var logger bytes.Buffer
+	w, err := NewWatcher(WatchOptions{
+		Dir:          spool,
+		Pattern:      "*.csv",
+		Filetype:     "csv",
+		TopCount:     DefaultDomainCount,
+		OutputDir:    outputDir,
+		PollInterval: time.Second,
+		Settle:       time.Minute,
+		DayGrace:     time.Hour,
+		Processed:    processed,
+		MoveTo:       filepath.Join(spool, "done"),
+	}, true, &logger)
+	if err != nil {
+		t.Fatalf("NewWatcher failed: %v", err)
+	}
+	w.now = func() time.Time { return *now }
+	return w, &logger
+}
+
+// loadWatchOutput loads the dataset written for a date
+func loadWatchOutput(t *testing.T, outputDir, date string) MagnitudeDataset {
+	t.Helper()
+
+	seq := NewDatasetSequence(0, nil, false, nil)
+	if err := seq.LoadDNSMagFile(filepath.Join(outputDir, "dnsmag-"+date+".cbor")); err != nil {
+		t.Fatalf("Failed to load dataset for %s: %v", date, err)
+	}
+	return seq.Result
+}
+
+func TestWatcher_DaysAndSettle(t *testing.T) {
+	spool := t.TempDir()
+	outputDir := t.TempDir()
+	day1 := time.Date(2026, 9, 1, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2026, 9, 2, 10, 0, 0, 0, time.UTC)
+
+	writeSpoolFile(t, spool, "a.csv", "192.168.1.1,example.com,5\n", day1)
+	writeSpoolFile(t, spool, "b.csv", "10.0.0.1,example.org,3\n", day1)
+	writeSpoolFile(t, spool, "c.csv", "10.0.0.1,example.net,7\n", day2)
+	writeSpoolFile(t, spool, "ignored.txt", "10.0.0.1,example.se,1\n", day2)
+
+	now := day2.Add(time.Hour)
+	w, logger := newTestWatcher(t, spool, outputDir, ProcessedDelete, &now)
+
+	// Files are seen for the first time, and not yet considered complete
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if len(w.days) != 0 {
+		t.Fatalf("Expected no files to be processed before settle time, got %d days", len(w.days))
+	}
+
+	// After the settle time, the files are processed. Day 1 has closed, so its dataset is written and its
+	// files are deleted. The file of day 2 is kept until the dataset of day 2 is written.
+	now = now.Add(time.Minute)
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	for _, name := range []string{"a.csv", "b.csv"} {
+		if _, err := os.Stat(filepath.Join(spool, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted after processing", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(spool, "c.csv")); err != nil {
+		t.Errorf("Expected c.csv to be kept until its day is written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(spool, "ignored.txt")); err != nil {
+		t.Errorf("Expected file not matching pattern to be left alone: %v", err)
+	}
+
+	dataset := loadWatchOutput(t, outputDir, "2026-09-01")
+	validateDatasetDomains(t, dataset, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{"com": 5, "org": 3},
+	})
+	if dataset.Partial {
+		t.Error("Expected dataset of closed day not to be partial")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "dnsmag-2026-09-02.cbor")); !os.IsNotExist(err) {
+		t.Error("Expected no dataset to be written for open day")
+	}
+
+	// Day 2 closes after the grace period
+	now = time.Date(2026, 9, 3, 1, 0, 0, 0, time.UTC)
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	dataset = loadWatchOutput(t, outputDir, "2026-09-02")
+	validateDatasetDomains(t, dataset, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{"net": 7},
+	})
+	if _, err := os.Stat(filepath.Join(spool, "c.csv")); !os.IsNotExist(err) {
+		t.Errorf("Expected c.csv to be deleted once its day was written")
+	}
+
+	if !strings.Contains(logger.String(), "Saved dataset for 2026-09-02") {
+		t.Errorf("Expected saved dataset message in output:\n%s", logger.String())
+	}
+}
+
+func TestWatcher_ShutdownAndReopen(t *testing.T) {
+	spool := t.TempDir()
+	outputDir := t.TempDir()
+	day := time.Date(2026, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	writeSpoolFile(t, spool, "a.csv", "192.168.1.1,example.com,5\n", day)
+
+	now := day.Add(time.Hour)
+	w, _ := newTestWatcher(t, spool, outputDir, ProcessedMove, &now)
+	if err := os.Mkdir(filepath.Join(spool, "done"), 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	w.opts.Settle = 0
+
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(spool, "a.csv")); err != nil {
+		t.Errorf("Expected processed file to stay until its day is written: %v", err)
+	}
+
+	// Stopping the watcher writes the open day as a partial dataset, after which the file is moved
+	if err := w.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if dataset := loadWatchOutput(t, outputDir, "2026-09-01"); !dataset.Partial {
+		t.Error("Expected dataset of open day to be partial after shutdown")
+	}
+	if _, err := os.Stat(filepath.Join(spool, "done", "a.csv")); err != nil {
+		t.Errorf("Expected processed file to be moved: %v", err)
+	}
+
+	// A restarted watcher continues from the partial dataset
+	writeSpoolFile(t, spool, "b.csv", "10.0.0.1,example.com,2\n", day)
+	w, _ = newTestWatcher(t, spool, outputDir, ProcessedMove, &now)
+	w.opts.Settle = 0
+	now = time.Date(2026, 9, 2, 2, 0, 0, 0, time.UTC)
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	dataset := loadWatchOutput(t, outputDir, "2026-09-01")
+	if dataset.Partial {
+		t.Error("Expected dataset of closed day not to be partial")
+	}
+	validateDatasetDomains(t, dataset, DatasetDomainsExpected{
+		expectedDomains: map[DomainName]uint64{"com": 7},
+	})
+}
+
+func TestWatcher_KeepAndBrokenFiles(t *testing.T) {
+	spool := t.TempDir()
+	outputDir := t.TempDir()
+	day := time.Date(2026, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	writeSpoolFile(t, spool, "a.csv", "192.168.1.1,example.com,5\n", day)
+	writeSpoolFile(t, spool, "b.csv", "192.168.1.1,example.com,-5\n", day)
+
+	now := day.Add(time.Hour)
+	w, logger := newTestWatcher(t, spool, outputDir, ProcessedKeep, &now)
+	w.opts.Settle = 0
+
+	// Kept files are only processed once, and a broken file does not stop the watcher
+	for range 2 {
+		if err := w.Poll(context.Background()); err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+	}
+	if !strings.Contains(logger.String(), "Failed to process "+filepath.Join(spool, "b.csv")) {
+		t.Errorf("Expected failure message for broken file in output:\n%s", logger.String())
+	}
+
+	if got := w.days["2026-09-01"].AllQueriesCount; got != 5 {
+		t.Errorf("Expected 5 queries, got %d", got)
+	}
+}
+
+func TestWatcher_RestartWithKeptFiles(t *testing.T) {
+	spool := t.TempDir()
+	outputDir := t.TempDir()
+	day := time.Date(2026, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	writeSpoolFile(t, spool, "a.csv", "192.168.1.1,example.com,5\n", day)
+
+	now := day.Add(time.Hour)
+	w, _ := newTestWatcher(t, spool, outputDir, ProcessedKeep, &now)
+	w.opts.Settle = 0
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if err := w.Shutdown(); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	// After a restart, the kept file is recognised in the reopened dataset and not counted again. A file
+	// with the same name but different contents is collected.
+	for i, restart := range []struct {
+		data    string
+		skipped bool
+		queries uint64
+	}{
+		{"192.168.1.1,example.com,5\n", true, 5},
+		{"192.168.1.1,example.com,6\n", false, 11},
+	} {
+		writeSpoolFile(t, spool, "a.csv", restart.data, day)
+		w, logger := newTestWatcher(t, spool, outputDir, ProcessedKeep, &now)
+		w.opts.Settle = 0
+		if err := w.Poll(context.Background()); err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+		if skipped := strings.Contains(logger.String(), "already collected into the dataset for 2026-09-01"); skipped != restart.skipped {
+			t.Errorf("Restart %d: expected skipped %v, output:\n%s", i, restart.skipped, logger.String())
+		}
+		if err := w.Shutdown(); err != nil {
+			t.Fatalf("Shutdown failed: %v", err)
+		}
+		if dataset := loadWatchOutput(t, outputDir, "2026-09-01"); dataset.AllQueriesCount != restart.queries {
+			t.Errorf("Restart %d: expected %d queries, got %d", i, restart.queries, dataset.AllQueriesCount)
+		}
+	}
+}
+
+func TestWatcher_InvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts WatchOptions
+	}{
+		{"invalid pattern", WatchOptions{Pattern: "[", PollInterval: time.Second, Processed: ProcessedKeep}},
+		{"no poll interval", WatchOptions{Processed: ProcessedKeep}},
+		{"invalid processed action", WatchOptions{PollInterval: time.Second, Processed: "archive"}},
+		{"move without directory", WatchOptions{PollInterval: time.Second, Processed: ProcessedMove}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewWatcher(tt.opts, false, nil); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestLoadDailyDataset_StatError(t *testing.T) {
+	// A file instead of an output directory is an error, not a missing dataset
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", notDir, err)
+	}
+	if dataset, err := loadDailyDataset(notDir, "2026-09-01", DefaultDomainCount, nil); err == nil {
+		t.Errorf("Expected an error, got dataset %v", dataset)
+	}
+	if dataset, err := loadDailyDataset(t.TempDir(), "2026-09-01", DefaultDomainCount, nil); dataset != nil || err != nil {
+		t.Errorf("Expected no dataset and no error for a missing dataset, got %v (%v)", dataset, err)
+	}
+}
@@ -0,0 +1,485 @@
+// Author: Fredrik Thulin <fredrik@ispik.se>
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed webui
+var webUI embed.FS
+
+// webDatasetSuffixes are the file name suffixes of the DNSMAG files the web UI loads
+var webDatasetSuffixes = []string{".cbor", ".cbor.gz", ".cbor.zst"}
+
+// WebOptions configures a WebServer
+type WebOptions struct {
+	TLDs           map[string]bool // Delegated top-level domains, or nil if unknown
+	RescanInterval time.Duration   // Time between scans of the directory for changed files while serving, 0 for none
+	ReportSource   string          // Source of the reports, or empty for the sources of the datasets
+	SourceType     string          // Source type of the reports
+	Logger         io.Writer       // Where to log files that can not be loaded, if anywhere
+}
+
+// WebServer serves a read-only web UI with the magnitudes of the domains in a directory of DNSMAG files.
+// The datasets of each day are aggregated, and reloaded in the background when files are added, changed
+// or removed. Requests are served from the previous datasets until they have been reloaded.
+type WebServer struct {
+	dir         string
+	opts        WebOptions
+	identity    *ecdh.PrivateKey    // Key to decrypt encrypted datasets with, if any
+	trustedKeys []ed25519.PublicKey // Keys datasets must be signed by, if any
+	mux         *http.ServeMux
+
+	refreshMu sync.Mutex   // Serialises scans of the directory
+	mu        sync.RWMutex // Protects index
+	index     *webIndex
+}
+
+// webIndex is the aggregated datasets of each day in the directory
+type webIndex struct {
+	signature string             // Digest of the names, sizes and modification times of the files
+	dates     []string           // In ascending order
+	days      map[string]*webDay // By date
+}
+
+// webDay is the aggregated dataset of a day, with its domains ranked by magnitude
+type webDay struct {
+	dataset MagnitudeDataset
+	sorted  []DomainMagnitude  // In order of rank, by descending magnitude and then by name
+	rank    map[DomainName]int // 1 for the domain with the highest magnitude
+}
+
+// webDomain is a domain on a day
+type webDomain struct {
+	Rank          int     `json:"rank"`
+	Domain        string  `json:"domain"`
+	Magnitude     float64 `json:"magnitude"`
+	UniqueClients uint64  `json:"uniqueClients"`
+	QueryVolume   uint64  `json:"queryVolume"`
+	Delegated     *bool   `json:"delegated"` // Whether the TLD of the domain is delegated, null if unknown
+}
+
+// webTop is the top domains of a day
+type webTop struct {
+	Date               string      `json:"date"`
+	Source             string      `json:"source"`
+	TotalUniqueClients uint64      `json:"totalUniqueClients"`
+	TotalQueryVolume   uint64      `json:"totalQueryVolume"`
+	TotalDomains       int         `json:"totalDomains"`
+	Domains            []webDomain `json:"domains"`
+}
+
+// webHistoryPoint is a domain on a day of its history, with null values on days without the domain
+type webHistoryPoint struct {
+	Date          string   `json:"date"`
+	Rank          *int     `json:"rank"`
+	Magnitude     *float64 `json:"magnitude"`
+	UniqueClients *uint64  `json:"uniqueClients"`
+	QueryVolume   *uint64  `json:"queryVolume"`
+}
+
+// webHistory is a domain on every day
+type webHistory struct {
+	Domain    string            `json:"domain"`
+	Delegated *bool             `json:"delegated"`
+	Points    []webHistoryPoint `json:"points"`
+}
+
+// LoadTLDs loads the delegated top-level domains from a file in the format of the list IANA publishes at
+// https://data.iana.org/TLD/tlds-alpha-by-domain.txt, one TLD per line, with comments starting with #
+func LoadTLDs(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	tlds := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tlds[strings.TrimSuffix(strings.ToLower(line), ".")] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tlds) == 0 {
+		return nil, fmt.Errorf("no TLDs found in %s", filename)
+	}
+	return tlds, nil
+}
+
+// NewWebServer returns a web UI for the DNSMAG files in dir
+func NewWebServer(dir string, opts WebOptions) (*WebServer, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if opts.Logger == nil {
+		opts.Logger = io.Discard
+	}
+	ui, err := fs.Sub(webUI, "webui")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &WebServer{dir: dir, opts: opts, mux: http.NewServeMux()}
+	s.mux.Handle("GET /", http.FileServerFS(ui))
+	s.mux.HandleFunc("GET /api/dates", s.handleDates)
+	s.mux.HandleFunc("GET /api/top/{date}", s.handleTop)
+	s.mux.HandleFunc("GET /api/history/{domain}", s.handleHistory)
+	s.mux.HandleFunc("GET /reports/{date}", s.handleReport)
+	return s, nil
+}
+
+// SetIdentity sets the key to decrypt encrypted datasets with
+func (s *WebServer) SetIdentity(identity *ecdh.PrivateKey) {
+	s.identity = identity
+}
+
+// RequireSignatures makes the web UI only show datasets signed by one of the trusted keys
+func (s *WebServer) RequireSignatures(trusted []ed25519.PublicKey) {
+	s.trustedKeys = trusted
+}
+
+func (s *WebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	s.mux.ServeHTTP(w, r)
+}
+
+// Serve serves the web UI on listener until the context is cancelled, rescanning the directory every
+// rescan interval
+func (s *WebServer) Serve(ctx context.Context, listener net.Listener) error {
+	if s.opts.RescanInterval > 0 {
+		refreshCtx, stop := context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.refreshPeriodically(refreshCtx)
+		}()
+		defer func() {
+			stop()
+			wg.Wait()
+		}()
+	}
+
+	server := &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(listener) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// refreshPeriodically refreshes the datasets every rescan interval until the context is cancelled
+func (s *WebServer) refreshPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.RescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(); err != nil {
+				fmt.Fprintf(s.opts.Logger, "Warning: %v\n", err)
+			}
+		}
+	}
+}
+
+// Refresh scans the directory, and reloads the datasets if any files have changed since the last scan.
+// The previous datasets are served until the new ones have been loaded.
+func (s *WebServer) Refresh() error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	var files []string
+	signature := sha256.New()
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !slices.ContainsFunc(webDatasetSuffixes, func(suffix string) bool {
+			return strings.HasSuffix(path, suffix)
+		}) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, path)
+		fmt.Fprintf(signature, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", s.dir, err)
+	}
+
+	sum := hex.EncodeToString(signature.Sum(nil))
+	s.mu.RLock()
+	unchanged := s.index != nil && s.index.signature == sum
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	index := s.load(files)
+	index.signature = sum
+	s.mu.Lock()
+	s.index = index
+	s.mu.Unlock()
+	return nil
+}
+
+// load loads the datasets in files, and aggregates the datasets of each day. Files and datasets that can
+// not be loaded are skipped with a warning, as are rollups.
+func (s *WebServer) load(files []string) *webIndex {
+	sequences := make(map[string]*DatasetSequence)
+	for _, filename := range files {
+		// Aggregate the datasets of each file first, so that a broken file is skipped as a whole
+		fileSequences := make(map[string]*DatasetSequence)
+		err := s.loadFile(filename, func(dataset MagnitudeDataset) error {
+			if period := dataset.period(); period != nil {
+				fmt.Fprintf(s.opts.Logger, "Warning: Skipping dataset %s, a rollup of the period %s\n",
+					dataset.extraSourceFilename, period)
+				return nil
+			}
+			seq := fileSequences[dataset.DateString()]
+			if seq == nil {
+				seq = NewDatasetSequence(0, nil, false, s.opts.Logger)
+				fileSequences[dataset.DateString()] = seq
+			}
+			return seq.addDataset(dataset)
+		})
+		if err != nil {
+			fmt.Fprintf(s.opts.Logger, "Warning: Skipping %s: %v\n", filename, err)
+			continue
+		}
+		for date, fileSeq := range fileSequences {
+			daySeq := sequences[date]
+			if daySeq == nil {
+				sequences[date] = fileSeq
+				continue
+			}
+			if err := daySeq.addDataset(fileSeq.Result); err != nil {
+				fmt.Fprintf(s.opts.Logger, "Warning: Skipping the datasets of %s in %s: %v\n", date, filename, err)
+			}
+		}
+	}
+
+	index := &webIndex{days: make(map[string]*webDay)}
+	for date, seq := range sequences {
+		day := &webDay{dataset: seq.Result, rank: make(map[DomainName]int)}
+		day.sorted = seq.Result.rankedByMagnitude()
+		for i, dm := range day.sorted {
+			day.rank[dm.Domain] = i + 1
+		}
+		index.days[date] = day
+		index.dates = append(index.dates, date)
+	}
+	slices.Sort(index.dates)
+	return index
+}
+
+// loadFile calls fn with each dataset in a DNSMAG file, of any date
+func (s *WebServer) loadFile(filename string, fn func(MagnitudeDataset) error) error {
+	file, err := os.Open(filename) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+
+	seqNum := 1
+	return forEachCBORItem(file, func(item []byte) error {
+		sourceFilename := fmt.Sprintf("%s#%d", filename, seqNum)
+		seqNum++
+
+		dataset, err := decodeDatasetItem(item, sourceFilename, s.identity, s.trustedKeys)
+		if err != nil {
+			return err
+		}
+		dataset.finaliseStats()
+		if err := upgradeDataset(&dataset); err != nil {
+			return fmt.Errorf("failed to load dataset %s: %w", sourceFilename, err)
+		}
+		return fn(dataset)
+	})
+}
+
+// currentIndex returns the current index, or responds with an error if the datasets are not loaded yet
+func (s *WebServer) currentIndex(w http.ResponseWriter) (*webIndex, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.index == nil {
+		http.Error(w, "datasets not loaded", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return s.index, true
+}
+
+// currentDay returns the dataset of the date in the path of a request, or responds with an error
+func (s *WebServer) currentDay(w http.ResponseWriter, r *http.Request) (string, *webDay, bool) {
+	index, ok := s.currentIndex(w)
+	if !ok {
+		return "", nil, false
+	}
+	date := r.PathValue("date")
+	day := index.days[date]
+	if day == nil {
+		http.Error(w, fmt.Sprintf("no datasets for %q", date), http.StatusNotFound)
+		return "", nil, false
+	}
+	return date, day, true
+}
+
+// delegated returns whether the TLD of a domain is delegated, or nil if that is unknown
+func (s *WebServer) delegated(domain DomainName) *bool {
+	if s.opts.TLDs == nil {
+		return nil
+	}
+	tld := string(domain)
+	if i := strings.LastIndexByte(tld, '.'); i >= 0 {
+		tld = tld[i+1:]
+	}
+	delegated := domain == "." || s.opts.TLDs[tld]
+	return &delegated
+}
+
+// reportSource returns the source of the reports of a dataset
+func (s *WebServer) reportSource(dataset MagnitudeDataset) string {
+	if s.opts.ReportSource == "" {
+		return dataset.Metadata.sourceString()
+	}
+	return s.opts.ReportSource
+}
+
+// handleDates responds with the dates with datasets, in ascending order
+func (s *WebServer) handleDates(w http.ResponseWriter, _ *http.Request) {
+	index, ok := s.currentIndex(w)
+	if !ok {
+		return
+	}
+	dates := index.dates
+	if dates == nil {
+		dates = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"dates": dates, "delegation": s.opts.TLDs != nil})
+}
+
+// handleTop responds with the top n domains by magnitude on a day, or all domains if n is 0
+func (s *WebServer) handleTop(w http.ResponseWriter, r *http.Request) {
+	date, day, ok := s.currentDay(w, r)
+	if !ok {
+		return
+	}
+	n := len(day.sorted)
+	if value := r.URL.Query().Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid n %q", value), http.StatusBadRequest)
+			return
+		}
+		if n == 0 || n > len(day.sorted) {
+			n = len(day.sorted)
+		}
+	}
+
+	top := webTop{
+		Date:               date,
+		Source:             s.reportSource(day.dataset),
+		TotalUniqueClients: day.dataset.AllClientsCount,
+		TotalQueryVolume:   day.dataset.AllQueriesCount,
+		TotalDomains:       len(day.sorted),
+		Domains:            make([]webDomain, 0, n),
+	}
+	for i, dm := range day.sorted[:n] {
+		top.Domains = append(top.Domains, webDomain{
+			Rank:          i + 1,
+			Domain:        string(dm.Domain),
+			Magnitude:     dm.Magnitude,
+			UniqueClients: dm.DomainHll.ClientsCount,
+			QueryVolume:   dm.DomainHll.QueriesCount,
+			Delegated:     s.delegated(dm.Domain),
+		})
+	}
+	writeJSON(w, http.StatusOK, top)
+}
+
+// handleHistory responds with a domain on every day
+func (s *WebServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	index, ok := s.currentIndex(w)
+	if !ok {
+		return
+	}
+	domain := DomainName(strings.ToLower(r.PathValue("domain")))
+	if domain != "." {
+		domain = DomainName(strings.TrimSuffix(string(domain), "."))
+	}
+
+	history := webHistory{Domain: string(domain), Delegated: s.delegated(domain), Points: []webHistoryPoint{}}
+	for _, date := range index.dates {
+		day := index.days[date]
+		point := webHistoryPoint{Date: date}
+		if data, found := day.dataset.Domains[domain]; found {
+			rank := day.rank[domain]
+			magnitude := day.dataset.magnitude(data.ClientsCount)
+			clients, queries := data.ClientsCount, data.QueriesCount
+			point.Rank, point.Magnitude, point.UniqueClients, point.QueryVolume = &rank, &magnitude, &clients, &queries
+		}
+		history.Points = append(history.Points, point)
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+// handleReport responds with the JSON report of a day, as a download
+func (s *WebServer) handleReport(w http.ResponseWriter, r *http.Request) {
+	date, day, ok := s.currentDay(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dnsmag-report-%s.json"`, date))
+	writeJSON(w, http.StatusOK, GenerateReport(day.dataset, s.reportSource(day.dataset), s.opts.SourceType))
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTLDs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tlds-alpha-by-domain.txt")
+	content := "# Version 2026101800, Last Updated Sun Oct 18 07:07:01 2026 UTC\nCOM\nNET\n\nXN--P1AI\n"
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write TLDs: %v", err)
+	}
+	tlds, err := LoadTLDs(filename)
+	if err != nil {
+		t.Fatalf("LoadTLDs failed: %v", err)
+	}
+	if len(tlds) != 3 || !tlds["com"] || !tlds["net"] || !tlds["xn--p1ai"] {
+		t.Errorf("Unexpected TLDs %v", tlds)
+	}
+
+	if err := os.WriteFile(filename, []byte("# nothing\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write TLDs: %v", err)
+	}
+	if _, err := LoadTLDs(filename); err == nil {
+		t.Errorf("Expected an error for a file without TLDs")
+	}
+}
+
+// getFromWebServer sends a GET request to a web server, returning the response and body
+func getFromWebServer(t *testing.T, url string) (*http.Response, []byte) {
+	t.Helper()
+
+	resp, err := http.Get(url) // #nosec G107
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp, body
+}
+
+func TestWebServer(t *testing.T) {
+	dir := t.TempDir()
+
+	// Two files for the first day, one in a subdirectory, and a rollup that is skipped
+	day1 := newDiffDataset(t, 1, map[string]clientRange{"com": {0, 99}, "corp": {0, 49}})
+	day1.Metadata = &DatasetMetadata{Sources: []string{"example"}}
+	day1Other := newDiffDataset(t, 1, map[string]clientRange{"com": {100, 199}, "net": {0, 9}})
+	day1Other.Metadata = &DatasetMetadata{Sources: []string{"other"}}
+	day2 := newDiffDataset(t, 2, map[string]clientRange{"net": {0, 99}, "com": {0, 9}})
+	period, err := ParsePeriod("2026-09")
+	if err != nil {
+		t.Fatalf("ParsePeriod failed: %v", err)
+	}
+	rollup, err := RollupDatasets([]MagnitudeDataset{day1, day2}, period)
+	if err != nil {
+		t.Fatalf("RollupDatasets failed: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "other"), 0o755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	writeArchiveTestFile(t, filepath.Join(dir, "dnsmag-2026-09-01.cbor"), nil, day1)
+	writeArchiveTestFile(t, filepath.Join(dir, "other", "2026-09-01.cbor"), nil, day1Other)
+	writeArchiveTestFile(t, filepath.Join(dir, "2026-09.cbor"), nil, rollup)
+	if err := os.WriteFile(filepath.Join(dir, "broken.cbor"), []byte("not a dataset"), 0o600); err != nil {
+		t.Fatalf("Failed to write broken file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o600); err != nil {
+		t.Fatalf("Failed to write notes: %v", err)
+	}
+
+	logs := &syncBuffer{}
+	web, err := NewWebServer(dir, WebOptions{
+		TLDs:       map[string]bool{"com": true, "net": true},
+		SourceType: "recursive",
+		Logger:     logs,
+	})
+	if err != nil {
+		t.Fatalf("NewWebServer failed: %v", err)
+	}
+	if err := web.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	server := httptest.NewServer(web)
+	defer server.Close()
+
+	// The embedded UI
+	resp, body := getFromWebServer(t, server.URL+"/")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "<title>DNS Magnitude</title>") ||
+		resp.Header.Get("Content-Security-Policy") == "" {
+		t.Errorf("Expected the UI, got %d %v %s", resp.StatusCode, resp.Header, body)
+	}
+	for _, asset := range []string{"app.js", "style.css"} {
+		if resp, _ := getFromWebServer(t, server.URL+"/"+asset); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected %s, got %d", asset, resp.StatusCode)
+		}
+	}
+
+	var dates struct {
+		Dates      []string `json:"dates"`
+		Delegation bool     `json:"delegation"`
+	}
+	_, body = getFromWebServer(t, server.URL+"/api/dates")
+	if err := json.Unmarshal(body, &dates); err != nil || len(dates.Dates) != 1 || dates.Dates[0] != "2026-09-01" || !dates.Delegation {
+		t.Errorf("Unexpected dates %s (%v)", body, err)
+	}
+	for _, warning := range []string{"Skipping " + filepath.Join(dir, "broken.cbor"), "a rollup of the period 2026-09-01/2026-09-30"} {
+		if !strings.Contains(logs.String(), warning) {
+			t.Errorf("Expected a warning containing %q, got %s", warning, logs.String())
+		}
+	}
+
+	// The datasets of a day are aggregated
+	var top webTop
+	_, body = getFromWebServer(t, server.URL+"/api/top/2026-09-01?n=2")
+	if err := json.Unmarshal(body, &top); err != nil {
+		t.Fatalf("Invalid top %s: %v", body, err)
+	}
+	if top.Source != "example, other" || top.TotalDomains != 3 || len(top.Domains) != 2 || top.TotalQueryVolume != 260 {
+		t.Errorf("Unexpected top %+v", top)
+	}
+	if top.Domains[0].Domain != "com" || top.Domains[0].Rank != 1 || !withinPercent(top.Domains[0].UniqueClients, 200, 5) ||
+		top.Domains[0].Delegated == nil || !*top.Domains[0].Delegated {
+		t.Errorf("Unexpected first domain %+v", top.Domains[0])
+	}
+	if top.Domains[1].Domain != "corp" || top.Domains[1].Delegated == nil || *top.Domains[1].Delegated {
+		t.Errorf("Expected the undelegated corp second, got %+v", top.Domains[1])
+	}
+
+	// New files are picked up
+	if _, err := WriteDNSMagFileWithOptions(day2, filepath.Join(dir, "dnsmag-2026-09-02.cbor.gz"), nil, WriteOptions{Compression: "gzip"}); err != nil {
+		t.Fatalf("Failed to write compressed file: %v", err)
+	}
+	if err := web.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	var history webHistory
+	_, body = getFromWebServer(t, server.URL+"/api/history/NET.")
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatalf("Invalid history %s: %v", body, err)
+	}
+	if history.Domain != "net" || len(history.Points) != 2 || history.Points[0].Date != "2026-09-01" ||
+		*history.Points[0].Rank != 3 || *history.Points[1].Rank != 1 || !withinPercent(*history.Points[1].UniqueClients, 100, 5) {
+		t.Errorf("Unexpected history %s", body)
+	}
+	_, body = getFromWebServer(t, server.URL+"/api/history/corp")
+	if err := json.Unmarshal(body, &history); err != nil || history.Points[1].Magnitude != nil || history.Points[0].Magnitude == nil {
+		t.Errorf("Expected corp only on the first day, got %s (%v)", body, err)
+	}
+
+	// Reports are downloads
+	resp, body = getFromWebServer(t, server.URL+"/reports/2026-09-02")
+	var report Report
+	if err := json.Unmarshal(body, &report); err != nil || report.Date != "2026-09-02" || report.SourceType != "recursive" ||
+		resp.Header.Get("Content-Disposition") != `attachment; filename="dnsmag-report-2026-09-02.json"` {
+		t.Errorf("Unexpected report %v %s (%v)", resp.Header, body, err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/api/top/2026-09-03", http.StatusNotFound},
+		{"/api/top/2026-09-01?n=-1", http.StatusBadRequest},
+		{"/reports/2026-09-03", http.StatusNotFound},
+		{"/missing.html", http.StatusNotFound},
+	} {
+		if resp, body := getFromWebServer(t, server.URL+tt.path); resp.StatusCode != tt.status {
+			t.Errorf("GET %s: expected status %d, got %d %s", tt.path, tt.status, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestWebServer_UnknownDelegation(t *testing.T) {
+	dir := t.TempDir()
+	writeArchiveTestFile(t, filepath.Join(dir, "day.cbor"), nil, newDiffDataset(t, 1, map[string]clientRange{"lan": {0, 9}, "corp": {0, 9}}))
+
+	web, err := NewWebServer(dir, WebOptions{})
+	if err != nil {
+		t.Fatalf("NewWebServer failed: %v", err)
+	}
+	if err := web.Refresh(); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	server := httptest.NewServer(web)
+	defer server.Close()
+
+	_, body := getFromWebServer(t, server.URL+"/api/top/2026-09-01")
+	if !strings.Contains(string(body), `"delegated": null`) {
+		t.Errorf("Expected unknown delegation without TLDs, got %s", body)
+	}
+
+	// Domains with equal magnitudes are ranked by name
+	var top webTop
+	if err := json.Unmarshal(body, &top); err != nil || len(top.Domains) != 2 || top.Domains[0].Domain != "corp" ||
+		top.Domains[0].Rank != 1 || top.Domains[1].Domain != "lan" || top.Domains[1].Rank != 2 {
+		t.Errorf("Expected corp ranked before lan, got %s (%v)", body, err)
+	}
+
+	if _, err := NewWebServer(filepath.Join(dir, "day.cbor"), WebOptions{}); err == nil {
+		t.Errorf("Expected an error for a file instead of a directory")
+	}
+}
+
+func TestWebServer_BackgroundRefresh(t *testing.T) {
+	dir := t.TempDir()
+	writeArchiveTestFile(t, filepath.Join(dir, "day1.cbor"), nil, newDiffDataset(t, 1, map[string]clientRange{"com": {0, 9}}))
+
+	web, err := NewWebServer(dir, WebOptions{RescanInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewWebServer failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Requests do not load the datasets, that is done in the background
+	server := httptest.NewServer(web)
+	resp, _ := getFromWebServer(t, server.URL+"/api/dates")
+	server.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the datasets not to be loaded by a request, got %d", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- web.Serve(ctx, listener) }()
+	url := "http://" + listener.Addr().String()
+
+	writeArchiveTestFile(t, filepath.Join(dir, "day2.cbor"), nil, newDiffDataset(t, 2, map[string]clientRange{"com": {0, 9}}))
+	var body []byte
+	for range 200 {
+		if _, body = getFromWebServer(t, url+"/api/dates"); strings.Contains(string(body), "2026-09-02") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(string(body), `"2026-09-01"`) || !strings.Contains(string(body), `"2026-09-02"`) {
+		t.Errorf("Expected both days to be loaded in the background, got %s", body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+}
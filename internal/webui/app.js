@@ -0,0 +1,277 @@
+"use strict";
+
+// State of the page, kept in the URL fragment so that views can be bookmarked and shared
+const state = { date: "", count: "100", domain: "", metric: "magnitude", undelegatedOnly: false };
+
+const $ = (id) => document.getElementById(id);
+const numberFormat = new Intl.NumberFormat();
+
+function readFragment() {
+  const params = new URLSearchParams(location.hash.slice(1));
+  for (const key of Object.keys(state)) {
+    if (params.has(key)) {
+      state[key] = key === "undelegatedOnly" ? params.get(key) === "1" : params.get(key);
+    }
+  }
+}
+
+function writeFragment() {
+  const params = new URLSearchParams();
+  for (const [key, value] of Object.entries(state)) {
+    if (value !== "" && value !== false) {
+      params.set(key, value === true ? "1" : value);
+    }
+  }
+  history.replaceState(null, "", "#" + params.toString());
+}
+
+async function fetchJSON(path) {
+  const resp = await fetch(path);
+  if (!resp.ok) {
+    throw new Error(`${path}: ${resp.status} ${(await resp.text()).trim()}`);
+  }
+  return resp.json();
+}
+
+function showMessage(text) {
+  $("message").textContent = text;
+  $("message").hidden = !text;
+}
+
+function element(name, attrs = {}, text = "") {
+  const el = document.createElement(name);
+  for (const [key, value] of Object.entries(attrs)) {
+    el.setAttribute(key, value);
+  }
+  el.textContent = text;
+  return el;
+}
+
+function svgElement(name, attrs = {}, text = "") {
+  const el = document.createElementNS("http://www.w3.org/2000/svg", name);
+  for (const [key, value] of Object.entries(attrs)) {
+    el.setAttribute(key, value);
+  }
+  el.textContent = text;
+  return el;
+}
+
+function formatMetric(metric, value) {
+  if (value === null || value === undefined) {
+    return "–";
+  }
+  return metric === "magnitude" ? value.toFixed(3) : numberFormat.format(value);
+}
+
+async function loadDates() {
+  const { dates, delegation } = await fetchJSON("api/dates");
+  const select = $("date");
+  select.replaceChildren(...dates.slice().reverse().map((date) => element("option", { value: date }, date)));
+  $("undelegated-only-label").hidden = !delegation;
+  $("legend").hidden = !delegation;
+  if (dates.length === 0) {
+    showMessage("No datasets found.");
+    return false;
+  }
+  if (!dates.includes(state.date)) {
+    state.date = dates[dates.length - 1];
+  }
+  select.value = state.date;
+  return true;
+}
+
+async function loadTop() {
+  const top = await fetchJSON(`api/top/${encodeURIComponent(state.date)}?n=${state.undelegatedOnly ? 0 : state.count}`);
+  $("summary").hidden = false;
+  $("summary-source").textContent = top.source || "–";
+  $("summary-clients").textContent = numberFormat.format(top.totalUniqueClients);
+  $("summary-queries").textContent = numberFormat.format(top.totalQueryVolume);
+  $("summary-domains").textContent = numberFormat.format(top.totalDomains);
+  $("report").href = `reports/${encodeURIComponent(state.date)}`;
+  $("top-title").textContent = `Top domains by magnitude on ${top.date}`;
+
+  let domains = top.domains;
+  if (state.undelegatedOnly) {
+    domains = domains.filter((d) => d.delegated === false);
+    if (state.count !== "0") {
+      domains = domains.slice(0, Number(state.count));
+    }
+  }
+
+  const rows = domains.map((d) => {
+    const row = element("tr", { "data-domain": d.domain });
+    if (d.delegated === false) {
+      row.classList.add("undelegated");
+    }
+    if (d.domain === state.domain) {
+      row.classList.add("selected");
+    }
+    const name = element("td", {}, d.domain);
+    if (d.delegated === false) {
+      name.append(element("span", { class: "badge undelegated" }, "undelegated"));
+    }
+    row.append(
+      element("td", { class: "number" }, String(d.rank)),
+      name,
+      element("td", { class: "number" }, formatMetric("magnitude", d.magnitude)),
+      element("td", { class: "number" }, numberFormat.format(d.uniqueClients)),
+      element("td", { class: "number" }, numberFormat.format(d.queryVolume)),
+    );
+    row.addEventListener("click", () => selectDomain(d.domain));
+    return row;
+  });
+  $("domains").replaceChildren(...rows);
+  showMessage(rows.length === 0 ? "No domains to show." : "");
+}
+
+function selectDomain(domain) {
+  state.domain = domain;
+  writeFragment();
+  for (const row of $("domains").children) {
+    row.classList.toggle("selected", row.dataset.domain === domain);
+  }
+  loadHistory().catch((err) => showMessage(err.message));
+}
+
+let currentHistory = null;
+
+async function loadHistory() {
+  if (!state.domain) {
+    $("history").hidden = true;
+    return;
+  }
+  currentHistory = await fetchJSON(`api/history/${encodeURIComponent(state.domain)}`);
+  drawHistory();
+}
+
+// drawHistory draws the selected metric of the current domain over all days as a line chart
+function drawHistory() {
+  const history = currentHistory;
+  const metric = state.metric;
+  const chart = $("chart");
+  $("history").hidden = false;
+  $("history-title").textContent = `History of ${history.domain}` + (history.delegated === false ? " (undelegated)" : "");
+  $("metric").value = metric;
+
+  const width = 640, height = 320;
+  const margin = { top: 16, right: 16, bottom: 40, left: 72 };
+  const plotWidth = width - margin.left - margin.right;
+  const plotHeight = height - margin.top - margin.bottom;
+
+  const points = history.points;
+  const values = points.map((p) => p[metric]).filter((v) => v !== null);
+  const children = [];
+  if (values.length === 0) {
+    children.push(svgElement("text", { x: width / 2, y: height / 2, "text-anchor": "middle", class: "label" },
+      "No data for this domain"));
+    chart.replaceChildren(...children);
+    return;
+  }
+
+  // Ranks are drawn with the best rank at the top
+  const inverted = metric === "rank";
+  let low = inverted ? Math.min(...values) : 0;
+  let high = Math.max(...values);
+  if (high === low) {
+    high = low + 1;
+  }
+  const x = (i) => margin.left + (points.length === 1 ? plotWidth / 2 : (i * plotWidth) / (points.length - 1));
+  const y = (v) => {
+    const fraction = (v - low) / (high - low);
+    return margin.top + (inverted ? fraction : 1 - fraction) * plotHeight;
+  };
+
+  children.push(
+    svgElement("line", { class: "axis", x1: margin.left, y1: margin.top, x2: margin.left, y2: margin.top + plotHeight }),
+    svgElement("line", { class: "axis", x1: margin.left, y1: margin.top + plotHeight, x2: margin.left + plotWidth, y2: margin.top + plotHeight }),
+  );
+  for (const v of [low, (low + high) / 2, high]) {
+    children.push(svgElement("text", { class: "label", x: margin.left - 6, y: y(v) + 4, "text-anchor": "end" },
+      formatMetric(metric === "magnitude" ? "magnitude" : "", metric === "magnitude" ? v : Math.round(v))));
+  }
+  const labelEvery = Math.max(1, Math.ceil(points.length / 6));
+  points.forEach((p, i) => {
+    if (i % labelEvery === 0 || i === points.length - 1) {
+      children.push(svgElement("text", { class: "label", x: x(i), y: height - margin.bottom + 18, "text-anchor": "middle" }, p.date));
+    }
+  });
+
+  // Days without the domain break the line
+  let path = "";
+  let drawing = false;
+  points.forEach((p, i) => {
+    if (p[metric] === null) {
+      drawing = false;
+      return;
+    }
+    path += `${drawing ? "L" : "M"}${x(i).toFixed(1)},${y(p[metric]).toFixed(1)}`;
+    drawing = true;
+  });
+  children.push(svgElement("path", { class: "line", d: path }));
+
+  points.forEach((p, i) => {
+    if (p[metric] === null) {
+      return;
+    }
+    const point = svgElement("circle", { class: "point", cx: x(i), cy: y(p[metric]), r: 3.5 });
+    if (p.date === state.date) {
+      point.classList.add("current");
+    }
+    point.append(svgElement("title", {}, `${p.date}: ${formatMetric(metric, p[metric])}`));
+    point.addEventListener("click", () => {
+      state.date = p.date;
+      $("date").value = p.date;
+      refresh();
+    });
+    children.push(point);
+  });
+  chart.replaceChildren(...children);
+}
+
+async function refresh() {
+  writeFragment();
+  try {
+    await loadTop();
+    await loadHistory();
+  } catch (err) {
+    showMessage(err.message);
+  }
+}
+
+async function start() {
+  readFragment();
+  $("count").value = state.count;
+  $("metric").value = state.metric;
+  $("undelegated-only").checked = state.undelegatedOnly;
+
+  $("controls").addEventListener("submit", (event) => event.preventDefault());
+  $("date").addEventListener("change", (event) => {
+    state.date = event.target.value;
+    refresh();
+  });
+  $("count").addEventListener("change", (event) => {
+    state.count = event.target.value;
+    refresh();
+  });
+  $("undelegated-only").addEventListener("change", (event) => {
+    state.undelegatedOnly = event.target.checked;
+    refresh();
+  });
+  $("metric").addEventListener("change", (event) => {
+    state.metric = event.target.value;
+    writeFragment();
+    if (currentHistory) {
+      drawHistory();
+    }
+  });
+
+  try {
+    if (await loadDates()) {
+      await refresh();
+    }
+  } catch (err) {
+    showMessage(err.message);
+  }
+}
+
+start();